@@ -7,14 +7,18 @@ import (
 	"log"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 )
 
 //All handlers and API endpoints starts from here.
 var permissionMapping = map[string]int{
-	"create": permCreate,
-	"update": permUpdate,
-	"delete": permDelete,
+	"create":     permCreate,
+	"update":     permUpdate,
+	"delete":     permDelete,
+	"membership": permMembership,
+	"ownership":  permOwnership,
+	"view":       permView,
 }
 
 var resourceMapping = map[string]int{
@@ -45,7 +49,7 @@ func (state *RuntimeState) renderTemplateOrReturnJson(w http.ResponseWriter, r *
 			cacheControlValue = "private, max-age=5"
 		}
 		w.Header().Set("Cache-Control", cacheControlValue)
-		err := state.htmlTemplate.ExecuteTemplate(w, templateName, pageData)
+		err := state.executePageTemplate(w, r, templateName, pageData)
 		if err != nil {
 			log.Printf("Failed to execute %v", err)
 			http.Error(w, "error", http.StatusInternalServerError)
@@ -95,7 +99,7 @@ func (state *RuntimeState) createGrouphandler(w http.ResponseWriter, r *http.Req
 	members := r.PostFormValue("members")
 
 	//check whether the user has the ability to create group
-	allow, err := state.canPerformAction(username, groupinfo.Groupname, resourceGroup, permCreate)
+	allow, err := state.canPerformAction(r, username, groupinfo.Groupname, resourceGroup, permCreate)
 	if err != nil {
 		log.Println(err)
 		state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
@@ -157,15 +161,14 @@ func (state *RuntimeState) createGrouphandler(w http.ResponseWriter, r *http.Req
 		state.writeFailureResponse(w, r, fmt.Sprintf("error occurred! May be group name exists or may be members are not available!"), http.StatusInternalServerError)
 		return
 	}
-	if state.sysLog != nil {
-		state.sysLog.Write([]byte(fmt.Sprintf("Group "+"%s"+" was created by "+"%s", groupinfo.Groupname, username)))
-
-		for _, member := range strings.Split(members, ",") {
-			state.sysLog.Write([]byte(fmt.Sprintf("%s"+" was added to Group "+"%s"+" by "+"%s", member, groupinfo.Groupname, username)))
-		}
+	state.recordEvent(eventGroupCreated, groupinfo.Groupname, "", username,
+		fmt.Sprintf("Group "+"%s"+" was created by "+"%s", groupinfo.Groupname, username))
+	for _, member := range strings.Split(members, ",") {
+		state.recordEvent(eventMemberAdded, groupinfo.Groupname, member, username,
+			fmt.Sprintf("%s"+" was added to Group "+"%s"+" by "+"%s", member, groupinfo.Groupname, username))
 	}
 
-	isAdmin := state.Userinfo.UserisadminOrNot(username)
+	isAdmin := state.isAdmin(r, username)
 	pageData := simpleMessagePageData{
 		UserName:       username,
 		IsAdmin:        isAdmin,
@@ -201,7 +204,7 @@ func (state *RuntimeState) deleteGrouphandler(w http.ResponseWriter, r *http.Req
 	groups := r.PostFormValue("groupnames")
 	//check if groupnames are valid or not.
 	for _, eachGroup := range strings.Split(groups, ",") {
-		allow, err := state.canPerformAction(username, eachGroup, resourceGroup, permDelete)
+		allow, err := state.canPerformAction(r, username, eachGroup, resourceGroup, permDelete)
 		if err != nil {
 			log.Println(err)
 			state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
@@ -223,7 +226,7 @@ func (state *RuntimeState) deleteGrouphandler(w http.ResponseWriter, r *http.Req
 			return
 		}
 
-		for _, groupname := range state.Config.Base.AutoGroups {
+		for _, groupname := range state.currentConfig().AutoGroups {
 			if eachGroup == groupname {
 				state.writeFailureResponse(w, r, groupname+" is part of auto-added group, you cannot delete it!", http.StatusBadRequest)
 				return
@@ -238,10 +241,10 @@ func (state *RuntimeState) deleteGrouphandler(w http.ResponseWriter, r *http.Req
 		state.writeFailureResponse(w, r, fmt.Sprintf("error occurred! May be there is no such group!"), http.StatusInternalServerError)
 		return
 	}
-	if state.sysLog != nil {
-		for _, eachGroup := range groupnames {
-			state.sysLog.Write([]byte(fmt.Sprintf("Group "+"%s"+" was deleted by "+"%s", eachGroup, username)))
-		}
+	for _, eachGroup := range groupnames {
+		state.recordEvent(eventGroupDeleted, eachGroup, "", username,
+			fmt.Sprintf("Group "+"%s"+" was deleted by "+"%s", eachGroup, username))
+		state.notify(newNotificationEvent(eventGroupDeleted, eachGroup, "", username))
 	}
 	err = deleteEntryofGroupsInDB(groupnames, state)
 	if err != nil {
@@ -250,7 +253,7 @@ func (state *RuntimeState) deleteGrouphandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	isAdmin := state.Userinfo.UserisadminOrNot(username)
+	isAdmin := state.isAdmin(r, username)
 	pageData := simpleMessagePageData{
 		UserName:       username,
 		IsAdmin:        isAdmin,
@@ -286,7 +289,7 @@ func (state *RuntimeState) createServiceAccounthandler(w http.ResponseWriter, r
 	groupinfo.Mail = r.PostFormValue("mail")
 	groupinfo.LoginShell = r.PostFormValue("loginShell")
 
-	allow, err := state.canPerformAction(username, groupinfo.Groupname, resourceSVC, permCreate)
+	allow, err := state.canPerformAction(r, username, groupinfo.Groupname, resourceSVC, permCreate)
 	if err != nil {
 		log.Println(err)
 		state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
@@ -334,11 +337,10 @@ func (state *RuntimeState) createServiceAccounthandler(w http.ResponseWriter, r
 		state.writeFailureResponse(w, r, fmt.Sprintf("error occurred! May be group name exists or may be members are not available!"), http.StatusInternalServerError)
 		return
 	}
-	if state.sysLog != nil {
-		state.sysLog.Write([]byte(fmt.Sprintf("Service account "+"%s"+" was created by "+"%s", groupinfo.Groupname, username)))
-	}
+	state.recordEvent(eventServiceAccountCreated, groupinfo.Groupname, "", username,
+		fmt.Sprintf("Service account "+"%s"+" was created by "+"%s", groupinfo.Groupname, username))
 
-	isAdmin := state.Userinfo.UserisadminOrNot(username)
+	isAdmin := state.isAdmin(r, username)
 	pageData := simpleMessagePageData{
 		UserName:       username,
 		IsAdmin:        isAdmin,
@@ -374,6 +376,10 @@ func (state *RuntimeState) changeownership(w http.ResponseWriter, r *http.Reques
 		state.writeFailureResponse(w, r, "groupnamesParameter is missing", http.StatusBadRequest)
 		return
 	}
+	err = state.groupExistsorNot(w, managegroup)
+	if err != nil {
+		return
+	}
 	donecount := 0
 	//check if given member exists or not and see if he is already a groupmember if yes continue.
 	for _, group := range groupList {
@@ -385,7 +391,7 @@ func (state *RuntimeState) changeownership(w http.ResponseWriter, r *http.Reques
 		groupinfo := userinfo.GroupInfo{}
 		groupinfo.Groupname = group
 
-		allow, err := state.canPerformAction(username, group, resourceGroup, permUpdate)
+		allow, err := state.canChangeOwnership(r, username, group)
 		if err != nil {
 			log.Println(err)
 			state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
@@ -399,14 +405,32 @@ func (state *RuntimeState) changeownership(w http.ResponseWriter, r *http.Reques
 		if err != nil {
 			return
 		}
-		err = state.Userinfo.ChangeDescription(group, managegroup)
+		err = state.checkManagerCycle(group, managegroup)
+		if err != nil {
+			log.Println(err)
+			if err == errManagerCycle {
+				state.writeFailureResponse(w, r, fmt.Sprintf("Group %s: %s", group, err), http.StatusBadRequest)
+			} else {
+				state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
+			}
+			return
+		}
+		// The new managing group has to accept the transfer before it
+		// takes effect.
+		err = insertOwnershipTransfer(group, managegroup, username, state)
 		if err != nil {
 			log.Println(err)
 			state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
 			return
 		}
-		if state.sysLog != nil {
-			state.sysLog.Write([]byte(fmt.Sprintf("Group %s is managed by %s now, this change was made by %s.", group, managegroup, username)))
+		state.recordEvent(eventTransferRequested, group, "", username,
+			fmt.Sprintf("Transfer of group %s to %s was requested by %s.", group, managegroup, username))
+		usersEmail, err := state.Userinfo.GetEmailofusersingroup(managegroup)
+		if err != nil {
+			log.Println(err)
+		} else {
+			state.sendOwnershipTransferEmail(mailOwnershipTransferRequest, "",
+				ownershipTransfer{Groupname: group, ManageGroup: managegroup, RequestedBy: username}, usersEmail)
 		}
 		donecount += 1
 	}
@@ -415,12 +439,160 @@ func (state *RuntimeState) changeownership(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	isAdmin := state.Userinfo.UserisadminOrNot(username)
+	isAdmin := state.isAdmin(r, username)
 	pageData := simpleMessagePageData{
 		UserName:       username,
 		IsAdmin:        isAdmin,
-		Title:          "Change Ownership success",
-		SuccessMessage: "Group(s) have successfuly changed ownership",
+		Title:          "Change Ownership requested",
+		SuccessMessage: fmt.Sprintf("A member of %s has to accept the transfer before it replaces the current managers", managegroup),
+		ContinueURL:    ownershipTransfersPath,
+	}
+	state.renderTemplateOrReturnJson(w, r, "simpleMessagePage", pageData)
+}
+
+// canAddManager tells whether username may make manager a manager of
+// groupname without going through an ownership transfer, which is the case
+// for admins and for managers username is part of.
+func (state *RuntimeState) canAddManager(r *http.Request, username, groupname, manager string) (bool, error) {
+	if state.isAdmin(r, username) {
+		return true, nil
+	}
+	if managerUser, ok := userinfo.ManagerUsername(manager); ok {
+		return managerUser == username, nil
+	}
+	isMember, _, err := state.Userinfo.IsgroupmemberorNot(userinfo.ManagerGroupname(groupname, manager), username)
+	if err != nil && err != userinfo.GroupDoesNotExist {
+		return false, err
+	}
+	return isMember, nil
+}
+
+// setGroupManagersHandler replaces the managers of a group with a comma
+// separated list of group names and user:<username> values.
+func (state *RuntimeState) setGroupManagersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != postMethod {
+		state.writeFailureResponse(w, r, "POST Method is required", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := state.GetRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		if err.Error() == "missing form body" {
+			http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+		} else {
+			state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
+		}
+		return
+	}
+	groupname := r.PostFormValue("groupname")
+	var managers []string
+	seen := make(map[string]bool)
+	for _, manager := range strings.Split(r.PostFormValue("managers"), ",") {
+		manager = strings.TrimSpace(manager)
+		if len(manager) < 1 || seen[manager] {
+			continue
+		}
+		seen[manager] = true
+		managers = append(managers, manager)
+	}
+	if len(managers) < 1 {
+		state.writeFailureResponse(w, r, "managers parameter is missing", http.StatusBadRequest)
+		return
+	}
+	currentManagers, err := state.Userinfo.GetGroupManagers(groupname)
+	if err != nil {
+		log.Println(err)
+		if err == userinfo.GroupDoesNotExist {
+			state.writeFailureResponse(w, r, fmt.Sprintf("Group %s doesn't exist!", groupname), http.StatusBadRequest)
+		} else {
+			state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
+		}
+		return
+	}
+	allow, err := state.canChangeOwnership(r, username, groupname)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
+		return
+	}
+	if !allow {
+		state.writeFailureResponse(w, r, fmt.Sprintf("You don't have permission to update managers for group %s", groupname), http.StatusForbidden)
+		return
+	}
+	isCurrent := make(map[string]bool)
+	for _, manager := range currentManagers {
+		isCurrent[manager] = true
+	}
+	for _, manager := range managers {
+		if isCurrent[manager] {
+			continue
+		}
+		if managerUser, ok := userinfo.ManagerUsername(manager); ok {
+			exists, err := state.Userinfo.UsernameExistsornot(managerUser)
+			if err != nil {
+				log.Println(err)
+				state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
+				return
+			}
+			if !exists {
+				state.writeFailureResponse(w, r, fmt.Sprintf("User %s doesn't exist!", managerUser), http.StatusBadRequest)
+				return
+			}
+		} else if manager != descriptionAttribute {
+			exists, _, err := state.Userinfo.GroupnameExistsornot(manager)
+			if err != nil {
+				log.Println(err)
+				state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
+				return
+			}
+			if !exists {
+				state.writeFailureResponse(w, r, fmt.Sprintf("Group %s doesn't exist!", manager), http.StatusBadRequest)
+				return
+			}
+			err = state.checkManagerCycle(groupname, manager)
+			if err != nil {
+				log.Println(err)
+				if err == errManagerCycle {
+					state.writeFailureResponse(w, r, fmt.Sprintf("Group %s: %s", manager, err), http.StatusBadRequest)
+				} else {
+					state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
+				}
+				return
+			}
+		}
+		canAdd, err := state.canAddManager(r, username, groupname, manager)
+		if err != nil {
+			log.Println(err)
+			state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
+			return
+		}
+		if !canAdd {
+			state.writeFailureResponse(w, r,
+				fmt.Sprintf("%s has to accept an ownership transfer before managing group %s", manager, groupname), http.StatusForbidden)
+			return
+		}
+	}
+	err = state.Userinfo.SetGroupManagers(groupname, managers)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
+		return
+	}
+	state.recordEvent(eventManagersChanged, groupname, "", username, fmt.Sprintf("Managers of group %s were set to %s by %s.",
+		groupname, strings.Join(managers, ", "), username))
+
+	isAdmin := state.isAdmin(r, username)
+	pageData := simpleMessagePageData{
+		UserName:       username,
+		IsAdmin:        isAdmin,
+		Title:          "Group Managers Updated",
+		SuccessMessage: fmt.Sprintf("Group %s is managed by %s", groupname, strings.Join(managers, ", ")),
+		ContinueURL:    groupinfoPath + "?groupname=" + groupname,
 	}
 	state.renderTemplateOrReturnJson(w, r, "simpleMessagePage", pageData)
 }
@@ -478,12 +650,29 @@ func (state *RuntimeState) getGroupsJSHandler(w http.ResponseWriter, r *http.Req
 	var groupsToSend [][]string
 	switch r.FormValue("type") {
 	case "all":
-		groupsToSend, err = state.Userinfo.GetAllGroupsManagedBy()
+		allGroups, err := state.Userinfo.GetAllGroupsManagedBy()
 		if err != nil {
 			log.Println(err)
 			state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
 			return
 		}
+		canView, err := state.newGroupViewFilter(r, username)
+		if err != nil {
+			log.Println(err)
+			state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
+			return
+		}
+		for _, groupTuple := range allGroups {
+			visible, err := canView(groupTuple[0])
+			if err != nil {
+				log.Println(err)
+				state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
+				return
+			}
+			if visible {
+				groupsToSend = append(groupsToSend, groupTuple)
+			}
+		}
 	case "pendingRequests":
 		groupsToSend, err = state.getPendingRequestGroupsofUser(username)
 		if err != nil {
@@ -498,8 +687,26 @@ func (state *RuntimeState) getGroupsJSHandler(w http.ResponseWriter, r *http.Req
 			state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
 			return
 		}
-		sort.Strings(allgroups)
-		groupsToSend = [][]string{allgroups}
+		canView, err := state.newGroupViewFilter(r, username)
+		if err != nil {
+			log.Println(err)
+			state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
+			return
+		}
+		visibleGroups := []string{}
+		for _, group := range allgroups {
+			visible, err := canView(group)
+			if err != nil {
+				log.Println(err)
+				state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
+				return
+			}
+			if visible {
+				visibleGroups = append(visibleGroups, group)
+			}
+		}
+		sort.Strings(visibleGroups)
+		groupsToSend = [][]string{visibleGroups}
 	case "pendingActions":
 		outputText = getGroupsJSPendingActionsText
 		if r.FormValue("encoding") == "json" {
@@ -524,14 +731,17 @@ func (state *RuntimeState) getGroupsJSHandler(w http.ResponseWriter, r *http.Req
 			state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
 			return
 		}
-		userGroupMap := make(map[string]interface{})
-		for _, groupName := range userGroups {
-			userGroupMap[groupName] = nil
-		}
+		sort.Strings(userGroups)
 		for _, groupTuple := range allGroups {
-			managingGroup := groupTuple[1]
-			_, ok := userGroupMap[managingGroup]
-			if ok {
+			// Self-managed groups were never listed here, only groups
+			// with a managing group or user manager.
+			var managers []string
+			for _, manager := range groupTuple[1:] {
+				if manager != descriptionAttribute {
+					managers = append(managers, manager)
+				}
+			}
+			if isManagerByGroups(username, userGroups, groupTuple[0], managers) {
 				groupsToSend = append(groupsToSend, groupTuple)
 			}
 		}
@@ -612,7 +822,7 @@ func (state *RuntimeState) getUsersJSHandler(w http.ResponseWriter, r *http.Requ
 		state.writeFailureResponse(w, r, "GET Method is required", http.StatusMethodNotAllowed)
 		return
 	}
-	_, err := state.GetRemoteUserName(w, r)
+	username, err := state.GetRemoteUserName(w, r)
 	if err != nil {
 		log.Println(err)
 		return
@@ -637,6 +847,16 @@ func (state *RuntimeState) getUsersJSHandler(w http.ResponseWriter, r *http.Requ
 			state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
 			return
 		}
+		visible, err := state.canViewGroup(r, username, groupName)
+		if err != nil {
+			log.Println(err)
+			state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
+			return
+		}
+		if !visible {
+			http.Error(w, fmt.Sprint("Group doesn't exist!"), http.StatusBadRequest)
+			return
+		}
 		outputText = getUsersGroupJSText
 
 	default:
@@ -689,8 +909,7 @@ func (state *RuntimeState) permissionManageHandler(w http.ResponseWriter, r *htt
 		log.Println(err)
 		return
 	}
-	if !state.Userinfo.UserisadminOrNot(username) {
-		http.Error(w, "you are not authorized", http.StatusForbidden)
+	if !state.requireCapability(w, r, username, capManagePermissions) {
 		return
 	}
 
@@ -708,7 +927,6 @@ func (state *RuntimeState) permissionManageHandler(w http.ResponseWriter, r *htt
 	groupname := r.PostFormValue("groupname")
 	resourceType := r.PostFormValue("resourceType")
 	resourceName := r.PostFormValue("resourceName")
-	log.Println(r.PostFormValue("permissions"))
 	permissionList := strings.Split(r.PostFormValue("permissions"), ",")
 
 	if len(permissionList) < 1 {
@@ -729,28 +947,312 @@ func (state *RuntimeState) permissionManageHandler(w http.ResponseWriter, r *htt
 		return
 	}
 
+	err = validateResourcePattern(resourceName)
+	if err != nil {
+		state.writeFailureResponse(w, r, fmt.Sprintf("Invalid resource name %q: %s", resourceName, err), http.StatusBadRequest)
+		return
+	}
+
 	var permissions, permVal int
 	for _, permission := range permissionList {
 		if permVal, ok = permissionMapping[permission]; !ok {
 			state.writeFailureResponse(w, r, fmt.Sprintf("%s permission does not exist", permission), http.StatusBadRequest)
 			return
 		}
-		permissions += permVal
+		permissions |= permVal
 	}
-	err = insertPermissionEntry(groupname, resourceName, resourceVal, permissions, state)
+	deny := r.PostFormValue("effect") == "deny"
+	if !deny && !state.requirePrivilegedGrantAdmin(w, r, username, resourceName, resourceVal, permissions) {
+		return
+	}
+	err = insertPermissionEntry(groupname, resourceName, resourceVal, permissions, deny, state)
 	if err != nil {
 		state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
-	if state.sysLog != nil {
-		state.sysLog.Write([]byte(fmt.Sprintf("Permission %d to group %s was created by "+"%s", permissions, groupname, username)))
+	effect := "Permission"
+	if deny {
+		effect = "Deny rule"
 	}
+	state.recordEvent(eventPermissionCreated, groupname, "", username,
+		fmt.Sprintf("%s %d on %s to group %s was created by "+"%s", effect, permissions, resourceName, groupname, username))
 	pageData := simpleMessagePageData{
 		UserName:       username,
-		IsAdmin:        true,
+		IsAdmin:        state.isAdmin(r, username),
 		Title:          "Permission Creation Success",
 		SuccessMessage: "permissions successfully created",
 	}
 	state.renderTemplateOrReturnJson(w, r, "simpleMessagePage", pageData)
 }
+
+func (state *RuntimeState) permissionsListHandler(w http.ResponseWriter, r *http.Request) {
+	username, err := state.GetRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	if !state.requireCapability(w, r, username, capViewPermissions) {
+		return
+	}
+	query := r.URL.Query()
+	pageData := permissionsPageData{
+		UserName:           username,
+		IsAdmin:            state.isAdmin(r, username),
+		Title:              "Permission Grants",
+		GroupnameFilter:    query.Get("groupname"),
+		ResourceTypeFilter: query.Get("resourceType"),
+		ResourceFilter:     query.Get("resource"),
+		PermissionFilter:   query.Get("permission"),
+	}
+	pageData.CanManage, err = state.hasCapability(r, username, capManagePermissions)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
+		return
+	}
+	var resourceVal int
+	if pageData.ResourceTypeFilter != "" {
+		var ok bool
+		if resourceVal, ok = resourceMapping[pageData.ResourceTypeFilter]; !ok {
+			state.writeFailureResponse(w, r, fmt.Sprintf("%s resource type does not exist", pageData.ResourceTypeFilter), http.StatusBadRequest)
+			return
+		}
+	}
+	pageData.Permissions, err = listPermissionEntries(pageData.GroupnameFilter, resourceVal, pageData.ResourceFilter, state)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
+		return
+	}
+	groupMembers := make(map[string][]string)
+	for i, entry := range pageData.Permissions {
+		members, ok := groupMembers[entry.Groupname]
+		if !ok {
+			members, _, err = state.Userinfo.GetusersofaGroup(entry.Groupname)
+			if err != nil && err != userinfo.GroupDoesNotExist {
+				log.Println(err)
+				state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
+				return
+			}
+			groupMembers[entry.Groupname] = members
+		}
+		pageData.Permissions[i].Holders = members
+	}
+
+	// Effective holders need a single resource and permission to check.
+	if resourceVal != 0 && pageData.ResourceFilter != "" && pageData.PermissionFilter != "" {
+		permVal, ok := permissionMapping[pageData.PermissionFilter]
+		if !ok {
+			state.writeFailureResponse(w, r, fmt.Sprintf("%s permission does not exist", pageData.PermissionFilter), http.StatusBadRequest)
+			return
+		}
+		pageData.EffectiveHolders, err = state.getPermissionHolders(pageData.ResourceFilter, resourceVal, permVal)
+		if err != nil {
+			log.Println(err)
+			state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
+			return
+		}
+		pageData.HasEffectiveHolders = true
+	}
+	state.renderTemplateOrReturnJson(w, r, "permissionsPage", pageData)
+}
+
+func (state *RuntimeState) permissionEditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != postMethod {
+		state.writeFailureResponse(w, r, "POST Method is required", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := state.GetRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	if !state.requireCapability(w, r, username, capManagePermissions) {
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		if err.Error() == "missing form body" {
+			http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+		} else {
+			state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
+		}
+		return
+	}
+	id, err := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+	if err != nil {
+		state.writeFailureResponse(w, r, "Invalid id parameter", http.StatusBadRequest)
+		return
+	}
+	permissions, err := parsePermissionNames(r.PostFormValue("permissions"))
+	if err != nil {
+		state.writeFailureResponse(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	denyPermissions, err := parsePermissionNames(r.PostFormValue("denyPermissions"))
+	if err != nil {
+		state.writeFailureResponse(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if permissions == 0 && denyPermissions == 0 {
+		state.writeFailureResponse(w, r, "no permissions given, delete the grant to remove all of them", http.StatusBadRequest)
+		return
+	}
+	if permissions&denyPermissions != 0 {
+		state.writeFailureResponse(w, r, "a permission cannot be both allowed and denied", http.StatusBadRequest)
+		return
+	}
+	entry, err := getPermissionEntryByID(id, state)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
+		return
+	}
+	if entry == nil {
+		state.writeFailureResponse(w, r, fmt.Sprintf("Permission grant %d doesn't exist!", id), http.StatusBadRequest)
+		return
+	}
+	if !state.requirePrivilegedGrantAdmin(w, r, username, entry.Resource, resourceMapping[entry.ResourceType], permissions) {
+		return
+	}
+	err = updatePermissionEntryByID(id, permissions, denyPermissions, state)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
+		return
+	}
+	state.recordEvent(eventPermissionChanged, entry.Groupname, "", username,
+		fmt.Sprintf("Permission of group %s on %s %s was changed from %s (deny %s) to %s (deny %s) by %s",
+			entry.Groupname, entry.ResourceType, entry.Resource,
+			strings.Join(entry.Permissions, ","), strings.Join(entry.DenyPermissions, ","),
+			strings.Join(permissionBitsToNames(permissions), ","), strings.Join(permissionBitsToNames(denyPermissions), ","), username))
+	pageData := simpleMessagePageData{
+		UserName:       username,
+		IsAdmin:        state.isAdmin(r, username),
+		Title:          "Permission Update Success",
+		SuccessMessage: "permissions successfully updated",
+		ContinueURL:    permissionsListPath,
+	}
+	state.renderTemplateOrReturnJson(w, r, "simpleMessagePage", pageData)
+}
+
+func (state *RuntimeState) permissionDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != postMethod {
+		state.writeFailureResponse(w, r, "POST Method is required", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := state.GetRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	if !state.requireCapability(w, r, username, capManagePermissions) {
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		if err.Error() == "missing form body" {
+			http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+		} else {
+			state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
+		}
+		return
+	}
+	var entries []*permissionEntry
+	for _, idString := range strings.Split(r.PostFormValue("ids"), ",") {
+		if len(idString) < 1 {
+			continue
+		}
+		id, err := strconv.ParseInt(idString, 10, 64)
+		if err != nil {
+			state.writeFailureResponse(w, r, "Invalid ids parameter", http.StatusBadRequest)
+			return
+		}
+		entry, err := getPermissionEntryByID(id, state)
+		if err != nil {
+			log.Println(err)
+			state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
+			return
+		}
+		if entry == nil {
+			state.writeFailureResponse(w, r, fmt.Sprintf("Permission grant %d doesn't exist!", id), http.StatusBadRequest)
+			return
+		}
+		if !state.requirePrivilegedGrantAdmin(w, r, username, entry.Resource, resourceMapping[entry.ResourceType],
+			entry.Permission|entry.DenyPermission) {
+			return
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		state.writeFailureResponse(w, r, "Invalid ids parameter", http.StatusBadRequest)
+		return
+	}
+	for _, entry := range entries {
+		err = deletePermissionEntryByID(entry.ID, state)
+		if err != nil {
+			log.Println(err)
+			state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
+			return
+		}
+		state.recordEvent(eventPermissionDeleted, entry.Groupname, "", username,
+			fmt.Sprintf("Permission %s of group %s on %s %s was deleted by %s",
+				strings.Join(entry.Permissions, ","), entry.Groupname, entry.ResourceType, entry.Resource, username))
+	}
+	pageData := simpleMessagePageData{
+		UserName:       username,
+		IsAdmin:        state.isAdmin(r, username),
+		Title:          "Permission Deletion Success",
+		SuccessMessage: "permissions successfully deleted",
+		ContinueURL:    permissionsListPath,
+	}
+	state.renderTemplateOrReturnJson(w, r, "simpleMessagePage", pageData)
+}
+
+// permissionTestHandler explains whether a user may perform an action on a
+// resource and which permission rule decided it.
+func (state *RuntimeState) permissionTestHandler(w http.ResponseWriter, r *http.Request) {
+	username, err := state.GetRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	if !state.requireCapability(w, r, username, capViewPermissions) {
+		return
+	}
+	query := r.URL.Query()
+	pageData := permissionTestPageData{
+		UserName:     username,
+		IsAdmin:      state.isAdmin(r, username),
+		Title:        "Test Permission",
+		TestUsername: query.Get("username"),
+		ResourceType: query.Get("resourceType"),
+		Resource:     query.Get("resource"),
+		Permission:   query.Get("permission"),
+	}
+	if pageData.TestUsername != "" {
+		resourceVal, ok := resourceMapping[pageData.ResourceType]
+		if !ok {
+			state.writeFailureResponse(w, r, fmt.Sprintf("%s resource type does not exist", pageData.ResourceType), http.StatusBadRequest)
+			return
+		}
+		permVal, ok := permissionMapping[pageData.Permission]
+		if !ok {
+			state.writeFailureResponse(w, r, fmt.Sprintf("%s permission does not exist", pageData.Permission), http.StatusBadRequest)
+			return
+		}
+		if pageData.Resource == "" {
+			state.writeFailureResponse(w, r, "resource parameter is missing", http.StatusBadRequest)
+			return
+		}
+		pageData.Decision, err = state.explainAction(r, pageData.TestUsername, pageData.Resource, resourceVal, permVal)
+		if err != nil {
+			log.Println(err)
+			state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
+			return
+		}
+		pageData.Tested = true
+	}
+	state.renderTemplateOrReturnJson(w, r, "permissionTestPage", pageData)
+}
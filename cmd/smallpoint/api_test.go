@@ -80,11 +80,21 @@ func setupTestState() (RuntimeState, error) {
 	if err != nil {
 		return state, err
 	}
+	for _, table := range []string{"ownership_transfers", "group_join_policies", "group_invitations",
+		"event_outbox", "event_endpoints", "event_dead_letters", "notification_preferences",
+		"mail_queue", "sessions"} {
+		_, err = state.db.Exec("delete from " + table)
+		if err != nil {
+			return state, err
+		}
+	}
 	mockldap := mock.New()
 	state.Userinfo = mockldap
 	state.UserSourceinfo = mockldap
 	state.allUsersCacheValue = make(map[string]time.Time)
 	state.pendingUserActionsCache = make(map[string]pendingUserActionsCacheEntry)
+	state.Config.OpenID = authn.OpenIDConfig{AuthURL: "https://idp.example.com/authorize",
+		TokenURL: "https://idp.example.com/token"}
 	state.authenticator = authn.NewAuthenticator(state.Config.OpenID, "smallpoint", nil,
 		[]string{}, nil,
 		nil)
@@ -105,6 +115,8 @@ func getTestApiEndpoints(state *RuntimeState) map[string]http.HandlerFunc {
 		creategroupPath:          state.createGrouphandler,
 		deletegroupPath:          state.deleteGrouphandler,
 		createServiceAccountPath: state.createServiceAccounthandler,
+		acceptOwnershipPath:      state.acceptOwnershipTransferHandler,
+		rejectOwnershipPath:      state.rejectOwnershipTransferHandler,
 	}
 	return testApiEndpoints
 }
@@ -115,6 +127,9 @@ func getAdminOnlyEndpoints(state *RuntimeState) map[string]http.HandlerFunc {
 		deletegroupPath:           state.deleteGrouphandler,
 		createServiceAccountPath:  state.createServiceAccounthandler,
 		changeownershipbuttonPath: state.changeownership,
+		importGroupsPath:          state.importGroupsHandler,
+		permissionsEditPath:       state.permissionEditHandler,
+		permissionsDeletePath:     state.permissionDeleteHandler,
 	}
 	return adminOnlyApiEndpoints
 }
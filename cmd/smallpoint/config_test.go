@@ -3,10 +3,14 @@ package main
 import (
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/Symantec/ldap-group-management/lib/authn"
 	"gopkg.in/yaml.v2"
 )
 
@@ -55,3 +59,188 @@ func TestLoadConfigFileBase(t *testing.T) {
 	}
 
 }
+
+func TestLoadConfigFileSQLBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // clean up
+	configFilename := filepath.Join(dir, "config-test.yml")
+	appConfig := AppConfigFile{}
+	appConfig.Base.TemplatesPath = dir
+	appConfig.Base.StorageURL = "sqlite:" + filepath.Join(dir, "demodb.sqlite")
+	appConfig.Base.DirectoryBackend = "sql"
+	appConfig.TargetSQL.StorageURL = "sqlite:" + filepath.Join(dir, "directory.sqlite")
+	err = writeConfig(configFilename, &appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadedConfig, err := loadConfig(configFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allGroups, err := loadedConfig.Userinfo.GetallGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allGroups) != 0 {
+		t.Fatalf("new sql directory should be empty, got %v", allGroups)
+	}
+
+	appConfig.Base.DirectoryBackend = "nis"
+	err = writeConfig(configFilename, &appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadConfig(configFilename)
+	if err == nil {
+		t.Fatal("should have failed on unknown directory backend")
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // clean up
+	configFilename := filepath.Join(dir, "config-test.yml")
+	secretsFilename := filepath.Join(dir, "sharedSecrets.txt")
+	err = ioutil.WriteFile(secretsFilename, []byte("oldsecret\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appConfig := AppConfigFile{}
+	appConfig.Base.HttpAddress = ":3000"
+	appConfig.Base.TemplatesPath = dir
+	appConfig.Base.StorageURL = "sqlite:" + filepath.Join(dir, "demodb.sqlite")
+	appConfig.Base.ClusterSharedSecretFilename = secretsFilename
+	err = writeConfig(configFilename, &appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := loadConfig(configFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := time.Now().Add(time.Hour)
+	sessionID, err := (&dbSessionStore{state: state}).NewSession("user1", httptest.NewRequest("GET", indexPath, nil),
+		expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldCookie, err := state.authenticator.GenSessionCookieValue("user1", sessionID, expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appConfig.Base.HttpAddress = ":4000"
+	appConfig.Base.Roles = map[string][]string{roleHelpdesk: {"group1"}}
+	appConfig.Base.IdPRoles = map[string][]string{roleHelpdesk: {"idp-helpdesk"}}
+	err = writeConfig(configFilename, &appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(secretsFilename, []byte("newsecret\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = state.reloadConfig(configFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Config.Base.Roles[roleHelpdesk]) != 1 {
+		t.Fatal("roles were not reloaded")
+	}
+	// The group filter registered at startup follows the reloaded idp_roles.
+	groups := state.authenticator.FilterGroups([]string{"idp-helpdesk", "everyone"})
+	if len(groups) != 1 || groups[0] != "idp-helpdesk" {
+		t.Fatalf("group filter ignored the reloaded idp_roles, kept %q", groups)
+	}
+	if state.Config.Base.HttpAddress != ":3000" {
+		t.Fatal("http_address only changes on restart")
+	}
+	if len(state.Config.Base.SharedSecrets) != 1 || state.Config.Base.SharedSecrets[0] != "newsecret" {
+		t.Fatalf("shared secrets were not reloaded %q", state.Config.Base.SharedSecrets)
+	}
+	// Cookies signed with the previous secret keep working.
+	req := httptest.NewRequest("GET", indexPath, nil)
+	req.AddCookie(&http.Cookie{Name: authn.AuthCookieName, Value: oldCookie})
+	username, err := state.authenticator.GetRemoteUserName(httptest.NewRecorder(), req)
+	if err != nil || username != "user1" {
+		t.Fatalf("cookie of the previous secret rejected %q %v", username, err)
+	}
+
+	// An invalid file leaves the running configuration alone.
+	appConfig.Base.Roles = map[string][]string{"superuser": {"group1"}}
+	err = writeConfig(configFilename, &appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = state.reloadConfig(configFilename)
+	if err == nil {
+		t.Fatal("reload of an invalid config should fail")
+	}
+	if len(state.Config.Base.Roles[roleHelpdesk]) != 1 {
+		t.Fatal("invalid reload changed the roles")
+	}
+	// So does a templates_path which cannot be loaded.
+	appConfig.Base.Roles = map[string][]string{roleHelpdesk: {"group1", "group2"}}
+	appConfig.Base.TemplatesPath = filepath.Join(dir, "missing")
+	err = writeConfig(configFilename, &appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = state.reloadConfig(configFilename)
+	if err == nil {
+		t.Fatal("reload with missing templates should fail")
+	}
+	if len(state.Config.Base.Roles[roleHelpdesk]) != 1 || state.Config.Base.TemplatesPath == appConfig.Base.TemplatesPath {
+		t.Fatal("failed reload changed the configuration")
+	}
+}
+
+func TestLoadConfigIdPRoles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // clean up
+	configFilename := filepath.Join(dir, "config-test.yml")
+	secretsFilename := filepath.Join(dir, "sharedSecrets.txt")
+	err = ioutil.WriteFile(secretsFilename, []byte("supersecret\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appConfig := AppConfigFile{}
+	appConfig.Base.TemplatesPath = dir
+	appConfig.Base.StorageURL = "sqlite:" + filepath.Join(dir, "demodb.sqlite")
+	appConfig.Base.ClusterSharedSecretFilename = secretsFilename
+	appConfig.Base.DirectoryBackend = "sql"
+	appConfig.TargetSQL.StorageURL = "sqlite:" + filepath.Join(dir, "directory.sqlite")
+	appConfig.Base.IdPRoles = map[string][]string{roleAdmin: {"idp-admins"}}
+	err = writeConfig(configFilename, &appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := loadConfig(configFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the mapped groups of the identity provider reach the cookie.
+	groups := state.authenticator.FilterGroups([]string{"everyone", "idp-admins"})
+	if len(groups) != 1 || groups[0] != "idp-admins" {
+		t.Fatalf("bad filter of identity provider groups, kept %q", groups)
+	}
+	// The sessions of the loaded state are checked against the database,
+	// the groups are set the way a login does.
+	var roles []string
+	withIdPGroups(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setIdPGroups(r, "user1", groups)
+		roles = state.getIdPRoles(r, "user1")
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", indexPath, nil))
+	if len(roles) != 1 || roles[0] != roleAdmin {
+		t.Fatalf("unexpected identity provider roles %v", roles)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"database/sql"
 	"errors"
+	"fmt"
 	"github.com/Symantec/ldap-group-management/lib/metrics"
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
@@ -61,14 +62,138 @@ func initDBSQlite(state *RuntimeState, db string) (err error) {
 
 		permissionStmt := `create table if not exists permissions (id INTEGER PRIMARY KEY AUTOINCREMENT, groupname text not null, 
 				resource_type int not null, resource text not null, permission int not null,
+				deny_permission int not null default 0,
 				unique (groupname, resource_type, resource));`
 		_, err = state.db.Exec(permissionStmt)
 		if err != nil {
 			log.Printf("init table permissions err: %s: %q\n", err, permissionStmt)
 			return err
 		}
+		err = migratePermissionsTable(state)
+		if err != nil {
+			return err
+		}
+
+		transferStmt := `create table if not exists ownership_transfers (id INTEGER PRIMARY KEY AUTOINCREMENT, groupname text not null unique,
+				managegroup text not null, requested_by text not null, time_stamp int not null);`
+		_, err = state.db.Exec(transferStmt)
+		if err != nil {
+			log.Printf("init table ownership_transfers err: %s: %q\n", err, transferStmt)
+			return err
+		}
+
+		joinPolicyStmt := `create table if not exists group_join_policies (id INTEGER PRIMARY KEY AUTOINCREMENT, groupname text not null unique,
+				policy text not null);`
+		_, err = state.db.Exec(joinPolicyStmt)
+		if err != nil {
+			log.Printf("init table group_join_policies err: %s: %q\n", err, joinPolicyStmt)
+			return err
+		}
+
+		invitationStmt := `create table if not exists group_invitations (id INTEGER PRIMARY KEY AUTOINCREMENT, groupname text not null,
+				username text not null, invited_by text not null, time_stamp int not null, expires_at int not null default 0,
+				unique (groupname, username));`
+		_, err = state.db.Exec(invitationStmt)
+		if err != nil {
+			log.Printf("init table group_invitations err: %s: %q\n", err, invitationStmt)
+			return err
+		}
+		err = migrateInvitationsTable(state)
+		if err != nil {
+			return err
+		}
+
+		outboxStmt := `create table if not exists event_outbox (id INTEGER PRIMARY KEY AUTOINCREMENT, event_type text not null,
+				groupname text not null, username text not null, actor text not null, message text not null,
+				time_stamp int not null);`
+		_, err = state.db.Exec(outboxStmt)
+		if err != nil {
+			log.Printf("init table event_outbox err: %s: %q\n", err, outboxStmt)
+			return err
+		}
+
+		endpointStmt := `create table if not exists event_endpoints (id INTEGER PRIMARY KEY AUTOINCREMENT, url text not null unique,
+				secret text not null, last_event_id int not null, attempts int not null, next_attempt int not null,
+				last_error text not null);`
+		_, err = state.db.Exec(endpointStmt)
+		if err != nil {
+			log.Printf("init table event_endpoints err: %s: %q\n", err, endpointStmt)
+			return err
+		}
+
+		deadLetterStmt := `create table if not exists event_dead_letters (id INTEGER PRIMARY KEY AUTOINCREMENT, endpoint_id int not null,
+				event_id int not null, error text not null, time_stamp int not null);`
+		_, err = state.db.Exec(deadLetterStmt)
+		if err != nil {
+			log.Printf("init table event_dead_letters err: %s: %q\n", err, deadLetterStmt)
+			return err
+		}
+
+		preferenceStmt := `create table if not exists notification_preferences (id INTEGER PRIMARY KEY AUTOINCREMENT,
+				username text not null unique, frequency text not null, last_digest int not null);`
+		_, err = state.db.Exec(preferenceStmt)
+		if err != nil {
+			log.Printf("init table notification_preferences err: %s: %q\n", err, preferenceStmt)
+			return err
+		}
+
+		mailQueueStmt := `create table if not exists mail_queue (id INTEGER PRIMARY KEY AUTOINCREMENT, template text not null,
+				recipients text not null, message text not null, time_stamp int not null, attempts int not null,
+				next_attempt int not null, last_error text not null, status text not null);`
+		_, err = state.db.Exec(mailQueueStmt)
+		if err != nil {
+			log.Printf("init table mail_queue err: %s: %q\n", err, mailQueueStmt)
+			return err
+		}
+
+		sessionsStmt := `create table if not exists sessions (id text not null primary key, username text not null,
+				created int not null, last_seen int not null, expires int not null, remote_addr text not null,
+				user_agent text not null);`
+		_, err = state.db.Exec(sessionsStmt)
+		if err != nil {
+			log.Printf("init table sessions err: %s: %q\n", err, sessionsStmt)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Tables created before deny rules existed lack the deny_permission column.
+func migratePermissionsTable(state *RuntimeState) error {
+	_, err := state.db.Exec("select deny_permission from permissions limit 1;")
+	if err == nil {
+		return nil
+	}
+	migrateStmt := "alter table permissions add column deny_permission int not null default 0;"
+	_, err = state.db.Exec(migrateStmt)
+	if err != nil {
+		log.Printf("migrate table permissions err: %s: %q\n", err, migrateStmt)
+		return err
 	}
+	return nil
+}
 
+// Tables created before invitations stored their expiry lack the expires_at
+// column, the existing invitations expire after the configured lifetime.
+func migrateInvitationsTable(state *RuntimeState) error {
+	_, err := state.db.Exec("select expires_at from group_invitations limit 1;")
+	if err == nil {
+		return nil
+	}
+	migrateStmt := "alter table group_invitations add column expires_at int not null default 0;"
+	_, err = state.db.Exec(migrateStmt)
+	if err != nil {
+		log.Printf("migrate table group_invitations err: %s: %q\n", err, migrateStmt)
+		return err
+	}
+	updateStmt := fmt.Sprintf("update group_invitations set expires_at=time_stamp+%d where expires_at=0;",
+		int64(state.invitationLifetime()/time.Second))
+	_, err = state.db.Exec(updateStmt)
+	if err != nil {
+		log.Printf("migrate table group_invitations err: %s: %q\n", err, updateStmt)
+		return err
+	}
 	return nil
 }
 
@@ -88,12 +213,89 @@ func initDBPostgres(state *RuntimeState, db string) (err error) {
 			return err
 		}
 		permissionStmt := `create table if not exists permissions (id SERIAL PRIMARY KEY, groupname text not null, resource_type int not null, resource text not null, permission int not null, 
+				deny_permission int not null default 0,
 				unique (groupname, resource_type, resource));`
 		_, err = state.db.Exec(permissionStmt)
 		if err != nil {
 			log.Printf("init table permissions failed, err: %s", err)
 			return err
 		}
+		err = migratePermissionsTable(state)
+		if err != nil {
+			return err
+		}
+		transferStmt := `create table if not exists ownership_transfers (id SERIAL PRIMARY KEY, groupname text not null unique,
+				managegroup text not null, requested_by text not null, time_stamp int not null);`
+		_, err = state.db.Exec(transferStmt)
+		if err != nil {
+			log.Printf("init table ownership_transfers failed, err: %s", err)
+			return err
+		}
+		joinPolicyStmt := `create table if not exists group_join_policies (id SERIAL PRIMARY KEY, groupname text not null unique,
+				policy text not null);`
+		_, err = state.db.Exec(joinPolicyStmt)
+		if err != nil {
+			log.Printf("init table group_join_policies failed, err: %s", err)
+			return err
+		}
+		invitationStmt := `create table if not exists group_invitations (id SERIAL PRIMARY KEY, groupname text not null,
+				username text not null, invited_by text not null, time_stamp int not null, expires_at int not null default 0,
+				unique (groupname, username));`
+		_, err = state.db.Exec(invitationStmt)
+		if err != nil {
+			log.Printf("init table group_invitations failed, err: %s", err)
+			return err
+		}
+		err = migrateInvitationsTable(state)
+		if err != nil {
+			return err
+		}
+		outboxStmt := `create table if not exists event_outbox (id BIGSERIAL PRIMARY KEY, event_type text not null,
+				groupname text not null, username text not null, actor text not null, message text not null,
+				time_stamp int not null);`
+		_, err = state.db.Exec(outboxStmt)
+		if err != nil {
+			log.Printf("init table event_outbox failed, err: %s", err)
+			return err
+		}
+		endpointStmt := `create table if not exists event_endpoints (id SERIAL PRIMARY KEY, url text not null unique,
+				secret text not null, last_event_id bigint not null, attempts int not null, next_attempt int not null,
+				last_error text not null);`
+		_, err = state.db.Exec(endpointStmt)
+		if err != nil {
+			log.Printf("init table event_endpoints failed, err: %s", err)
+			return err
+		}
+		deadLetterStmt := `create table if not exists event_dead_letters (id SERIAL PRIMARY KEY, endpoint_id int not null,
+				event_id bigint not null, error text not null, time_stamp int not null);`
+		_, err = state.db.Exec(deadLetterStmt)
+		if err != nil {
+			log.Printf("init table event_dead_letters failed, err: %s", err)
+			return err
+		}
+		preferenceStmt := `create table if not exists notification_preferences (id SERIAL PRIMARY KEY,
+				username text not null unique, frequency text not null, last_digest int not null);`
+		_, err = state.db.Exec(preferenceStmt)
+		if err != nil {
+			log.Printf("init table notification_preferences failed, err: %s", err)
+			return err
+		}
+		mailQueueStmt := `create table if not exists mail_queue (id SERIAL PRIMARY KEY, template text not null,
+				recipients text not null, message text not null, time_stamp int not null, attempts int not null,
+				next_attempt int not null, last_error text not null, status text not null);`
+		_, err = state.db.Exec(mailQueueStmt)
+		if err != nil {
+			log.Printf("init table mail_queue failed, err: %s", err)
+			return err
+		}
+		sessionsStmt := `create table if not exists sessions (id text not null primary key, username text not null,
+				created int not null, last_seen int not null, expires int not null, remote_addr text not null,
+				user_agent text not null);`
+		_, err = state.db.Exec(sessionsStmt)
+		if err != nil {
+			log.Printf("init table sessions failed, err: %s", err)
+			return err
+		}
 	}
 
 	return nil
@@ -176,6 +378,14 @@ func deleteEntryofGroupsInDB(groupnames []string, state *RuntimeState) error {
 		if err != nil {
 			return err
 		}
+		err = deleteJoinPolicy(entry, state)
+		if err != nil {
+			return err
+		}
+		err = deleteGroupInvitations(entry, state)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 
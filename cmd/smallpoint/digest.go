@@ -0,0 +1,430 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Symantec/ldap-group-management/lib/userinfo"
+)
+
+// How often managers want to hear about access requests.
+const (
+	// One email per request, the historic behaviour.
+	notifyImmediate = "immediate"
+	notifyHourly    = "hourly"
+	notifyDaily     = "daily"
+	notifyOff       = "off"
+)
+
+var notificationPreferences = []string{notifyImmediate, notifyHourly, notifyDaily, notifyOff}
+
+var digestPeriods = map[string]time.Duration{
+	notifyHourly: time.Hour,
+	notifyDaily:  24 * time.Hour,
+}
+
+const digestCheckInterval = 5 * time.Minute
+
+func validNotificationPreference(frequency string) bool {
+	for _, preference := range notificationPreferences {
+		if frequency == preference {
+			return true
+		}
+	}
+	return false
+}
+
+var deleteNotificationPreferenceStmt = map[string]string{
+	"sqlite":   "delete from notification_preferences where username=?;",
+	"postgres": "delete from notification_preferences where username=$1;",
+}
+
+var insertNotificationPreferenceStmt = map[string]string{
+	"sqlite":   "insert into notification_preferences(username, frequency, last_digest) values (?,?,?);",
+	"postgres": "insert into notification_preferences(username, frequency, last_digest) values ($1,$2,$3);",
+}
+
+// setNotificationPreference stores the preference of username, the first
+// digest is sent one period after it is chosen.
+func setNotificationPreference(username, frequency string, state *RuntimeState) error {
+	stmtText := deleteNotificationPreferenceStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(username)
+	if err != nil {
+		return err
+	}
+	stmtText = insertNotificationPreferenceStmt[state.dbType]
+	insertStmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return err
+	}
+	defer insertStmt.Close()
+	_, err = insertStmt.Exec(username, frequency, time.Now().Unix())
+	return err
+}
+
+var getNotificationPreferenceStmt = map[string]string{
+	"sqlite":   "select frequency from notification_preferences where username=?;",
+	"postgres": "select frequency from notification_preferences where username=$1;",
+}
+
+func getNotificationPreference(username string, state *RuntimeState) (string, error) {
+	stmtText := getNotificationPreferenceStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return "", err
+	}
+	defer stmt.Close()
+	var frequency string
+	err = stmt.QueryRow(username).Scan(&frequency)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return notifyImmediate, nil
+		}
+		return "", err
+	}
+	return frequency, nil
+}
+
+var listDelayedNotificationsStmt = map[string]string{
+	"sqlite":   "select username, frequency from notification_preferences where frequency<>?;",
+	"postgres": "select username, frequency from notification_preferences where frequency<>$1;",
+}
+
+// listDelayedNotifications returns the users who do not want an email per
+// request with their preference.
+func listDelayedNotifications(state *RuntimeState) (map[string]string, error) {
+	stmtText := listDelayedNotificationsStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(notifyImmediate)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	preferences := make(map[string]string)
+	for rows.Next() {
+		var username, frequency string
+		err = rows.Scan(&username, &frequency)
+		if err != nil {
+			return nil, err
+		}
+		preferences[username] = frequency
+	}
+	return preferences, rows.Err()
+}
+
+var listDueDigestsStmt = map[string]string{
+	"sqlite":   "select username, last_digest from notification_preferences where frequency=? and last_digest<=?;",
+	"postgres": "select username, last_digest from notification_preferences where frequency=$1 and last_digest<=$2;",
+}
+
+type digestSubscriber struct {
+	Username   string
+	LastDigest time.Time
+}
+
+// listDueDigests returns the users of frequency whose last digest is older
+// than its period.
+func listDueDigests(frequency string, now time.Time, state *RuntimeState) ([]digestSubscriber, error) {
+	stmtText := listDueDigestsStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(frequency, now.Add(-digestPeriods[frequency]).Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var subscribers []digestSubscriber
+	for rows.Next() {
+		var subscriber digestSubscriber
+		var lastDigest int64
+		err = rows.Scan(&subscriber.Username, &lastDigest)
+		if err != nil {
+			return nil, err
+		}
+		subscriber.LastDigest = time.Unix(lastDigest, 0)
+		subscribers = append(subscribers, subscriber)
+	}
+	return subscribers, rows.Err()
+}
+
+var updateLastDigestStmt = map[string]string{
+	"sqlite":   "update notification_preferences set last_digest=? where username=?;",
+	"postgres": "update notification_preferences set last_digest=$1 where username=$2;",
+}
+
+func updateLastDigest(username string, lastDigest time.Time, state *RuntimeState) error {
+	stmtText := updateLastDigestStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(lastDigest.Unix(), username)
+	return err
+}
+
+var getRequestsSinceStmt = map[string]string{
+	"sqlite":   "select username, groupname from pending_requests where time_stamp>?;",
+	"postgres": "select username, groupname from pending_requests where time_stamp>$1;",
+}
+
+// getRequestsSince returns the pending requests made after since.
+func getRequestsSince(since time.Time, state *RuntimeState) (map[[2]string]bool, error) {
+	stmtText := getRequestsSinceStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	requests := make(map[[2]string]bool)
+	for rows.Next() {
+		var username, groupname string
+		err = rows.Scan(&username, &groupname)
+		if err != nil {
+			return nil, err
+		}
+		requests[[2]string{username, groupname}] = true
+	}
+	return requests, rows.Err()
+}
+
+// getImmediateManagersEmail returns the addresses of the managers of
+// groupname who want an email for every request.
+func (state *RuntimeState) getImmediateManagersEmail(groupname string) ([]string, error) {
+	delayed, err := listDelayedNotifications(state)
+	if err != nil {
+		return nil, err
+	}
+	if len(delayed) == 0 {
+		return state.getManagersEmail(groupname)
+	}
+	managers, err := state.Userinfo.GetGroupManagers(groupname)
+	if err != nil {
+		return nil, err
+	}
+	users, err := userinfo.ManagerUsers(state.Userinfo, groupname, managers)
+	if err != nil {
+		return nil, err
+	}
+	var usersEmail []string
+	for _, user := range users {
+		if _, ok := delayed[user]; ok {
+			continue
+		}
+		userEmail, err := state.Userinfo.GetEmailofauser(user)
+		if err != nil {
+			return nil, err
+		}
+		usersEmail = append(usersEmail, userEmail...)
+	}
+	return usersEmail, nil
+}
+
+type digestRequest struct {
+	Username  string
+	Groupname string
+	New       bool
+}
+
+// digestBatch holds the requests username can act on because of one
+// manager, a managing group or username itself.
+type digestBatch struct {
+	Manager  string
+	Requests []digestRequest
+}
+
+// buildDigest batches the pending actions of username by manager, it also
+// tells whether any of them was requested after since.
+func (state *RuntimeState) buildDigest(username string, since time.Time) ([]digestBatch, bool, error) {
+	actions, err := state.getUserPendingActionsNonCached(username)
+	if err != nil || len(actions) == 0 {
+		return nil, false, err
+	}
+	recent, err := getRequestsSince(since, state)
+	if err != nil {
+		return nil, false, err
+	}
+	userGroups, err := state.Userinfo.GetgroupsofUser(username)
+	if err != nil {
+		return nil, false, err
+	}
+	sort.Strings(userGroups)
+	batches := make(map[string]*digestBatch)
+	hasNew := false
+	for _, action := range actions {
+		request := digestRequest{Username: action[0], Groupname: action[1],
+			New: recent[[2]string{action[0], action[1]}]}
+		managers, err := state.Userinfo.GetGroupManagers(request.Groupname)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, manager := range managers {
+			if !isManagerByGroups(username, userGroups, request.Groupname, []string{manager}) {
+				continue
+			}
+			name, ok := userinfo.ManagerUsername(manager)
+			if !ok {
+				name = userinfo.ManagerGroupname(request.Groupname, manager)
+			}
+			batch, ok := batches[name]
+			if !ok {
+				batch = &digestBatch{Manager: name}
+				batches[name] = batch
+			}
+			batch.Requests = append(batch.Requests, request)
+			hasNew = hasNew || request.New
+			break
+		}
+	}
+	var digest []digestBatch
+	for _, batch := range batches {
+		digest = append(digest, *batch)
+	}
+	sort.Slice(digest, func(i, j int) bool { return digest[i].Manager < digest[j].Manager })
+	return digest, hasNew, nil
+}
+
+const digestMailTemplateText = `{{define "subject"}}Access requests waiting for your review{{end}}
+{{define "text"}}The following access requests are waiting for your review:
+{{range .Batches}}
+As manager of {{.Manager}}:{{range .Requests}}
+  {{.Username}} requested access to group {{.Groupname}}{{if .New}} (new){{end}}{{end}}
+{{end}}
+Please take a review at {{.Hostname}}/pending-actions
+{{end}}
+{{define "html"}}<p>The following access requests are waiting for your review:</p>
+{{range .Batches}}
+<p>As manager of <b>{{.Manager}}</b>:</p>
+<ul>{{range .Requests}}
+<li>{{.Username}} requested access to group {{.Groupname}}{{if .New}} <b>(new)</b>{{end}}</li>{{end}}
+</ul>
+{{end}}
+<p>Please take a review at <a href="{{.Hostname}}/pending-actions">{{.Hostname}}/pending-actions</a></p>
+{{end}}`
+
+// sendDigest emails the pending actions of username when some were
+// requested since the previous digest.
+func (state *RuntimeState) sendDigest(username string, since time.Time) error {
+	batches, hasNew, err := state.buildDigest(username, since)
+	if err != nil || !hasNew {
+		return err
+	}
+	usersEmail, err := state.Userinfo.GetEmailofauser(username)
+	if err != nil {
+		return err
+	}
+	if len(usersEmail) < 1 {
+		return nil
+	}
+	mailData := struct {
+		Batches  []digestBatch
+		Hostname string
+	}{batches, state.baseURL()}
+	return state.sendEmail(mailDigest, usersEmail[:1], mailData)
+}
+
+// sendDueDigests sends the digests whose period has elapsed at now.
+func (state *RuntimeState) sendDueDigests(now time.Time) error {
+	for _, frequency := range []string{notifyHourly, notifyDaily} {
+		subscribers, err := listDueDigests(frequency, now, state)
+		if err != nil {
+			return err
+		}
+		for _, subscriber := range subscribers {
+			err = state.sendDigest(subscriber.Username, subscriber.LastDigest)
+			if err != nil {
+				log.Printf("digest for %s failed: %s", subscriber.Username, err)
+				continue
+			}
+			err = updateLastDigest(subscriber.Username, now, state)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (state *RuntimeState) digestMailerLoop() {
+	for {
+		err := state.sendDueDigests(time.Now())
+		if err != nil {
+			log.Printf("digest mailer failed: %s", err)
+		}
+		time.Sleep(digestCheckInterval)
+	}
+}
+
+func (state *RuntimeState) notificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	// The unsubscribe links of the emails lead to the preferences form.
+	if r.Method == getMethod {
+		http.Redirect(w, r, pendingactionsPath+"#notifications", http.StatusFound)
+		return
+	}
+	if r.Method != postMethod {
+		state.writeFailureResponse(w, r, "POST Method is required", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := state.GetRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		if err.Error() == "missing form body" {
+			http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+		} else {
+			state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		}
+		return
+	}
+	frequency := r.PostFormValue("frequency")
+	if !validNotificationPreference(frequency) {
+		state.writeFailureResponse(w, r, fmt.Sprintf("Invalid notification preference %q", frequency), http.StatusBadRequest)
+		return
+	}
+	err = setNotificationPreference(username, frequency, state)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+
+	pageData := simpleMessagePageData{
+		UserName:       username,
+		IsAdmin:        state.isAdmin(r, username),
+		Title:          "Notification Preference Updated",
+		SuccessMessage: fmt.Sprintf("You will be notified about access requests: %s", frequency),
+		ContinueURL:    pendingactionsPath,
+	}
+	state.renderTemplateOrReturnJson(w, r, "simpleMessagePage", pageData)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotificationPreferences(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The unsubscribe links of the emails are opened with a GET.
+	rr := testUserRequest(&state, "user1", "GET", notificationPreferencesPath, state.notificationPreferencesHandler, nil)
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != pendingactionsPath+"#notifications" {
+		t.Fatalf("unsubscribe link returned %d to %s", rr.Code, rr.Header().Get("Location"))
+	}
+	rr = testUserRequest(&state, "user1", "POST", notificationPreferencesPath, state.notificationPreferencesHandler,
+		url.Values{"frequency": {"weekly"}})
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("invalid preference returned %d", rr.Code)
+	}
+	rr = testUserRequest(&state, "user1", "POST", notificationPreferencesPath, state.notificationPreferencesHandler,
+		url.Values{"frequency": {notifyDaily}})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("set preference returned %d", rr.Code)
+	}
+	preference, err := getNotificationPreference("user1", &state)
+	if err != nil || preference != notifyDaily {
+		t.Fatalf("bad preference %s err=%v", preference, err)
+	}
+	preference, err = getNotificationPreference("user2", &state)
+	if err != nil || preference != notifyImmediate {
+		t.Fatalf("bad default preference %s err=%v", preference, err)
+	}
+	// group1 is self-managed, user1 and user2 are its members.
+	usersEmail, err := state.getImmediateManagersEmail("group1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(usersEmail, []string{"user2@example.com"}) {
+		t.Fatalf("bad immediate managers %v", usersEmail)
+	}
+}
+
+func TestDigestMailer(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent []*smtpDialerMock
+	smtpClient = func(server smtpServer) (smtpDialer, error) {
+		client := &smtpDialerMock{}
+		sent = append(sent, client)
+		return client, nil
+	}
+	err = insertRequestInDB("user3", []string{"group1"}, &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deleteEntryInDB("user3", "group1", &state)
+	err = setNotificationPreference("user2", notifyHourly, &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	err = state.sendDueDigests(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = state.deliverMailQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 0 {
+		t.Fatal("digest sent before the end of its period")
+	}
+
+	err = updateLastDigest("user2", now.Add(-2*time.Hour), &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = state.sendDueDigests(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = state.deliverMailQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 {
+		t.Fatalf("expected one digest, %d were sent", len(sent))
+	}
+	body := sent[0].Buffer.Buffer.String()
+	if !strings.Contains(body, "As manager of group1:") ||
+		!strings.Contains(body, "user3 requested access to group group1 (new)") ||
+		!strings.Contains(body, "/pending-actions") {
+		t.Fatalf("bad digest %q", body)
+	}
+	subscribers, err := listDueDigests(notifyHourly, now, &state)
+	if err != nil || len(subscribers) != 0 {
+		t.Fatalf("digest still due %+v err=%v", subscribers, err)
+	}
+
+	// Without new requests no digest is sent.
+	err = state.sendDueDigests(now.Add(2 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = state.deliverMailQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 {
+		t.Fatalf("digest without new requests was sent")
+	}
+}
@@ -1,13 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"fmt"
+	"github.com/Symantec/ldap-group-management/lib/userinfo"
 	"github.com/mssola/user_agent"
+	htmltemplate "html/template"
 	"io"
+	"io/ioutil"
 	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
 	"net"
 	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
 	texttemplate "text/template"
+	"time"
 )
 
 // From: https://blog.andreiavram.ro/golang-unit-testing-interfaces/
@@ -17,26 +32,359 @@ type smtpDialer interface {
 	//Hello(localName string) error
 	Mail(from string) error
 	Rcpt(to string) error
+	Quit() error
 }
 
-var (
-	smtpClient = func(addr string) (smtpDialer, error) {
-		// Dial the tcp connection
-		conn, err := net.Dial("tcp", addr)
+// How the connection to the SMTP server is secured.
+const (
+	smtpTLSNone = "none"
+	// Upgrade a plain connection, usually on port 587.
+	smtpTLSStartTLS = "starttls"
+	// TLS from the first byte, usually on port 465.
+	smtpTLSImplicit = "tls"
+)
+
+const smtpDialTimeout = 30 * time.Second
+
+type smtpServer struct {
+	Address  string
+	Username string
+	Password string
+	TLS      string
+}
+
+func (state *RuntimeState) smtpServer() smtpServer {
+	config := state.currentConfig()
+	return smtpServer{
+		Address:  config.SMTPserver,
+		Username: config.SMTPUsername,
+		Password: config.SMTPPassword,
+		TLS:      config.SMTPTLS,
+	}
+}
+
+func validSMTPTLS(mode string) bool {
+	switch mode {
+	case "", smtpTLSNone, smtpTLSStartTLS, smtpTLSImplicit:
+		return true
+	}
+	return false
+}
+
+// dialSMTP connects to server, securing and authenticating the connection
+// as configured.
+func dialSMTP(server smtpServer) (smtpDialer, error) {
+	host, _, err := net.SplitHostPort(server.Address)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+
+	// Dial the tcp connection
+	var conn net.Conn
+	if server.TLS == smtpTLSImplicit {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: smtpDialTimeout}, "tcp", server.Address, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", server.Address, smtpDialTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Connect to the SMTP server
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if server.TLS == smtpTLSStartTLS {
+		err = c.StartTLS(tlsConfig)
 		if err != nil {
+			c.Close()
 			return nil, err
 		}
-
-		// Connect to the SMTP server
-		c, err := smtp.NewClient(conn, addr)
+	}
+	if server.Username != "" {
+		// PlainAuth refuses to send the password over a connection
+		// which is neither encrypted nor to localhost.
+		err = c.Auth(smtp.PlainAuth("", server.Username, server.Password, host))
 		if err != nil {
+			c.Close()
 			return nil, err
 		}
+	}
+
+	return c, nil
+}
 
-		return c, nil
+var smtpClient = dialSMTP
+
+// getManagersEmail returns the addresses of every manager of groupname,
+// the members of all the managing groups and the individual managers.
+func (state *RuntimeState) getManagersEmail(groupname string) ([]string, error) {
+	managers, err := state.Userinfo.GetGroupManagers(groupname)
+	if err != nil {
+		return nil, err
 	}
+	var usersEmail []string
+	seen := make(map[string]bool)
+	for _, manager := range managers {
+		if manager == "" {
+			continue
+		}
+		var managerEmail []string
+		if managerUser, ok := userinfo.ManagerUsername(manager); ok {
+			managerEmail, err = state.Userinfo.GetEmailofauser(managerUser)
+		} else {
+			managerEmail, err = state.Userinfo.GetEmailofusersingroup(userinfo.ManagerGroupname(groupname, manager))
+		}
+		if err != nil {
+			if err == userinfo.GroupDoesNotExist {
+				continue
+			}
+			return nil, err
+		}
+		for _, address := range managerEmail {
+			if !seen[address] {
+				seen[address] = true
+				usersEmail = append(usersEmail, address)
+			}
+		}
+	}
+	return usersEmail, nil
+}
+
+// Names of the email templates. A deployment can replace any of them with
+// a file named after it with a .tmpl extension in the email directory of
+// templates_path. Every template defines "subject", "text" and "html".
+const (
+	mailRequestAccess             = "request_access"
+	mailRequestApproved           = "request_approved"
+	mailRequestRejected           = "request_rejected"
+	mailOwnershipTransferRequest  = "ownership_transfer_request"
+	mailOwnershipTransferAccepted = "ownership_transfer_accepted"
+	mailOwnershipTransferRejected = "ownership_transfer_rejected"
+	mailInvitation                = "invitation"
+	mailOrphanedGroups            = "orphaned_groups"
+	mailDigest                    = "digest"
+	mailNotification              = "notification"
 )
 
+const emailTemplatesDirectory = "email"
+
+var defaultEmailTemplates = map[string]string{
+	mailRequestAccess:             requestAccessMailTemplateText,
+	mailRequestApproved:           requestApproveMailTemplateText,
+	mailRequestRejected:           requestRejectMailTemplateText,
+	mailOwnershipTransferRequest:  ownershipTransferRequestMailTemplateText,
+	mailOwnershipTransferAccepted: ownershipTransferAcceptedMailTemplateText,
+	mailOwnershipTransferRejected: ownershipTransferRejectedMailTemplateText,
+	mailInvitation:                invitationMailTemplateText,
+	mailOrphanedGroups:            orphanedGroupsMailTemplateText,
+	mailDigest:                    digestMailTemplateText,
+	mailNotification:              notificationMailTemplateText,
+}
+
+type emailTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+func parseEmailTemplate(name, source string) (*emailTemplate, error) {
+	textTemplate, err := texttemplate.New(name).Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range []string{"subject", "text", "html"} {
+		if textTemplate.Lookup(part) == nil {
+			return nil, fmt.Errorf("email template %s does not define %s", name, part)
+		}
+	}
+	htmlTemplate, err := htmltemplate.New(name).Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	return &emailTemplate{text: textTemplate, html: htmlTemplate}, nil
+}
+
+// parseEmailTemplates prefers the templates found in templatesPath to the
+// built-in ones.
+func parseEmailTemplates(templatesPath string) (map[string]*emailTemplate, error) {
+	emailTemplates := make(map[string]*emailTemplate)
+	for name, source := range defaultEmailTemplates {
+		templatePath := filepath.Join(templatesPath, emailTemplatesDirectory, name+".tmpl")
+		customSource, err := ioutil.ReadFile(templatePath)
+		if err == nil {
+			source = string(customSource)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		emailTemplates[name], err = parseEmailTemplate(name, source)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return emailTemplates, nil
+}
+
+func (state *RuntimeState) loadEmailTemplates() (err error) {
+	state.emailTemplates, err = parseEmailTemplates(state.Config.Base.TemplatesPath)
+	return err
+}
+
+// baseURL is the URL of smallpoint used in emails, hostname may be given
+// with or without a scheme.
+func (state *RuntimeState) baseURL() string {
+	hostname := strings.TrimSuffix(state.currentConfig().Hostname, "/")
+	if hostname == "" || strings.Contains(hostname, "://") {
+		return hostname
+	}
+	return "https://" + hostname
+}
+
+func (state *RuntimeState) newMessageID() (string, error) {
+	random := make([]byte, 12)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	domain := "smallpoint"
+	senderAddress := state.currentConfig().SmtpSenderAddress
+	if at := strings.LastIndex(senderAddress, "@"); at >= 0 {
+		domain = senderAddress[at+1:]
+	}
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().Unix(), hex.EncodeToString(random), domain), nil
+}
+
+// composeEmail renders the template name with data into a multipart
+// message holding a text and an HTML version.
+func (state *RuntimeState) composeEmail(name string, recipients []string, data interface{}) ([]byte, error) {
+	state.configMutex.RLock()
+	templ, ok := state.emailTemplates[name]
+	state.configMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown email template %s", name)
+	}
+	var subject, text, html bytes.Buffer
+	err := templ.text.ExecuteTemplate(&subject, "subject", data)
+	if err != nil {
+		return nil, err
+	}
+	err = templ.text.ExecuteTemplate(&text, "text", data)
+	if err != nil {
+		return nil, err
+	}
+	err = templ.html.ExecuteTemplate(&html, "html", data)
+	if err != nil {
+		return nil, err
+	}
+	messageID, err := state.newMessageID()
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	parts := []struct {
+		contentType string
+		content     []byte
+	}{
+		{"text/plain; charset=utf-8", text.Bytes()},
+		{"text/html; charset=utf-8", html.Bytes()},
+	}
+	for _, part := range parts {
+		partWriter, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoder := quotedprintable.NewWriter(partWriter)
+		_, err = encoder.Write(part.content)
+		if err != nil {
+			return nil, err
+		}
+		err = encoder.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var message bytes.Buffer
+	headers := [][2]string{
+		{"From", state.currentConfig().SmtpSenderAddress},
+		{"To", strings.Join(recipients, ", ")},
+		{"Subject", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject.String()))},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", messageID},
+		{"List-Unsubscribe", "<" + state.baseURL() + notificationPreferencesPath + ">"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + writer.Boundary()},
+	}
+	for _, header := range headers {
+		fmt.Fprintf(&message, "%s: %s\r\n", header[0], header[1])
+	}
+	message.WriteString("\r\n")
+	message.Write(body.Bytes())
+	return message.Bytes(), nil
+}
+
+// sendEmail renders the template name with data and puts it in the mail
+// queue for recipients.
+func (state *RuntimeState) sendEmail(name string, recipients []string, data interface{}) error {
+	if len(recipients) < 1 {
+		return nil
+	}
+	message, err := state.composeEmail(name, recipients, data)
+	if err != nil {
+		return err
+	}
+	err = enqueueMail(name, recipients, message, state)
+	if err != nil {
+		return err
+	}
+	state.wakeMailQueue()
+	return nil
+}
+
+// deliverEmail hands message to the SMTP server.
+func (state *RuntimeState) deliverEmail(recipients []string, message []byte) error {
+	c, err := smtpClient(state.smtpServer())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	err = c.Mail(state.currentConfig().SmtpSenderAddress)
+	if err != nil {
+		return err
+	}
+	for _, recipient := range recipients {
+		err = c.Rcpt(recipient)
+		if err != nil {
+			return err
+		}
+	}
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = wc.Write(message)
+	if err != nil {
+		wc.Close()
+		return err
+	}
+	err = wc.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
 ////Request Access email  start.....//////
 
 //for request access button
@@ -54,49 +402,33 @@ func (state *RuntimeState) SendRequestemail(username string, groupnames []string
 			return fmt.Errorf("no manager for group %s", entry)
 
 		}
-		var usersEmail []string
-		if managerEntry == "self-managed" {
-			managerEntry = entry
-		}
-		usersEmail, err = state.Userinfo.GetEmailofusersingroup(managerEntry)
+		// Managers who chose a digest or no notification at all are
+		// left out, the digest mailer takes care of the former.
+		usersEmail, err := state.getImmediateManagersEmail(entry)
 		if err != nil {
-			log.Printf("SendRequestemail: GetEmailofusersingroup err:%s", err)
+			log.Printf("SendRequestemail: getImmediateManagersEmail err:%s", err)
 			return err
 
 		}
+		if len(usersEmail) == 0 {
+			continue
+		}
 		state.SuccessRequestemail(username, usersEmail, entry, remoteAddr, userAgent)
 	}
 	return nil
 }
 
-// TODO: @SLR9511: The Hostname should be a param, please servisit
-const requestAccessMailTemplateText = `Subject: Request access to group {{.Groupname}}
-User {{.RequestedUser}} requested access to group {{.Groupname}}.
-Please take a review at {{.Hostname}}/pending-actions`
+const requestAccessMailTemplateText = `{{define "subject"}}Request access to group {{.Groupname}}{{end}}
+{{define "text"}}User {{.RequestedUser}} requested access to group {{.Groupname}}.
+Please take a review at {{.Hostname}}/pending-actions
+{{end}}
+{{define "html"}}<p>User <b>{{.RequestedUser}}</b> requested access to group <b>{{.Groupname}}</b>.</p>
+<p>Please take a review at <a href="{{.Hostname}}/pending-actions">{{.Hostname}}/pending-actions</a></p>
+{{end}}`
 
 //send email for requesting access to a group
 func (state *RuntimeState) SuccessRequestemail(requesteduser string, usersEmail []string,
 	groupname, remoteAddr, userAgent string) error {
-	// Connect to the remote SMTP server.
-	c, err := smtpClient(state.Config.Base.SMTPserver)
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-	defer c.Close()
-	// Set the sender and recipient.
-	c.Mail(state.Config.Base.SmtpSenderAddress)
-	for _, recipient := range usersEmail {
-		//c.Rcpt("recipient@example.net")
-		c.Rcpt(recipient)
-	}
-	// Send the email body.
-	wc, err := c.Data()
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-	defer wc.Close()
 	//get browser details
 	ua := user_agent.New(userAgent)
 	uaName, _ := ua.Browser()
@@ -104,29 +436,27 @@ func (state *RuntimeState) SuccessRequestemail(requesteduser string, usersEmail
 	mailData := mailAttributes{
 		RequestedUser: requesteduser,
 		Groupname:     groupname,
-		Hostname:      state.Config.Base.Hostname,
+		Hostname:      state.baseURL(),
 		Browser:       uaName,
 		OS:            ua.OS(),
 		OtherUser:     ""}
-
-	templ, err := texttemplate.New("mailbody").Parse(requestAccessMailTemplateText)
-	if err != nil {
-		log.Fatal(err)
-	}
-	err = templ.Execute(wc, mailData)
+	err := state.sendEmail(mailRequestAccess, usersEmail, mailData)
 	if err != nil {
-		log.Fatal(err)
+		log.Println(err)
 	}
-
-	return nil
+	return err
 }
 
 ////Request Access email  end.....//////
 
 ////Approve email  start.....//////
 
-const requestApproveMailTemplateText = `Subject: Approve access to group {{.Groupname}}
-User {{.OtherUser}} approved user {{.RequestedUser}}'s access request to group {{.Groupname}}`
+const requestApproveMailTemplateText = `{{define "subject"}}Approve access to group {{.Groupname}}{{end}}
+{{define "text"}}User {{.OtherUser}} approved user {{.RequestedUser}}'s access request to group {{.Groupname}}
+{{end}}
+{{define "html"}}<p>User <b>{{.OtherUser}}</b> approved user <b>{{.RequestedUser}}</b>'s access request to group
+<a href="{{.Hostname}}/group_info/?groupname={{.Groupname}}">{{.Groupname}}</a></p>
+{{end}}`
 
 //send approve email
 func (state *RuntimeState) sendApproveemail(username string,
@@ -151,15 +481,7 @@ func (state *RuntimeState) sendApproveemail(username string,
 			log.Println(err)
 			return err
 		}
-		managerGroupName, err := state.Userinfo.GetDescriptionvalue(entry[1])
-		if err != nil {
-			log.Println(err)
-			return err
-		}
-		if managerGroupName == "self-managed" {
-			managerGroupName = entry[1]
-		}
-		otherUsersMail, err := state.Userinfo.GetEmailofusersingroup(managerGroupName)
+		otherUsersMail, err := state.getManagersEmail(entry[1])
 		if err != nil {
 			log.Println(err)
 			return err
@@ -177,26 +499,6 @@ func (state *RuntimeState) sendApproveemail(username string,
 //for approving requests in pending actions main email function
 func (state *RuntimeState) approveRequestemail(requesteduser string, otheruser string, usersEmail []string,
 	groupname string, remoteAddr string, userAgent string) error {
-	// Connect to the remote SMTP server.
-	c, err := smtpClient(state.Config.Base.SMTPserver)
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-	defer c.Close()
-	// Set the sender and recipient.
-	c.Mail(state.Config.Base.SmtpSenderAddress)
-	for _, recipient := range usersEmail {
-		//c.Rcpt("recipient@example.net")
-		c.Rcpt(recipient)
-	}
-	// Send the email body.
-	wc, err := c.Data()
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-	defer wc.Close()
 	//get browser details
 	ua := user_agent.New(userAgent)
 	uaName, _ := ua.Browser()
@@ -207,25 +509,23 @@ func (state *RuntimeState) approveRequestemail(requesteduser string, otheruser s
 		Browser:       uaName,
 		OS:            ua.OS(),
 		OtherUser:     otheruser,
-		Hostname:      state.Config.Base.Hostname}
-
-	templ, err := texttemplate.New("mailbody").Parse(requestApproveMailTemplateText)
+		Hostname:      state.baseURL()}
+	err := state.sendEmail(mailRequestApproved, usersEmail, mailData)
 	if err != nil {
-		log.Fatal(err)
-	}
-	err = templ.Execute(wc, mailData)
-	if err != nil {
-		log.Fatal(err)
+		log.Println(err)
 	}
-
-	return nil
+	return err
 }
 
 ////Approve email  end.....//////
 
 ////Reject email  start.....//////
-const requestRejectMailTemplateText = `Subject: Rejected access to group {{.Groupname}}
-User {{.OtherUser}} rejected user {{.RequestedUser}}'s access request to group {{.Groupname}}`
+const requestRejectMailTemplateText = `{{define "subject"}}Rejected access to group {{.Groupname}}{{end}}
+{{define "text"}}User {{.OtherUser}} rejected user {{.RequestedUser}}'s access request to group {{.Groupname}}
+{{end}}
+{{define "html"}}<p>User <b>{{.OtherUser}}</b> rejected user <b>{{.RequestedUser}}</b>'s access request to group
+<a href="{{.Hostname}}/group_info/?groupname={{.Groupname}}">{{.Groupname}}</a></p>
+{{end}}`
 
 //send reject email
 func (state *RuntimeState) sendRejectemail(username string, userPair [][]string,
@@ -250,33 +550,15 @@ func (state *RuntimeState) sendRejectemail(username string, userPair [][]string,
 			log.Println(err)
 			return err
 		}
-		description, err := state.Userinfo.GetDescriptionvalue(entry[1])
+		other_users_email, err := state.getManagersEmail(entry[1])
 		if err != nil {
 			log.Println(err)
 			return err
 		}
-		if description == "self-managed" {
-			other_users_email, err := state.Userinfo.GetEmailofusersingroup(entry[1])
-			if err != nil {
-				log.Println(err)
-				return err
-			}
-			err = state.RejectRequestemail(requesteduser, username, other_users_email, entry[1], remoteAddr, userAgent)
-			if err != nil {
-				log.Println(err)
-				return err
-			}
-		} else {
-			other_users_email, err := state.Userinfo.GetEmailofusersingroup(description)
-			if err != nil {
-				log.Println(err)
-				return err
-			}
-			err = state.RejectRequestemail(requesteduser, username, other_users_email, entry[1], remoteAddr, userAgent)
-			if err != nil {
-				log.Println(err)
-				return err
-			}
+		err = state.RejectRequestemail(requesteduser, username, other_users_email, entry[1], remoteAddr, userAgent)
+		if err != nil {
+			log.Println(err)
+			return err
 		}
 		targetAddress = nil
 	}
@@ -285,26 +567,6 @@ func (state *RuntimeState) sendRejectemail(username string, userPair [][]string,
 
 func (state *RuntimeState) RejectRequestemail(requesteduser string, otheruser string, usersEmail []string,
 	groupname string, remoteAddr string, userAgent string) error {
-	// Connect to the remote SMTP server.
-	c, err := smtpClient(state.Config.Base.SMTPserver)
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-	defer c.Close()
-	// Set the sender and recipient.
-	c.Mail(state.Config.Base.SmtpSenderAddress)
-	for _, recipient := range usersEmail {
-		//c.Rcpt("recipient@example.net")
-		c.Rcpt(recipient)
-	}
-	// Send the email body.
-	wc, err := c.Data()
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-	defer wc.Close()
 	//get browser details
 	ua := user_agent.New(userAgent)
 	uaName, _ := ua.Browser()
@@ -315,20 +577,89 @@ func (state *RuntimeState) RejectRequestemail(requesteduser string, otheruser st
 		Browser:       uaName,
 		OS:            ua.OS(),
 		OtherUser:     otheruser,
-		Hostname:      state.Config.Base.Hostname}
-
-	templ, err := texttemplate.New("mailbody").Parse(requestRejectMailTemplateText)
+		Hostname:      state.baseURL()}
+	err := state.sendEmail(mailRequestRejected, usersEmail, mailData)
 	if err != nil {
-		log.Fatal(err)
+		log.Println(err)
 	}
-	err = templ.Execute(wc, mailData)
+	return err
+}
+
+///// reject email end/////
+
+////Ownership transfer email start/////
+
+const ownershipTransferRequestMailTemplateText = `{{define "subject"}}Ownership transfer of group {{.Groupname}}{{end}}
+{{define "text"}}User {{.RequestedUser}} asked to make {{.ManageGroup}} the only manager of group {{.Groupname}}, replacing its current managers.
+A member of {{.ManageGroup}} has to accept it at {{.Hostname}}/ownership_transfers
+{{end}}
+{{define "html"}}<p>User <b>{{.RequestedUser}}</b> asked to make <b>{{.ManageGroup}}</b> the only manager of group <b>{{.Groupname}}</b>, replacing its current managers.</p>
+<p>A member of {{.ManageGroup}} has to accept it at <a href="{{.Hostname}}/ownership_transfers">{{.Hostname}}/ownership_transfers</a></p>
+{{end}}`
+
+const ownershipTransferAcceptedMailTemplateText = `{{define "subject"}}Ownership transfer of group {{.Groupname}} accepted{{end}}
+{{define "text"}}User {{.OtherUser}} accepted the transfer of group {{.Groupname}} to {{.ManageGroup}} requested by {{.RequestedUser}}.
+Group {{.Groupname}} is now managed by {{.ManageGroup}} only, it replaced the previous managers.
+{{end}}
+{{define "html"}}<p>User <b>{{.OtherUser}}</b> accepted the transfer of group <b>{{.Groupname}}</b> to <b>{{.ManageGroup}}</b> requested by {{.RequestedUser}}.</p>
+<p>Group <a href="{{.Hostname}}/group_info/?groupname={{.Groupname}}">{{.Groupname}}</a> is now managed by {{.ManageGroup}} only, it replaced the previous managers.</p>
+{{end}}`
+
+const ownershipTransferRejectedMailTemplateText = `{{define "subject"}}Ownership transfer of group {{.Groupname}} rejected{{end}}
+{{define "text"}}User {{.OtherUser}} rejected the transfer of group {{.Groupname}} to {{.ManageGroup}} requested by {{.RequestedUser}}.
+{{end}}
+{{define "html"}}<p>User <b>{{.OtherUser}}</b> rejected the transfer of group <b>{{.Groupname}}</b> to <b>{{.ManageGroup}}</b> requested by {{.RequestedUser}}.</p>
+{{end}}`
+
+// sendOwnershipTransferEmail mails transfer to usersEmail.
+func (state *RuntimeState) sendOwnershipTransferEmail(templateName string, otheruser string,
+	transfer ownershipTransfer, usersEmail []string) error {
+	mailData := mailAttributes{
+		RequestedUser: transfer.RequestedBy,
+		OtherUser:     otheruser,
+		Groupname:     transfer.Groupname,
+		ManageGroup:   transfer.ManageGroup,
+		Hostname:      state.baseURL()}
+	err := state.sendEmail(templateName, usersEmail, mailData)
 	if err != nil {
-		log.Fatal(err)
+		log.Println(err)
 	}
+	return err
+}
 
-	return nil
+////Ownership transfer email end/////
+
+////Invitation email start/////
+
+const invitationMailTemplateText = `{{define "subject"}}Invitation to group {{.Groupname}}{{end}}
+{{define "text"}}User {{.InvitedBy}} invited you to join group {{.Groupname}}.
+Please accept or decline it at {{.Hostname}}/pending-requests before {{.ExpiresAt.Format "2006-01-02 15:04 MST"}}.
+{{end}}
+{{define "html"}}<p>User <b>{{.InvitedBy}}</b> invited you to join group <b>{{.Groupname}}</b>.</p>
+<p>Please accept or decline it at <a href="{{.Hostname}}/pending-requests">{{.Hostname}}/pending-requests</a>
+before {{.ExpiresAt.Format "2006-01-02 15:04 MST"}}.</p>
+{{end}}`
+
+func (state *RuntimeState) sendInvitationEmail(invitation groupInvitation) error {
+	usersEmail, err := state.Userinfo.GetEmailofauser(invitation.Username)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if len(usersEmail) < 1 {
+		return nil
+	}
+	mailData := struct {
+		groupInvitation
+		Hostname string
+	}{invitation, state.baseURL()}
+	err = state.sendEmail(mailInvitation, usersEmail[:1], mailData)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
 }
 
-///// reject email end/////
+////Invitation email end/////
 
 /// Email function end////
@@ -4,8 +4,16 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 type mockIOWriteCloser struct {
@@ -38,16 +46,56 @@ func (*smtpDialerMock) Mail(from string) error {
 func (*smtpDialerMock) Rcpt(to string) error {
 	return nil
 }
+func (*smtpDialerMock) Quit() error {
+	return nil
+}
 func (mock *smtpDialerMock) Data() (io.WriteCloser, error) {
 	return &mock.Buffer, nil
 }
 
+// readTestEmail parses a message sent through the mock and returns its
+// headers with its decoded parts keyed by content type.
+func readTestEmail(t *testing.T, raw string) (mail.Header, map[string]string) {
+	message, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("bad content type %s", mediaType)
+	}
+	parts := make(map[string]string)
+	reader := multipart.NewReader(message.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		partType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[partType] = string(content)
+	}
+	return message.Header, parts
+}
+
 func TestSuccessRequestemail(t *testing.T) {
 	state, err := setupTestState()
 	if err != nil {
 		t.Fatal(err)
 	}
-	smtpClient = func(addr string) (smtpDialer, error) {
+	smtpClient = func(server smtpServer) (smtpDialer, error) {
 		client := &smtpDialerMock{}
 		return client, nil
 	}
@@ -63,7 +111,7 @@ func TestApproveRequestemail(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	smtpClient = func(addr string) (smtpDialer, error) {
+	smtpClient = func(server smtpServer) (smtpDialer, error) {
 		client := &smtpDialerMock{}
 		return client, nil
 	}
@@ -79,7 +127,7 @@ func TestRejectRequestemail(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	smtpClient = func(addr string) (smtpDialer, error) {
+	smtpClient = func(server smtpServer) (smtpDialer, error) {
 		client := &smtpDialerMock{}
 		return client, nil
 	}
@@ -89,3 +137,140 @@ func TestRejectRequestemail(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestSendInvitationEmail(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var client *smtpDialerMock
+	smtpClient = func(server smtpServer) (smtpDialer, error) {
+		client = &smtpDialerMock{}
+		return client, nil
+	}
+	state.Config.Base.Hostname = "smallpoint.example.com"
+	invitedAt := time.Date(2019, 5, 1, 10, 0, 0, 0, time.UTC)
+	err = state.sendInvitationEmail(groupInvitation{Groupname: "group1", Username: "user3", InvitedBy: "user2",
+		InvitedAt: invitedAt, ExpiresAt: invitedAt.Add(defaultInvitationLifetime)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = state.deliverMailQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, parts := readTestEmail(t, client.Buffer.Buffer.String())
+	if header.Get("Subject") != "Invitation to group group1" {
+		t.Fatalf("bad subject %q", header.Get("Subject"))
+	}
+	for _, expected := range []string{"User user2 invited you",
+		"https://smallpoint.example.com/pending-requests", "2019-05-08 10:00 UTC"} {
+		if !strings.Contains(parts["text/plain"], expected) {
+			t.Fatalf("invitation email is missing %q:\n%s", expected, parts["text/plain"])
+		}
+	}
+}
+
+func TestEmailHeaders(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var client *smtpDialerMock
+	smtpClient = func(server smtpServer) (smtpDialer, error) {
+		client = &smtpDialerMock{}
+		return client, nil
+	}
+	state.Config.Base.Hostname = "https://smallpoint.example.com"
+	state.Config.Base.SmtpSenderAddress = "smallpoint@example.com"
+	err = state.SuccessRequestemail("user3", []string{"user1@example.com", "user2@example.com"},
+		"group1", "127.0.0.1", "curl/7.58.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = state.deliverMailQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, parts := readTestEmail(t, client.Buffer.Buffer.String())
+	expectedHeaders := map[string]string{
+		"From":             "smallpoint@example.com",
+		"To":               "user1@example.com, user2@example.com",
+		"Subject":          "Request access to group group1",
+		"List-Unsubscribe": "<https://smallpoint.example.com/notification_preferences>",
+	}
+	for key, expected := range expectedHeaders {
+		if header.Get(key) != expected {
+			t.Fatalf("bad %s header %q", key, header.Get(key))
+		}
+	}
+	if _, err := header.Date(); err != nil {
+		t.Fatalf("bad date header: %s", err)
+	}
+	if !strings.HasSuffix(header.Get("Message-ID"), "@example.com>") {
+		t.Fatalf("bad message id %q", header.Get("Message-ID"))
+	}
+	if !strings.Contains(parts["text/plain"], "user3") ||
+		!strings.Contains(parts["text/html"], `href="https://smallpoint.example.com/pending-actions"`) {
+		t.Fatalf("bad parts %+v", parts)
+	}
+}
+
+func TestCustomEmailTemplate(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	templatesPath, err := ioutil.TempDir("", "smallpoint-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(templatesPath)
+	err = os.Mkdir(filepath.Join(templatesPath, emailTemplatesDirectory), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	custom := `{{define "subject"}}[ACME] {{.Groupname}}{{end}}
+{{define "text"}}{{.RequestedUser}} wants {{.Groupname}}{{end}}
+{{define "html"}}<p>{{.RequestedUser}} wants {{.Groupname}}</p>{{end}}`
+	err = ioutil.WriteFile(filepath.Join(templatesPath, emailTemplatesDirectory, mailRequestAccess+".tmpl"),
+		[]byte(custom), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Config.Base.TemplatesPath = templatesPath
+	err = state.loadEmailTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var client *smtpDialerMock
+	smtpClient = func(server smtpServer) (smtpDialer, error) {
+		client = &smtpDialerMock{}
+		return client, nil
+	}
+	err = state.SuccessRequestemail("user3", []string{"user1@example.com"}, "group1", "127.0.0.1", "curl/7.58.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = state.deliverMailQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, parts := readTestEmail(t, client.Buffer.Buffer.String())
+	if header.Get("Subject") != "[ACME] group1" || parts["text/plain"] != "user3 wants group1" {
+		t.Fatalf("custom template not used: %q %+v", header.Get("Subject"), parts)
+	}
+	// The other templates fall back to the built-in ones.
+	if _, ok := state.emailTemplates[mailRequestApproved]; !ok {
+		t.Fatal("missing default template")
+	}
+
+	err = ioutil.WriteFile(filepath.Join(templatesPath, emailTemplatesDirectory, mailRequestAccess+".tmpl"),
+		[]byte(`{{define "subject"}}no body{{end}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.loadEmailTemplates() == nil {
+		t.Fatal("template without text and html parts was accepted")
+	}
+}
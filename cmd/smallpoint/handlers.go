@@ -93,7 +93,7 @@ func (state *RuntimeState) defaultPathHandler(w http.ResponseWriter, r *http.Req
 }
 
 func (state *RuntimeState) autoAddtoGroups(username string) error {
-	addtoGroups := state.Config.Base.AutoGroups
+	addtoGroups := state.currentConfig().AutoGroups
 	for _, group := range addtoGroups {
 		var groupinfo userinfo.GroupInfo
 		groupinfo.Groupname = group
@@ -154,7 +154,17 @@ func setLoggerUsername(w http.ResponseWriter, authUser string) {
 	}
 }
 
+// GetRemoteUserName returns the user the request acts as, the user an admin
+// impersonates or the authenticated user.
 func (state *RuntimeState) GetRemoteUserName(w http.ResponseWriter, r *http.Request) (string, error) {
+	username, err := state.getAuthenticatedUserName(w, r)
+	if err != nil {
+		return "", err
+	}
+	return state.applyImpersonation(w, r, username)
+}
+
+func (state *RuntimeState) getAuthenticatedUserName(w http.ResponseWriter, r *http.Request) (string, error) {
 	_, err := checkCSRF(w, r)
 	if err != nil {
 		log.Println(err)
@@ -163,20 +173,26 @@ func (state *RuntimeState) GetRemoteUserName(w http.ResponseWriter, r *http.Requ
 		}
 		return "", err
 	}
-	username, err := state.authenticator.GetRemoteUserName(w, r)
+	username, idpGroups, err := state.authenticator.GetRemoteUser(w, r)
 	if err != nil {
 		return "", err
 	}
 	setLoggerUsername(w, username)
+	setIdPGroups(r, username, idpGroups)
 
 	//TODO: add test case for it
 	err = state.createUserorNot(username)
 	if err != nil {
-		log.Println(err)
-		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
-		return "", err
+		// Users holding a role through the identity provider can still get
+		// in while the directory is unavailable.
+		if len(state.getIdPRoles(r, username)) < 1 {
+			log.Println(err)
+			http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+			return "", err
+		}
+		log.Printf("cannot check directory entry of %s, continuing with identity provider roles: %s", username, err)
 	}
-	return username, err
+	return username, nil
 }
 
 //Main page with all LDAP groups displayed
@@ -185,11 +201,12 @@ func (state *RuntimeState) allGroupsHandler(w http.ResponseWriter, r *http.Reque
 	if err != nil {
 		return
 	}
-	isAdmin := state.Userinfo.UserisadminOrNot(username)
+	isAdmin := state.isAdmin(r, username)
 	pageData := allGroupsPageData{
-		UserName: username,
-		IsAdmin:  isAdmin,
-		Title:    "All Groups",
+		UserName:  username,
+		IsAdmin:   isAdmin,
+		Title:     "All Groups",
+		JSSources: []string{"/js/allGroups.js"},
 	}
 	state.renderTemplateOrReturnJson(w, r, "allGroupsPage", pageData)
 	return
@@ -202,7 +219,7 @@ func (state *RuntimeState) mygroupsHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	isAdmin := state.Userinfo.UserisadminOrNot(username)
+	isAdmin := state.isAdmin(r, username)
 	setSecurityHeaders(w)
 	w.Header().Set("Cache-Control", "private, max-age=30")
 	pageData := myGroupsPageData{
@@ -211,7 +228,7 @@ func (state *RuntimeState) mygroupsHandler(w http.ResponseWriter, r *http.Reques
 		Title:     "My Groups",
 		JSSources: []string{"/getGroups.js"},
 	}
-	err = state.htmlTemplate.ExecuteTemplate(w, "myGroupsPage", pageData)
+	err = state.executePageTemplate(w, r, "myGroupsPage", pageData)
 	if err != nil {
 		log.Printf("Failed to execute %v", err)
 		http.Error(w, "error", http.StatusInternalServerError)
@@ -226,7 +243,7 @@ func (state *RuntimeState) myManagedGroupsHandler(w http.ResponseWriter, r *http
 		return
 	}
 
-	isAdmin := state.Userinfo.UserisadminOrNot(username)
+	isAdmin := state.isAdmin(r, username)
 	setSecurityHeaders(w)
 	w.Header().Set("Cache-Control", "private, max-age=30")
 	pageData := myGroupsPageData{
@@ -235,7 +252,7 @@ func (state *RuntimeState) myManagedGroupsHandler(w http.ResponseWriter, r *http
 		Title:     "My Managed Groups",
 		JSSources: []string{"/getGroups.js?type=managedByMe"},
 	}
-	err = state.htmlTemplate.ExecuteTemplate(w, "myGroupsPage", pageData)
+	err = state.executePageTemplate(w, r, "myGroupsPage", pageData)
 	if err != nil {
 		log.Printf("Failed to execute %v", err)
 		http.Error(w, "error", http.StatusInternalServerError)
@@ -294,16 +311,23 @@ func (state *RuntimeState) pendingRequests(w http.ResponseWriter, r *http.Reques
 		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
 		return
 	}
-	isAdmin := state.Userinfo.UserisadminOrNot(username)
+	invitations, err := listUserInvitations(username, state)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	isAdmin := state.isAdmin(r, username)
 	pageData := pendingRequestsPageData{
 		UserName:           username,
 		IsAdmin:            isAdmin,
 		Title:              "Pending Group Requests",
 		HasPendingRequests: hasRequests,
+		Invitations:        invitations,
 	}
 	setSecurityHeaders(w)
 	w.Header().Set("Cache-Control", "private, max-age=30")
-	err = state.htmlTemplate.ExecuteTemplate(w, "pendingRequestsPage", pageData)
+	err = state.executePageTemplate(w, r, "pendingRequestsPage", pageData)
 	if err != nil {
 		log.Printf("Failed to execute %v", err)
 		http.Error(w, "error", http.StatusInternalServerError)
@@ -322,7 +346,7 @@ func (state *RuntimeState) creategroupWebpageHandler(w http.ResponseWriter, r *h
 	go state.Userinfo.GetallUsers()
 	go state.Userinfo.GetallGroups()
 
-	isAdmin := state.Userinfo.UserisadminOrNot(username)
+	isAdmin := state.isAdmin(r, username)
 	pageData := createGroupPageData{
 		UserName: username,
 		IsAdmin:  isAdmin,
@@ -330,7 +354,7 @@ func (state *RuntimeState) creategroupWebpageHandler(w http.ResponseWriter, r *h
 	}
 	setSecurityHeaders(w)
 	w.Header().Set("Cache-Control", "private, max-age=30")
-	err = state.htmlTemplate.ExecuteTemplate(w, "createGroupPage", pageData)
+	err = state.executePageTemplate(w, r, "createGroupPage", pageData)
 	if err != nil {
 		log.Printf("Failed to execute %v", err)
 		http.Error(w, "error", http.StatusInternalServerError)
@@ -344,7 +368,7 @@ func (state *RuntimeState) deletegroupWebpageHandler(w http.ResponseWriter, r *h
 		return
 	}
 	go state.Userinfo.GetallGroups() //cache warmup
-	isAdmin := state.Userinfo.UserisadminOrNot(username)
+	isAdmin := state.isAdmin(r, username)
 	pageData := deleteGroupPageData{
 		UserName: username,
 		IsAdmin:  isAdmin,
@@ -352,7 +376,7 @@ func (state *RuntimeState) deletegroupWebpageHandler(w http.ResponseWriter, r *h
 	}
 	setSecurityHeaders(w)
 	w.Header().Set("Cache-Control", "private, max-age=30")
-	err = state.htmlTemplate.ExecuteTemplate(w, "deleteGroupPage", pageData)
+	err = state.executePageTemplate(w, r, "deleteGroupPage", pageData)
 	if err != nil {
 		log.Printf("Failed to execute %v", err)
 		http.Error(w, "error", http.StatusInternalServerError)
@@ -392,26 +416,91 @@ func (state *RuntimeState) requestAccessHandler(w http.ResponseWriter, r *http.R
 	}
 
 	//fmt.Print(out["groups"])
+	canView, err := state.newGroupViewFilter(r, username)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
 	for _, entry := range out["groups"] {
 		err = state.groupExistsorNot(w, entry)
 		if err != nil {
 			return
 		}
+		visible, err := canView(entry)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+			return
+		}
+		if !visible {
+			http.Error(w, fmt.Sprint("Bad request!"), http.StatusBadRequest)
+			return
+		}
+	}
+	// Open groups are joined right away, the others need an approval.
+	var requestGroups, joinGroups []string
+	for _, entry := range out["groups"] {
+		policy, err := getJoinPolicy(entry, state)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+			return
+		}
+		switch policy {
+		case joinPolicyOpen:
+			joinGroups = append(joinGroups, entry)
+		case joinPolicyClosed:
+			http.Error(w, fmt.Sprintf("Group %s does not accept requests", entry), http.StatusBadRequest)
+			return
+		case joinPolicyInviteOnly:
+			http.Error(w, fmt.Sprintf("Group %s can only be joined on invitation", entry), http.StatusBadRequest)
+			return
+		default:
+			requestGroups = append(requestGroups, entry)
+		}
 	}
-	err = insertRequestInDB(username, out["groups"], state)
-	if err != nil {
-		log.Printf("requestAccessHandler: Error inserting request into DB err:: %s", err)
-		http.Error(w, "oops! an error occured.", http.StatusInternalServerError)
-		return
+	for _, entry := range joinGroups {
+		IsgroupMember, _, err := state.Userinfo.IsgroupmemberorNot(entry, username)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+			return
+		}
+		if IsgroupMember {
+			continue
+		}
+		err = state.Userinfo.AddmemberstoExisting(userinfo.GroupInfo{Groupname: entry, MemberUid: []string{username}})
+		if err != nil {
+			log.Println(err)
+			http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+			return
+		}
+		state.recordEvent(eventMemberAdded, entry, username, username,
+			fmt.Sprintf("%s"+" joined open Group "+"%s", username, entry))
+	}
+	successMessage := "Requests sent successfully, to manage your requests please visit My Pending Requests."
+	if len(requestGroups) > 0 {
+		err = insertRequestInDB(username, requestGroups, state)
+		if err != nil {
+			log.Printf("requestAccessHandler: Error inserting request into DB err:: %s", err)
+			http.Error(w, "oops! an error occured.", http.StatusInternalServerError)
+			return
+		}
+		state.SendRequestemail(username, requestGroups, r.RemoteAddr, r.UserAgent())
+		for _, entry := range requestGroups {
+			state.notify(newNotificationEvent(eventRequestCreated, entry, username, username))
+		}
+	} else {
+		successMessage = fmt.Sprintf("You joined %s.", strings.Join(joinGroups, ", "))
 	}
-	go state.SendRequestemail(username, out["groups"], r.RemoteAddr, r.UserAgent())
 
-	isAdmin := state.Userinfo.UserisadminOrNot(username)
+	isAdmin := state.isAdmin(r, username)
 	pageData := simpleMessagePageData{
 		UserName:       username,
 		IsAdmin:        isAdmin,
 		Title:          "Request sent Successfully",
-		SuccessMessage: "Requests sent successfully, to manage your requests please visit My Pending Requests.",
+		SuccessMessage: successMessage,
 	}
 	state.renderTemplateOrReturnJson(w, r, "simpleMessagePage", pageData)
 }
@@ -519,9 +608,9 @@ func (state *RuntimeState) exitfromGroup(w http.ResponseWriter, r *http.Request)
 			http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
 			return
 		}
-		if state.sysLog != nil {
-			state.sysLog.Write([]byte(fmt.Sprintf("%s"+" exited from Group "+"%s", username, entry)))
-		}
+		state.recordEvent(eventMemberRemoved, entry, username, username,
+			fmt.Sprintf("%s"+" exited from Group "+"%s", username, entry))
+		state.notify(newNotificationEvent(eventMemberRemoved, entry, username, username))
 	}
 	w.WriteHeader(http.StatusOK)
 
@@ -555,7 +644,7 @@ func (state *RuntimeState) cleanupPendingRequests() error {
 			continue
 		}
 	}
-	return nil
+	return deleteExpiredInvitations(state)
 }
 
 const userPendingActionsCacheDuration = time.Second * 5
@@ -634,9 +723,9 @@ func (state *RuntimeState) getUserPendingActionsNonCached(username string) ([][]
 	if err != nil {
 		return nil, err
 	}
-	group2manager := make(map[string]string)
+	group2managers := make(map[string][]string)
 	for _, entry := range allGroups {
-		group2manager[entry[0]] = entry[1]
+		group2managers[entry[0]] = entry[1:]
 	}
 
 	var rvalue [][]string
@@ -645,17 +734,7 @@ func (state *RuntimeState) getUserPendingActionsNonCached(username string) ([][]
 		groupName := entry[1]
 		//requestingUser := entry[0]
 		//fmt.Println(groupName)
-		managerGroup := group2manager[groupName]
-
-		if managerGroup == descriptionAttribute {
-			managerGroup = groupName
-		}
-
-		groupIndex := sort.SearchStrings(userGroups, managerGroup)
-		if groupIndex >= len(userGroups) {
-			continue
-		}
-		if userGroups[groupIndex] != managerGroup {
+		if !isManagerByGroups(username, userGroups, groupName, group2managers[groupName]) {
 			continue
 		}
 
@@ -665,6 +744,25 @@ func (state *RuntimeState) getUserPendingActionsNonCached(username string) ([][]
 	return rvalue, nil
 }
 
+// isManagerByGroups tells whether username is one of managers of groupname
+// given the sorted list of the groups username belongs to.
+func isManagerByGroups(username string, userGroups []string, groupName string, managers []string) bool {
+	for _, manager := range managers {
+		if managerUser, ok := userinfo.ManagerUsername(manager); ok {
+			if managerUser == username {
+				return true
+			}
+			continue
+		}
+		managerGroup := userinfo.ManagerGroupname(groupName, manager)
+		groupIndex := sort.SearchStrings(userGroups, managerGroup)
+		if groupIndex < len(userGroups) && userGroups[groupIndex] == managerGroup {
+			return true
+		}
+	}
+	return false
+}
+
 //User's Pending Actions
 func (state *RuntimeState) pendingActions(w http.ResponseWriter, r *http.Request) {
 	username, err := state.GetRemoteUserName(w, r)
@@ -679,17 +777,32 @@ func (state *RuntimeState) pendingActions(w http.ResponseWriter, r *http.Request
 		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
 		return
 	}
+	invitations, err := state.listManagedInvitations(r, username)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	notificationPreference, err := getNotificationPreference(username, state)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
 
-	isAdmin := state.Userinfo.UserisadminOrNot(username)
+	isAdmin := state.isAdmin(r, username)
 	pageData := pendingActionsPageData{
-		UserName:          username,
-		IsAdmin:           isAdmin,
-		Title:             "Pending Group Requests",
-		HasPendingActions: len(userPendingActions) > 0,
+		UserName:                username,
+		IsAdmin:                 isAdmin,
+		Title:                   "Pending Group Requests",
+		HasPendingActions:       len(userPendingActions) > 0,
+		Invitations:             invitations,
+		NotificationPreference:  notificationPreference,
+		NotificationPreferences: notificationPreferences,
 	}
 	setSecurityHeaders(w)
 	w.Header().Set("Cache-Control", "private, max-age=30")
-	err = state.htmlTemplate.ExecuteTemplate(w, "pendingActionsPage", pageData)
+	err = state.executePageTemplate(w, r, "pendingActionsPage", pageData)
 	if err != nil {
 		log.Printf("Failed to execute %v", err)
 		http.Error(w, "error", http.StatusInternalServerError)
@@ -745,13 +858,13 @@ func (state *RuntimeState) approveHandler(w http.ResponseWriter, r *http.Request
 		if err != nil {
 			return
 		}
-		IsgroupAdmin, err := state.Userinfo.IsgroupAdminorNot(authUser, requestedGroup)
+		canManage, err := state.canManageMembership(r, authUser, requestedGroup)
 		if err != nil {
 			log.Println(err)
 			http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
 			return
 		}
-		if !IsgroupAdmin {
+		if !canManage {
 			http.Error(w, fmt.Sprint("Bad request!"), http.StatusBadRequest)
 			return
 		}
@@ -783,16 +896,16 @@ func (state *RuntimeState) approveHandler(w http.ResponseWriter, r *http.Request
 			http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
 			return
 		}
-		if state.sysLog != nil {
-			state.sysLog.Write([]byte(fmt.Sprintf("%s"+" joined Group "+"%s"+" approved by "+"%s", requestingUser, requestedGroup, authUser)))
-		}
+		state.recordEvent(eventMemberAdded, requestedGroup, requestingUser, authUser,
+			fmt.Sprintf("%s"+" joined Group "+"%s"+" approved by "+"%s", requestingUser, requestedGroup, authUser))
+		state.notify(newNotificationEvent(eventRequestApproved, requestedGroup, requestingUser, authUser))
 		err = deleteEntryInDB(requestingUser, requestedGroup, state)
 		if err != nil {
 			fmt.Println("error here!")
 			log.Println(err)
 		}
 	}
-	go state.sendApproveemail(authUser, out["groups"], r.RemoteAddr, r.UserAgent())
+	state.sendApproveemail(authUser, out["groups"], r.RemoteAddr, r.UserAgent())
 	w.WriteHeader(http.StatusOK)
 
 }
@@ -822,13 +935,13 @@ func (state *RuntimeState) rejectHandler(w http.ResponseWriter, r *http.Request)
 	}
 	//this handler just deletes requests from the DB, so check if the user is authorized to reject or not.
 	for _, entry := range out["groups"] {
-		IsgroupAdmin, err := state.Userinfo.IsgroupAdminorNot(username, entry[1])
+		canManage, err := state.canManageMembership(r, username, entry[1])
 		if err != nil {
 			log.Println(err)
 			http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
 			return
 		}
-		if !IsgroupAdmin {
+		if !canManage {
 			http.Error(w, fmt.Sprint("Bad request!"), http.StatusBadRequest)
 			return
 		}
@@ -852,8 +965,9 @@ func (state *RuntimeState) rejectHandler(w http.ResponseWriter, r *http.Request)
 			return
 
 		}
+		state.notify(newNotificationEvent(eventRequestRejected, entry[1], entry[0], username))
 	}
-	go state.sendRejectemail(username, out["groups"], r.RemoteAddr, r.UserAgent())
+	state.sendRejectemail(username, out["groups"], r.RemoteAddr, r.UserAgent())
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -865,7 +979,7 @@ func (state *RuntimeState) addmemberstoGroupWebpageHandler(w http.ResponseWriter
 	// warm up caches
 	go state.Userinfo.GetallUsers()
 	go state.Userinfo.GetallGroups()
-	isAdmin := state.Userinfo.UserisadminOrNot(username)
+	isAdmin := state.isAdmin(r, username)
 	pageData := addMembersToGroupPagData{
 		UserName: username,
 		IsAdmin:  isAdmin,
@@ -873,7 +987,7 @@ func (state *RuntimeState) addmemberstoGroupWebpageHandler(w http.ResponseWriter
 	}
 	setSecurityHeaders(w)
 	w.Header().Set("Cache-Control", "private, max-age=30")
-	err = state.htmlTemplate.ExecuteTemplate(w, "addMembersToGroupPage", pageData)
+	err = state.executePageTemplate(w, r, "addMembersToGroupPage", pageData)
 	if err != nil {
 		log.Printf("Failed to execute %v", err)
 		http.Error(w, "error", http.StatusInternalServerError)
@@ -907,13 +1021,13 @@ func (state *RuntimeState) addmemberstoExistingGroup(w http.ResponseWriter, r *h
 	if err != nil {
 		return
 	}
-	isAdmin, err := state.isGroupAdmin(username, groupinfo.Groupname)
+	canManage, err := state.canManageMembership(r, username, groupinfo.Groupname)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
 		return
 	}
-	if !isAdmin {
+	if !canManage {
 		log.Printf("User %s is not admin for group %s ", username, groupinfo.Groupname)
 		http.Error(w, "Not authorized", http.StatusForbidden)
 		return
@@ -952,13 +1066,12 @@ func (state *RuntimeState) addmemberstoExistingGroup(w http.ResponseWriter, r *h
 			return
 		}
 	}
-	if state.sysLog != nil {
-		for _, member := range strings.Split(members, ",") {
-			state.sysLog.Write([]byte(fmt.Sprintf("%s"+" was added to Group "+"%s"+" by "+"%s", member, groupinfo.Groupname, username)))
-		}
+	for _, member := range strings.Split(members, ",") {
+		state.recordEvent(eventMemberAdded, groupinfo.Groupname, member, username,
+			fmt.Sprintf("%s"+" was added to Group "+"%s"+" by "+"%s", member, groupinfo.Groupname, username))
 	}
 
-	isGlobalAdmin := state.Userinfo.UserisadminOrNot(username)
+	isGlobalAdmin := state.isAdmin(r, username)
 	pageData := simpleMessagePageData{
 		UserName:       username,
 		IsAdmin:        isGlobalAdmin,
@@ -974,7 +1087,7 @@ func (state *RuntimeState) deletemembersfromGroupWebpageHandler(w http.ResponseW
 	if err != nil {
 		return
 	}
-	isAdmin := state.Userinfo.UserisadminOrNot(username)
+	isAdmin := state.isAdmin(r, username)
 	pageData := deleteMembersFromGroupPageData{
 		UserName: username,
 		IsAdmin:  isAdmin,
@@ -982,7 +1095,7 @@ func (state *RuntimeState) deletemembersfromGroupWebpageHandler(w http.ResponseW
 	}
 	setSecurityHeaders(w)
 	w.Header().Set("Cache-Control", "private, max-age=30")
-	err = state.htmlTemplate.ExecuteTemplate(w, "deleteMembersFromGroupPage", pageData)
+	err = state.executePageTemplate(w, r, "deleteMembersFromGroupPage", pageData)
 	if err != nil {
 		log.Printf("Failed to execute %v", err)
 		http.Error(w, "error", http.StatusInternalServerError)
@@ -1013,7 +1126,7 @@ func (state *RuntimeState) deletemembersfromExistingGroup(w http.ResponseWriter,
 	////// TODO: @SLR9511: why is done this way?... please revisit
 	if members == "" {
 		log.Printf("no members")
-		isAdmin := state.Userinfo.UserisadminOrNot(username)
+		isAdmin := state.isAdmin(r, username)
 		pageData := deleteMembersFromGroupPageData{
 			UserName:  username,
 			IsAdmin:   isAdmin,
@@ -1022,7 +1135,7 @@ func (state *RuntimeState) deletemembersfromExistingGroup(w http.ResponseWriter,
 		}
 		setSecurityHeaders(w)
 		w.Header().Set("Cache-Control", "private, max-age=30")
-		err = state.htmlTemplate.ExecuteTemplate(w, "deleteMembersFromGroupPage", pageData)
+		err = state.executePageTemplate(w, r, "deleteMembersFromGroupPage", pageData)
 		if err != nil {
 			log.Printf("Failed to execute %v", err)
 			http.Error(w, "error", http.StatusInternalServerError)
@@ -1037,13 +1150,13 @@ func (state *RuntimeState) deletemembersfromExistingGroup(w http.ResponseWriter,
 	if err != nil {
 		return
 	}
-	isAdmin, err := state.isGroupAdmin(username, groupinfo.Groupname)
+	canManage, err := state.canManageMembership(r, username, groupinfo.Groupname)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
 		return
 	}
-	if !isAdmin {
+	if !canManage {
 		log.Printf("Unauthorized")
 		http.Error(w, fmt.Sprint(err), http.StatusForbidden)
 		return
@@ -1079,12 +1192,14 @@ func (state *RuntimeState) deletemembersfromExistingGroup(w http.ResponseWriter,
 		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
 		return
 	}
-	if state.sysLog != nil {
-		for _, member := range strings.Split(members, ",") {
-			state.sysLog.Write([]byte(fmt.Sprintf("%s was deleted from Group %s by %s", member, groupinfo.Groupname, username)))
-		}
+	// Only the users who were members are recorded, downstream systems
+	// rely on the outbox to follow the membership.
+	for _, member := range groupinfo.MemberUid {
+		state.recordEvent(eventMemberRemoved, groupinfo.Groupname, member, username,
+			fmt.Sprintf("%s was deleted from Group %s by %s", member, groupinfo.Groupname, username))
+		state.notify(newNotificationEvent(eventMemberRemoved, groupinfo.Groupname, member, username))
 	}
-	isGlobalAdmin := state.Userinfo.UserisadminOrNot(username)
+	isGlobalAdmin := state.isAdmin(r, username)
 	pageData := simpleMessagePageData{
 		UserName:       username,
 		IsAdmin:        isGlobalAdmin,
@@ -1100,7 +1215,7 @@ func (state *RuntimeState) createserviceAccountPageHandler(w http.ResponseWriter
 	if err != nil {
 		return
 	}
-	isAdmin := state.Userinfo.UserisadminOrNot(username)
+	isAdmin := state.isAdmin(r, username)
 
 	pageData := createServiceAccountPageData{
 		UserName: username,
@@ -1109,7 +1224,7 @@ func (state *RuntimeState) createserviceAccountPageHandler(w http.ResponseWriter
 	}
 	setSecurityHeaders(w)
 	w.Header().Set("Cache-Control", "private, max-age=30")
-	err = state.htmlTemplate.ExecuteTemplate(w, "createServiceAccountPage", pageData)
+	err = state.executePageTemplate(w, r, "createServiceAccountPage", pageData)
 	if err != nil {
 		log.Printf("Failed to execute %v", err)
 		http.Error(w, "error", http.StatusInternalServerError)
@@ -1136,7 +1251,7 @@ func (state *RuntimeState) groupExistsorNot(w http.ResponseWriter, groupname str
 	return nil
 }
 
-func (state *RuntimeState) isGroupAdmin(username string, groupname string) (bool, error) {
+func (state *RuntimeState) isGroupAdmin(r *http.Request, username string, groupname string) (bool, error) {
 	IsgroupAdmin, err := state.Userinfo.IsgroupAdminorNot(username, groupname)
 	if err != nil {
 		if err == userinfo.GroupDoesNotExist {
@@ -1147,7 +1262,7 @@ func (state *RuntimeState) isGroupAdmin(username string, groupname string) (bool
 	if IsgroupAdmin {
 		return true, nil
 	}
-	return state.Userinfo.UserisadminOrNot(username), nil
+	return state.isAdmin(r, username), nil
 }
 
 func (state *RuntimeState) groupInfoWebpage(w http.ResponseWriter, r *http.Request) {
@@ -1179,6 +1294,17 @@ func (state *RuntimeState) groupInfoWebpage(w http.ResponseWriter, r *http.Reque
 		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
 		return
 	}
+	visible, err := state.canViewGroup(r, username, groupName)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	// Hidden groups look just like missing ones.
+	if !visible {
+		http.Error(w, fmt.Sprint("Group doesn't exist!"), http.StatusBadRequest)
+		return
+	}
 	IsgroupMember := false
 	for _, user := range groupMembers {
 		if user == username {
@@ -1194,7 +1320,45 @@ func (state *RuntimeState) groupInfoWebpage(w http.ResponseWriter, r *http.Reque
 		}
 	}
 
-	isAdmin := state.Userinfo.UserisadminOrNot(username)
+	if !IsgroupAdmin {
+		IsgroupAdmin, err = state.canManageMembership(r, username, groupName)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	managers, err := state.Userinfo.GetGroupManagers(groupName)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	if len(managers) > 1 {
+		managedby = strings.Join(managers, ", ")
+	}
+	orphanReason, err := state.orphanReason(groupName, managers)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+
+	joinPolicy, err := getJoinPolicy(groupName, state)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	invitation, err := getInvitation(groupName, username, state)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+
+	isAdmin := state.isAdmin(r, username)
 	pageData := groupInfoPageData{
 		UserName:            username,
 		IsAdmin:             isAdmin,
@@ -1203,10 +1367,14 @@ func (state *RuntimeState) groupInfoWebpage(w http.ResponseWriter, r *http.Reque
 		IsGroupAdmin:        IsgroupAdmin || isAdmin,
 		GroupName:           groupName,
 		GroupManagedbyValue: managedby,
+		OrphanReason:        orphanReason,
+		JoinPolicy:          joinPolicy,
+		JoinPolicies:        joinPolicies,
+		HasInvitation:       invitation != nil,
 	}
 	setSecurityHeaders(w)
 	w.Header().Set("Cache-Control", "private, max-age=15")
-	err = state.htmlTemplate.ExecuteTemplate(w, "groupInfoPage", pageData)
+	err = state.executePageTemplate(w, r, "groupInfoPage", pageData)
 	if err != nil {
 		log.Printf("Failed to execute %v", err)
 		http.Error(w, "error", http.StatusInternalServerError)
@@ -1219,7 +1387,7 @@ func (state *RuntimeState) changeownershipWebpageHandler(w http.ResponseWriter,
 	if err != nil {
 		return
 	}
-	isAdmin := state.Userinfo.UserisadminOrNot(username)
+	isAdmin := state.isAdmin(r, username)
 
 	pageData := changeGroupOwnershipPageData{
 		UserName: username,
@@ -1228,7 +1396,7 @@ func (state *RuntimeState) changeownershipWebpageHandler(w http.ResponseWriter,
 	}
 	setSecurityHeaders(w)
 	w.Header().Set("Cache-Control", "private, max-age=30")
-	err = state.htmlTemplate.ExecuteTemplate(w, "changeGroupOwnershipPage", pageData)
+	err = state.executePageTemplate(w, r, "changeGroupOwnershipPage", pageData)
 	if err != nil {
 		log.Printf("Failed to execute %v", err)
 		http.Error(w, "error", http.StatusInternalServerError)
@@ -1241,11 +1409,10 @@ func (state *RuntimeState) permissionmanageWebpageHandler(w http.ResponseWriter,
 	if err != nil {
 		return
 	}
-	isAdmin := state.Userinfo.UserisadminOrNot(username)
-	if !isAdmin {
-		http.Error(w, "you are not authorized", http.StatusForbidden)
+	if !state.requireCapability(w, r, username, capManagePermissions) {
 		return
 	}
+	isAdmin := state.isAdmin(r, username)
 	pageData := permManagePageData{
 		Title:    "Permission Management",
 		IsAdmin:  isAdmin,
@@ -1253,7 +1420,7 @@ func (state *RuntimeState) permissionmanageWebpageHandler(w http.ResponseWriter,
 	}
 	setSecurityHeaders(w)
 	w.Header().Set("Cache-Control", "private, max-age=30")
-	err = state.htmlTemplate.ExecuteTemplate(w, "permManagePage", pageData)
+	err = state.executePageTemplate(w, r, "permManagePage", pageData)
 	if err != nil {
 		log.Printf("Failed to execute %v", err)
 		http.Error(w, "error", http.StatusInternalServerError)
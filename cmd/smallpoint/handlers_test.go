@@ -221,7 +221,7 @@ func TestAddmemberstoExistingGroupSuccess(t *testing.T) {
 	if err != nil {
 		log.Println(err)
 	}
-	smtpClient = func(addr string) (smtpDialer, error) {
+	smtpClient = func(server smtpServer) (smtpDialer, error) {
 		client := &smtpDialerMock{}
 		return client, nil
 	}
@@ -252,7 +252,7 @@ func TestApproveHandler(t *testing.T) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	smtpClient = func(addr string) (smtpDialer, error) {
+	smtpClient = func(server smtpServer) (smtpDialer, error) {
 		client := &smtpDialerMock{}
 		return client, nil
 	}
@@ -295,7 +295,7 @@ func TestRejectHandler(t *testing.T) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	smtpClient = func(addr string) (smtpDialer, error) {
+	smtpClient = func(server smtpServer) (smtpDialer, error) {
 		client := &smtpDialerMock{}
 		return client, nil
 	}
@@ -337,7 +337,7 @@ func TestExitfromGroup(t *testing.T) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	smtpClient = func(addr string) (smtpDialer, error) {
+	smtpClient = func(server smtpServer) (smtpDialer, error) {
 		client := &smtpDialerMock{}
 		return client, nil
 	}
@@ -376,7 +376,7 @@ func TestDeletemembersfromExistingGroupMinimal(t *testing.T) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	smtpClient = func(addr string) (smtpDialer, error) {
+	smtpClient = func(server smtpServer) (smtpDialer, error) {
 		client := &smtpDialerMock{}
 		return client, nil
 	}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	impersonationCookieName = "smallpoint_impersonate"
+	impersonationLifetime   = time.Hour
+	// Set on the responses served to an admin viewing as another user.
+	impersonatedByHeader = "X-Smallpoint-Impersonated-By"
+)
+
+var errImpersonatedWrite = errors.New("writes are not allowed while impersonating")
+
+type impersonationBannerData struct {
+	Admin       string
+	UserName    string
+	AllowWrites bool
+}
+
+func setImpersonationCookie(w http.ResponseWriter, username string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{Name: impersonationCookieName, Value: username, Path: indexPath,
+		MaxAge: maxAge, HttpOnly: true, Secure: true})
+}
+
+// impersonatedUser returns the user an admin asked to view smallpoint as,
+// or an empty string.
+func impersonatedUser(r *http.Request) string {
+	cookie, err := r.Cookie(impersonationCookieName)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// applyImpersonation returns the user username acts as. Admins with an
+// impersonation cookie act as its user, every such request is audited and
+// the ones which could change something are refused unless allowed by the
+// configuration.
+func (state *RuntimeState) applyImpersonation(w http.ResponseWriter, r *http.Request, username string) (string, error) {
+	target := impersonatedUser(r)
+	if target == "" {
+		return username, nil
+	}
+	if !state.isAdmin(r, username) {
+		log.Printf("dropping impersonation of %s by non admin %s", target, username)
+		setImpersonationCookie(w, "", -1)
+		return username, nil
+	}
+	if r.Method != getMethod && r.Method != "HEAD" && !state.currentConfig().AllowImpersonatedWrites {
+		http.Error(w, fmt.Sprintf("%s: stop viewing as %s first", errImpersonatedWrite, target),
+			http.StatusForbidden)
+		return "", errImpersonatedWrite
+	}
+	state.recordEvent(eventImpersonatedRequest, "", target, username,
+		fmt.Sprintf("%s acting as %s: %s %s", username, target, r.Method, r.URL.Path))
+	w.Header().Set(impersonatedByHeader, username)
+	setLoggerUsername(w, username+"/"+target)
+	return target, nil
+}
+
+// executePageTemplate renders the page templateName, with the impersonation
+// banner right after its body tag when an admin is viewing as another user.
+func (state *RuntimeState) executePageTemplate(w http.ResponseWriter, r *http.Request,
+	templateName string, pageData interface{}) error {
+	// The loaded templates are never executed so that each request can
+	// clone them with its own functions.
+	state.configMutex.RLock()
+	pageTemplate, err := state.htmlTemplate.Clone()
+	state.configMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	pageTemplate.Funcs(state.templateFuncs(r))
+	admin := w.Header().Get(impersonatedByHeader)
+	if admin == "" {
+		return pageTemplate.ExecuteTemplate(w, templateName, pageData)
+	}
+	// Pages seen as another user must not come back from the cache once
+	// the admin is back to their own view.
+	w.Header().Set("Cache-Control", "no-store")
+	var page, banner bytes.Buffer
+	err = pageTemplate.ExecuteTemplate(&page, templateName, pageData)
+	if err != nil {
+		return err
+	}
+	err = pageTemplate.ExecuteTemplate(&banner, "impersonationBanner", impersonationBannerData{
+		Admin:       admin,
+		UserName:    impersonatedUser(r),
+		AllowWrites: state.currentConfig().AllowImpersonatedWrites,
+	})
+	if err != nil {
+		return err
+	}
+	position := 0
+	if body := bytes.Index(page.Bytes(), []byte("<body")); body >= 0 {
+		if end := bytes.IndexByte(page.Bytes()[body:], '>'); end >= 0 {
+			position = body + end + 1
+		}
+	}
+	_, err = w.Write(page.Bytes()[:position])
+	if err == nil {
+		_, err = banner.WriteTo(w)
+	}
+	if err == nil {
+		_, err = w.Write(page.Bytes()[position:])
+	}
+	return err
+}
+
+// impersonateHandler lets an admin view smallpoint as another user.
+func (state *RuntimeState) impersonateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != postMethod {
+		state.writeFailureResponse(w, r, "POST Method is required", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := state.getAuthenticatedUserName(w, r)
+	if err != nil {
+		return
+	}
+	if !state.isAdmin(r, username) {
+		http.Error(w, "you are not authorized", http.StatusForbidden)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		if err.Error() == "missing form body" {
+			http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+		} else {
+			state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		}
+		return
+	}
+	target := r.PostFormValue("username")
+	if target == "" || target == username {
+		state.writeFailureResponse(w, r, "Choose another user to view as", http.StatusBadRequest)
+		return
+	}
+	found, err := state.Userinfo.UsernameExistsornot(target)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		state.writeFailureResponse(w, r, fmt.Sprintf("User %s doesn't exist!", target), http.StatusBadRequest)
+		return
+	}
+	setImpersonationCookie(w, target, int(impersonationLifetime.Seconds()))
+	state.recordEvent(eventImpersonationStarted, "", target, username,
+		fmt.Sprintf("%s started viewing as %s.", username, target))
+
+	pageData := simpleMessagePageData{
+		UserName:       username,
+		IsAdmin:        true,
+		Title:          "Viewing as " + target,
+		SuccessMessage: fmt.Sprintf("You are now viewing smallpoint as %s.", target),
+		ContinueURL:    indexPath,
+	}
+	state.renderTemplateOrReturnJson(w, r, "simpleMessagePage", pageData)
+}
+
+// stopImpersonationHandler returns an admin to their own view.
+func (state *RuntimeState) stopImpersonationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != postMethod {
+		state.writeFailureResponse(w, r, "POST Method is required", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := state.getAuthenticatedUserName(w, r)
+	if err != nil {
+		return
+	}
+	target := impersonatedUser(r)
+	setImpersonationCookie(w, "", -1)
+	if target != "" {
+		state.recordEvent(eventImpersonationEnded, "", target, username,
+			fmt.Sprintf("%s stopped viewing as %s.", username, target))
+	}
+	pageData := simpleMessagePageData{
+		UserName:       username,
+		IsAdmin:        state.isAdmin(r, username),
+		Title:          "Viewing as Yourself",
+		SuccessMessage: fmt.Sprintf("%s, you are viewing smallpoint as yourself again.", username),
+		ContinueURL:    indexPath,
+	}
+	state.renderTemplateOrReturnJson(w, r, "simpleMessagePage", pageData)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func testImpersonatedRequest(state *RuntimeState, username string, target string, method string,
+	path string, handler http.HandlerFunc, formValues url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(formValues.Encode()))
+	cookie := testGenValidCookie(state.authenticator, username)
+	req.AddCookie(&cookie)
+	req.AddCookie(&http.Cookie{Name: impersonationCookieName, Value: target})
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "text/html")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestImpersonation(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := testUserRequest(&state, "user2", "POST", impersonatePath, state.impersonateHandler,
+		url.Values{"username": {"user3"}})
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("impersonation by non admin returned %d", rr.Code)
+	}
+	rr = testUserRequest(&state, "user1", "POST", impersonatePath, state.impersonateHandler,
+		url.Values{"username": {"nosuchuser"}})
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("impersonation of unknown user returned %d", rr.Code)
+	}
+	rr = testUserRequest(&state, "user1", "POST", impersonatePath, state.impersonateHandler,
+		url.Values{"username": {"user2"}})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("impersonation returned %d", rr.Code)
+	}
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != impersonationCookieName || cookies[0].Value != "user2" {
+		t.Fatalf("bad impersonation cookie %+v", cookies)
+	}
+
+	// Pages are rendered as the impersonated user with the banner.
+	rr = testImpersonatedRequest(&state, "user1", "user2", "GET", indexPath, state.mygroupsHandler, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("impersonated page returned %d", rr.Code)
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, "Welcome, <strong>user2</strong>") ||
+		!strings.Contains(body, "user1, you are viewing smallpoint as user2.") {
+		t.Fatalf("impersonated page without banner:\n%s", body)
+	}
+	if strings.Index(body, "<body") > strings.Index(body, "viewing smallpoint as") {
+		t.Fatal("banner rendered before the body")
+	}
+	if rr.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("impersonated page cached with %s", rr.Header().Get("Cache-Control"))
+	}
+
+	// Writes are blocked unless allowed.
+	rr = testImpersonatedRequest(&state, "user1", "user2", "POST", revokeUserSessionsPath,
+		state.revokeUserSessionsHandler, url.Values{})
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("impersonated write returned %d", rr.Code)
+	}
+	state.Config.Base.AllowImpersonatedWrites = true
+	rr = testImpersonatedRequest(&state, "user1", "user2", "POST", revokeUserSessionsPath,
+		state.revokeUserSessionsHandler, url.Values{})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("allowed impersonated write returned %d", rr.Code)
+	}
+	state.Config.Base.AllowImpersonatedWrites = false
+
+	// Only admins can impersonate.
+	rr = testImpersonatedRequest(&state, "user3", "user2", "GET", indexPath, state.mygroupsHandler, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("page of non admin returned %d", rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "Welcome, <strong>user3</strong>") ||
+		rr.Header().Get(impersonatedByHeader) != "" {
+		t.Fatal("non admin impersonated another user")
+	}
+
+	rr = testImpersonatedRequest(&state, "user1", "user2", "POST", stopImpersonationPath,
+		state.stopImpersonationHandler, url.Values{})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("stop impersonation returned %d", rr.Code)
+	}
+	cookies = rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != impersonationCookieName || cookies[0].MaxAge >= 0 {
+		t.Fatalf("impersonation cookie not cleared %+v", cookies)
+	}
+
+	events, err := getOutboxEvents(0, 100, &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var eventTypes []string
+	for _, event := range events {
+		if event.Event == eventSessionsRevoked {
+			continue
+		}
+		if event.Username != "user2" || event.Actor != "user1" {
+			t.Fatalf("bad impersonation event %+v", event)
+		}
+		eventTypes = append(eventTypes, event.Event)
+	}
+	expected := []string{eventImpersonationStarted, eventImpersonatedRequest, eventImpersonatedRequest,
+		eventImpersonationEnded}
+	if strings.Join(eventTypes, ",") != strings.Join(expected, ",") {
+		t.Fatalf("impersonation events %v, expected %v", eventTypes, expected)
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Symantec/ldap-group-management/lib/userinfo"
+)
+
+// Invitations expire after a week unless invitation_lifetime is set.
+const defaultInvitationLifetime = 7 * 24 * time.Hour
+
+type groupInvitation struct {
+	Groupname string
+	Username  string
+	InvitedBy string
+	InvitedAt time.Time
+	ExpiresAt time.Time
+}
+
+func (state *RuntimeState) invitationLifetime() time.Duration {
+	if value := state.currentConfig().InvitationLifetime; value > 0 {
+		return value
+	}
+	return defaultInvitationLifetime
+}
+
+var insertInvitationStmt = map[string]string{
+	"sqlite":   "insert into group_invitations(groupname, username, invited_by, time_stamp, expires_at) values (?,?,?,?,?);",
+	"postgres": "insert into group_invitations(groupname, username, invited_by, time_stamp, expires_at) values ($1,$2,$3,$4,$5);",
+}
+
+// insertInvitation records an invitation, inviting the same user again
+// replaces the previous invitation. The expiry is fixed when the invitation
+// is sent, changing invitation_lifetime later does not move it.
+func insertInvitation(groupname, username, invitedBy string, state *RuntimeState) (*groupInvitation, error) {
+	err := deleteInvitation(groupname, username, state)
+	if err != nil {
+		return nil, err
+	}
+	stmtText := insertInvitationStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return nil, err
+	}
+	defer stmt.Close()
+	invitedAt := time.Unix(time.Now().Unix(), 0)
+	invitation := &groupInvitation{Groupname: groupname, Username: username, InvitedBy: invitedBy,
+		InvitedAt: invitedAt, ExpiresAt: invitedAt.Add(state.invitationLifetime())}
+	_, err = stmt.Exec(groupname, username, invitedBy, invitedAt.Unix(), invitation.ExpiresAt.Unix())
+	if err != nil {
+		return nil, err
+	}
+	return invitation, nil
+}
+
+var deleteInvitationStmt = map[string]string{
+	"sqlite":   "delete from group_invitations where groupname=? and username=?;",
+	"postgres": "delete from group_invitations where groupname=$1 and username=$2;",
+}
+
+func deleteInvitation(groupname, username string, state *RuntimeState) error {
+	stmtText := deleteInvitationStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(groupname, username)
+	return err
+}
+
+var deleteGroupInvitationsStmt = map[string]string{
+	"sqlite":   "delete from group_invitations where groupname=?;",
+	"postgres": "delete from group_invitations where groupname=$1;",
+}
+
+func deleteGroupInvitations(groupname string, state *RuntimeState) error {
+	stmtText := deleteGroupInvitationsStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(groupname)
+	return err
+}
+
+var deleteExpiredInvitationsStmt = map[string]string{
+	"sqlite":   "delete from group_invitations where expires_at<=?;",
+	"postgres": "delete from group_invitations where expires_at<=$1;",
+}
+
+func deleteExpiredInvitations(state *RuntimeState) error {
+	stmtText := deleteExpiredInvitationsStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(time.Now().Unix())
+	return err
+}
+
+var getInvitationStmt = map[string]string{
+	"sqlite": `select groupname, username, invited_by, time_stamp, expires_at from group_invitations
+		where groupname=? and username=? and expires_at>?;`,
+	"postgres": `select groupname, username, invited_by, time_stamp, expires_at from group_invitations
+		where groupname=$1 and username=$2 and expires_at>$3;`,
+}
+
+// getInvitation returns nil when username was not invited to groupname or
+// when the invitation expired.
+func getInvitation(groupname, username string, state *RuntimeState) (*groupInvitation, error) {
+	invitations, err := queryInvitations(getInvitationStmt, state, groupname, username, time.Now().Unix())
+	if err != nil || len(invitations) < 1 {
+		return nil, err
+	}
+	return &invitations[0], nil
+}
+
+var listUserInvitationsStmt = map[string]string{
+	"sqlite": `select groupname, username, invited_by, time_stamp, expires_at from group_invitations
+		where username=? and expires_at>? order by time_stamp, groupname;`,
+	"postgres": `select groupname, username, invited_by, time_stamp, expires_at from group_invitations
+		where username=$1 and expires_at>$2 order by time_stamp, groupname;`,
+}
+
+// listUserInvitations returns the invitations username has not answered yet.
+func listUserInvitations(username string, state *RuntimeState) ([]groupInvitation, error) {
+	return queryInvitations(listUserInvitationsStmt, state, username, time.Now().Unix())
+}
+
+var listInvitationsStmt = map[string]string{
+	"sqlite": `select groupname, username, invited_by, time_stamp, expires_at from group_invitations
+		where expires_at>? order by time_stamp, groupname, username;`,
+	"postgres": `select groupname, username, invited_by, time_stamp, expires_at from group_invitations
+		where expires_at>$1 order by time_stamp, groupname, username;`,
+}
+
+func listInvitations(state *RuntimeState) ([]groupInvitation, error) {
+	return queryInvitations(listInvitationsStmt, state, time.Now().Unix())
+}
+
+func queryInvitations(stmtMap map[string]string, state *RuntimeState, args ...interface{}) ([]groupInvitation, error) {
+	stmtText := stmtMap[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	invitations := []groupInvitation{}
+	for rows.Next() {
+		var invitation groupInvitation
+		var timeStamp, expiresAt int64
+		err = rows.Scan(&invitation.Groupname, &invitation.Username, &invitation.InvitedBy, &timeStamp, &expiresAt)
+		if err != nil {
+			return nil, err
+		}
+		invitation.InvitedAt = time.Unix(timeStamp, 0)
+		invitation.ExpiresAt = time.Unix(expiresAt, 0)
+		invitations = append(invitations, invitation)
+	}
+	return invitations, rows.Err()
+}
+
+// listManagedInvitations returns the pending invitations to the groups
+// whose membership username can manage.
+func (state *RuntimeState) listManagedInvitations(r *http.Request, username string) ([]groupInvitation, error) {
+	invitations, err := listInvitations(state)
+	if err != nil {
+		return nil, err
+	}
+	canManage := make(map[string]bool)
+	managed := []groupInvitation{}
+	for _, invitation := range invitations {
+		allowed, ok := canManage[invitation.Groupname]
+		if !ok {
+			allowed, err = state.canManageMembership(r, username, invitation.Groupname)
+			if err != nil {
+				return nil, err
+			}
+			canManage[invitation.Groupname] = allowed
+		}
+		if allowed {
+			managed = append(managed, invitation)
+		}
+	}
+	return managed, nil
+}
+
+// inviteHandler lets the managers of a group invite users, the users join
+// the group when they accept.
+func (state *RuntimeState) inviteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != postMethod {
+		state.writeFailureResponse(w, r, "POST Method is required", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := state.GetRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		if err.Error() == "missing form body" {
+			http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+		} else {
+			state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		}
+		return
+	}
+	groupname := r.PostFormValue("groupname")
+	exists, _, err := state.Userinfo.GroupnameExistsornot(groupname)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		state.writeFailureResponse(w, r, fmt.Sprintf("Group %s doesn't exist!", groupname), http.StatusBadRequest)
+		return
+	}
+	canManage, err := state.canManageMembership(r, username, groupname)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	if !canManage {
+		state.writeFailureResponse(w, r, "Not authorized", http.StatusForbidden)
+		return
+	}
+	policy, err := getJoinPolicy(groupname, state)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	if policy == joinPolicyClosed {
+		state.writeFailureResponse(w, r, fmt.Sprintf("Group %s is closed, add members directly", groupname), http.StatusBadRequest)
+		return
+	}
+	var invitees []string
+	for _, member := range strings.Split(r.PostFormValue("members"), ",") {
+		if len(member) < 1 {
+			continue
+		}
+		userExists, err := state.Userinfo.UsernameExistsornot(member)
+		if err != nil {
+			log.Println(err)
+			state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+			return
+		}
+		if !userExists {
+			state.writeFailureResponse(w, r, fmt.Sprintf("User %s doesn't exist!", member), http.StatusBadRequest)
+			return
+		}
+		isMember, _, err := state.Userinfo.IsgroupmemberorNot(groupname, member)
+		if err != nil {
+			log.Println(err)
+			state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+			return
+		}
+		if isMember {
+			continue
+		}
+		invitees = append(invitees, member)
+	}
+	if len(invitees) < 1 {
+		state.writeFailureResponse(w, r, "Nobody to invite", http.StatusBadRequest)
+		return
+	}
+	for _, invitee := range invitees {
+		invitation, err := insertInvitation(groupname, invitee, username, state)
+		if err != nil {
+			log.Println(err)
+			state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+			return
+		}
+		state.recordEvent(eventInvitationCreated, groupname, invitee, username,
+			fmt.Sprintf("%s was invited to group %s by %s.", invitee, groupname, username))
+		state.sendInvitationEmail(*invitation)
+	}
+
+	pageData := simpleMessagePageData{
+		UserName:       username,
+		IsAdmin:        state.isAdmin(r, username),
+		Title:          "Invitations Sent",
+		SuccessMessage: fmt.Sprintf("Invited %s to group %s", strings.Join(invitees, ", "), groupname),
+		ContinueURL:    groupinfoPath + "?groupname=" + groupname,
+	}
+	state.renderTemplateOrReturnJson(w, r, "simpleMessagePage", pageData)
+}
+
+// acceptInvitationHandler adds the caller to the group it was invited to.
+func (state *RuntimeState) acceptInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != postMethod {
+		state.writeFailureResponse(w, r, "POST Method is required", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := state.GetRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		if err.Error() == "missing form body" {
+			http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+		} else {
+			state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		}
+		return
+	}
+	groupname := r.PostFormValue("groupname")
+	invitation, err := getInvitation(groupname, username, state)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	if invitation == nil {
+		state.writeFailureResponse(w, r, fmt.Sprintf("No invitation to group %s", groupname), http.StatusBadRequest)
+		return
+	}
+	policy, err := getJoinPolicy(groupname, state)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	if policy == joinPolicyClosed {
+		state.writeFailureResponse(w, r, fmt.Sprintf("Group %s was closed since you were invited", groupname), http.StatusBadRequest)
+		return
+	}
+	isMember, _, err := state.Userinfo.IsgroupmemberorNot(groupname, username)
+	if err != nil {
+		log.Println(err)
+		if err == userinfo.GroupDoesNotExist {
+			state.writeFailureResponse(w, r, fmt.Sprintf("Group %s doesn't exist!", groupname), http.StatusBadRequest)
+		} else {
+			state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		}
+		return
+	}
+	if !isMember {
+		err = state.Userinfo.AddmemberstoExisting(userinfo.GroupInfo{Groupname: groupname, MemberUid: []string{username}})
+		if err != nil {
+			log.Println(err)
+			state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+			return
+		}
+	}
+	err = deleteInvitation(groupname, username, state)
+	if err != nil {
+		log.Println(err)
+	}
+	state.recordEvent(eventMemberAdded, groupname, username, username,
+		fmt.Sprintf("%s joined group %s on the invitation of %s.", username, groupname, invitation.InvitedBy))
+
+	pageData := simpleMessagePageData{
+		UserName:       username,
+		IsAdmin:        state.isAdmin(r, username),
+		Title:          "Invitation Accepted",
+		SuccessMessage: fmt.Sprintf("You are a member of group %s now", groupname),
+		ContinueURL:    groupinfoPath + "?groupname=" + groupname,
+	}
+	state.renderTemplateOrReturnJson(w, r, "simpleMessagePage", pageData)
+}
+
+// revokeInvitationHandler drops an invitation, managers use it to revoke
+// the invitations they sent and invited users to decline them.
+func (state *RuntimeState) revokeInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != postMethod {
+		state.writeFailureResponse(w, r, "POST Method is required", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := state.GetRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		if err.Error() == "missing form body" {
+			http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+		} else {
+			state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		}
+		return
+	}
+	groupname := r.PostFormValue("groupname")
+	invitee := r.PostFormValue("username")
+	if invitee == "" {
+		invitee = username
+	}
+	if invitee != username {
+		canManage, err := state.canManageMembership(r, username, groupname)
+		if err != nil {
+			log.Println(err)
+			state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+			return
+		}
+		if !canManage {
+			state.writeFailureResponse(w, r, "Not authorized", http.StatusForbidden)
+			return
+		}
+	}
+	invitation, err := getInvitation(groupname, invitee, state)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	if invitation == nil {
+		state.writeFailureResponse(w, r, fmt.Sprintf("No invitation of %s to group %s", invitee, groupname), http.StatusBadRequest)
+		return
+	}
+	err = deleteInvitation(groupname, invitee, state)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	message := fmt.Sprintf("The invitation of %s to group %s was revoked", invitee, groupname)
+	continueURL := pendingactionsPath
+	if invitee == username {
+		message = fmt.Sprintf("You declined the invitation to group %s", groupname)
+		continueURL = pendingrequestsPath
+	}
+	state.recordEvent(eventInvitationDropped, groupname, invitee, username,
+		fmt.Sprintf("Invitation of %s to group %s sent by %s was dropped by %s.",
+			invitee, groupname, invitation.InvitedBy, username))
+
+	pageData := simpleMessagePageData{
+		UserName:       username,
+		IsAdmin:        state.isAdmin(r, username),
+		Title:          "Invitation Dropped",
+		SuccessMessage: message,
+		ContinueURL:    continueURL,
+	}
+	state.renderTemplateOrReturnJson(w, r, "simpleMessagePage", pageData)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRevokeInvitation(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	smtpClient = func(server smtpServer) (smtpDialer, error) {
+		return &smtpDialerMock{}, nil
+	}
+	formValues := url.Values{"groupname": {"group1"}, "members": {"user3"}}
+	rr := testUserRequest(&state, "user2", "POST", invitePath, state.inviteHandler, formValues)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("invite returned %d", rr.Code)
+	}
+	invitations, err := listUserInvitations("user3", &state)
+	if err != nil || len(invitations) != 1 || invitations[0].InvitedBy != "user2" {
+		t.Fatalf("bad invitations of user3 %+v err=%v", invitations, err)
+	}
+	managed, err := state.listManagedInvitations(nil, "user2")
+	if err != nil || len(managed) != 1 {
+		t.Fatalf("bad invitations managed by user2 %+v err=%v", managed, err)
+	}
+	managed, err = state.listManagedInvitations(nil, "user3")
+	if err != nil || len(managed) != 0 {
+		t.Fatalf("user3 does not manage group1 %+v err=%v", managed, err)
+	}
+
+	revokeValues := url.Values{"groupname": {"group1"}, "username": {"user3"}}
+	// user3 is not in group2, it cannot revoke invitations to group1 of
+	// other users but it may decline its own.
+	rr = testUserRequest(&state, "user3", "POST", revokeInvitationPath, state.revokeInvitationHandler,
+		url.Values{"groupname": {"group1"}, "username": {"user1"}})
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("revoke by outsider returned %d", rr.Code)
+	}
+	rr = testUserRequest(&state, "user2", "POST", revokeInvitationPath, state.revokeInvitationHandler, revokeValues)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("revoke returned %d", rr.Code)
+	}
+	rr = testUserRequest(&state, "user3", "POST", acceptInvitationPath, state.acceptInvitationHandler,
+		url.Values{"groupname": {"group1"}})
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("accepting a revoked invitation returned %d", rr.Code)
+	}
+
+	rr = testUserRequest(&state, "user2", "POST", invitePath, state.inviteHandler, formValues)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("invite returned %d", rr.Code)
+	}
+	rr = testUserRequest(&state, "user3", "POST", revokeInvitationPath, state.revokeInvitationHandler,
+		url.Values{"groupname": {"group1"}})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("decline returned %d", rr.Code)
+	}
+	invitation, err := getInvitation("group1", "user3", &state)
+	if err != nil || invitation != nil {
+		t.Fatalf("declined invitation was kept %+v err=%v", invitation, err)
+	}
+}
+
+func TestInvitationExpiry(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	invitation, err := insertInvitation("group1", "user3", "user2", &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !invitation.ExpiresAt.Equal(invitation.InvitedAt.Add(defaultInvitationLifetime)) {
+		t.Fatalf("bad expiry of the invitation %+v", invitation)
+	}
+	_, err = insertInvitation("group2", "user3", "user2", &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = state.db.Exec("update group_invitations set expires_at=? where groupname=?",
+		time.Now().Add(-time.Hour).Unix(), "group1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	invitation, err = getInvitation("group1", "user3", &state)
+	if err != nil || invitation != nil {
+		t.Fatalf("expired invitation was returned %+v err=%v", invitation, err)
+	}
+	// The expiry was fixed when the invitations were sent, changing the
+	// lifetime neither revives nor expires them.
+	state.Config.Base.InvitationLifetime = 3 * defaultInvitationLifetime
+	invitation, err = getInvitation("group1", "user3", &state)
+	if err != nil || invitation != nil {
+		t.Fatalf("longer lifetime revived an expired invitation %+v err=%v", invitation, err)
+	}
+	state.Config.Base.InvitationLifetime = time.Second
+	invitations, err := listUserInvitations("user3", &state)
+	if err != nil || len(invitations) != 1 || invitations[0].Groupname != "group2" {
+		t.Fatalf("bad invitations of user3 %+v err=%v", invitations, err)
+	}
+	rr := testUserRequest(&state, "user3", "GET", pendingrequestsPath, state.pendingRequests, nil)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "my_invitations") {
+		t.Fatalf("invitation is not listed, code %d", rr.Code)
+	}
+	err = state.cleanupPendingRequests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	err = state.db.QueryRow("select count(*) from group_invitations").Scan(&count)
+	if err != nil || count != 1 {
+		t.Fatalf("expected only the valid invitation to be kept, %d left err=%v", count, err)
+	}
+}
+
+func TestMigrateInvitationsTable(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = state.db.Exec("drop table group_invitations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = state.db.Exec(`create table group_invitations (id INTEGER PRIMARY KEY AUTOINCREMENT, groupname text not null,
+		username text not null, invited_by text not null, time_stamp int not null, unique (groupname, username))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invitedAt := time.Now().Add(-time.Hour).Unix()
+	_, err = state.db.Exec("insert into group_invitations(groupname, username, invited_by, time_stamp) values (?,?,?,?)",
+		"group1", "user3", "user2", invitedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = migrateInvitationsTable(&state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invitation, err := getInvitation("group1", "user3", &state)
+	if err != nil || invitation == nil {
+		t.Fatalf("migrated invitation is missing err=%v", err)
+	}
+	if invitation.ExpiresAt.Unix() != invitedAt+int64(defaultInvitationLifetime/time.Second) {
+		t.Fatalf("bad expiry of the migrated invitation %+v", invitation)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Join policies decide what happens when a user asks to join a group.
+const (
+	// Users become members as soon as they ask.
+	joinPolicyOpen = "open"
+	// A manager has to approve the request, the historic behaviour.
+	joinPolicyApproval = "approval-required"
+	// Only users invited by a manager can join.
+	joinPolicyInviteOnly = "invite-only"
+	// Nobody can ask to join, managers add members themselves.
+	joinPolicyClosed = "closed"
+)
+
+var joinPolicies = []string{joinPolicyOpen, joinPolicyApproval, joinPolicyInviteOnly, joinPolicyClosed}
+
+func validJoinPolicy(policy string) bool {
+	for _, joinPolicy := range joinPolicies {
+		if policy == joinPolicy {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultJoinPolicy applies to groups without a policy of their own.
+func (state *RuntimeState) defaultJoinPolicy() string {
+	if policy := state.currentConfig().DefaultJoinPolicy; policy != "" {
+		return policy
+	}
+	return joinPolicyApproval
+}
+
+var deleteJoinPolicyStmt = map[string]string{
+	"sqlite":   "delete from group_join_policies where groupname=?;",
+	"postgres": "delete from group_join_policies where groupname=$1;",
+}
+
+var insertJoinPolicyStmt = map[string]string{
+	"sqlite":   "insert into group_join_policies(groupname, policy) values (?,?);",
+	"postgres": "insert into group_join_policies(groupname, policy) values ($1,$2);",
+}
+
+func setJoinPolicy(groupname, policy string, state *RuntimeState) error {
+	err := deleteJoinPolicy(groupname, state)
+	if err != nil {
+		return err
+	}
+	stmtText := insertJoinPolicyStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(groupname, policy)
+	return err
+}
+
+func deleteJoinPolicy(groupname string, state *RuntimeState) error {
+	stmtText := deleteJoinPolicyStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(groupname)
+	return err
+}
+
+var getJoinPolicyStmt = map[string]string{
+	"sqlite":   "select policy from group_join_policies where groupname=?;",
+	"postgres": "select policy from group_join_policies where groupname=$1;",
+}
+
+func getJoinPolicy(groupname string, state *RuntimeState) (string, error) {
+	stmtText := getJoinPolicyStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return "", err
+	}
+	defer stmt.Close()
+	var policy string
+	err = stmt.QueryRow(groupname).Scan(&policy)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			return "", err
+		}
+		policy = state.defaultJoinPolicy()
+	}
+	// Nobody joins the admin or the role groups without an approval.
+	if policy == joinPolicyOpen && state.isPrivilegedGroup(groupname) {
+		return joinPolicyApproval, nil
+	}
+	return policy, nil
+}
+
+// canSetJoinPolicy allows the managers of a group and the holders of the
+// update permission on it.
+func (state *RuntimeState) canSetJoinPolicy(r *http.Request, username, groupname string) (bool, error) {
+	isGroupAdmin, err := state.isGroupAdmin(r, username, groupname)
+	if err != nil || isGroupAdmin {
+		return isGroupAdmin, err
+	}
+	return state.canPerformAction(r, username, groupname, resourceGroup, permUpdate)
+}
+
+func (state *RuntimeState) joinPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != postMethod {
+		state.writeFailureResponse(w, r, "POST Method is required", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := state.GetRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		if err.Error() == "missing form body" {
+			http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+		} else {
+			state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		}
+		return
+	}
+	groupname := r.PostFormValue("groupname")
+	policy := r.PostFormValue("policy")
+	if !validJoinPolicy(policy) {
+		state.writeFailureResponse(w, r, fmt.Sprintf("Invalid join policy %q", policy), http.StatusBadRequest)
+		return
+	}
+	exists, _, err := state.Userinfo.GroupnameExistsornot(groupname)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		state.writeFailureResponse(w, r, fmt.Sprintf("Group %s doesn't exist!", groupname), http.StatusBadRequest)
+		return
+	}
+	allowed, err := state.canSetJoinPolicy(r, username, groupname)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		state.writeFailureResponse(w, r, fmt.Sprintf("You don't have permission to change the join policy of group %s", groupname), http.StatusForbidden)
+		return
+	}
+	if policy == joinPolicyOpen && state.isPrivilegedGroup(groupname) {
+		state.writeFailureResponse(w, r, fmt.Sprintf("Group %s grants admin rights or a role and cannot be open", groupname), http.StatusBadRequest)
+		return
+	}
+	err = setJoinPolicy(groupname, policy, state)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	state.recordEvent(eventJoinPolicyChanged, groupname, "", username,
+		fmt.Sprintf("Join policy of group %s was set to %s by %s.", groupname, policy, username))
+
+	pageData := simpleMessagePageData{
+		UserName:       username,
+		IsAdmin:        state.isAdmin(r, username),
+		Title:          "Join Policy Updated",
+		SuccessMessage: fmt.Sprintf("Group %s is %s now", groupname, policy),
+		ContinueURL:    groupinfoPath + "?groupname=" + groupname,
+	}
+	state.renderTemplateOrReturnJson(w, r, "simpleMessagePage", pageData)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func testRequestAccess(t *testing.T, state *RuntimeState, username string, groups ...string) *httptest.ResponseRecorder {
+	jsonBytes, err := json.Marshal(map[string][]string{"groups": groups})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", requestaccessPath, bytes.NewReader(jsonBytes))
+	cookie := testGenValidCookie(state.authenticator, username)
+	req.AddCookie(&cookie)
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(state.requestAccessHandler).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestJoinPolicies(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	smtpClient = func(server smtpServer) (smtpDialer, error) {
+		return &smtpDialerMock{}, nil
+	}
+	policy, err := getJoinPolicy("group2", &state)
+	if err != nil || policy != joinPolicyApproval {
+		t.Fatalf("bad default policy %q err=%v", policy, err)
+	}
+
+	// user2 does not manage group2.
+	formValues := url.Values{"groupname": {"group2"}, "policy": {joinPolicyOpen}}
+	rr := testUserRequest(&state, "user2", "POST", joinPolicyPath, state.joinPolicyHandler, formValues)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("set policy by non manager returned %d", rr.Code)
+	}
+	rr = testUserRequest(&state, "user3", "POST", joinPolicyPath, state.joinPolicyHandler,
+		url.Values{"groupname": {"group2"}, "policy": {"whatever"}})
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("invalid policy returned %d", rr.Code)
+	}
+	rr = testUserRequest(&state, "user3", "POST", joinPolicyPath, state.joinPolicyHandler, formValues)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("set policy returned %d", rr.Code)
+	}
+	rr = testRequestAccess(t, &state, "user2", "group2")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("joining open group returned %d: %s", rr.Code, rr.Body.String())
+	}
+	isMember, _, err := state.Userinfo.IsgroupmemberorNot("group2", "user2")
+	if err != nil || !isMember {
+		t.Fatalf("user2 should have joined group2, err=%v", err)
+	}
+	requests, _, err := findrequestsofUserinDB("user2", &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, group := range requests {
+		if group == "group2" {
+			t.Fatal("joining an open group should not leave a request behind")
+		}
+	}
+
+	for _, policy := range []string{joinPolicyClosed, joinPolicyInviteOnly} {
+		err = setJoinPolicy("group1", policy, &state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr = testRequestAccess(t, &state, "user3", "group1")
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("request to %s group returned %d", policy, rr.Code)
+		}
+	}
+
+	// The admin group is never open, even with an older stored policy.
+	state.Config.TargetLDAP.AdminGroup = "group1"
+	rr = testUserRequest(&state, "user1", "POST", joinPolicyPath, state.joinPolicyHandler,
+		url.Values{"groupname": {"group1"}, "policy": {joinPolicyOpen}})
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("opening the admin group returned %d", rr.Code)
+	}
+	err = setJoinPolicy("group1", joinPolicyOpen, &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = testRequestAccess(t, &state, "user3", "group1")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("request to the admin group returned %d: %s", rr.Code, rr.Body.String())
+	}
+	isMember, _, err = state.Userinfo.IsgroupmemberorNot("group1", "user3")
+	if err != nil || isMember {
+		t.Fatalf("user3 joined the admin group without an approval, err=%v", err)
+	}
+}
+
+func TestInvitations(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = setJoinPolicy("group1", joinPolicyInviteOnly, &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	formValues := url.Values{"groupname": {"group1"}, "members": {"user3"}}
+	rr := testUserRequest(&state, "user3", "POST", invitePath, state.inviteHandler, formValues)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("invite by non manager returned %d", rr.Code)
+	}
+	rr = testUserRequest(&state, "user2", "POST", invitePath, state.inviteHandler, formValues)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("invite returned %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = testUserRequest(&state, "user2", "POST", acceptInvitationPath, state.acceptInvitationHandler,
+		url.Values{"groupname": {"group1"}})
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("accepting without invitation returned %d", rr.Code)
+	}
+	rr = testUserRequest(&state, "user3", "POST", acceptInvitationPath, state.acceptInvitationHandler,
+		url.Values{"groupname": {"group1"}})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("accept returned %d: %s", rr.Code, rr.Body.String())
+	}
+	isMember, _, err := state.Userinfo.IsgroupmemberorNot("group1", "user3")
+	if err != nil || !isMember {
+		t.Fatalf("user3 should have joined group1, err=%v", err)
+	}
+	invitation, err := getInvitation("group1", "user3", &state)
+	if err != nil || invitation != nil {
+		t.Fatalf("accepted invitation was kept %+v err=%v", invitation, err)
+	}
+
+	err = setJoinPolicy("group1", joinPolicyClosed, &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = testUserRequest(&state, "user2", "POST", invitePath, state.inviteHandler,
+		url.Values{"groupname": {"group1"}, "members": {"user4"}})
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("invite to closed group returned %d", rr.Code)
+	}
+}
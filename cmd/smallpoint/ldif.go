@@ -0,0 +1,548 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Symantec/ldap-group-management/lib/ldif"
+	"github.com/Symantec/ldap-group-management/lib/userinfo"
+)
+
+const maxLDIFImportSize = 32 << 20
+
+// importedGroup is a group read from LDIF with all its managers, the first
+// one is also kept in Description.
+type importedGroup struct {
+	userinfo.GroupInfo
+	Managers []string
+}
+
+const (
+	defaultGroupBaseDN   = "ou=groups"
+	defaultServiceBaseDN = "ou=services"
+	defaultUserBaseDN    = "ou=people"
+)
+
+// The DNs in exported files follow the target LDAP layout, the SQL backend
+// has no DNs of its own so relative defaults are used when it is not set.
+func (state *RuntimeState) ldifGroupBaseDN() string {
+	if state.Config.TargetLDAP.GroupSearchBaseDNs != "" {
+		return state.Config.TargetLDAP.GroupSearchBaseDNs
+	}
+	return defaultGroupBaseDN
+}
+
+func (state *RuntimeState) ldifServiceBaseDN() string {
+	if state.Config.TargetLDAP.ServiceAccountBaseDNs != "" {
+		return state.Config.TargetLDAP.ServiceAccountBaseDNs
+	}
+	return defaultServiceBaseDN
+}
+
+func (state *RuntimeState) ldifUserBaseDN() string {
+	if state.Config.TargetLDAP.UserSearchBaseDNs != "" {
+		return state.Config.TargetLDAP.UserSearchBaseDNs
+	}
+	return defaultUserBaseDN
+}
+
+func (state *RuntimeState) ldifManageAttribute() string {
+	if state.Config.TargetLDAP.GroupManageAttribute != "" {
+		return state.Config.TargetLDAP.GroupManageAttribute
+	}
+	return "description"
+}
+
+func (state *RuntimeState) managerToLDIFValue(groupname string, manager string) string {
+	if manager == groupname {
+		manager = descriptionAttribute
+	}
+	if strings.ToLower(state.ldifManageAttribute()) != "owner" {
+		return manager
+	}
+	if managerUser, ok := userinfo.ManagerUsername(manager); ok {
+		return "uid=" + managerUser + "," + state.ldifUserBaseDN()
+	}
+	if manager == descriptionAttribute {
+		manager = groupname
+	}
+	return "cn=" + manager + "," + state.ldifGroupBaseDN()
+}
+
+func (state *RuntimeState) managerFromLDIFValue(groupname string, value string) (string, error) {
+	if strings.ToLower(state.ldifManageAttribute()) == "owner" {
+		rdn := strings.SplitN(value, ",", 2)[0]
+		switch {
+		case strings.HasPrefix(strings.ToLower(rdn), "uid="):
+			return userinfo.UserManagerPrefix + rdn[4:], nil
+		case !strings.HasPrefix(strings.ToLower(rdn), "cn="):
+			return "", fmt.Errorf("owner %q of group %s is not a group or user DN", value, groupname)
+		}
+		value = rdn[3:]
+	}
+	if value == groupname {
+		return descriptionAttribute, nil
+	}
+	return value, nil
+}
+
+// exportGroupsLDIF writes all the managed groups and service accounts of
+// the directory backend as LDIF and returns the number of entries written.
+func (state *RuntimeState) exportGroupsLDIF(writer io.Writer) (int, error) {
+	groups, err := state.Userinfo.GetallGroupsInfo()
+	if err != nil {
+		return 0, err
+	}
+	accounts, err := state.Userinfo.GetallServiceAccountsInfo()
+	if err != nil {
+		return 0, err
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Groupname < groups[j].Groupname })
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Groupname < accounts[j].Groupname })
+
+	var entries []ldif.Entry
+	for _, group := range groups {
+		entry := ldif.Entry{DN: "cn=" + group.Groupname + "," + state.ldifGroupBaseDN()}
+		entry.AddAttributeValues("objectClass", "posixGroup", "top", "groupOfNames")
+		entry.AddAttributeValues("cn", group.Groupname)
+		entry.AddAttributeValues("gidNumber", group.GidNumber)
+		managers, err := state.Userinfo.GetGroupManagers(group.Groupname)
+		if err != nil {
+			return 0, err
+		}
+		for _, manager := range managers {
+			entry.AddAttributeValues(state.ldifManageAttribute(),
+				state.managerToLDIFValue(group.Groupname, manager))
+		}
+		members := append([]string(nil), group.MemberUid...)
+		sort.Strings(members)
+		for _, member := range members {
+			entry.AddAttributeValues("memberUid", member)
+			entry.AddAttributeValues("member", "uid="+member+","+state.ldifUserBaseDN())
+		}
+		entries = append(entries, entry)
+	}
+	for _, account := range accounts {
+		group := ldif.Entry{DN: "cn=" + account.Groupname + "," + state.ldifServiceBaseDN()}
+		group.AddAttributeValues("objectClass", "posixGroup", "top", "groupOfNames")
+		group.AddAttributeValues("cn", account.Groupname)
+		group.AddAttributeValues("gidNumber", account.GidNumber)
+
+		user := ldif.Entry{DN: "uid=" + account.Groupname + "," + state.ldifServiceBaseDN()}
+		user.AddAttributeValues("objectClass", "posixAccount", "top")
+		user.AddAttributeValues("cn", account.Groupname)
+		user.AddAttributeValues("uid", account.Groupname)
+		user.AddAttributeValues("gidNumber", account.GidNumber)
+		user.AddAttributeValues("uidNumber", account.UidNumber)
+		user.AddAttributeValues("loginShell", account.LoginShell)
+		if account.Mail != "" {
+			user.AddAttributeValues("mail", account.Mail)
+		}
+		entries = append(entries, group, user)
+	}
+	return len(entries), ldif.Write(writer, entries)
+}
+
+func hasObjectClass(entry *ldif.Entry, objectClass string) bool {
+	for _, value := range entry.GetAttributeValues("objectClass") {
+		if strings.EqualFold(value, objectClass) {
+			return true
+		}
+	}
+	return false
+}
+
+func parentDN(dn string) string {
+	splitDN := strings.SplitN(dn, ",", 2)
+	if len(splitDN) < 2 {
+		return ""
+	}
+	return strings.TrimSpace(splitDN[1])
+}
+
+func requireNumber(entry *ldif.Entry, name string) (string, error) {
+	value := entry.GetAttributeValue(name)
+	if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+		return "", fmt.Errorf("%s: invalid %s %q", entry.DN, name, value)
+	}
+	return value, nil
+}
+
+// parseGroupsLDIF turns LDIF entries into groups and service accounts.
+// Service account posixGroup entries only carry the gidNumber which is
+// repeated on the posixAccount entry, so they are skipped.
+func (state *RuntimeState) parseGroupsLDIF(entries []ldif.Entry) ([]importedGroup, []userinfo.GroupInfo, error) {
+	var groups []importedGroup
+	var accounts []userinfo.GroupInfo
+	for i := range entries {
+		entry := &entries[i]
+		isServiceEntry := strings.EqualFold(parentDN(entry.DN), state.ldifServiceBaseDN())
+		switch {
+		case isServiceEntry && hasObjectClass(entry, "posixAccount"):
+			var account userinfo.GroupInfo
+			account.Groupname = entry.GetAttributeValue("uid")
+			if account.Groupname == "" {
+				return nil, nil, fmt.Errorf("%s: missing uid", entry.DN)
+			}
+			var err error
+			if account.GidNumber, err = requireNumber(entry, "gidNumber"); err != nil {
+				return nil, nil, err
+			}
+			if account.UidNumber, err = requireNumber(entry, "uidNumber"); err != nil {
+				return nil, nil, err
+			}
+			account.Mail = entry.GetAttributeValue("mail")
+			account.LoginShell = entry.GetAttributeValue("loginShell")
+			if account.LoginShell == "" {
+				account.LoginShell = "/bin/false"
+			}
+			accounts = append(accounts, account)
+		case isServiceEntry:
+			continue
+		case hasObjectClass(entry, "posixGroup") || hasObjectClass(entry, "groupOfNames"):
+			var group importedGroup
+			group.Groupname = entry.GetAttributeValue("cn")
+			if group.Groupname == "" {
+				return nil, nil, fmt.Errorf("%s: missing cn", entry.DN)
+			}
+			var err error
+			if group.GidNumber, err = requireNumber(entry, "gidNumber"); err != nil {
+				return nil, nil, err
+			}
+			values := entry.GetAttributeValues(state.ldifManageAttribute())
+			if len(values) < 1 {
+				return nil, nil, fmt.Errorf("%s: missing %s", entry.DN, state.ldifManageAttribute())
+			}
+			for _, value := range values {
+				manager, err := state.managerFromLDIFValue(group.Groupname, value)
+				if err != nil {
+					return nil, nil, err
+				}
+				group.Managers = append(group.Managers, manager)
+			}
+			group.Description = group.Managers[0]
+			group.MemberUid = entry.GetAttributeValues("memberUid")
+			groups = append(groups, group)
+		default:
+			return nil, nil, fmt.Errorf("%s: not a group or service account", entry.DN)
+		}
+	}
+	return groups, accounts, nil
+}
+
+// validateGroupsImport checks everything up front so that a bad file does
+// not leave a partial import behind.
+func (state *RuntimeState) validateGroupsImport(groups []importedGroup, accounts []userinfo.GroupInfo) error {
+	// gidNumbers are allocated per base DN, service accounts and groups
+	// may legitimately share one.
+	names := make(map[string]bool)
+	groupGidNumbers := make(map[string]string)
+	accountGidNumbers := make(map[string]string)
+	checkUnique := func(gidNumbers map[string]string, name string, gidNumber string) error {
+		if names[name] {
+			return fmt.Errorf("%s appears more than once", name)
+		}
+		names[name] = true
+		if other, ok := gidNumbers[gidNumber]; ok {
+			return fmt.Errorf("gidNumber %s is used by both %s and %s", gidNumber, other, name)
+		}
+		gidNumbers[gidNumber] = name
+		return nil
+	}
+	for _, group := range groups {
+		if err := checkUnique(groupGidNumbers, group.Groupname, group.GidNumber); err != nil {
+			return err
+		}
+	}
+	for _, account := range accounts {
+		if err := checkUnique(accountGidNumbers, account.Groupname, account.GidNumber); err != nil {
+			return err
+		}
+	}
+
+	for _, group := range groups {
+		exists, _, err := state.Userinfo.GroupnameExistsornot(group.Groupname)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("group %s already exists", group.Groupname)
+		}
+	}
+	for _, account := range accounts {
+		exists, _, err := state.Userinfo.ServiceAccountExistsornot(account.Groupname)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("service account %s already exists", account.Groupname)
+		}
+	}
+	if len(groups) > 0 {
+		existingGroups, err := state.Userinfo.GetallGroupsInfo()
+		if err != nil {
+			return err
+		}
+		err = checkExistingGidNumbers(groupGidNumbers, existingGroups)
+		if err != nil {
+			return err
+		}
+	}
+	if len(accounts) > 0 {
+		existingAccounts, err := state.Userinfo.GetallServiceAccountsInfo()
+		if err != nil {
+			return err
+		}
+		err = checkExistingGidNumbers(accountGidNumbers, existingAccounts)
+		if err != nil {
+			return err
+		}
+	}
+
+	checkedUsers := make(map[string]bool)
+	userExists := func(username string) (bool, error) {
+		if checkedUsers[username] {
+			return true, nil
+		}
+		exists, err := state.Userinfo.UsernameExistsornot(username)
+		checkedUsers[username] = exists
+		return exists, err
+	}
+	for _, group := range groups {
+		for _, manager := range group.Managers {
+			if managerUser, ok := userinfo.ManagerUsername(manager); ok {
+				exists, err := userExists(managerUser)
+				if err != nil {
+					return err
+				}
+				if !exists {
+					return fmt.Errorf("manager %s of %s does not exist", managerUser, group.Groupname)
+				}
+				continue
+			}
+			if manager == descriptionAttribute || names[manager] {
+				continue
+			}
+			exists, _, err := state.Userinfo.GroupnameExistsornot(manager)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("manager group %s of %s does not exist", manager, group.Groupname)
+			}
+		}
+		for _, member := range group.MemberUid {
+			exists, err := userExists(member)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("member %s of %s does not exist", member, group.Groupname)
+			}
+		}
+	}
+	return nil
+}
+
+// checkExistingGidNumbers fails when one of the imported gidNumbers, mapped
+// to the name importing it, is already used in the directory.
+func checkExistingGidNumbers(gidNumbers map[string]string, existing []userinfo.GroupInfo) error {
+	for _, entry := range existing {
+		if name, ok := gidNumbers[entry.GidNumber]; ok && entry.GidNumber != "" {
+			return fmt.Errorf("gidNumber %s of %s is already used by %s", entry.GidNumber, name,
+				entry.Groupname)
+		}
+	}
+	return nil
+}
+
+// readGroupsImport parses and validates an LDIF export.
+func (state *RuntimeState) readGroupsImport(reader io.Reader) ([]importedGroup, []userinfo.GroupInfo, error) {
+	entries, err := ldif.Parse(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	groups, accounts, err := state.parseGroupsLDIF(entries)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(groups) == 0 && len(accounts) == 0 {
+		return nil, nil, errors.New("no groups or service accounts found")
+	}
+	err = state.validateGroupsImport(groups, accounts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return groups, accounts, nil
+}
+
+// importGroups recreates validated groups and service accounts keeping
+// their gidNumbers. Groups are created self-managed first so that managers
+// may refer to groups later in the same file. It returns the names created
+// so far even on error.
+func (state *RuntimeState) importGroups(groups []importedGroup, accounts []userinfo.GroupInfo) ([]string, error) {
+	var imported []string
+	var err error
+	for _, group := range groups {
+		err = state.Userinfo.CreateGroup(userinfo.GroupInfo{Groupname: group.Groupname,
+			Description: descriptionAttribute, GidNumber: group.GidNumber})
+		if err != nil {
+			return imported, err
+		}
+		imported = append(imported, group.Groupname)
+		if len(group.MemberUid) == 0 {
+			continue
+		}
+		err = state.Userinfo.AddmemberstoExisting(userinfo.GroupInfo{Groupname: group.Groupname,
+			MemberUid: group.MemberUid})
+		if err != nil {
+			return imported, err
+		}
+	}
+	for _, group := range groups {
+		if len(group.Managers) == 1 && group.Managers[0] == descriptionAttribute {
+			continue
+		}
+		err = state.Userinfo.SetGroupManagers(group.Groupname, group.Managers)
+		if err != nil {
+			return imported, err
+		}
+	}
+	for _, account := range accounts {
+		err = state.Userinfo.CreateServiceAccount(account)
+		if err != nil {
+			return imported, err
+		}
+		imported = append(imported, account.Groupname)
+	}
+	return imported, nil
+}
+
+// runCommand runs the offline subcommands given after the flags.
+func (state *RuntimeState) runCommand(args []string) error {
+	switch {
+	case args[0] == "export-groups" && len(args) <= 2:
+		writer := io.Writer(os.Stdout)
+		if len(args) == 2 {
+			file, err := os.Create(args[1])
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			writer = file
+		}
+		count, err := state.exportGroupsLDIF(writer)
+		if err != nil {
+			return err
+		}
+		log.Printf("Exported %d LDIF entries", count)
+		return nil
+	case args[0] == "import-groups" && len(args) == 2:
+		file, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		groups, accounts, err := state.readGroupsImport(file)
+		if err != nil {
+			return err
+		}
+		imported, err := state.importGroups(groups, accounts)
+		log.Printf("Imported %d groups and service accounts: %s", len(imported), strings.Join(imported, ","))
+		return err
+	}
+	flag.Usage()
+	return fmt.Errorf("unknown command %q", strings.Join(args, " "))
+}
+
+func (state *RuntimeState) exportGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	username, err := state.GetRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	if !state.requireCapability(w, r, username, capExportGroups) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="smallpoint-groups.ldif"`)
+	w.Header().Set("Cache-Control", "private, no-store")
+	count, err := state.exportGroupsLDIF(w)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	state.recordEvent(eventLDIFExported, "", "", username,
+		fmt.Sprintf("%d LDIF entries were exported by %s", count, username))
+}
+
+func (state *RuntimeState) importGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != postMethod {
+		state.writeFailureResponse(w, r, "POST Method is required", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := state.GetRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	if !state.isAdmin(r, username) {
+		http.Error(w, "you are not authorized", http.StatusForbidden)
+		return
+	}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		err = r.ParseMultipartForm(maxLDIFImportSize)
+	} else {
+		err = r.ParseForm()
+	}
+	if err != nil {
+		log.Println(err)
+		if err.Error() == "missing form body" {
+			http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+		} else {
+			state.writeFailureResponse(w, r, fmt.Sprintf("Something wrong with internal server."), http.StatusInternalServerError)
+		}
+		return
+	}
+	var reader io.Reader
+	file, _, err := r.FormFile("ldif")
+	if err == nil {
+		defer file.Close()
+		reader = file
+	} else {
+		reader = strings.NewReader(r.PostFormValue("ldif"))
+	}
+
+	groups, accounts, err := state.readGroupsImport(reader)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, fmt.Sprintf("Invalid LDIF: %s", err), http.StatusBadRequest)
+		return
+	}
+	imported, err := state.importGroups(groups, accounts)
+	for _, name := range imported {
+		state.recordEvent(eventGroupCreated, name, "", username,
+			fmt.Sprintf("Group %s was imported from LDIF by %s", name, username))
+	}
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, fmt.Sprintf("LDIF import stopped after importing %d entries, check the logs.", len(imported)), http.StatusInternalServerError)
+		return
+	}
+
+	isAdmin := state.isAdmin(r, username)
+	pageData := simpleMessagePageData{
+		UserName:       username,
+		IsAdmin:        isAdmin,
+		Title:          "LDIF Import Success",
+		SuccessMessage: fmt.Sprintf("%d groups and service accounts have been imported", len(imported)),
+	}
+	state.renderTemplateOrReturnJson(w, r, "simpleMessagePage", pageData)
+}
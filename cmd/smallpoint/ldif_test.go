@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Symantec/ldap-group-management/lib/userinfo"
+	"github.com/Symantec/ldap-group-management/lib/userinfo/sqluserinfo"
+)
+
+const testImportLDIF = `version: 1
+
+dn: cn=group10,ou=groups
+objectClass: posixGroup
+cn: group10
+gidNumber: 30010
+description: group11
+memberUid: user2
+
+dn: cn=group11,ou=groups
+objectClass: posixGroup
+cn: group11
+gidNumber: 30011
+description: self-managed
+memberUid: user1
+memberUid: user3
+
+dn: cn=svc10,ou=services
+objectClass: posixGroup
+cn: svc10
+gidNumber: 30020
+
+dn: uid=svc10,ou=services
+objectClass: posixAccount
+uid: svc10
+gidNumber: 30020
+uidNumber: 30021
+loginShell: /bin/false
+mail: svc10@example.com
+`
+
+func newTestSQLUserinfo(t *testing.T, dir string, name string) *sqluserinfo.UserInfoSQLSource {
+	u := &sqluserinfo.UserInfoSQLSource{StorageURL: "sqlite:" + filepath.Join(dir, name)}
+	for _, username := range []string{"user1", "user2", "user3"} {
+		err := u.CreateUser(username, []string{username}, []string{username + "@example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return u
+}
+
+func testImportRequest(state *RuntimeState, cookie http.Cookie, ldifText string) *httptest.ResponseRecorder {
+	formValues := url.Values{"ldif": {ldifText}}
+	req := httptest.NewRequest("POST", importGroupsPath, strings.NewReader(formValues.Encode()))
+	req.AddCookie(&cookie)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(state.importGroupsHandler).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestImportGroupsHandler(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := testImportRequest(&state, testCreateValidCookie(state.authenticator), testImportLDIF)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("non admin import returned %d", rr.Code)
+	}
+
+	adminCookie := testCreateValidAdminCookie(state.authenticator)
+	badLDIF := strings.Replace(testImportLDIF, "memberUid: user2", "memberUid: user9", 1)
+	rr = testImportRequest(&state, adminCookie, badLDIF)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("import with unknown member returned %d", rr.Code)
+	}
+	exists, _, err := state.Userinfo.GroupnameExistsornot("group11")
+	if err != nil || exists {
+		t.Fatalf("invalid import should not create anything, err=%v", err)
+	}
+	// gidNumber 20000 belongs to group3.
+	takenGidLDIF := strings.Replace(testImportLDIF, "gidNumber: 30011", "gidNumber: 20000", 1)
+	rr = testImportRequest(&state, adminCookie, takenGidLDIF)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "already used by group3") {
+		t.Fatalf("import with a gidNumber in use returned %d: %s", rr.Code, rr.Body.String())
+	}
+	exists, _, err = state.Userinfo.GroupnameExistsornot("group10")
+	if err != nil || exists {
+		t.Fatalf("import with a gidNumber in use should not create anything, err=%v", err)
+	}
+
+	rr = testImportRequest(&state, adminCookie, testImportLDIF)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("import returned %d: %s", rr.Code, rr.Body.String())
+	}
+	manager, err := state.Userinfo.GetDescriptionvalue("group10")
+	if err != nil || manager != "group11" {
+		t.Fatalf("bad manager of group10 %q err=%v", manager, err)
+	}
+	members, _, err := state.Userinfo.GetusersofaGroup("group11")
+	if err != nil || !reflect.DeepEqual(members, []string{"user1", "user3"}) {
+		t.Fatalf("bad members of group11 %v err=%v", members, err)
+	}
+	exists, _, err = state.Userinfo.ServiceAccountExistsornot("svc10")
+	if err != nil || !exists {
+		t.Fatalf("svc10 was not imported, err=%v", err)
+	}
+
+	rr = testImportRequest(&state, adminCookie, testImportLDIF)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("importing existing groups returned %d", rr.Code)
+	}
+}
+
+func TestExportGroupsHandler(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", exportGroupsPath, nil)
+	cookie := testCreateValidCookie(state.authenticator)
+	req.AddCookie(&cookie)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(state.exportGroupsHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("non admin export returned %d", rr.Code)
+	}
+
+	req = httptest.NewRequest("GET", exportGroupsPath, nil)
+	cookie = testCreateValidAdminCookie(state.authenticator)
+	req.AddCookie(&cookie)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(state.exportGroupsHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("export returned %d", rr.Code)
+	}
+	exported := rr.Body.String()
+	for _, expected := range []string{
+		"dn: cn=group3,ou=groups\n",
+		"description: group1\n",
+		"memberUid: user2\n",
+		"gidNumber: 20000\n",
+	} {
+		if !strings.Contains(exported, expected) {
+			t.Fatalf("export is missing %q:\n%s", expected, exported)
+		}
+	}
+	// The mock directory reuses gidNumber 20001, the export must not be
+	// importable as is.
+	_, _, err = state.readGroupsImport(strings.NewReader(exported))
+	if err == nil || !strings.Contains(err.Error(), "gidNumber 20001") {
+		t.Fatalf("duplicate gidNumber was not detected, err=%v", err)
+	}
+}
+
+func TestLDIFRoundTripSQL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smallpoint_ldif_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := newTestSQLUserinfo(t, dir, "source.sqlite3")
+	target := newTestSQLUserinfo(t, dir, "target.sqlite3")
+	for _, group := range []userinfo.GroupInfo{
+		{Groupname: "group1", Description: "group2", MemberUid: []string{"user1", "user2"}, GidNumber: "20001"},
+		{Groupname: "group2", Description: "self-managed", MemberUid: []string{"user3"}, GidNumber: "20007"},
+	} {
+		err = source.CreateGroup(group)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = source.SetGroupManagers("group1", []string{"group2", "user:user3", "self-managed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = source.CreateServiceAccount(userinfo.GroupInfo{Groupname: "svc1", Mail: "svc1@example.com",
+		LoginShell: "/bin/bash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var exported bytes.Buffer
+	sourceState := RuntimeState{Userinfo: source}
+	_, err = sourceState.exportGroupsLDIF(&exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetState := RuntimeState{Userinfo: target}
+	groups, accounts, err := targetState.readGroupsImport(&exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = targetState.importGroups(groups, accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, getInfo := range []func(u userinfo.UserInfo) ([]userinfo.GroupInfo, error){
+		userinfo.UserInfo.GetallGroupsInfo,
+		userinfo.UserInfo.GetallServiceAccountsInfo,
+	} {
+		expected, err := getInfo(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		imported, err := getInfo(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(expected, imported) {
+			t.Fatalf("round trip mismatch\nexpected %+v\ngot      %+v", expected, imported)
+		}
+	}
+	managers, err := target.GetGroupManagers("group1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(managers, []string{"group2", "user:user3", "self-managed"}) {
+		t.Fatalf("managers of group1 were not imported %v", managers)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Symantec/ldap-group-management/lib/metrics"
+)
+
+// Status of the emails kept in the mail queue, delivered ones are removed.
+const (
+	mailPending = "pending"
+	// Every delivery attempt failed, an admin has to retry it.
+	mailFailed = "failed"
+)
+
+const (
+	defaultMailDeliveryInterval = time.Minute
+	defaultMailRetryBackoff     = time.Minute
+	defaultMailMaxAttempts      = 6
+	mailQueueBatchSize          = 100
+)
+
+type queuedMail struct {
+	ID          int64
+	Template    string
+	Recipients  []string
+	Created     time.Time
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+	Status      string
+	message     []byte
+}
+
+var insertQueuedMailStmt = map[string]string{
+	"sqlite": "insert into mail_queue(template, recipients, message, time_stamp, attempts, next_attempt, last_error, status) " +
+		"values (?,?,?,?,0,0,'',?);",
+	"postgres": "insert into mail_queue(template, recipients, message, time_stamp, attempts, next_attempt, last_error, status) " +
+		"values ($1,$2,$3,$4,0,0,'',$5);",
+}
+
+func enqueueMail(template string, recipients []string, message []byte, state *RuntimeState) error {
+	stmtText := insertQueuedMailStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(template, strings.Join(recipients, ","), string(message), time.Now().Unix(), mailPending)
+	return err
+}
+
+var getDueMailStmt = map[string]string{
+	"sqlite": "select id, template, recipients, message, time_stamp, attempts, next_attempt, last_error, status " +
+		"from mail_queue where status=? and next_attempt<=? order by id limit ?;",
+	"postgres": "select id, template, recipients, message, time_stamp, attempts, next_attempt, last_error, status " +
+		"from mail_queue where status=$1 and next_attempt<=$2 order by id limit $3;",
+}
+
+var listQueuedMailStmt = map[string]string{
+	"sqlite": "select id, template, recipients, '', time_stamp, attempts, next_attempt, last_error, status " +
+		"from mail_queue order by id;",
+	"postgres": "select id, template, recipients, '', time_stamp, attempts, next_attempt, last_error, status " +
+		"from mail_queue order by id;",
+}
+
+func queryQueuedMail(state *RuntimeState, stmtText string, args ...interface{}) ([]queuedMail, error) {
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	mails := []queuedMail{}
+	for rows.Next() {
+		var mail queuedMail
+		var recipients, message string
+		var created, nextAttempt int64
+		err = rows.Scan(&mail.ID, &mail.Template, &recipients, &message, &created, &mail.Attempts,
+			&nextAttempt, &mail.LastError, &mail.Status)
+		if err != nil {
+			return nil, err
+		}
+		mail.Recipients = strings.Split(recipients, ",")
+		mail.message = []byte(message)
+		mail.Created = time.Unix(created, 0)
+		if nextAttempt > 0 {
+			mail.NextAttempt = time.Unix(nextAttempt, 0)
+		}
+		mails = append(mails, mail)
+	}
+	return mails, rows.Err()
+}
+
+// getDueMail returns the pending emails whose next attempt is not after now.
+func getDueMail(now time.Time, state *RuntimeState) ([]queuedMail, error) {
+	return queryQueuedMail(state, getDueMailStmt[state.dbType], mailPending, now.Unix(), mailQueueBatchSize)
+}
+
+// listQueuedMail returns every email of the queue without its message.
+func listQueuedMail(state *RuntimeState) ([]queuedMail, error) {
+	return queryQueuedMail(state, listQueuedMailStmt[state.dbType])
+}
+
+var updateQueuedMailStmt = map[string]string{
+	"sqlite":   "update mail_queue set attempts=?, next_attempt=?, last_error=?, status=? where id=?;",
+	"postgres": "update mail_queue set attempts=$1, next_attempt=$2, last_error=$3, status=$4 where id=$5;",
+}
+
+func updateQueuedMail(mail queuedMail, state *RuntimeState) (bool, error) {
+	stmtText := updateQueuedMailStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return false, err
+	}
+	defer stmt.Close()
+	var nextAttempt int64
+	if !mail.NextAttempt.IsZero() {
+		nextAttempt = mail.NextAttempt.Unix()
+	}
+	result, err := stmt.Exec(mail.Attempts, nextAttempt, mail.LastError, mail.Status, mail.ID)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	return updated > 0, err
+}
+
+var deleteQueuedMailStmt = map[string]string{
+	"sqlite":   "delete from mail_queue where id=?;",
+	"postgres": "delete from mail_queue where id=$1;",
+}
+
+func deleteQueuedMail(id int64, state *RuntimeState) error {
+	stmtText := deleteQueuedMailStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(id)
+	return err
+}
+
+var countQueuedMailStmt = map[string]string{
+	"sqlite":   "select status, count(*) from mail_queue group by status;",
+	"postgres": "select status, count(*) from mail_queue group by status;",
+}
+
+func countQueuedMail(state *RuntimeState) (map[string]int, error) {
+	stmtText := countQueuedMailStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[string]int{mailPending: 0, mailFailed: 0}
+	for rows.Next() {
+		var status string
+		var count int
+		err = rows.Scan(&status, &count)
+		if err != nil {
+			return nil, err
+		}
+		counts[status] = count
+	}
+	return counts, rows.Err()
+}
+
+func (state *RuntimeState) mailMaxAttempts() int {
+	if value := state.currentConfig().MailMaxAttempts; value > 0 {
+		return value
+	}
+	return defaultMailMaxAttempts
+}
+
+func (state *RuntimeState) mailRetryBackoff() time.Duration {
+	if value := state.currentConfig().MailRetryBackoff; value > 0 {
+		return value
+	}
+	return defaultMailRetryBackoff
+}
+
+// deliverMailQueue sends the due emails. A failed delivery is retried with
+// an exponential backoff, once the attempts are exhausted the email stays
+// in the queue as failed.
+func (state *RuntimeState) deliverMailQueue() error {
+	mails, err := getDueMail(time.Now(), state)
+	if err != nil {
+		return err
+	}
+	for _, mail := range mails {
+		start := time.Now()
+		err = state.deliverEmail(mail.Recipients, mail.message)
+		if err == nil {
+			metrics.MetricLogExternalServiceDuration("smtp", time.Since(start))
+			metrics.MetricLogMailDelivery("sent")
+			err = deleteQueuedMail(mail.ID, state)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		mail.Attempts++
+		mail.LastError = err.Error()
+		if mail.Attempts < state.mailMaxAttempts() {
+			metrics.MetricLogMailDelivery("retried")
+			mail.NextAttempt = time.Now().Add(state.mailRetryBackoff() << uint(mail.Attempts-1))
+		} else {
+			metrics.MetricLogMailDelivery("failed")
+			log.Printf("email %d (%s) to %s failed: %s", mail.ID, mail.Template,
+				strings.Join(mail.Recipients, ", "), err)
+			mail.Status = mailFailed
+		}
+		_, err = updateQueuedMail(mail, state)
+		if err != nil {
+			return err
+		}
+	}
+	counts, err := countQueuedMail(state)
+	if err != nil {
+		return err
+	}
+	for status, count := range counts {
+		metrics.MetricSetMailQueueMessages(status, count)
+	}
+	return nil
+}
+
+// wakeMailQueue lets the delivery loop send a newly queued email without
+// waiting for the next interval.
+func (state *RuntimeState) wakeMailQueue() {
+	select {
+	case state.mailQueueWake <- struct{}{}:
+	default:
+	}
+}
+
+func (state *RuntimeState) mailQueueLoop() {
+	interval := state.currentConfig().MailDeliveryInterval
+	if interval <= 0 {
+		interval = defaultMailDeliveryInterval
+	}
+	for {
+		err := state.deliverMailQueue()
+		if err != nil {
+			log.Printf("mail queue delivery failed: %s", err)
+		}
+		select {
+		case <-state.mailQueueWake:
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (state *RuntimeState) mailQueueHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != getMethod {
+		state.writeFailureResponse(w, r, "GET Method is required", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := state.GetRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	if !state.isAdmin(r, username) {
+		http.Error(w, "you are not authorized", http.StatusForbidden)
+		return
+	}
+	mails, err := listQueuedMail(state)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	pageData := mailQueuePageData{
+		UserName: username,
+		IsAdmin:  true,
+		Title:    "Mail Queue",
+		Mails:    mails,
+	}
+	state.renderTemplateOrReturnJson(w, r, "mailQueuePage", pageData)
+}
+
+// retryMailHandler puts a failed email back in the queue with a fresh set
+// of attempts.
+func (state *RuntimeState) retryMailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != postMethod {
+		state.writeFailureResponse(w, r, "POST Method is required", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := state.GetRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	if !state.isAdmin(r, username) {
+		http.Error(w, "you are not authorized", http.StatusForbidden)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		if err.Error() == "missing form body" {
+			http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+		} else {
+			state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		}
+		return
+	}
+	id, err := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+	if err != nil {
+		state.writeFailureResponse(w, r, "Invalid email id", http.StatusBadRequest)
+		return
+	}
+	updated, err := updateQueuedMail(queuedMail{ID: id, Status: mailPending}, state)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	if !updated {
+		state.writeFailureResponse(w, r, fmt.Sprintf("Email %d is not in the queue", id), http.StatusNotFound)
+		return
+	}
+	state.wakeMailQueue()
+
+	pageData := simpleMessagePageData{
+		UserName:       username,
+		IsAdmin:        true,
+		Title:          "Email Queued",
+		SuccessMessage: fmt.Sprintf("Email %d will be sent again.", id),
+		ContinueURL:    mailQueuePath,
+	}
+	state.renderTemplateOrReturnJson(w, r, "simpleMessagePage", pageData)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type failingSMTPDialerMock struct {
+	smtpDialerMock
+}
+
+func (*failingSMTPDialerMock) Rcpt(to string) error {
+	if strings.HasPrefix(to, "bounce") {
+		return fmt.Errorf("550 mailbox unavailable")
+	}
+	return nil
+}
+
+func TestMailQueueRetries(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Config.Base.MailRetryBackoff = time.Millisecond
+	state.Config.Base.MailMaxAttempts = 2
+	var sent []*failingSMTPDialerMock
+	smtpClient = func(server smtpServer) (smtpDialer, error) {
+		client := &failingSMTPDialerMock{}
+		sent = append(sent, client)
+		return client, nil
+	}
+	mailData := mailAttributes{RequestedUser: "user3", Groupname: "group1", Hostname: state.baseURL()}
+	for _, recipient := range []string{"user1@example.com", "bounce@example.com"} {
+		err = state.sendEmail(mailRequestAccess, []string{recipient}, mailData)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sent) != 0 {
+		t.Fatal("email sent before the delivery of the queue")
+	}
+
+	err = state.deliverMailQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mails, err := listQueuedMail(&state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 2 || len(mails) != 1 || mails[0].Status != mailPending || mails[0].Attempts != 1 ||
+		mails[0].LastError == "" || mails[0].NextAttempt.IsZero() {
+		t.Fatalf("bad queue after the first delivery %+v", mails)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	err = state.deliverMailQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mails, err = listQueuedMail(&state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 3 || len(mails) != 1 || mails[0].Status != mailFailed || mails[0].Attempts != 2 {
+		t.Fatalf("bad queue after the last attempt %+v", mails)
+	}
+	// Failed emails are left alone.
+	err = state.deliverMailQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 3 {
+		t.Fatal("failed email was sent again")
+	}
+
+	rr := testUserRequest(&state, "user2", "GET", mailQueuePath, state.mailQueueHandler, url.Values{})
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("mail queue returned %d to a regular user", rr.Code)
+	}
+	rr = testUserRequest(&state, "user1", "GET", mailQueuePath, state.mailQueueHandler, url.Values{})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("mail queue returned %d", rr.Code)
+	}
+	var pageData mailQueuePageData
+	err = json.NewDecoder(rr.Body).Decode(&pageData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pageData.Mails) != 1 || pageData.Mails[0].Recipients[0] != "bounce@example.com" {
+		t.Fatalf("bad mail queue page %+v", pageData)
+	}
+
+	id := strconv.FormatInt(mails[0].ID, 10)
+	rr = testUserRequest(&state, "user1", "POST", retryMailPath, state.retryMailHandler, url.Values{"id": {id + "0"}})
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("retry of an unknown email returned %d", rr.Code)
+	}
+	rr = testUserRequest(&state, "user1", "POST", retryMailPath, state.retryMailHandler, url.Values{"id": {id}})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("retry returned %d", rr.Code)
+	}
+	mails, err = listQueuedMail(&state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mails) != 1 || mails[0].Status != mailPending || mails[0].Attempts != 0 {
+		t.Fatalf("bad queue after a retry %+v", mails)
+	}
+}
+
+// serveTestSMTP answers a single SMTP session offering AUTH PLAIN and
+// returns the commands it received.
+func serveTestSMTP(listener net.Listener) chan []string {
+	commands := make(chan []string, 1)
+	go func() {
+		var received []string
+		defer func() { commands <- received }()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "220 localhost ESMTP\r\n")
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			received = append(received, line)
+			verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch verb {
+			case "EHLO":
+				fmt.Fprintf(conn, "250-localhost\r\n250 AUTH PLAIN\r\n")
+			case "AUTH":
+				fmt.Fprintf(conn, "235 2.7.0 Authentication successful\r\n")
+			case "DATA":
+				fmt.Fprintf(conn, "354 End data with <CR><LF>.<CR><LF>\r\n")
+				for {
+					line, err = reader.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+				}
+				fmt.Fprintf(conn, "250 OK\r\n")
+			case "QUIT":
+				fmt.Fprintf(conn, "221 Bye\r\n")
+				return
+			default:
+				fmt.Fprintf(conn, "250 OK\r\n")
+			}
+		}
+	}()
+	return commands
+}
+
+func TestSMTPClientAuth(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	commands := serveTestSMTP(listener)
+	smtpClient = dialSMTP
+	state.Config.Base.SMTPserver = listener.Addr().String()
+	state.Config.Base.SMTPUsername = "smallpoint"
+	state.Config.Base.SMTPPassword = "secret"
+	state.Config.Base.SmtpSenderAddress = "smallpoint@example.com"
+	err = state.deliverEmail([]string{"user1@example.com"}, []byte("Subject: test\r\n\r\ntest\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := <-commands
+	auth := base64.StdEncoding.EncodeToString([]byte("\x00smallpoint\x00secret"))
+	expected := []string{"AUTH PLAIN " + auth, "MAIL FROM:<smallpoint@example.com>",
+		"RCPT TO:<user1@example.com>", "DATA", "QUIT"}
+	if len(received) < len(expected) {
+		t.Fatalf("bad smtp session %q", received)
+	}
+	received = received[len(received)-len(expected):]
+	for i := range expected {
+		if !strings.HasPrefix(received[i], expected[i]) {
+			t.Fatalf("expected %q, got %q", expected[i], received[i])
+		}
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/Symantec/keymaster/lib/instrumentedwriter"
 	"github.com/Symantec/ldap-group-management/lib/userinfo"
 	"github.com/Symantec/ldap-group-management/lib/userinfo/ldapuserinfo"
+	"github.com/Symantec/ldap-group-management/lib/userinfo/sqluserinfo"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gopkg.in/natefinch/lumberjack.v2"
 	"gopkg.in/yaml.v2"
@@ -35,19 +36,45 @@ type baseConfig struct {
 	TemplatesPath               string `yaml:"templates_path"`
 	SMTPserver                  string `yaml:"smtp_server"`
 	SmtpSenderAddress           string `yaml:"smtp_sender_address"`
+	SMTPUsername                string `yaml:"smtp_username"`
+	SMTPPassword                string `yaml:"smtp_password"`
+	SMTPTLS                     string `yaml:"smtp_tls"`
 	ClientCAFilename            string `yaml:"client_ca_filename"`
 	LogDirectory                string `yaml:"log_directory"`
 	ClusterSharedSecretFilename string `yaml:"cluster_shared_secret_filename"`
 	SharedSecrets               []string
-	Hostname                    string   `yaml:"hostname"`
-	AutoGroups                  []string `yaml:"auto_add_to_groups"`
+	Hostname                    string                   `yaml:"hostname"`
+	AutoGroups                  []string                 `yaml:"auto_add_to_groups"`
+	DirectoryBackend            string                   `yaml:"directory_backend"`
+	HiddenGroups                []string                 `yaml:"hidden_groups"`
+	Roles                       map[string][]string      `yaml:"roles"`
+	IdPRoles                    map[string][]string      `yaml:"idp_roles"`
+	OrphanedGroupsCheckInterval time.Duration            `yaml:"orphaned_groups_check_interval"`
+	EmailAdminsOrphanedGroups   bool                     `yaml:"email_admins_about_orphaned_groups"`
+	DefaultJoinPolicy           string                   `yaml:"default_join_policy"`
+	InvitationLifetime          time.Duration            `yaml:"invitation_lifetime"`
+	NotificationSinks           []notificationSinkConfig `yaml:"notification_sinks"`
+	EventDeliveryInterval       time.Duration            `yaml:"event_delivery_interval"`
+	EventRetryBackoff           time.Duration            `yaml:"event_retry_backoff"`
+	EventMaxAttempts            int                      `yaml:"event_max_attempts"`
+	MailDeliveryInterval        time.Duration            `yaml:"mail_delivery_interval"`
+	MailRetryBackoff            time.Duration            `yaml:"mail_retry_backoff"`
+	MailMaxAttempts             int                      `yaml:"mail_max_attempts"`
+	// Rules mapping the client certificates signed by the CAs of
+	// client_ca_filename to usernames, the common name if empty.
+	ClientCertificateRules []authn.ClientCertificateRule `yaml:"client_certificate_rules"`
+	ClientCRLFilenames     []string                      `yaml:"client_crl_filenames"`
+	// Lets admins viewing as another user change things on their behalf.
+	AllowImpersonatedWrites bool `yaml:"allow_impersonated_writes"`
 }
 
 type AppConfigFile struct {
 	Base       baseConfig                      `yaml:"base"`
 	OpenID     authn.OpenIDConfig              `yaml:"openid"`
+	SAML       authn.SAMLConfig                `yaml:"saml"`
 	SourceLDAP ldapuserinfo.UserInfoLDAPSource `yaml:"source_config"`
 	TargetLDAP ldapuserinfo.UserInfoLDAPSource `yaml:"target_config"`
+	TargetSQL  sqluserinfo.UserInfoSQLSource   `yaml:"target_sql_config"`
 }
 
 type pendingUserActionsCacheEntry struct {
@@ -62,6 +89,8 @@ type RuntimeState struct {
 	Userinfo       userinfo.UserInfo
 	UserSourceinfo userinfo.UserInfo
 	htmlTemplate   *template.Template
+	emailTemplates map[string]*emailTemplate
+	mailQueueWake  chan struct{}
 	sysLog         *syslog.Writer
 	authenticator  *authn.Authenticator
 
@@ -69,6 +98,12 @@ type RuntimeState struct {
 	allUsersCacheValue           map[string]time.Time
 	pendingUserActionsCacheMutex sync.Mutex
 	pendingUserActionsCache      map[string]pendingUserActionsCacheEntry
+	orphanedGroupsMutex          sync.Mutex
+	orphanedGroups               map[string]orphanedGroup
+	notificationSinks            []*configuredSink
+	// Protects the base config, the templates and the notification sinks
+	// which a reload of the configuration replaces.
+	configMutex sync.RWMutex
 }
 
 type GetGroups struct {
@@ -139,6 +174,36 @@ const (
 	myManagedGroupsWebPagePath  = "/my_managed_groups"
 	permissionmanageWebPagePath = "/permissionmanage"
 	permissionmanagePath        = "/permissionmanage/"
+	permissionsListPath         = "/permissions"
+	permissionsEditPath         = "/permissions/edit/"
+	permissionsDeletePath       = "/permissions/delete/"
+	permissionsTestPath         = "/permissions/test"
+	exportGroupsPath            = "/export_groups/"
+	importGroupsPath            = "/import_groups/"
+	ownershipTransfersPath      = "/ownership_transfers"
+	acceptOwnershipPath         = "/ownership_transfers/accept"
+	rejectOwnershipPath         = "/ownership_transfers/reject"
+	orphanedGroupsPath          = "/orphaned_groups"
+	setManagersPath             = "/set_managers"
+	joinPolicyPath              = "/join_policy"
+	invitePath                  = "/invite"
+	acceptInvitationPath        = "/invitations/accept"
+	revokeInvitationPath        = "/invitations/revoke"
+	eventsPath                  = "/events"
+	eventEndpointsPath          = "/events/endpoints"
+	deleteEventEndpointPath     = "/events/endpoints/delete"
+	deadLettersPath             = "/events/dead_letters"
+	notificationPreferencesPath = "/notification_preferences"
+	mailQueuePath               = "/mail_queue"
+	retryMailPath               = "/mail_queue/retry"
+	logoutPath                  = "/logout"
+	sessionsPath                = "/sessions"
+	revokeSessionPath           = "/sessions/revoke"
+	revokeUserSessionsPath      = "/sessions/revoke_user"
+	impersonatePath             = "/impersonate"
+	stopImpersonationPath       = "/impersonate/stop"
+	searchGroupsPath            = "/search/groups"
+	searchUsersPath             = "/search/users"
 
 	getGroupsJSPath = "/getGroups.js"
 	getUsersJSPath  = "/getUsers.js"
@@ -158,23 +223,37 @@ func (l httpLogger) Log(record instrumentedwriter.LogRecord) {
 	}
 }
 
-func (state *RuntimeState) loadTemplates() (err error) {
+// templateFuncs returns the functions of the page templates, the roles
+// given by the identity provider are only known within the request r.
+func (state *RuntimeState) templateFuncs(r *http.Request) template.FuncMap {
+	return template.FuncMap{
+		"userHasCapability": func(username string, capabilityName string) (bool, error) {
+			return state.userHasCapability(r, username, capabilityName)
+		},
+		"userRoles": func(username string) ([]string, error) {
+			return state.getUserRoles(r, username)
+		},
+	}
+}
+
+// parseTemplates parses the page templates, a reload of the configuration
+// swaps them in only once they all parsed.
+func (state *RuntimeState) parseTemplates(templatesPath string) (htmlTemplate *template.Template, err error) {
 
-	state.htmlTemplate = template.New("main")
+	htmlTemplate = template.New("main").Funcs(state.templateFuncs(nil))
 
 	//Load extra templates
-	templatesPath := state.Config.Base.TemplatesPath
 	if _, err = os.Stat(templatesPath); err != nil {
-		return err
+		return nil, err
 	}
 
 	//Eventally this will include the customization path
 	templateFiles := []string{}
 	for _, templateFilename := range templateFiles {
 		templatePath := filepath.Join(templatesPath, templateFilename)
-		_, err = state.htmlTemplate.ParseFiles(templatePath)
+		_, err = htmlTemplate.ParseFiles(templatePath)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
@@ -185,15 +264,26 @@ func (state *RuntimeState) loadTemplates() (err error) {
 		createGroupPageText, deleteGroupPageText,
 		simpleMessagePageText, addMembersToGroupPageText, groupInfoPageText,
 		createServiceAccountPageText, changeGroupOwnershipPageText,
-		deleteMembersFromGroupPageText, commonHeadText, permManagePageText}
+		deleteMembersFromGroupPageText, commonHeadText, permManagePageText,
+		permissionsPageText, permissionTestPageText, ownershipTransfersPageText,
+		orphanedGroupsPageText, mailQueuePageText, sessionsPageText,
+		impersonationBannerHTMLText}
 	for _, templateString := range extraTemplates {
-		_, err = state.htmlTemplate.Parse(templateString)
+		_, err = htmlTemplate.Parse(templateString)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	return nil
+	return htmlTemplate, nil
+}
+
+func (state *RuntimeState) loadTemplates() (err error) {
+	state.htmlTemplate, err = state.parseTemplates(state.Config.Base.TemplatesPath)
+	if err != nil {
+		return err
+	}
+	return state.loadEmailTemplates()
 }
 
 func getClusterSecretsFile(clusterSecretsFilename string) ([]string, error) {
@@ -221,69 +311,148 @@ func getClusterSecretsFile(clusterSecretsFilename string) ([]string, error) {
 	return rarray, nil
 }
 
-//parses initializes from the config file
-func loadConfig(configFilename string) (RuntimeState, error) {
+// initUserinfo selects the directory backend. "ldap" (the default) uses the
+// target ldap, "sql" keeps users and groups in the database described by
+// target_sql_config. The source ldap is still used to fetch new users
+// attributes when it is configured.
+func (state *RuntimeState) initUserinfo() error {
+	switch state.Config.Base.DirectoryBackend {
+	case "", "ldap":
+		state.Userinfo = &state.Config.TargetLDAP
+		state.UserSourceinfo = &state.Config.SourceLDAP
+	case "sql":
+		err := state.Config.TargetSQL.InitDB()
+		if err != nil {
+			return err
+		}
+		state.Userinfo = &state.Config.TargetSQL
+		state.UserSourceinfo = &state.Config.TargetSQL
+		if state.Config.SourceLDAP.LDAPTargetURLs != "" {
+			state.UserSourceinfo = &state.Config.SourceLDAP
+		}
+	default:
+		return fmt.Errorf("invalid directory backend %s", state.Config.Base.DirectoryBackend)
+	}
+	return nil
+}
 
-	var state RuntimeState
+// readConfigFile parses and validates the config file, it is used at startup
+// and again on every reload.
+func readConfigFile(configFilename string) (AppConfigFile, error) {
+	var config AppConfigFile
 
 	if _, err := os.Stat(configFilename); os.IsNotExist(err) {
 		err = fmt.Errorf("mising config file failure. Filename=%s", configFilename)
-		return state, err
+		return config, err
 	}
 	//ioutil.ReadFile returns a byte slice (i.e)(source)
 	source, err := ioutil.ReadFile(configFilename)
 	if err != nil {
 		err = errors.New("cannot read config file")
-		return state, err
+		return config, err
 	}
 
 	//Unmarshall(source []byte,out interface{})decodes the source byte slice/value and puts them in out.
-	err = yaml.Unmarshal(source, &state.Config)
+	err = yaml.Unmarshal(source, &config)
 
 	if err != nil {
 		err = errors.New("Cannot parse config file")
 		log.Printf("Source=%s", source)
-		return state, err
+		return config, err
+	}
+
+	err = validateRoles(config.Base.Roles)
+	if err != nil {
+		return config, err
+	}
+	err = validateIdPRoles(config.Base.IdPRoles)
+	if err != nil {
+		return config, err
+	}
+	if config.Base.DefaultJoinPolicy != "" && !validJoinPolicy(config.Base.DefaultJoinPolicy) {
+		return config, fmt.Errorf("invalid default_join_policy %s", config.Base.DefaultJoinPolicy)
+	}
+	if config.Base.DefaultJoinPolicy == joinPolicyOpen {
+		return config, errors.New("default_join_policy cannot be open, set it on each group instead")
+	}
+	if !validSMTPTLS(config.Base.SMTPTLS) {
+		return config, fmt.Errorf("invalid smtp_tls %s", config.Base.SMTPTLS)
+	}
+	return config, nil
+}
+
+//parses initializes from the config file
+// The handlers and the callbacks registered here keep pointers to the
+// returned state, reloads change it in place.
+func loadConfig(configFilename string) (*RuntimeState, error) {
+
+	state := &RuntimeState{}
+
+	var err error
+	state.Config, err = readConfigFile(configFilename)
+	if err != nil {
+		return nil, err
+	}
+	state.notificationSinks, err = state.newNotificationSinks(state.Config.Base.NotificationSinks)
+	if err != nil {
+		return nil, err
 	}
 
 	//Load extra templates
 	err = state.loadTemplates()
 	if err != nil {
-		return state, err
+		return nil, err
 	}
 
-	err = initDB(&state)
+	err = initDB(state)
 	if err != nil {
-		return state, err
+		return nil, err
 	}
 
-	state.Userinfo = &state.Config.TargetLDAP
+	err = state.initUserinfo()
+	if err != nil {
+		return nil, err
+	}
 	state.allUsersCacheValue = make(map[string]time.Time)
 	state.pendingUserActionsCache = make(map[string]pendingUserActionsCacheEntry)
-	state.UserSourceinfo = &state.Config.SourceLDAP
+	state.mailQueueWake = make(chan struct{}, 1)
 
 	if len(state.Config.Base.ClusterSharedSecretFilename) > 1 {
 		state.Config.Base.SharedSecrets, err = getClusterSecretsFile(state.Config.Base.ClusterSharedSecretFilename)
 		if err != nil {
-			return state, err
+			return nil, err
 		}
 	}
 	//
 	state.authenticator = authn.NewAuthenticator(state.Config.OpenID, "smallpoint", nil,
 		state.Config.Base.SharedSecrets, nil,
 		nil)
+	state.authenticator.SetGroupFilter(state.isMappedIdPGroup)
+	state.authenticator.SetSessionStore(&dbSessionStore{state: state})
+	certificateMapper, err := authn.NewClientCertificateMapper(state.Config.Base.ClientCertificateRules,
+		state.Config.Base.ClientCRLFilenames)
+	if err != nil {
+		return nil, err
+	}
+	state.authenticator.SetClientCertificateMapper(certificateMapper)
+	if state.Config.SAML.IdPSSOURL != "" {
+		err = state.authenticator.EnableSAML(state.Config.SAML)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	for _, group := range state.Config.Base.AutoGroups {
 		GroupExistsornot, _, err := state.Userinfo.GroupnameExistsornot(group)
 		if err != nil {
-			return state, err
+			return nil, err
 		}
 		if !GroupExistsornot {
 			err = errors.New("Group " + group + " doesn't exist in CPE LDAP")
-			return state, err
+			return nil, err
 		}
 	}
-	return state, err
+	return state, nil
 }
 
 type mailAttributes struct {
@@ -293,10 +462,12 @@ type mailAttributes struct {
 	Browser       string
 	OS            string
 	Hostname      string
+	ManageGroup   string
 }
 
 func Usage() {
 	fmt.Fprintf(os.Stderr, "Usage of %s (version %s):\n", os.Args[0], Version)
+	fmt.Fprintf(os.Stderr, "  %s [flags] [export-groups [file] | import-groups file]\n", os.Args[0])
 	flag.PrintDefaults()
 }
 
@@ -308,6 +479,13 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	if flag.NArg() > 0 {
+		err = state.runCommand(flag.Args())
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	//start to log
 	state.sysLog, err = syslog.New(syslog.LOG_NOTICE|syslog.LOG_AUTHPRIV, "smallpoint")
@@ -316,9 +494,17 @@ func main() {
 	}
 	defer state.sysLog.Close()
 
+	go state.orphanedGroupsCheckLoop()
+	go state.outboxDeliveryLoop()
+	go state.digestMailerLoop()
+	go state.mailQueueLoop()
+	go state.configReloadLoop(*configFilename)
+
 	http.Handle(metricsPath, promhttp.Handler())
 
 	http.HandleFunc(authn.Oauth2redirectPath, state.authenticator.Oauth2RedirectPathHandler)
+	http.HandleFunc(authn.SAMLMetadataPath, state.authenticator.SAMLMetadataHandler)
+	http.HandleFunc(authn.SAMLACSPath, state.authenticator.SAMLACSHandler)
 
 	http.Handle(creategroupWebPagePath, http.HandlerFunc(state.creategroupWebpageHandler))
 	http.Handle(deletegroupWebPagePath, http.HandlerFunc(state.deletegroupWebpageHandler))
@@ -341,6 +527,9 @@ func main() {
 
 	http.Handle(changeownershipPath, http.HandlerFunc(state.changeownershipWebpageHandler))
 	http.Handle(changeownershipbuttonPath, http.HandlerFunc(state.changeownership))
+	http.Handle(ownershipTransfersPath, http.HandlerFunc(state.ownershipTransfersHandler))
+	http.Handle(acceptOwnershipPath, http.HandlerFunc(state.acceptOwnershipTransferHandler))
+	http.Handle(rejectOwnershipPath, http.HandlerFunc(state.rejectOwnershipTransferHandler))
 
 	http.Handle(deletemembersPath, http.HandlerFunc(state.deletemembersfromGroupWebpageHandler))
 	http.Handle(deletemembersbuttonPath, http.HandlerFunc(state.deletemembersfromExistingGroup))
@@ -356,6 +545,33 @@ func main() {
 	http.Handle(myManagedGroupsWebPagePath, http.HandlerFunc(state.myManagedGroupsHandler))
 	http.Handle(permissionmanageWebPagePath, http.HandlerFunc(state.permissionmanageWebpageHandler))
 	http.Handle(permissionmanagePath, http.HandlerFunc(state.permissionManageHandler))
+	http.Handle(permissionsListPath, http.HandlerFunc(state.permissionsListHandler))
+	http.Handle(permissionsEditPath, http.HandlerFunc(state.permissionEditHandler))
+	http.Handle(permissionsDeletePath, http.HandlerFunc(state.permissionDeleteHandler))
+	http.Handle(permissionsTestPath, http.HandlerFunc(state.permissionTestHandler))
+	http.Handle(exportGroupsPath, http.HandlerFunc(state.exportGroupsHandler))
+	http.Handle(importGroupsPath, http.HandlerFunc(state.importGroupsHandler))
+	http.Handle(setManagersPath, http.HandlerFunc(state.setGroupManagersHandler))
+	http.Handle(joinPolicyPath, http.HandlerFunc(state.joinPolicyHandler))
+	http.Handle(invitePath, http.HandlerFunc(state.inviteHandler))
+	http.Handle(acceptInvitationPath, http.HandlerFunc(state.acceptInvitationHandler))
+	http.Handle(revokeInvitationPath, http.HandlerFunc(state.revokeInvitationHandler))
+	http.Handle(eventsPath, http.HandlerFunc(state.eventsHandler))
+	http.Handle(eventEndpointsPath, http.HandlerFunc(state.eventEndpointsHandler))
+	http.Handle(deleteEventEndpointPath, http.HandlerFunc(state.deleteEventEndpointHandler))
+	http.Handle(deadLettersPath, http.HandlerFunc(state.deadLettersHandler))
+	http.Handle(notificationPreferencesPath, http.HandlerFunc(state.notificationPreferencesHandler))
+	http.Handle(mailQueuePath, http.HandlerFunc(state.mailQueueHandler))
+	http.Handle(retryMailPath, http.HandlerFunc(state.retryMailHandler))
+	http.Handle(logoutPath, http.HandlerFunc(state.logoutHandler))
+	http.Handle(sessionsPath, http.HandlerFunc(state.sessionsHandler))
+	http.Handle(revokeSessionPath, http.HandlerFunc(state.revokeSessionHandler))
+	http.Handle(revokeUserSessionsPath, http.HandlerFunc(state.revokeUserSessionsHandler))
+	http.Handle(impersonatePath, http.HandlerFunc(state.impersonateHandler))
+	http.Handle(stopImpersonationPath, http.HandlerFunc(state.stopImpersonationHandler))
+	http.Handle(searchGroupsPath, http.HandlerFunc(state.searchGroupsHandler))
+	http.Handle(searchUsersPath, http.HandlerFunc(state.searchUsersHandler))
+	http.Handle(orphanedGroupsPath, http.HandlerFunc(state.orphanedGroupsHandler))
 
 	fs := http.FileServer(http.Dir(state.Config.Base.TemplatesPath))
 	http.Handle(cssPath, fs)
@@ -395,7 +611,7 @@ func main() {
 	accessLogger := httpLogger{AccessLogger: log.New(l, "", 0)}
 	serviceServer := &http.Server{
 		Addr:         state.Config.Base.HttpAddress,
-		Handler:      instrumentedwriter.NewLoggingHandler(http.DefaultServeMux, accessLogger),
+		Handler:      instrumentedwriter.NewLoggingHandler(withIdPGroups(http.DefaultServeMux), accessLogger),
 		TLSConfig:    tlsConfig,
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
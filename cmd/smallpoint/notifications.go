@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Events delivered to the notification sinks.
+const (
+	eventRequestCreated  = "request_created"
+	eventRequestApproved = "request_approved"
+	eventRequestRejected = "request_rejected"
+	eventMemberRemoved   = "member_removed"
+	eventGroupDeleted    = "group_deleted"
+)
+
+var notificationEvents = []string{eventRequestCreated, eventRequestApproved,
+	eventRequestRejected, eventMemberRemoved, eventGroupDeleted}
+
+// Kinds of notification sinks.
+const (
+	// JSON body signed with HMAC-SHA256, the secret is required.
+	sinkTypeWebhook = "webhook"
+	// Incoming webhook of Slack, Mattermost uses the same payload.
+	sinkTypeSlack = "slack"
+	// Plain text email sent to a fixed list of recipients.
+	sinkTypeSMTP = "smtp"
+)
+
+const (
+	defaultNotificationRetries  = 3
+	defaultNotificationBackoff  = 5 * time.Second
+	notificationEventHeader     = "X-Smallpoint-Event"
+	notificationSignatureHeader = "X-Smallpoint-Signature"
+)
+
+var notificationHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+type notificationSinkConfig struct {
+	Name       string   `yaml:"name"`
+	Type       string   `yaml:"type"`
+	URL        string   `yaml:"url"`
+	Secret     string   `yaml:"secret"`
+	Recipients []string `yaml:"recipients"`
+	// Events the sink is subscribed to, all of them when empty.
+	Events       []string      `yaml:"events"`
+	MaxRetries   int           `yaml:"max_retries"`
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+}
+
+type notificationEvent struct {
+	Event     string    `json:"event"`
+	Groupname string    `json:"group"`
+	Username  string    `json:"user,omitempty"`
+	Actor     string    `json:"actor,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+func newNotificationEvent(event, groupname, username, actor string) notificationEvent {
+	return notificationEvent{Event: event, Groupname: groupname, Username: username,
+		Actor: actor, Time: time.Now().UTC()}
+}
+
+// String is the human readable form used by the chat and email sinks.
+func (event notificationEvent) String() string {
+	switch event.Event {
+	case eventRequestCreated:
+		return fmt.Sprintf("%s requested access to group %s", event.Username, event.Groupname)
+	case eventRequestApproved:
+		return fmt.Sprintf("Request of %s to join group %s was approved by %s", event.Username, event.Groupname, event.Actor)
+	case eventRequestRejected:
+		return fmt.Sprintf("Request of %s to join group %s was rejected by %s", event.Username, event.Groupname, event.Actor)
+	case eventMemberRemoved:
+		if event.Actor == event.Username {
+			return fmt.Sprintf("%s exited from group %s", event.Username, event.Groupname)
+		}
+		return fmt.Sprintf("%s was removed from group %s by %s", event.Username, event.Groupname, event.Actor)
+	case eventGroupDeleted:
+		return fmt.Sprintf("Group %s was deleted by %s", event.Groupname, event.Actor)
+	}
+	return fmt.Sprintf("%s on group %s", event.Event, event.Groupname)
+}
+
+type notificationSink interface {
+	send(event notificationEvent) error
+}
+
+type configuredSink struct {
+	config notificationSinkConfig
+	sink   notificationSink
+	events map[string]bool
+}
+
+func (s *configuredSink) subscribed(event string) bool {
+	return len(s.events) == 0 || s.events[event]
+}
+
+type webhookSink struct {
+	url    string
+	secret string
+}
+
+func postNotification(url string, body []byte, header http.Header) error {
+	req, err := http.NewRequest(postMethod, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := notificationHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// signNotification returns the value of the signature header for body.
+func signNotification(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *webhookSink) send(event notificationEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set(notificationEventHeader, event.Event)
+	header.Set(notificationSignatureHeader, signNotification(s.secret, body))
+	return postNotification(s.url, body, header)
+}
+
+type slackSink struct {
+	url string
+}
+
+func (s *slackSink) send(event notificationEvent) error {
+	body, err := json.Marshal(map[string]string{"text": event.String()})
+	if err != nil {
+		return err
+	}
+	return postNotification(s.url, body, nil)
+}
+
+const notificationMailTemplateText = `{{define "subject"}}{{.}}{{end}}
+{{define "text"}}{{.}} at {{.Time.Format "Mon, 02 Jan 2006 15:04:05 MST"}}.
+{{end}}
+{{define "html"}}<p>{{.}} at {{.Time.Format "Mon, 02 Jan 2006 15:04:05 MST"}}.</p>
+{{end}}`
+
+type smtpSink struct {
+	state      *RuntimeState
+	recipients []string
+}
+
+func (s *smtpSink) send(event notificationEvent) error {
+	return s.state.sendEmail(mailNotification, s.recipients, event)
+}
+
+// newNotificationSinks validates the configured sinks and builds them.
+func (state *RuntimeState) newNotificationSinks(configs []notificationSinkConfig) ([]*configuredSink, error) {
+	var sinks []*configuredSink
+	for _, config := range configs {
+		configured := &configuredSink{config: config, events: make(map[string]bool)}
+		for _, event := range config.Events {
+			known := false
+			for _, notificationEvent := range notificationEvents {
+				if event == notificationEvent {
+					known = true
+				}
+			}
+			if !known {
+				return nil, fmt.Errorf("notification sink %s: unknown event %s", config.Name, event)
+			}
+			configured.events[event] = true
+		}
+		switch config.Type {
+		case sinkTypeWebhook, sinkTypeSlack:
+			if config.URL == "" {
+				return nil, fmt.Errorf("notification sink %s: missing url", config.Name)
+			}
+			if config.Type == sinkTypeWebhook {
+				// Receivers could not tell our events from forged ones
+				// without a signature.
+				if config.Secret == "" {
+					return nil, fmt.Errorf("notification sink %s: missing secret", config.Name)
+				}
+				configured.sink = &webhookSink{url: config.URL, secret: config.Secret}
+			} else {
+				configured.sink = &slackSink{url: config.URL}
+			}
+		case sinkTypeSMTP:
+			if len(config.Recipients) < 1 {
+				return nil, fmt.Errorf("notification sink %s: missing recipients", config.Name)
+			}
+			configured.sink = &smtpSink{state: state, recipients: config.Recipients}
+		default:
+			return nil, fmt.Errorf("notification sink %s: invalid type %s", config.Name, config.Type)
+		}
+		sinks = append(sinks, configured)
+	}
+	return sinks, nil
+}
+
+// deliverNotification sends event to a sink, retrying with an exponential
+// backoff when it fails. Delivery is best-effort: the retries only live in
+// memory, events still pending when smallpoint stops are lost.
+func deliverNotification(s *configuredSink, event notificationEvent) error {
+	retries := s.config.MaxRetries
+	if retries <= 0 {
+		retries = defaultNotificationRetries
+	}
+	backoff := s.config.RetryBackoff
+	if backoff <= 0 {
+		backoff = defaultNotificationBackoff
+	}
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = s.sink.send(event)
+		if err == nil || attempt >= retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// notify hands events to every subscribed sink without waiting for them,
+// failures are logged and never reach the caller.
+func (state *RuntimeState) notify(events ...notificationEvent) {
+	state.configMutex.RLock()
+	sinks := state.notificationSinks
+	state.configMutex.RUnlock()
+	for _, s := range sinks {
+		for _, event := range events {
+			if !s.subscribed(event.Event) {
+				continue
+			}
+			go func(s *configuredSink, event notificationEvent) {
+				err := deliverNotification(s, event)
+				if err != nil {
+					log.Printf("notification %s to sink %s failed: %s", event.Event, s.config.Name, err)
+				}
+			}(s, event)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type receivedNotification struct {
+	Header http.Header
+	Body   []byte
+}
+
+// newNotificationServer stands in for a webhook receiver, it fails the first
+// failures requests and sends every successful one to the returned channel.
+func newNotificationServer(failures int) (*httptest.Server, chan receivedNotification, func() int) {
+	var mutex sync.Mutex
+	attempts := 0
+	received := make(chan receivedNotification, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		attempts++
+		attempt := attempts
+		mutex.Unlock()
+		if attempt <= failures {
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- receivedNotification{Header: r.Header, Body: body}
+	}))
+	return server, received, func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return attempts
+	}
+}
+
+func TestNotificationSinkConfig(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	badConfigs := [][]notificationSinkConfig{
+		{{Name: "nourl", Type: sinkTypeWebhook, Secret: "secret"}},
+		{{Name: "nosecret", Type: sinkTypeWebhook, URL: "http://localhost"}},
+		{{Name: "norecipients", Type: sinkTypeSMTP}},
+		{{Name: "badtype", Type: "pager", URL: "http://localhost"}},
+		{{Name: "badevent", Type: sinkTypeSlack, URL: "http://localhost", Events: []string{"group_created"}}},
+	}
+	for _, configs := range badConfigs {
+		_, err = state.newNotificationSinks(configs)
+		if err == nil {
+			t.Fatalf("sink %s should be invalid", configs[0].Name)
+		}
+	}
+	sinks, err := state.newNotificationSinks([]notificationSinkConfig{
+		{Name: "all", Type: sinkTypeSlack, URL: "http://localhost"},
+		{Name: "deletions", Type: sinkTypeWebhook, URL: "http://localhost", Secret: "secret",
+			Events: []string{eventMemberRemoved, eventGroupDeleted}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sinks[0].subscribed(eventRequestCreated) || !sinks[1].subscribed(eventGroupDeleted) {
+		t.Fatal("sink should be subscribed")
+	}
+	if sinks[1].subscribed(eventRequestCreated) {
+		t.Fatal("sink should not be subscribed to request_created")
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	server, received, _ := newNotificationServer(0)
+	defer server.Close()
+	sink := &configuredSink{sink: &webhookSink{url: server.URL, secret: "secret"}}
+	event := newNotificationEvent(eventRequestApproved, "group1", "user3", "user1")
+	err := deliverNotification(sink, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notification := <-received
+	if notification.Header.Get(notificationEventHeader) != eventRequestApproved {
+		t.Fatalf("bad event header %q", notification.Header.Get(notificationEventHeader))
+	}
+	if notification.Header.Get(notificationSignatureHeader) != signNotification("secret", notification.Body) {
+		t.Fatal("bad signature")
+	}
+	var decoded notificationEvent
+	err = json.Unmarshal(notification.Body, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Groupname != "group1" || decoded.Username != "user3" || decoded.Actor != "user1" {
+		t.Fatalf("bad event %+v", decoded)
+	}
+}
+
+func TestSlackSink(t *testing.T) {
+	server, received, _ := newNotificationServer(0)
+	defer server.Close()
+	sink := &configuredSink{sink: &slackSink{url: server.URL}}
+	err := deliverNotification(sink, newNotificationEvent(eventGroupDeleted, "group2", "", "user1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	notification := <-received
+	var payload map[string]string
+	err = json.Unmarshal(notification.Body, &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload["text"] != "Group group2 was deleted by user1" {
+		t.Fatalf("bad slack message %q", payload["text"])
+	}
+}
+
+func TestNotificationRetry(t *testing.T) {
+	server, received, attempts := newNotificationServer(2)
+	defer server.Close()
+	sink := &configuredSink{config: notificationSinkConfig{RetryBackoff: time.Millisecond},
+		sink: &webhookSink{url: server.URL, secret: "secret"}}
+	err := deliverNotification(sink, newNotificationEvent(eventRequestCreated, "group1", "user3", "user3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-received
+	if attempts() != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts())
+	}
+
+	failing, _, failingAttempts := newNotificationServer(100)
+	defer failing.Close()
+	sink = &configuredSink{config: notificationSinkConfig{MaxRetries: 1, RetryBackoff: time.Millisecond},
+		sink: &webhookSink{url: failing.URL, secret: "secret"}}
+	err = deliverNotification(sink, newNotificationEvent(eventRequestCreated, "group1", "user3", "user3"))
+	if err == nil {
+		t.Fatal("delivery to a failing sink should fail")
+	}
+	if failingAttempts() != 2 {
+		t.Fatalf("expected 2 attempts, got %d", failingAttempts())
+	}
+}
+
+func TestSMTPSink(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mock *smtpDialerMock
+	smtpClient = func(server smtpServer) (smtpDialer, error) {
+		mock = &smtpDialerMock{}
+		return mock, nil
+	}
+	sink := &smtpSink{state: &state, recipients: []string{"audit@example.com"}}
+	err = sink.send(newNotificationEvent(eventMemberRemoved, "group2", "user3", "user3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = state.deliverMailQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, parts := readTestEmail(t, mock.Buffer.Buffer.String())
+	if header.Get("Subject") != "user3 exited from group group2" || header.Get("To") != "audit@example.com" {
+		t.Fatalf("bad email headers %+v", header)
+	}
+	if !strings.HasPrefix(parts["text/plain"], "user3 exited from group group2 at ") {
+		t.Fatalf("bad email %q", parts["text/plain"])
+	}
+}
+
+func TestNotifyMemberRemoved(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, received, _ := newNotificationServer(0)
+	defer server.Close()
+	state.notificationSinks, err = state.newNotificationSinks([]notificationSinkConfig{
+		{Name: "removals", Type: sinkTypeWebhook, URL: server.URL, Secret: "secret",
+			Events: []string{eventMemberRemoved}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	formValues := url.Values{"groupname": {"group2"}, "members": {"user3"}}
+	rr := testUserRequest(&state, "user1", "POST", deletemembersbuttonPath, state.deletemembersfromExistingGroup, formValues)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("delete members returned %d", rr.Code)
+	}
+	select {
+	case notification := <-received:
+		var event notificationEvent
+		err = json.Unmarshal(notification.Body, &event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.Event != eventMemberRemoved || event.Username != "user3" || event.Actor != "user1" {
+			t.Fatalf("bad event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification received")
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Symantec/ldap-group-management/lib/userinfo"
+)
+
+// Reasons why nobody is able to manage a group.
+const (
+	orphanNoManager        = "the group has no manager"
+	orphanManagerMissing   = "the managing group does not exist"
+	orphanUserMissing      = "the managing user does not exist"
+	orphanManagerEmpty     = "the managing group has no members"
+	orphanSelfManagedEmpty = "the group is self-managed and has no members"
+)
+
+type orphanedGroup struct {
+	Groupname string
+	Manager   string
+	Reason    string
+}
+
+// orphanReason tells why groupname cannot be managed by anybody, it returns
+// an empty string when someone can approve requests for it. With several
+// managers the reason of the first one is given.
+func (state *RuntimeState) orphanReason(groupname string, managers []string) (string, error) {
+	reason := ""
+	for _, manager := range managers {
+		managerReason, err := state.managerOrphanReason(groupname, manager)
+		if err != nil {
+			return "", err
+		}
+		if managerReason == "" {
+			return "", nil
+		}
+		if reason == "" {
+			reason = managerReason
+		}
+	}
+	if reason == "" {
+		return orphanNoManager, nil
+	}
+	return reason, nil
+}
+
+func (state *RuntimeState) managerOrphanReason(groupname, manager string) (string, error) {
+	if manager == "" {
+		return orphanNoManager, nil
+	}
+	if managerUser, ok := userinfo.ManagerUsername(manager); ok {
+		exists, err := state.Userinfo.UsernameExistsornot(managerUser)
+		if err != nil || exists {
+			return "", err
+		}
+		return orphanUserMissing, nil
+	}
+	manager = userinfo.ManagerGroupname(groupname, manager)
+	members, _, err := state.Userinfo.GetusersofaGroup(manager)
+	if err != nil {
+		if err == userinfo.GroupDoesNotExist {
+			return orphanManagerMissing, nil
+		}
+		return "", err
+	}
+	if len(members) > 0 {
+		return "", nil
+	}
+	if manager == groupname {
+		return orphanSelfManagedEmpty, nil
+	}
+	return orphanManagerEmpty, nil
+}
+
+// findOrphanedGroups checks every group returned by GetAllGroupsManagedBy,
+// sorted by group name.
+func (state *RuntimeState) findOrphanedGroups() ([]orphanedGroup, error) {
+	allGroups, err := state.Userinfo.GetAllGroupsManagedBy()
+	if err != nil {
+		return nil, err
+	}
+	orphans := []orphanedGroup{}
+	for _, groupTuple := range allGroups {
+		groupname := groupTuple[0]
+		managers := groupTuple[1:]
+		reason, err := state.orphanReason(groupname, managers)
+		if err != nil {
+			return nil, err
+		}
+		if reason != "" {
+			orphans = append(orphans, orphanedGroup{Groupname: groupname,
+				Manager: strings.Join(managers, ", "), Reason: reason})
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].Groupname < orphans[j].Groupname })
+	return orphans, nil
+}
+
+// adminGroupName returns the admin group of the directory backend in use.
+func (state *RuntimeState) adminGroupName() string {
+	if state.currentConfig().DirectoryBackend == "sql" {
+		return state.Config.TargetSQL.AdminGroup
+	}
+	return state.Config.TargetLDAP.AdminGroup
+}
+
+// checkOrphanedGroups refreshes the list of orphaned groups and returns the
+// ones which were not orphaned at the previous check.
+func (state *RuntimeState) checkOrphanedGroups() ([]orphanedGroup, error) {
+	orphans, err := state.findOrphanedGroups()
+	if err != nil {
+		return nil, err
+	}
+	state.orphanedGroupsMutex.Lock()
+	defer state.orphanedGroupsMutex.Unlock()
+	var newOrphans []orphanedGroup
+	current := make(map[string]orphanedGroup)
+	for _, orphan := range orphans {
+		if previous, ok := state.orphanedGroups[orphan.Groupname]; !ok || previous.Reason != orphan.Reason {
+			newOrphans = append(newOrphans, orphan)
+		}
+		current[orphan.Groupname] = orphan
+	}
+	state.orphanedGroups = current
+	return newOrphans, nil
+}
+
+func (state *RuntimeState) orphanedGroupsCheckLoop() {
+	interval := state.currentConfig().OrphanedGroupsCheckInterval
+	if interval <= 0 {
+		interval = cacheRefreshDuration
+	}
+	for {
+		newOrphans, err := state.checkOrphanedGroups()
+		if err != nil {
+			log.Printf("orphaned groups check failed: %s", err)
+		} else if len(newOrphans) > 0 {
+			log.Printf("found %d newly orphaned groups", len(newOrphans))
+			if state.currentConfig().EmailAdminsOrphanedGroups {
+				err = state.sendOrphanedGroupsEmail(newOrphans)
+				if err != nil {
+					log.Printf("orphaned groups email failed: %s", err)
+				}
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+const orphanedGroupsMailTemplateText = `{{define "subject"}}Groups nobody can manage{{end}}
+{{define "text"}}The following groups have nobody able to approve access requests:
+{{range .}}
+{{.Groupname}}: {{.Reason}}{{if .Manager}} (manager {{.Manager}}){{end}}{{end}}
+{{end}}
+{{define "html"}}<p>The following groups have nobody able to approve access requests:</p>
+<ul>{{range .}}
+<li><b>{{.Groupname}}</b>: {{.Reason}}{{if .Manager}} (manager {{.Manager}}){{end}}</li>{{end}}
+</ul>
+{{end}}`
+
+func (state *RuntimeState) sendOrphanedGroupsEmail(orphans []orphanedGroup) error {
+	adminGroup := state.adminGroupName()
+	if adminGroup == "" {
+		return fmt.Errorf("no admin group configured")
+	}
+	usersEmail, err := state.Userinfo.GetEmailofusersingroup(adminGroup)
+	if err != nil {
+		return err
+	}
+	return state.sendEmail(mailOrphanedGroups, usersEmail, orphans)
+}
+
+func (state *RuntimeState) orphanedGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != getMethod {
+		state.writeFailureResponse(w, r, "GET Method is required", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := state.GetRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	if !state.isAdmin(r, username) {
+		http.Error(w, "you are not authorized", http.StatusForbidden)
+		return
+	}
+	orphans, err := state.findOrphanedGroups()
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	pageData := orphanedGroupsPageData{
+		UserName:       username,
+		IsAdmin:        true,
+		Title:          "Orphaned Groups",
+		OrphanedGroups: orphans,
+	}
+	state.renderTemplateOrReturnJson(w, r, "orphanedGroupsPage", pageData)
+}
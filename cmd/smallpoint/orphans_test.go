@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Symantec/ldap-group-management/lib/userinfo"
+)
+
+func TestFindOrphanedGroups(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	smtpClient = func(server smtpServer) (smtpDialer, error) {
+		client := &smtpDialerMock{}
+		return client, nil
+	}
+	for _, group := range []userinfo.GroupInfo{
+		{Groupname: "empty1", Description: descriptionAttribute},
+		{Groupname: "ghosted", Description: "ghost", MemberUid: []string{"user2"}},
+		{Groupname: "managedbyempty", Description: "empty1", MemberUid: []string{"user2"}},
+	} {
+		err = state.Userinfo.CreateGroup(group)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	newOrphans, err := state.checkOrphanedGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []orphanedGroup{
+		{Groupname: "empty1", Manager: descriptionAttribute, Reason: orphanSelfManagedEmpty},
+		{Groupname: "ghosted", Manager: "ghost", Reason: orphanManagerMissing},
+		{Groupname: "managedbyempty", Manager: "empty1", Reason: orphanManagerEmpty},
+	}
+	if !reflect.DeepEqual(newOrphans, expected) {
+		t.Fatalf("unexpected orphans %+v", newOrphans)
+	}
+	newOrphans, err = state.checkOrphanedGroups()
+	if err != nil || len(newOrphans) != 0 {
+		t.Fatalf("orphans should only be new once %+v err=%v", newOrphans, err)
+	}
+	state.Config.TargetLDAP.AdminGroup = "group3"
+	err = state.sendOrphanedGroupsEmail(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := testUserRequest(&state, "user2", "GET", orphanedGroupsPath, state.orphanedGroupsHandler, nil)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("non admin report returned %d", rr.Code)
+	}
+	rr = testUserRequest(&state, "user1", "GET", orphanedGroupsPath, state.orphanedGroupsHandler, nil)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "managedbyempty") {
+		t.Fatalf("report returned %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = testUserRequest(&state, "user2", "GET", groupinfoPath+"?groupname=ghosted", state.groupInfoWebpage, nil)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), orphanManagerMissing) {
+		t.Fatalf("group page does not flag the orphan, code %d", rr.Code)
+	}
+}
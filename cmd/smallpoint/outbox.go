@@ -0,0 +1,640 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Outbox events besides the ones shared with the notification sinks.
+const (
+	eventGroupCreated          = "group_created"
+	eventMemberAdded           = "member_added"
+	eventServiceAccountCreated = "service_account_created"
+	eventManagersChanged       = "managers_changed"
+	eventTransferRequested     = "ownership_transfer_requested"
+	eventTransferRejected      = "ownership_transfer_rejected"
+	eventPermissionCreated     = "permission_created"
+	eventPermissionChanged     = "permission_changed"
+	eventPermissionDeleted     = "permission_deleted"
+	eventJoinPolicyChanged     = "join_policy_changed"
+	eventInvitationCreated     = "invitation_created"
+	eventInvitationDropped     = "invitation_dropped"
+	eventLDIFExported          = "ldif_exported"
+	eventEndpointRegistered    = "event_endpoint_registered"
+	eventEndpointDeleted       = "event_endpoint_deleted"
+	eventSessionsRevoked       = "sessions_revoked"
+	eventImpersonationStarted  = "impersonation_started"
+	eventImpersonationEnded    = "impersonation_ended"
+	eventImpersonatedRequest   = "impersonated_request"
+)
+
+const (
+	defaultEventDeliveryInterval = 10 * time.Second
+	defaultEventRetryBackoff     = 30 * time.Second
+	defaultEventMaxAttempts      = 5
+	outboxBatchSize              = 100
+	maxEventsPageSize            = 1000
+)
+
+type outboxEvent struct {
+	ID        int64     `json:"id"`
+	Event     string    `json:"event"`
+	Groupname string    `json:"group,omitempty"`
+	Username  string    `json:"user,omitempty"`
+	Actor     string    `json:"actor,omitempty"`
+	Message   string    `json:"message"`
+	Time      time.Time `json:"time"`
+}
+
+// eventEndpoint is an HTTP endpoint receiving every outbox event in order,
+// LastEventID is the last event it acknowledged or which was dead-lettered.
+type eventEndpoint struct {
+	ID          int64     `json:"id"`
+	URL         string    `json:"url"`
+	LastEventID int64     `json:"last_event_id"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+	secret      string
+}
+
+type eventsPage struct {
+	Events     []outboxEvent `json:"events"`
+	NextCursor string        `json:"next_cursor"`
+}
+
+type deadLetter struct {
+	outboxEvent
+	Error string `json:"error"`
+}
+
+// recordEvent writes message to the system log and appends the event to the
+// outbox read by downstream automation.
+func (state *RuntimeState) recordEvent(event, groupname, username, actor, message string) {
+	if state.sysLog != nil {
+		state.sysLog.Write([]byte(message))
+	}
+	err := insertOutboxEvent(outboxEvent{Event: event, Groupname: groupname, Username: username,
+		Actor: actor, Message: message, Time: time.Now()}, state)
+	if err != nil {
+		log.Printf("outbox insert of %s failed: %s", event, err)
+	}
+}
+
+var insertOutboxEventStmt = map[string]string{
+	"sqlite":   "insert into event_outbox(event_type, groupname, username, actor, message, time_stamp) values (?,?,?,?,?,?);",
+	"postgres": "insert into event_outbox(event_type, groupname, username, actor, message, time_stamp) values ($1,$2,$3,$4,$5,$6);",
+}
+
+func insertOutboxEvent(event outboxEvent, state *RuntimeState) error {
+	stmtText := insertOutboxEventStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(event.Event, event.Groupname, event.Username, event.Actor, event.Message, event.Time.Unix())
+	return err
+}
+
+var getOutboxEventsStmt = map[string]string{
+	"sqlite":   "select id, event_type, groupname, username, actor, message, time_stamp from event_outbox where id>? order by id limit ?;",
+	"postgres": "select id, event_type, groupname, username, actor, message, time_stamp from event_outbox where id>$1 order by id limit $2;",
+}
+
+// getOutboxEvents returns at most limit events recorded after the event
+// with the id cursor.
+func getOutboxEvents(cursor int64, limit int, state *RuntimeState) ([]outboxEvent, error) {
+	stmtText := getOutboxEventsStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []outboxEvent{}
+	for rows.Next() {
+		var event outboxEvent
+		var timeStamp int64
+		err = rows.Scan(&event.ID, &event.Event, &event.Groupname, &event.Username, &event.Actor,
+			&event.Message, &timeStamp)
+		if err != nil {
+			return nil, err
+		}
+		event.Time = time.Unix(timeStamp, 0)
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+var insertEventEndpointStmt = map[string]string{
+	"sqlite": `insert into event_endpoints(url, secret, last_event_id, attempts, next_attempt, last_error)
+			select ?, ?, coalesce(max(id), 0), 0, 0, '' from event_outbox;`,
+	"postgres": `insert into event_endpoints(url, secret, last_event_id, attempts, next_attempt, last_error)
+			select $1::text, $2::text, coalesce(max(id), 0), 0, 0, '' from event_outbox;`,
+}
+
+// insertEventEndpoint registers an endpoint, it only receives the events
+// recorded from now on.
+func insertEventEndpoint(endpointURL, secret string, state *RuntimeState) error {
+	stmtText := insertEventEndpointStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(endpointURL, secret)
+	return err
+}
+
+var deleteEventEndpointStmt = map[string]string{
+	"sqlite":   "delete from event_endpoints where url=?;",
+	"postgres": "delete from event_endpoints where url=$1;",
+}
+
+var deleteDeadLettersStmt = map[string]string{
+	"sqlite":   "delete from event_dead_letters where endpoint_id=?;",
+	"postgres": "delete from event_dead_letters where endpoint_id=$1;",
+}
+
+func deleteEventEndpoint(endpoint eventEndpoint, state *RuntimeState) error {
+	err := deleteDeadLetters(endpoint, state)
+	if err != nil {
+		return err
+	}
+	stmtText := deleteEventEndpointStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(endpoint.URL)
+	return err
+}
+
+func deleteDeadLetters(endpoint eventEndpoint, state *RuntimeState) error {
+	stmtText := deleteDeadLettersStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(endpoint.ID)
+	return err
+}
+
+var listEventEndpointsStmt = map[string]string{
+	"sqlite":   "select id, url, secret, last_event_id, attempts, next_attempt, last_error from event_endpoints order by id;",
+	"postgres": "select id, url, secret, last_event_id, attempts, next_attempt, last_error from event_endpoints order by id;",
+}
+
+func listEventEndpoints(state *RuntimeState) ([]eventEndpoint, error) {
+	stmtText := listEventEndpointsStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	endpoints := []eventEndpoint{}
+	for rows.Next() {
+		var endpoint eventEndpoint
+		var nextAttempt int64
+		err = rows.Scan(&endpoint.ID, &endpoint.URL, &endpoint.secret, &endpoint.LastEventID,
+			&endpoint.Attempts, &nextAttempt, &endpoint.LastError)
+		if err != nil {
+			return nil, err
+		}
+		if nextAttempt != 0 {
+			endpoint.NextAttempt = time.Unix(nextAttempt, 0)
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, rows.Err()
+}
+
+func getEventEndpoint(endpointURL string, state *RuntimeState) (*eventEndpoint, error) {
+	endpoints, err := listEventEndpoints(state)
+	if err != nil {
+		return nil, err
+	}
+	for _, endpoint := range endpoints {
+		if endpoint.URL == endpointURL {
+			return &endpoint, nil
+		}
+	}
+	return nil, nil
+}
+
+var updateEventEndpointStmt = map[string]string{
+	"sqlite":   "update event_endpoints set last_event_id=?, attempts=?, next_attempt=?, last_error=? where id=?;",
+	"postgres": "update event_endpoints set last_event_id=$1, attempts=$2, next_attempt=$3, last_error=$4 where id=$5;",
+}
+
+func updateEventEndpoint(endpoint eventEndpoint, state *RuntimeState) error {
+	stmtText := updateEventEndpointStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return err
+	}
+	defer stmt.Close()
+	var nextAttempt int64
+	if !endpoint.NextAttempt.IsZero() {
+		nextAttempt = endpoint.NextAttempt.Unix()
+	}
+	_, err = stmt.Exec(endpoint.LastEventID, endpoint.Attempts, nextAttempt, endpoint.LastError, endpoint.ID)
+	return err
+}
+
+var insertDeadLetterStmt = map[string]string{
+	"sqlite":   "insert into event_dead_letters(endpoint_id, event_id, error, time_stamp) values (?,?,?,?);",
+	"postgres": "insert into event_dead_letters(endpoint_id, event_id, error, time_stamp) values ($1,$2,$3,$4);",
+}
+
+func insertDeadLetter(endpoint eventEndpoint, eventID int64, state *RuntimeState) error {
+	stmtText := insertDeadLetterStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(endpoint.ID, eventID, endpoint.LastError, time.Now().Unix())
+	return err
+}
+
+var listDeadLettersStmt = map[string]string{
+	"sqlite": `select o.id, o.event_type, o.groupname, o.username, o.actor, o.message, o.time_stamp, d.error
+			from event_dead_letters d join event_outbox o on o.id=d.event_id where d.endpoint_id=? order by o.id;`,
+	"postgres": `select o.id, o.event_type, o.groupname, o.username, o.actor, o.message, o.time_stamp, d.error
+			from event_dead_letters d join event_outbox o on o.id=d.event_id where d.endpoint_id=$1 order by o.id;`,
+}
+
+func listDeadLetters(endpoint eventEndpoint, state *RuntimeState) ([]deadLetter, error) {
+	stmtText := listDeadLettersStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(endpoint.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deadLetters := []deadLetter{}
+	for rows.Next() {
+		var letter deadLetter
+		var timeStamp int64
+		err = rows.Scan(&letter.ID, &letter.Event, &letter.Groupname, &letter.Username, &letter.Actor,
+			&letter.Message, &timeStamp, &letter.Error)
+		if err != nil {
+			return nil, err
+		}
+		letter.Time = time.Unix(timeStamp, 0)
+		deadLetters = append(deadLetters, letter)
+	}
+	return deadLetters, rows.Err()
+}
+
+func (state *RuntimeState) eventMaxAttempts() int {
+	if value := state.currentConfig().EventMaxAttempts; value > 0 {
+		return value
+	}
+	return defaultEventMaxAttempts
+}
+
+func (state *RuntimeState) eventRetryBackoff() time.Duration {
+	if value := state.currentConfig().EventRetryBackoff; value > 0 {
+		return value
+	}
+	return defaultEventRetryBackoff
+}
+
+// deliverEvents sends the pending events to endpoint in order. A failed
+// delivery is retried with an exponential backoff by later calls, once the
+// attempts are exhausted the event is dead-lettered and delivery goes on.
+func (state *RuntimeState) deliverEvents(endpoint eventEndpoint) error {
+	events, err := getOutboxEvents(endpoint.LastEventID, outboxBatchSize, state)
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		body, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		header := http.Header{}
+		header.Set(notificationEventHeader, event.Event)
+		header.Set(notificationSignatureHeader, signNotification(endpoint.secret, body))
+		err = postNotification(endpoint.URL, body, header)
+		if err != nil {
+			endpoint.Attempts++
+			endpoint.LastError = err.Error()
+			if endpoint.Attempts < state.eventMaxAttempts() {
+				endpoint.NextAttempt = time.Now().Add(state.eventRetryBackoff() << uint(endpoint.Attempts-1))
+				return updateEventEndpoint(endpoint, state)
+			}
+			log.Printf("event %d to %s dead-lettered: %s", event.ID, endpoint.URL, err)
+			err = insertDeadLetter(endpoint, event.ID, state)
+			if err != nil {
+				return err
+			}
+		} else {
+			endpoint.LastError = ""
+		}
+		endpoint.LastEventID = event.ID
+		endpoint.Attempts = 0
+		endpoint.NextAttempt = time.Time{}
+		err = updateEventEndpoint(endpoint, state)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliverOutbox hands the outbox to every endpoint which is not waiting for
+// a retry.
+func (state *RuntimeState) deliverOutbox() error {
+	endpoints, err := listEventEndpoints(state)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, endpoint := range endpoints {
+		if endpoint.NextAttempt.After(now) {
+			continue
+		}
+		err = state.deliverEvents(endpoint)
+		if err != nil {
+			log.Printf("event delivery to %s failed: %s", endpoint.URL, err)
+		}
+	}
+	return nil
+}
+
+func (state *RuntimeState) outboxDeliveryLoop() {
+	interval := state.currentConfig().EventDeliveryInterval
+	if interval <= 0 {
+		interval = defaultEventDeliveryInterval
+	}
+	for {
+		err := state.deliverOutbox()
+		if err != nil {
+			log.Printf("outbox delivery failed: %s", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) error {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(data)
+}
+
+// eventsHandler returns the outbox events after the cursor parameter, the
+// next_cursor of the response is used to poll the following page.
+func (state *RuntimeState) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != getMethod {
+		state.writeFailureResponse(w, r, "GET Method is required", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := state.GetRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	if !state.isAdmin(r, username) {
+		http.Error(w, "you are not authorized", http.StatusForbidden)
+		return
+	}
+	var cursor int64
+	if value := r.FormValue("cursor"); value != "" {
+		cursor, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || cursor < 0 {
+			state.writeFailureResponse(w, r, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := outboxBatchSize
+	if value := r.FormValue("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxEventsPageSize {
+			state.writeFailureResponse(w, r, fmt.Sprintf("limit has to be between 1 and %d", maxEventsPageSize), http.StatusBadRequest)
+			return
+		}
+	}
+	events, err := getOutboxEvents(cursor, limit, state)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	page := eventsPage{Events: events, NextCursor: strconv.FormatInt(cursor, 10)}
+	if len(events) > 0 {
+		page.NextCursor = strconv.FormatInt(events[len(events)-1].ID, 10)
+	}
+	err = writeJSON(w, page)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// eventEndpointsHandler lists the registered endpoints on GET and registers
+// the url form value on POST.
+func (state *RuntimeState) eventEndpointsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != getMethod && r.Method != postMethod {
+		state.writeFailureResponse(w, r, "GET or POST Method is required", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := state.GetRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	if !state.isAdmin(r, username) {
+		http.Error(w, "you are not authorized", http.StatusForbidden)
+		return
+	}
+	if r.Method == getMethod {
+		endpoints, err := listEventEndpoints(state)
+		if err != nil {
+			log.Println(err)
+			state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+			return
+		}
+		err = writeJSON(w, endpoints)
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		if err.Error() == "missing form body" {
+			http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+		} else {
+			state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		}
+		return
+	}
+	endpointURL := r.PostFormValue("url")
+	parsedURL, err := url.Parse(endpointURL)
+	if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Host == "" {
+		state.writeFailureResponse(w, r, fmt.Sprintf("Invalid endpoint url %q", endpointURL), http.StatusBadRequest)
+		return
+	}
+	existing, err := getEventEndpoint(endpointURL, state)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	if existing != nil {
+		state.writeFailureResponse(w, r, fmt.Sprintf("Endpoint %s is already registered", endpointURL), http.StatusBadRequest)
+		return
+	}
+	// Every delivery is signed, a secret is generated when none is given
+	// and only shown in this response.
+	secret := r.PostFormValue("secret")
+	successMessage := fmt.Sprintf("Events will be delivered to %s", endpointURL)
+	if secret == "" {
+		random := make([]byte, 32)
+		_, err = rand.Read(random)
+		if err != nil {
+			log.Println(err)
+			state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+			return
+		}
+		secret = hex.EncodeToString(random)
+		successMessage += fmt.Sprintf(", signed with the secret %s which will not be shown again", secret)
+	}
+	err = insertEventEndpoint(endpointURL, secret, state)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	state.recordEvent(eventEndpointRegistered, "", "", username,
+		fmt.Sprintf("Event endpoint %s was registered by %s", endpointURL, username))
+	pageData := simpleMessagePageData{
+		UserName:       username,
+		IsAdmin:        true,
+		Title:          "Event Endpoint Registered",
+		SuccessMessage: successMessage,
+	}
+	state.renderTemplateOrReturnJson(w, r, "simpleMessagePage", pageData)
+}
+
+func (state *RuntimeState) deleteEventEndpointHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != postMethod {
+		state.writeFailureResponse(w, r, "POST Method is required", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := state.GetRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	if !state.isAdmin(r, username) {
+		http.Error(w, "you are not authorized", http.StatusForbidden)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		if err.Error() == "missing form body" {
+			http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+		} else {
+			state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		}
+		return
+	}
+	endpointURL := r.PostFormValue("url")
+	endpoint, err := getEventEndpoint(endpointURL, state)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	if endpoint == nil {
+		state.writeFailureResponse(w, r, fmt.Sprintf("Endpoint %s is not registered", endpointURL), http.StatusBadRequest)
+		return
+	}
+	err = deleteEventEndpoint(*endpoint, state)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	state.recordEvent(eventEndpointDeleted, "", "", username,
+		fmt.Sprintf("Event endpoint %s was deleted by %s", endpointURL, username))
+	pageData := simpleMessagePageData{
+		UserName:       username,
+		IsAdmin:        true,
+		Title:          "Event Endpoint Deleted",
+		SuccessMessage: fmt.Sprintf("Events are not delivered to %s anymore", endpointURL),
+	}
+	state.renderTemplateOrReturnJson(w, r, "simpleMessagePage", pageData)
+}
+
+// deadLettersHandler returns the events which could not be delivered to the
+// endpoint given by the url parameter.
+func (state *RuntimeState) deadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != getMethod {
+		state.writeFailureResponse(w, r, "GET Method is required", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := state.GetRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	if !state.isAdmin(r, username) {
+		http.Error(w, "you are not authorized", http.StatusForbidden)
+		return
+	}
+	endpointURL := r.FormValue("url")
+	endpoint, err := getEventEndpoint(endpointURL, state)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	if endpoint == nil {
+		state.writeFailureResponse(w, r, fmt.Sprintf("Endpoint %s is not registered", endpointURL), http.StatusBadRequest)
+		return
+	}
+	deadLetters, err := listDeadLetters(*endpoint, state)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	err = writeJSON(w, deadLetters)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventsPolling(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	formValues := url.Values{"groupname": {"group2"}, "members": {"user3,user2"}}
+	rr := testUserRequest(&state, "user1", "POST", deletemembersbuttonPath, state.deletemembersfromExistingGroup, formValues)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("delete members returned %d", rr.Code)
+	}
+	state.recordEvent(eventJoinPolicyChanged, "group1", "", "user1", "Join policy of group1 changed")
+	state.recordEvent(eventGroupDeleted, "group1", "", "user1", "Group group1 was deleted")
+
+	rr = testUserRequest(&state, "user2", "GET", eventsPath, state.eventsHandler, url.Values{})
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("events returned %d to a regular user", rr.Code)
+	}
+	var page eventsPage
+	rr = testUserRequest(&state, "user1", "GET", eventsPath+"?limit=2", state.eventsHandler, url.Values{})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("events returned %d", rr.Code)
+	}
+	err = json.NewDecoder(rr.Body).Decode(&page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// user2 is not a member of group2 so only user3 was removed.
+	if len(page.Events) != 2 || page.Events[0].Event != eventMemberRemoved || page.Events[0].Username != "user3" ||
+		page.Events[1].Event != eventJoinPolicyChanged {
+		t.Fatalf("bad first page %+v", page)
+	}
+	rr = testUserRequest(&state, "user1", "GET", eventsPath+"?limit=2&cursor="+page.NextCursor, state.eventsHandler, url.Values{})
+	page = eventsPage{}
+	err = json.NewDecoder(rr.Body).Decode(&page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Events) != 1 || page.Events[0].Event != eventGroupDeleted {
+		t.Fatalf("bad second page %+v", page)
+	}
+	cursor := page.NextCursor
+	rr = testUserRequest(&state, "user1", "GET", eventsPath+"?cursor="+cursor, state.eventsHandler, url.Values{})
+	page = eventsPage{}
+	err = json.NewDecoder(rr.Body).Decode(&page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Events) != 0 || page.NextCursor != cursor {
+		t.Fatalf("bad last page %+v", page)
+	}
+	rr = testUserRequest(&state, "user1", "GET", eventsPath+"?cursor=abc", state.eventsHandler, url.Values{})
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("invalid cursor returned %d", rr.Code)
+	}
+}
+
+func TestOutboxDelivery(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Config.Base.EventRetryBackoff = time.Millisecond
+	state.Config.Base.EventMaxAttempts = 2
+	state.recordEvent(eventGroupCreated, "group4", "", "user1", "Group group4 was created by user1")
+
+	server, received, attempts := newNotificationServer(1)
+	defer server.Close()
+	failing, _, _ := newNotificationServer(100)
+	defer failing.Close()
+	for _, endpointURL := range []string{server.URL, failing.URL} {
+		formValues := url.Values{"url": {endpointURL}, "secret": {"secret"}}
+		rr := testUserRequest(&state, "user1", "POST", eventEndpointsPath, state.eventEndpointsHandler, formValues)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("register endpoint returned %d", rr.Code)
+		}
+	}
+	rr := testUserRequest(&state, "user1", "POST", eventEndpointsPath, state.eventEndpointsHandler,
+		url.Values{"url": {"ftp://example.com"}})
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("register of a bad url returned %d", rr.Code)
+	}
+	state.recordEvent(eventMemberAdded, "group1", "user3", "user1", "user3 was added to Group group1 by user1")
+	state.recordEvent(eventMemberRemoved, "group1", "user3", "user1", "user3 was deleted from Group group1 by user1")
+
+	for i := 0; i < 2; i++ {
+		err = state.deliverOutbox()
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if attempts() != 5 {
+		t.Fatalf("expected 5 attempts, got %d", attempts())
+	}
+	// Events recorded before the registration of the endpoint are not
+	// delivered, the registrations themselves are events.
+	for _, expected := range []string{eventEndpointRegistered, eventEndpointRegistered, eventMemberAdded, eventMemberRemoved} {
+		notification := <-received
+		var event outboxEvent
+		err = json.Unmarshal(notification.Body, &event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.Event != expected {
+			t.Fatalf("expected %s, got %+v", expected, event)
+		}
+		if notification.Header.Get(notificationSignatureHeader) != signNotification("secret", notification.Body) {
+			t.Fatal("bad signature")
+		}
+	}
+
+	rr = testUserRequest(&state, "user1", "GET", deadLettersPath+"?url="+url.QueryEscape(failing.URL),
+		state.deadLettersHandler, url.Values{})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("dead letters returned %d", rr.Code)
+	}
+	var deadLetters []deadLetter
+	err = json.NewDecoder(rr.Body).Decode(&deadLetters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deadLetters) != 1 || deadLetters[0].Event != eventEndpointRegistered || deadLetters[0].Error == "" {
+		t.Fatalf("bad dead letters %+v", deadLetters)
+	}
+
+	rr = testUserRequest(&state, "user1", "POST", deleteEventEndpointPath, state.deleteEventEndpointHandler,
+		url.Values{"url": {failing.URL}})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("delete endpoint returned %d", rr.Code)
+	}
+	endpoints, err := listEventEndpoints(&state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints) != 1 || endpoints[0].URL != server.URL || endpoints[0].Attempts != 0 {
+		t.Fatalf("bad endpoints %+v", endpoints)
+	}
+
+	// Endpoints registered without a secret get a generated one.
+	rr = testUserRequest(&state, "user1", "POST", eventEndpointsPath, state.eventEndpointsHandler,
+		url.Values{"url": {"https://example.com/events"}})
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "signed with the secret") {
+		t.Fatalf("register without a secret returned %d: %s", rr.Code, rr.Body.String())
+	}
+	generated, err := getEventEndpoint("https://example.com/events", &state)
+	if err != nil || generated == nil || len(generated.secret) != 64 ||
+		!strings.Contains(rr.Body.String(), generated.secret) {
+		t.Fatalf("bad generated secret %+v err=%v", generated, err)
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Symantec/ldap-group-management/lib/userinfo"
+)
+
+var errManagerCycle = errors.New("the new managing group is itself managed by the group")
+
+// ownershipTransfer hands a group over to ManageGroup, once accepted it
+// replaces every current manager of the group, groups and users alike.
+type ownershipTransfer struct {
+	Groupname       string
+	CurrentManagers []string
+	ManageGroup     string
+	RequestedBy     string
+	RequestedAt     time.Time
+	CanAccept       bool `json:",omitempty"`
+	CanCancelOrDeny bool `json:",omitempty"`
+}
+
+var insertOwnershipTransferStmt = map[string]string{
+	"sqlite":   "insert into ownership_transfers(groupname, managegroup, requested_by, time_stamp) values (?,?,?,?);",
+	"postgres": "insert into ownership_transfers(groupname, managegroup, requested_by, time_stamp) values ($1,$2,$3,$4);",
+}
+
+// insertOwnershipTransfer records a pending transfer, it replaces any older
+// pending transfer of the same group.
+func insertOwnershipTransfer(groupname, managegroup, requestedBy string, state *RuntimeState) error {
+	err := deleteOwnershipTransfer(groupname, state)
+	if err != nil {
+		return err
+	}
+	stmtText := insertOwnershipTransferStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(groupname, managegroup, requestedBy, time.Now().Unix())
+	return err
+}
+
+var deleteOwnershipTransferStmt = map[string]string{
+	"sqlite":   "delete from ownership_transfers where groupname=?;",
+	"postgres": "delete from ownership_transfers where groupname=$1;",
+}
+
+func deleteOwnershipTransfer(groupname string, state *RuntimeState) error {
+	stmtText := deleteOwnershipTransferStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(groupname)
+	return err
+}
+
+var getOwnershipTransferStmt = map[string]string{
+	"sqlite":   "select groupname, managegroup, requested_by, time_stamp from ownership_transfers where groupname=?;",
+	"postgres": "select groupname, managegroup, requested_by, time_stamp from ownership_transfers where groupname=$1;",
+}
+
+// getOwnershipTransfer returns nil when the group has no pending transfer.
+func getOwnershipTransfer(groupname string, state *RuntimeState) (*ownershipTransfer, error) {
+	stmtText := getOwnershipTransferStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return nil, err
+	}
+	defer stmt.Close()
+	var transfer ownershipTransfer
+	var timeStamp int64
+	err = stmt.QueryRow(groupname).Scan(&transfer.Groupname, &transfer.ManageGroup, &transfer.RequestedBy, &timeStamp)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	transfer.RequestedAt = time.Unix(timeStamp, 0)
+	return &transfer, nil
+}
+
+var listOwnershipTransfersStmt = map[string]string{
+	"sqlite":   "select groupname, managegroup, requested_by, time_stamp from ownership_transfers order by time_stamp, groupname;",
+	"postgres": "select groupname, managegroup, requested_by, time_stamp from ownership_transfers order by time_stamp, groupname;",
+}
+
+func listOwnershipTransfers(state *RuntimeState) ([]ownershipTransfer, error) {
+	stmtText := listOwnershipTransfersStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var transfers []ownershipTransfer
+	for rows.Next() {
+		var transfer ownershipTransfer
+		var timeStamp int64
+		err = rows.Scan(&transfer.Groupname, &transfer.ManageGroup, &transfer.RequestedBy, &timeStamp)
+		if err != nil {
+			return nil, err
+		}
+		transfer.RequestedAt = time.Unix(timeStamp, 0)
+		transfers = append(transfers, transfer)
+	}
+	return transfers, rows.Err()
+}
+
+// checkManagerCycle follows the managing groups of managegroup and fails if
+// it comes back to groupname, A managed by B and B managed by A would leave
+// both groups without an outside owner.
+func (state *RuntimeState) checkManagerCycle(groupname, managegroup string) error {
+	if managegroup == groupname || userinfo.ManagerGroupname(groupname, managegroup) == "" {
+		return nil
+	}
+	visited := map[string]bool{}
+	pending := []string{managegroup}
+	for len(pending) > 0 {
+		current := pending[0]
+		pending = pending[1:]
+		if visited[current] {
+			continue
+		}
+		visited[current] = true
+		managers, err := state.Userinfo.GetGroupManagers(current)
+		if err != nil {
+			if err == userinfo.GroupDoesNotExist {
+				continue
+			}
+			return err
+		}
+		for _, manager := range managers {
+			if manager == groupname {
+				return errManagerCycle
+			}
+			managerGroup := userinfo.ManagerGroupname(current, manager)
+			if managerGroup != "" && managerGroup != current {
+				pending = append(pending, managerGroup)
+			}
+		}
+	}
+	return nil
+}
+
+// ownershipTransferRecipients returns the addresses of every current
+// manager of the group of transfer and of the members of the receiving
+// group.
+func (state *RuntimeState) ownershipTransferRecipients(transfer ownershipTransfer) ([]string, error) {
+	usersEmail, err := state.getManagersEmail(transfer.Groupname)
+	if err != nil {
+		return nil, err
+	}
+	groupEmails, err := state.Userinfo.GetEmailofusersingroup(transfer.ManageGroup)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, email := range usersEmail {
+		seen[email] = true
+	}
+	for _, email := range groupEmails {
+		if !seen[email] {
+			seen[email] = true
+			usersEmail = append(usersEmail, email)
+		}
+	}
+	return usersEmail, nil
+}
+
+func (state *RuntimeState) canAcceptOwnershipTransfer(r *http.Request, username string, transfer *ownershipTransfer) (bool, error) {
+	if state.isAdmin(r, username) {
+		return true, nil
+	}
+	isMember, _, err := state.Userinfo.IsgroupmemberorNot(transfer.ManageGroup, username)
+	if err != nil && err != userinfo.GroupDoesNotExist {
+		return false, err
+	}
+	return isMember, nil
+}
+
+func (state *RuntimeState) ownershipTransfersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != getMethod {
+		state.writeFailureResponse(w, r, "GET Method is required", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := state.GetRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	transfers, err := listOwnershipTransfers(state)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	pageData := ownershipTransfersPageData{
+		UserName:  username,
+		IsAdmin:   state.isAdmin(r, username),
+		Title:     "Ownership Transfers",
+		Transfers: []ownershipTransfer{},
+	}
+	for _, transfer := range transfers {
+		transfer.CanAccept, err = state.canAcceptOwnershipTransfer(r, username, &transfer)
+		if err != nil {
+			log.Println(err)
+			state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+			return
+		}
+		if !transfer.CanAccept && transfer.RequestedBy != username {
+			continue
+		}
+		transfer.CanCancelOrDeny = true
+		transfer.CurrentManagers, err = state.Userinfo.GetGroupManagers(transfer.Groupname)
+		if err != nil && err != userinfo.GroupDoesNotExist {
+			log.Println(err)
+			state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+			return
+		}
+		pageData.Transfers = append(pageData.Transfers, transfer)
+	}
+	state.renderTemplateOrReturnJson(w, r, "ownershipTransfersPage", pageData)
+}
+
+// ownershipTransferDecision loads the transfer named in the form of an
+// accept or reject request, it writes the error response when it fails.
+func (state *RuntimeState) ownershipTransferDecision(w http.ResponseWriter, r *http.Request) (string, *ownershipTransfer, error) {
+	if r.Method != postMethod {
+		state.writeFailureResponse(w, r, "POST Method is required", http.StatusMethodNotAllowed)
+		return "", nil, errors.New("bad method")
+	}
+	username, err := state.GetRemoteUserName(w, r)
+	if err != nil {
+		return "", nil, err
+	}
+	err = r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		if err.Error() == "missing form body" {
+			http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+		} else {
+			state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		}
+		return "", nil, err
+	}
+	groupname := r.PostFormValue("groupname")
+	transfer, err := getOwnershipTransfer(groupname, state)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return "", nil, err
+	}
+	if transfer == nil {
+		state.writeFailureResponse(w, r, fmt.Sprintf("No pending ownership transfer for group %s", groupname), http.StatusBadRequest)
+		return "", nil, errors.New("no transfer")
+	}
+	return username, transfer, nil
+}
+
+func (state *RuntimeState) acceptOwnershipTransferHandler(w http.ResponseWriter, r *http.Request) {
+	username, transfer, err := state.ownershipTransferDecision(w, r)
+	if err != nil {
+		return
+	}
+	canAccept, err := state.canAcceptOwnershipTransfer(r, username, transfer)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	if !canAccept {
+		state.writeFailureResponse(w, r, fmt.Sprintf("Only members of %s can accept this transfer", transfer.ManageGroup), http.StatusForbidden)
+		return
+	}
+	err = state.groupExistsorNot(w, transfer.Groupname)
+	if err != nil {
+		return
+	}
+	// The managers may have changed since the transfer was requested.
+	err = state.checkManagerCycle(transfer.Groupname, transfer.ManageGroup)
+	if err != nil {
+		log.Println(err)
+		if err == errManagerCycle {
+			state.writeFailureResponse(w, r, fmt.Sprintf("Group %s: %s", transfer.Groupname, err), http.StatusBadRequest)
+		} else {
+			state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		}
+		return
+	}
+	// The previous managers are told before they are replaced.
+	usersEmail, err := state.ownershipTransferRecipients(*transfer)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	err = state.Userinfo.SetGroupManagers(transfer.Groupname, []string{transfer.ManageGroup})
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	err = deleteOwnershipTransfer(transfer.Groupname, state)
+	if err != nil {
+		log.Println(err)
+	}
+	state.recordEvent(eventManagersChanged, transfer.Groupname, "", username,
+		fmt.Sprintf("Group %s is managed by %s alone now, this change was requested by %s and accepted by %s.",
+			transfer.Groupname, transfer.ManageGroup, transfer.RequestedBy, username))
+	state.sendOwnershipTransferEmail(mailOwnershipTransferAccepted, username, *transfer, usersEmail)
+
+	pageData := simpleMessagePageData{
+		UserName:       username,
+		IsAdmin:        state.isAdmin(r, username),
+		Title:          "Ownership Transfer Accepted",
+		SuccessMessage: fmt.Sprintf("Group %s is now managed by %s only, it replaced the previous managers", transfer.Groupname, transfer.ManageGroup),
+		ContinueURL:    groupinfoPath + "?groupname=" + transfer.Groupname,
+	}
+	state.renderTemplateOrReturnJson(w, r, "simpleMessagePage", pageData)
+}
+
+// rejectOwnershipTransferHandler lets the receiving group refuse a transfer
+// and the requester withdraw it.
+func (state *RuntimeState) rejectOwnershipTransferHandler(w http.ResponseWriter, r *http.Request) {
+	username, transfer, err := state.ownershipTransferDecision(w, r)
+	if err != nil {
+		return
+	}
+	allowed := transfer.RequestedBy == username
+	if !allowed {
+		allowed, err = state.canAcceptOwnershipTransfer(r, username, transfer)
+		if err != nil {
+			log.Println(err)
+			state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+			return
+		}
+	}
+	if !allowed {
+		state.writeFailureResponse(w, r, fmt.Sprintf("Only members of %s can reject this transfer", transfer.ManageGroup), http.StatusForbidden)
+		return
+	}
+	err = deleteOwnershipTransfer(transfer.Groupname, state)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	state.recordEvent(eventTransferRejected, transfer.Groupname, "", username,
+		fmt.Sprintf("Transfer of group %s to %s requested by %s was rejected by %s.",
+			transfer.Groupname, transfer.ManageGroup, transfer.RequestedBy, username))
+	usersEmail, err := state.ownershipTransferRecipients(*transfer)
+	if err != nil {
+		log.Println(err)
+	} else {
+		state.sendOwnershipTransferEmail(mailOwnershipTransferRejected, username, *transfer, usersEmail)
+	}
+
+	pageData := simpleMessagePageData{
+		UserName:       username,
+		IsAdmin:        state.isAdmin(r, username),
+		Title:          "Ownership Transfer Rejected",
+		SuccessMessage: fmt.Sprintf("The transfer of group %s to %s was dropped", transfer.Groupname, transfer.ManageGroup),
+		ContinueURL:    ownershipTransfersPath,
+	}
+	state.renderTemplateOrReturnJson(w, r, "simpleMessagePage", pageData)
+}
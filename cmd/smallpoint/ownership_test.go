@@ -0,0 +1,211 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/Symantec/ldap-group-management/lib/userinfo"
+)
+
+func TestOwnershipTransferWorkflow(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	smtpClient = func(server smtpServer) (smtpDialer, error) {
+		client := &smtpDialerMock{}
+		return client, nil
+	}
+	formValues := url.Values{"groupnames": {"group1"}, "managegroup": {"group2"}}
+	rr := testUserRequest(&state, "user1", "POST", changeownershipbuttonPath, state.changeownership, formValues)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("change owner returned %d", rr.Code)
+	}
+	manager, err := state.Userinfo.GetDescriptionvalue("group1")
+	if err != nil || manager != descriptionAttribute {
+		t.Fatalf("manager changed before acceptance %q err=%v", manager, err)
+	}
+
+	rr = testUserRequest(&state, "user2", "GET", ownershipTransfersPath+"?encoding=json", state.ownershipTransfersHandler, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("transfers page returned %d", rr.Code)
+	}
+	// user2 is not in group2, it cannot accept the transfer.
+	acceptValues := url.Values{"groupname": {"group1"}}
+	rr = testUserRequest(&state, "user2", "POST", acceptOwnershipPath, state.acceptOwnershipTransferHandler, acceptValues)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("accept by non member returned %d", rr.Code)
+	}
+	rr = testUserRequest(&state, "user3", "POST", acceptOwnershipPath, state.acceptOwnershipTransferHandler, acceptValues)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("accept returned %d: %s", rr.Code, rr.Body.String())
+	}
+	manager, err = state.Userinfo.GetDescriptionvalue("group1")
+	if err != nil || manager != "group2" {
+		t.Fatalf("bad manager of group1 %q err=%v", manager, err)
+	}
+	rr = testUserRequest(&state, "user3", "POST", acceptOwnershipPath, state.acceptOwnershipTransferHandler, acceptValues)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("accepting twice returned %d", rr.Code)
+	}
+
+	// group3 is managed by group1, which is managed by group2 now.
+	formValues = url.Values{"groupnames": {"group2"}, "managegroup": {"group3"}}
+	rr = testUserRequest(&state, "user1", "POST", changeownershipbuttonPath, state.changeownership, formValues)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("manager cycle returned %d", rr.Code)
+	}
+
+	formValues = url.Values{"groupnames": {"group3"}, "managegroup": {"group2"}}
+	rr = testUserRequest(&state, "user1", "POST", changeownershipbuttonPath, state.changeownership, formValues)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("change owner returned %d", rr.Code)
+	}
+	rejectValues := url.Values{"groupname": {"group3"}}
+	rr = testUserRequest(&state, "user2", "POST", rejectOwnershipPath, state.rejectOwnershipTransferHandler, rejectValues)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("reject by outsider returned %d", rr.Code)
+	}
+	rr = testUserRequest(&state, "user3", "POST", rejectOwnershipPath, state.rejectOwnershipTransferHandler, rejectValues)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("reject returned %d", rr.Code)
+	}
+	transfer, err := getOwnershipTransfer("group3", &state)
+	if err != nil || transfer != nil {
+		t.Fatalf("rejected transfer is still pending %+v err=%v", transfer, err)
+	}
+}
+
+func TestOwnershipTransferReplacesEveryManager(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = state.Userinfo.SetGroupManagers("group3", []string{"group3", userinfo.UserManagerPrefix + "user2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	formValues := url.Values{"groupnames": {"group3"}, "managegroup": {"group2"}}
+	rr := testUserRequest(&state, "user1", "POST", changeownershipbuttonPath, state.changeownership, formValues)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("change owner returned %d", rr.Code)
+	}
+	acceptValues := url.Values{"groupname": {"group3"}}
+	rr = testUserRequest(&state, "user3", "POST", acceptOwnershipPath, state.acceptOwnershipTransferHandler, acceptValues)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("accept returned %d: %s", rr.Code, rr.Body.String())
+	}
+	managers, err := state.Userinfo.GetGroupManagers("group3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(managers, []string{"group2"}) {
+		t.Fatalf("bad managers of group3 %v", managers)
+	}
+	mails, err := listQueuedMail(&state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recipients []string
+	for _, mail := range mails {
+		if mail.Template == mailOwnershipTransferAccepted {
+			recipients = mail.Recipients
+		}
+	}
+	// user2 managed group3 on its own, it has to learn it lost the group.
+	sort.Strings(recipients)
+	expected := []string{"user1@example.com", "user2@example.com", "user3@example.com"}
+	if !reflect.DeepEqual(recipients, expected) {
+		t.Fatalf("accepted transfer mailed %v, expected %v", recipients, expected)
+	}
+}
+
+func TestCheckManagerCycle(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// group3 is managed by group1.
+	if err := state.checkManagerCycle("group1", "group3"); err != errManagerCycle {
+		t.Fatalf("cycle not detected, err=%v", err)
+	}
+	for _, pair := range [][]string{{"group3", "group2"}, {"group1", "group1"}, {"group2", "group1"}} {
+		if err := state.checkManagerCycle(pair[0], pair[1]); err != nil {
+			t.Fatalf("%v: %s", pair, err)
+		}
+	}
+}
+
+func TestSetGroupManagers(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	formValues := url.Values{"groupname": {"group3"}, "managers": {"group1,group2"}}
+	rr := testUserRequest(&state, "user3", "POST", setManagersPath, state.setGroupManagersHandler, formValues)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("set managers without grant returned %d", rr.Code)
+	}
+	err = insertPermissionEntry("group2", "group3", resourceGroup, permOwnership, false, &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// user3 is a member of group2, adding it needs no transfer.
+	rr = testUserRequest(&state, "user3", "POST", setManagersPath, state.setGroupManagersHandler, formValues)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("set managers returned %d: %s", rr.Code, rr.Body.String())
+	}
+	formValues = url.Values{"groupname": {"group3"}, "managers": {"group1,group2,user:user2"}}
+	rr = testUserRequest(&state, "user3", "POST", setManagersPath, state.setGroupManagersHandler, formValues)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("adding another user as manager returned %d", rr.Code)
+	}
+	formValues = url.Values{"groupname": {"group3"}, "managers": {"group2, user:nobody"}}
+	rr = testUserRequest(&state, "user1", "POST", setManagersPath, state.setGroupManagersHandler, formValues)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("unknown user manager returned %d", rr.Code)
+	}
+	formValues = url.Values{"groupname": {"group2"}, "managers": {"group3"}}
+	rr = testUserRequest(&state, "user1", "POST", setManagersPath, state.setGroupManagersHandler, formValues)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("manager cycle returned %d", rr.Code)
+	}
+	formValues = url.Values{"groupname": {"group3"}, "managers": {"group2, user:user2"}}
+	rr = testUserRequest(&state, "user1", "POST", setManagersPath, state.setGroupManagersHandler, formValues)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("set managers by admin returned %d", rr.Code)
+	}
+	managers, err := state.Userinfo.GetGroupManagers("group3")
+	if err != nil || !reflect.DeepEqual(managers, []string{"group2", "user:user2"}) {
+		t.Fatalf("bad managers of group3 %v err=%v", managers, err)
+	}
+	for _, username := range []string{"user2", "user3"} {
+		isManager, err := state.Userinfo.IsgroupAdminorNot(username, "group3")
+		if err != nil || !isManager {
+			t.Fatalf("%s should manage group3, err=%v", username, err)
+		}
+	}
+
+	err = insertRequestInDB("user3", []string{"group3"}, &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deleteEntryInDB("user3", "group3", &state)
+	// user2 is only a manager through its user entry.
+	actions, err := state.getUserPendingActionsNonCached("user2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, action := range actions {
+		if action[0] == "user3" && action[1] == "group3" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("request of user3 missing from pending actions %v", actions)
+	}
+}
@@ -1,20 +1,32 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
+	"path"
+	"regexp"
 	"sort"
 	"strings"
+	"sync"
+
+	"github.com/Symantec/ldap-group-management/lib/userinfo"
 )
 
 var checkPermissionStmt = map[string]string{
-	"sqlite":   "select groupname, resource from permissions where (resource=? or resource='*' or resource LIKE ?) and resource_type=? and (permission&?=?);",
-	"postgres": "select groupname, resource from permissions where (resource=$1 or resource='*' or resource LIKE $2) and resource_type=$3 and (permission&$4=$5);",
+	"sqlite":   "select id, groupname, resource, permission, deny_permission from permissions where resource_type=? order by id;",
+	"postgres": "select id, groupname, resource, permission, deny_permission from permissions where resource_type=$1 order by id;",
 }
 
 const (
 	permCreate = 1 << iota
 	permUpdate
 	permDelete
+	permMembership
+	permOwnership
+	permView
 )
 
 const (
@@ -22,23 +34,70 @@ const (
 	resourceSVC
 )
 
+// Resources starting with this prefix are regular expressions, anything
+// else is a glob.
+const resourceRegexpPrefix = "^"
+
+type permissionRule struct {
+	ID             int64
+	Groupname      string
+	Resource       string
+	Permission     int
+	DenyPermission int
+}
+
+type permissionDecision struct {
+	Allowed bool
+	Reason  string
+	Rule    *permissionRule `json:",omitempty"`
+}
+
+var resourceRegexpCache sync.Map
+
+func compileResourceRegexp(resource string) (*regexp.Regexp, error) {
+	if cached, ok := resourceRegexpCache.Load(resource); ok {
+		return cached.(*regexp.Regexp), nil
+	}
+	// Regexps always have to match the whole resource name.
+	expression := strings.TrimSuffix(strings.TrimPrefix(resource, resourceRegexpPrefix), "$")
+	re, err := regexp.Compile("^(?:" + expression + ")$")
+	if err != nil {
+		return nil, err
+	}
+	resourceRegexpCache.Store(resource, re)
+	return re, nil
+}
+
+// validateResourcePattern reports malformed globs and regexps before they
+// are stored.
+func validateResourcePattern(resource string) error {
+	if len(resource) < 1 {
+		return errors.New("resource name is empty")
+	}
+	if strings.HasPrefix(resource, resourceRegexpPrefix) {
+		_, err := compileResourceRegexp(resource)
+		return err
+	}
+	_, err := path.Match(resource, "")
+	return err
+}
+
+// checkResourceMatch reports whether input matches resource, which is either
+// an anchored regexp (^...) or a glob supporting *, ? and [...] anywhere.
 func checkResourceMatch(resource, input string) (bool, error) {
-	if strings.HasSuffix(resource, "*") {
-		if len(resource) == 1 {
-			return true, nil
-		}
-		resource = resource[:len(resource)-1]
-		if strings.HasPrefix(input, resource) {
-			return true, nil
+	if strings.HasPrefix(resource, resourceRegexpPrefix) {
+		re, err := compileResourceRegexp(resource)
+		if err != nil {
+			return false, err
 		}
+		return re.MatchString(input), nil
 	}
-	if resource == input {
-		return true, nil
-	}
-	return false, nil
+	return path.Match(resource, input)
 }
 
-func getPermittedGroups(resources string, resource_type, permission int, state *RuntimeState) ([]string, error) {
+// getMatchingPermissionRules returns every rule of resource_type whose
+// resource pattern matches resources, in creation order.
+func getMatchingPermissionRules(resources string, resource_type int, state *RuntimeState) ([]permissionRule, error) {
 	stmtText := checkPermissionStmt[state.dbType]
 	stmt, err := state.db.Prepare(stmtText)
 	if err != nil {
@@ -47,80 +106,193 @@ func getPermittedGroups(resources string, resource_type, permission int, state *
 	}
 	defer stmt.Close()
 
-	var groupnames []string
-
-	firstLetter := resources[:1]
-	rows, err := stmt.Query(resources, firstLetter+"%", resource_type, permission, permission)
+	rows, err := stmt.Query(resource_type)
 	if err != nil {
-		if err.Error() == "sql: no rows in result set" {
-			log.Println("No rows found")
-			return nil, err
-		} else {
-			log.Println(err)
-			return nil, err
-
-		}
+		log.Println(err)
+		return nil, err
 	}
 	defer rows.Close()
 
+	var rules []permissionRule
 	for rows.Next() {
-		var groupName string
-		var resourceName string
-		err = rows.Scan(&groupName, &resourceName)
+		var rule permissionRule
+		err = rows.Scan(&rule.ID, &rule.Groupname, &rule.Resource, &rule.Permission, &rule.DenyPermission)
 		if err != nil {
 			log.Println(err)
 			return nil, err
 		}
-		match, err := checkResourceMatch(resourceName, resources)
+		match, err := checkResourceMatch(rule.Resource, resources)
 		if err != nil {
-			log.Println(err)
-			return nil, err
+			// A single bad pattern should not break every permission check.
+			log.Printf("skipping permission %d with bad resource %q: %s", rule.ID, rule.Resource, err)
+			continue
 		}
-
 		if match {
-			groupnames = append(groupnames, groupName)
+			rules = append(rules, rule)
 		}
 	}
-	return groupnames, nil
+	return rules, rows.Err()
 }
 
-func (state *RuntimeState) canPerformAction(username, resources string, resource_type, permission int) (bool, error) {
-	if state.Userinfo.UserisadminOrNot(username) {
-		return true, nil
+// decidePermission applies the rules of the groups a user belongs to: a deny
+// of any requested bit wins over every allow, otherwise a single rule has to
+// allow all the requested bits.
+func decidePermission(rules []permissionRule, isMember func(groupname string) bool, permission int) permissionDecision {
+	for i, rule := range rules {
+		if rule.DenyPermission&permission != 0 && isMember(rule.Groupname) {
+			return permissionDecision{
+				Reason: fmt.Sprintf("denied by rule %d for group %s on %s", rule.ID, rule.Groupname, rule.Resource),
+				Rule:   &rules[i],
+			}
+		}
+	}
+	for i, rule := range rules {
+		if rule.Permission&permission == permission && isMember(rule.Groupname) {
+			return permissionDecision{
+				Allowed: true,
+				Reason:  fmt.Sprintf("allowed by rule %d for group %s on %s", rule.ID, rule.Groupname, rule.Resource),
+				Rule:    &rules[i],
+			}
+		}
 	}
+	return permissionDecision{Reason: "no rule grants this permission"}
+}
 
-	groups, err := getPermittedGroups(resources, resource_type, permission, state)
+// explainAction works out whether username may perform permission on a
+// resource and which rule decided it. Deny rules win over roles.
+func (state *RuntimeState) explainAction(r *http.Request, username, resources string, resource_type, permission int) (permissionDecision, error) {
+	if state.isAdmin(r, username) {
+		return permissionDecision{Allowed: true, Reason: "user is an admin"}, nil
+	}
+	if state.isPrivilegedAction(resources, resource_type, permission) {
+		return permissionDecision{Reason: "only admins can change a group granting admin rights or a role"}, nil
+	}
+	rules, err := getMatchingPermissionRules(resources, resource_type, state)
 	if err != nil {
-		return false, err
+		return permissionDecision{}, err
 	}
-
-	if len(groups) < 1 {
-		return false, nil
+	decision := permissionDecision{Reason: "no rule matches this resource"}
+	if len(rules) > 0 {
+		groupsOfUser, err := state.Userinfo.GetgroupsofUser(username)
+		if err != nil {
+			return permissionDecision{}, err
+		}
+		sort.Strings(groupsOfUser)
+		isMember := func(group string) bool {
+			index := sort.SearchStrings(groupsOfUser, group)
+			return index < len(groupsOfUser) && groupsOfUser[index] == group
+		}
+		decision = decidePermission(rules, isMember, permission)
+		if decision.Rule != nil {
+			return decision, nil
+		}
 	}
-	groupsOfUser, err := state.Userinfo.GetgroupsofUser(username)
+	role, err := state.roleGrantingPermission(r, username, resources, resource_type, permission)
+	if err != nil {
+		return permissionDecision{}, err
+	}
+	if role != "" {
+		return permissionDecision{Allowed: true, Reason: "granted by role " + role}, nil
+	}
+	return decision, nil
+}
+
+func (state *RuntimeState) canPerformAction(r *http.Request, username, resources string, resource_type, permission int) (bool, error) {
+	decision, err := state.explainAction(r, username, resources, resource_type, permission)
 	if err != nil {
 		return false, err
 	}
-	sort.Strings(groupsOfUser)
+	return decision.Allowed, nil
+}
 
-	for _, group := range groups {
-		var index int
-		index = sort.SearchStrings(groupsOfUser, group)
-		if index < len(groupsOfUser) && groupsOfUser[index] == group {
-			return true, nil
+// canManageMembership reports whether username may add or remove members of
+// groupname, either as one of its managers or through a membership grant.
+func (state *RuntimeState) canManageMembership(r *http.Request, username, groupname string) (bool, error) {
+	isGroupAdmin, err := state.isGroupAdmin(r, username, groupname)
+	if err != nil || isGroupAdmin {
+		return isGroupAdmin, err
+	}
+	return state.canPerformAction(r, username, groupname, resourceGroup, permMembership)
+}
+
+// canChangeOwnership accepts the older update grants as well so existing
+// permissions keep working.
+func (state *RuntimeState) canChangeOwnership(r *http.Request, username, groupname string) (bool, error) {
+	allow, err := state.canPerformAction(r, username, groupname, resourceGroup, permOwnership)
+	if err != nil || allow {
+		return allow, err
+	}
+	return state.canPerformAction(r, username, groupname, resourceGroup, permUpdate)
+}
+
+// isHiddenGroup reports whether groupname matches one of the hidden_groups
+// patterns of the configuration.
+func (state *RuntimeState) isHiddenGroup(groupname string) bool {
+	for _, pattern := range state.currentConfig().HiddenGroups {
+		match, err := checkResourceMatch(pattern, groupname)
+		if err != nil {
+			log.Printf("bad hidden_groups pattern %q: %s", pattern, err)
+			continue
+		}
+		if match {
+			return true
 		}
-		continue
 	}
+	return false
+}
+
+// newGroupViewFilter returns a function telling whether username may see a
+// group. Hidden groups are only visible to admins, to their members and
+// managers, and to holders of the view permission.
+func (state *RuntimeState) newGroupViewFilter(r *http.Request, username string) (func(groupname string) (bool, error), error) {
+	if len(state.currentConfig().HiddenGroups) < 1 || state.isAdmin(r, username) {
+		return func(string) (bool, error) { return true, nil }, nil
+	}
+	userGroups, err := state.Userinfo.GetgroupsofUser(username)
+	if err != nil {
+		return nil, err
+	}
+	isMember := make(map[string]bool)
+	for _, group := range userGroups {
+		isMember[group] = true
+	}
+	return func(groupname string) (bool, error) {
+		if isMember[groupname] || !state.isHiddenGroup(groupname) {
+			return true, nil
+		}
+		managers, err := state.Userinfo.GetGroupManagers(groupname)
+		if err != nil {
+			return false, err
+		}
+		for _, manager := range managers {
+			if managerUser, ok := userinfo.ManagerUsername(manager); ok && managerUser == username {
+				return true, nil
+			}
+			if isMember[manager] {
+				return true, nil
+			}
+		}
+		return state.canPerformAction(r, username, groupname, resourceGroup, permView)
+	}, nil
+}
 
-	return false, nil
+func (state *RuntimeState) canViewGroup(r *http.Request, username, groupname string) (bool, error) {
+	canView, err := state.newGroupViewFilter(r, username)
+	if err != nil {
+		return false, err
+	}
+	return canView(groupname)
 }
 
 var insertPermissionStmt = map[string]string{
-	"sqlite":   "insert into permissions(groupname, resource_type, resource, permission) values (?,?,?,?);",
-	"postgres": "insert into permissions(groupname, resource_type, resource, permission) values ($1, $2, $3, $4);",
+	"sqlite":   "insert into permissions(groupname, resource_type, resource, permission, deny_permission) values (?,?,?,?,?);",
+	"postgres": "insert into permissions(groupname, resource_type, resource, permission, deny_permission) values ($1, $2, $3, $4, $5);",
 }
 
-func insertPermissionEntry(groupname, resource string, resource_type, permission int, state *RuntimeState) error {
+// insertPermissionEntry adds allow (or deny) bits to the grant of a group on
+// a resource. The same bits are dropped from the opposite mask, the latest
+// decision for a group wins.
+func insertPermissionEntry(groupname, resource string, resource_type, permission int, deny bool, state *RuntimeState) error {
 	stmtText := insertPermissionStmt[state.dbType]
 	stmt, err := state.db.Prepare(stmtText)
 	if err != nil {
@@ -129,14 +301,20 @@ func insertPermissionEntry(groupname, resource string, resource_type, permission
 		return err
 	}
 	defer stmt.Close()
-	exists, oldPerm := permExistsOrNot(groupname, resource, resource_type, state)
+	allowPerm, denyPerm := permission, 0
+	if deny {
+		allowPerm, denyPerm = 0, permission
+	}
+	exists, oldPerm, oldDenyPerm := permExistsOrNot(groupname, resource, resource_type, state)
 	if exists {
-		if oldPerm&permission == permission {
+		newPerm := (oldPerm | allowPerm) &^ denyPerm
+		newDenyPerm := (oldDenyPerm | denyPerm) &^ allowPerm
+		if newPerm == oldPerm && newDenyPerm == oldDenyPerm {
 			return nil
 		}
-		return updatePermissionEntry(groupname, resource, oldPerm+permission, resource_type, state)
+		return updatePermissionEntry(groupname, resource, newPerm, newDenyPerm, resource_type, state)
 	}
-	_, err = stmt.Exec(groupname, resource_type, resource, permission)
+	_, err = stmt.Exec(groupname, resource_type, resource, allowPerm, denyPerm)
 	if err != nil {
 		return err
 	}
@@ -144,48 +322,48 @@ func insertPermissionEntry(groupname, resource string, resource_type, permission
 }
 
 var permExistsorNotStmt = map[string]string{
-	"sqlite":   "select permission from permissions where groupname=? and resource_type=? and resource=?;",
-	"postgres": "select permission from permissions where groupname=$1 and resource_type=$2 and resource=$3;",
+	"sqlite":   "select permission, deny_permission from permissions where groupname=? and resource_type=? and resource=?;",
+	"postgres": "select permission, deny_permission from permissions where groupname=$1 and resource_type=$2 and resource=$3;",
 }
 
-func permExistsOrNot(groupname, resource string, resource_type int, state *RuntimeState) (bool, int) {
+func permExistsOrNot(groupname, resource string, resource_type int, state *RuntimeState) (bool, int, int) {
 	stmtText := permExistsorNotStmt[state.dbType]
 	stmt, err := state.db.Prepare(stmtText)
 	if err != nil {
 		log.Print("Error Preparing statement" + stmtText)
 		log.Fatal(err)
-		return false, 0
+		return false, 0, 0
 	}
 	defer stmt.Close()
 	rows, err := stmt.Query(groupname, resource_type, resource)
 	if err != nil {
 		if err.Error() == "sql: no rows in result set" {
 			log.Printf("err='%s'", err)
-			return false, 0
+			return false, 0, 0
 		} else {
 			log.Printf("Problem with db ='%s'", err)
-			return false, 0
+			return false, 0, 0
 		}
 	}
 
 	defer rows.Close()
 	if rows.Next() {
-		var oldPerm int
-		err = rows.Scan(&oldPerm)
+		var oldPerm, oldDenyPerm int
+		err = rows.Scan(&oldPerm, &oldDenyPerm)
 		if err != nil {
-			return true, 0
+			return true, 0, 0
 		}
-		return true, oldPerm
+		return true, oldPerm, oldDenyPerm
 	}
-	return false, 0
+	return false, 0, 0
 }
 
 var updatePermissionStmt = map[string]string{
-	"sqlite":   "update permissions set permission=? where groupname=? and resource_type=? and resource=?;",
-	"postgres": "update permissions set permission=$1 where groupname=$2 and resource_type=$3 and resource=$4;",
+	"sqlite":   "update permissions set permission=?, deny_permission=? where groupname=? and resource_type=? and resource=?;",
+	"postgres": "update permissions set permission=$1, deny_permission=$2 where groupname=$3 and resource_type=$4 and resource=$5;",
 }
 
-func updatePermissionEntry(groupname, resource string, permission, resource_type int, state *RuntimeState) error {
+func updatePermissionEntry(groupname, resource string, permission, denyPermission, resource_type int, state *RuntimeState) error {
 	stmtText := updatePermissionStmt[state.dbType]
 	stmt, err := state.db.Prepare(stmtText)
 	if err != nil {
@@ -194,9 +372,220 @@ func updatePermissionEntry(groupname, resource string, permission, resource_type
 		return err
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(permission, groupname, resource_type, resource)
+	_, err = stmt.Exec(permission, denyPermission, groupname, resource_type, resource)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+type permissionEntry struct {
+	ID              int64
+	Groupname       string
+	ResourceType    string
+	Resource        string
+	Permission      int
+	Permissions     []string
+	DenyPermission  int
+	DenyPermissions []string
+	Holders         []string `json:",omitempty"`
+}
+
+// permissionNames lists names in bit order so the output is stable.
+var permissionNames = []string{"create", "update", "delete", "membership", "ownership", "view"}
+
+func permissionBitsToNames(permission int) []string {
+	var names []string
+	for _, name := range permissionNames {
+		if permission&permissionMapping[name] != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func resourceTypeToName(resourceType int) string {
+	for name, value := range resourceMapping {
+		if value == resourceType {
+			return name
+		}
+	}
+	return fmt.Sprint(resourceType)
+}
+
+// parsePermissionNames turns a comma separated list of permission names
+// into a bitmask, an empty list gives 0.
+func parsePermissionNames(permissionList string) (int, error) {
+	var permissions int
+	for _, permission := range strings.Split(permissionList, ",") {
+		permission = strings.TrimSpace(permission)
+		if len(permission) < 1 {
+			continue
+		}
+		permVal, ok := permissionMapping[permission]
+		if !ok {
+			return 0, fmt.Errorf("%s permission does not exist", permission)
+		}
+		permissions |= permVal
+	}
+	return permissions, nil
+}
+
+var listPermissionsStmt = map[string]string{
+	"sqlite":   "select id, groupname, resource_type, resource, permission, deny_permission from permissions order by groupname, resource_type, resource;",
+	"postgres": "select id, groupname, resource_type, resource, permission, deny_permission from permissions order by groupname, resource_type, resource;",
+}
+
+// listPermissionEntries returns the permission grants matching the filters,
+// empty filters match everything. A resource filter matches the grants that
+// apply to that resource, including wildcard ones.
+func listPermissionEntries(groupname string, resourceType int, resource string, state *RuntimeState) ([]permissionEntry, error) {
+	stmtText := listPermissionsStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query()
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []permissionEntry{}
+	for rows.Next() {
+		var entry permissionEntry
+		var entryResourceType int
+		err = rows.Scan(&entry.ID, &entry.Groupname, &entryResourceType, &entry.Resource, &entry.Permission, &entry.DenyPermission)
+		if err != nil {
+			log.Println(err)
+			return nil, err
+		}
+		if groupname != "" && entry.Groupname != groupname {
+			continue
+		}
+		if resourceType != 0 && entryResourceType != resourceType {
+			continue
+		}
+		if resource != "" && entry.Resource != resource {
+			match, err := checkResourceMatch(entry.Resource, resource)
+			if err != nil {
+				return nil, err
+			}
+			if !match {
+				continue
+			}
+		}
+		entry.ResourceType = resourceTypeToName(entryResourceType)
+		entry.Permissions = permissionBitsToNames(entry.Permission)
+		entry.DenyPermissions = permissionBitsToNames(entry.DenyPermission)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+var getPermissionByIDStmt = map[string]string{
+	"sqlite":   "select groupname, resource_type, resource, permission, deny_permission from permissions where id=?;",
+	"postgres": "select groupname, resource_type, resource, permission, deny_permission from permissions where id=$1;",
+}
+
+func getPermissionEntryByID(id int64, state *RuntimeState) (*permissionEntry, error) {
+	stmtText := getPermissionByIDStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return nil, err
+	}
+	defer stmt.Close()
+	entry := permissionEntry{ID: id}
+	var resourceType int
+	err = stmt.QueryRow(id).Scan(&entry.Groupname, &resourceType, &entry.Resource, &entry.Permission, &entry.DenyPermission)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		log.Println(err)
+		return nil, err
+	}
+	entry.ResourceType = resourceTypeToName(resourceType)
+	entry.Permissions = permissionBitsToNames(entry.Permission)
+	entry.DenyPermissions = permissionBitsToNames(entry.DenyPermission)
+	return &entry, nil
+}
+
+var updatePermissionByIDStmt = map[string]string{
+	"sqlite":   "update permissions set permission=?, deny_permission=? where id=?;",
+	"postgres": "update permissions set permission=$1, deny_permission=$2 where id=$3;",
+}
+
+func updatePermissionEntryByID(id int64, permission, denyPermission int, state *RuntimeState) error {
+	stmtText := updatePermissionByIDStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(permission, denyPermission, id)
+	return err
+}
+
+var deletePermissionByIDStmt = map[string]string{
+	"sqlite":   "delete from permissions where id=?;",
+	"postgres": "delete from permissions where id=$1;",
+}
+
+func deletePermissionEntryByID(id int64, state *RuntimeState) error {
+	stmtText := deletePermissionByIDStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(id)
+	return err
+}
+
+// getPermissionHolders returns the users who hold a permission on a resource
+// through a grant to one of their groups, taking deny rules into account.
+// Admins hold every permission and are not listed.
+func (state *RuntimeState) getPermissionHolders(resource string, resourceType, permission int) ([]string, error) {
+	rules, err := getMatchingPermissionRules(resource, resourceType, state)
+	if err != nil {
+		return nil, err
+	}
+	groupMembers := make(map[string]map[string]bool)
+	candidates := make(map[string]bool)
+	for _, rule := range rules {
+		memberSet, ok := groupMembers[rule.Groupname]
+		if !ok {
+			members, _, err := state.Userinfo.GetusersofaGroup(rule.Groupname)
+			if err != nil && err != userinfo.GroupDoesNotExist {
+				return nil, err
+			}
+			memberSet = make(map[string]bool)
+			for _, member := range members {
+				memberSet[member] = true
+			}
+			groupMembers[rule.Groupname] = memberSet
+		}
+		if rule.Permission&permission != permission {
+			continue
+		}
+		for member := range memberSet {
+			candidates[member] = true
+		}
+	}
+	holders := []string{}
+	for candidate := range candidates {
+		isMember := func(group string) bool { return groupMembers[group][candidate] }
+		if decidePermission(rules, isMember, permission).Allowed {
+			holders = append(holders, candidate)
+		}
+	}
+	sort.Strings(holders)
+	return holders, nil
+}
@@ -1,6 +1,14 @@
 package main
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -10,8 +18,8 @@ const (
 	input           = "group3"
 )
 
-var resourcesAllow = []string{"*", "group3*"}
-var resourcesDeny = []string{"group2", "group33", "group33*"}
+var resourcesAllow = []string{"*", "group3*", "gr*p3", "group?", "group[0-9]", "^group\\d+$", "^gr.up3"}
+var resourcesDeny = []string{"group2", "group33", "group33*", "*4", "^group", "^roup3", "^group3.+"}
 
 type resourcePerm struct {
 	resourceType int
@@ -33,7 +41,7 @@ func TestCanPerformAction(t *testing.T) {
 	}
 
 	for _, item := range resourcePermList {
-		allow, err := state.canPerformAction(userWithPerm, item.resource, item.resourceType, item.permission)
+		allow, err := state.canPerformAction(nil, userWithPerm, item.resource, item.resourceType, item.permission)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -41,7 +49,7 @@ func TestCanPerformAction(t *testing.T) {
 			t.Errorf("got %v want %v", allow, true)
 		}
 
-		allow, err = state.canPerformAction(userWithoutPerm, item.resource, item.resourceType, item.permission)
+		allow, err = state.canPerformAction(nil, userWithoutPerm, item.resource, item.resourceType, item.permission)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -73,3 +81,378 @@ func TestCheckResourceMatch(t *testing.T) {
 		}
 	}
 }
+
+func TestListPermissionEntries(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := listPermissionEntries("group2", 0, "", &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 grants got %+v", entries)
+	}
+	entries, err = listPermissionEntries("", resourceGroup, "group1", &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ResourceType != "group" ||
+		!reflect.DeepEqual(entries[0].Permissions, []string{"create", "update", "delete"}) {
+		t.Fatalf("bad group1 grants %+v", entries)
+	}
+	entries, err = listPermissionEntries("group1", 0, "", &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("group1 should not have grants %+v", entries)
+	}
+}
+
+func TestPermissionsListHandler(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", permissionsListPath+"?resourceType=group&resource=group1&permission=delete", nil)
+	cookie := testCreateValidAdminCookie(state.authenticator)
+	req.AddCookie(&cookie)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(state.permissionsListHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var pageData permissionsPageData
+	err = json.Unmarshal(rr.Body.Bytes(), &pageData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pageData.Permissions) != 1 || !reflect.DeepEqual(pageData.Permissions[0].Holders, []string{"user1", "user3"}) {
+		t.Fatalf("bad grants %+v", pageData.Permissions)
+	}
+	if !pageData.HasEffectiveHolders || !reflect.DeepEqual(pageData.EffectiveHolders, []string{"user1", "user3"}) {
+		t.Fatalf("bad effective holders %+v", pageData.EffectiveHolders)
+	}
+
+	req = httptest.NewRequest("GET", permissionsListPath+"?groupname=group2", nil)
+	req.Header.Set("Accept", "text/html")
+	req.AddCookie(&cookie)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(state.permissionsListHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "new_svc_account") {
+		t.Fatalf("bad html page %v", rr.Code)
+	}
+
+	req = httptest.NewRequest("GET", permissionsListPath, nil)
+	cookie = testCreateValidCookie(state.authenticator)
+	req.AddCookie(&cookie)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(state.permissionsListHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("non admin got %v", rr.Code)
+	}
+}
+
+func testPermissionPost(state *RuntimeState, path string, handler http.HandlerFunc, formValues url.Values) int {
+	req := httptest.NewRequest("POST", path, strings.NewReader(formValues.Encode()))
+	cookie := testCreateValidAdminCookie(state.authenticator)
+	req.AddCookie(&cookie)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func TestPermissionEditAndDeleteHandlers(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := listPermissionEntries("group2", resourceGroup, "group1", &state)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("bad grants %+v err=%v", entries, err)
+	}
+	id := strconv.FormatInt(entries[0].ID, 10)
+
+	for _, formValues := range []url.Values{
+		{"id": {id}, "permissions": {"create,fly"}},
+		{"id": {id}, "permissions": {""}},
+		{"id": {"999999"}, "permissions": {"create"}},
+	} {
+		if code := testPermissionPost(&state, permissionsEditPath, state.permissionEditHandler, formValues); code != http.StatusBadRequest {
+			t.Fatalf("edit %v returned %v", formValues, code)
+		}
+	}
+	code := testPermissionPost(&state, permissionsEditPath, state.permissionEditHandler,
+		url.Values{"id": {id}, "permissions": {"update"}})
+	if code != http.StatusOK {
+		t.Fatalf("edit returned %v", code)
+	}
+	allow, err := state.canPerformAction(nil, userWithPerm, "group1", resourceGroup, permDelete)
+	if err != nil || allow {
+		t.Fatalf("delete permission should have been removed, err=%v", err)
+	}
+	allow, err = state.canPerformAction(nil, userWithPerm, "group1", resourceGroup, permUpdate)
+	if err != nil || !allow {
+		t.Fatalf("update permission should remain, err=%v", err)
+	}
+
+	code = testPermissionPost(&state, permissionsDeletePath, state.permissionDeleteHandler, url.Values{"ids": {id + ",999999"}})
+	if code != http.StatusBadRequest {
+		t.Fatalf("delete with unknown id returned %v", code)
+	}
+	code = testPermissionPost(&state, permissionsDeletePath, state.permissionDeleteHandler, url.Values{"ids": {id}})
+	if code != http.StatusOK {
+		t.Fatalf("delete returned %v", code)
+	}
+	entry, err := getPermissionEntryByID(entries[0].ID, &state)
+	if err != nil || entry != nil {
+		t.Fatalf("grant was not deleted %+v err=%v", entry, err)
+	}
+}
+
+func TestPermissionManageDuplicatePermissions(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := testPermissionPost(&state, permissionmanagePath, state.permissionManageHandler,
+		url.Values{"groupname": {"group1"}, "resourceType": {"group"}, "resourceName": {"foo"}, "permissions": {"view,view"}})
+	if code != http.StatusOK {
+		t.Fatalf("grant returned %v", code)
+	}
+	entries, err := listPermissionEntries("group1", resourceGroup, "foo", &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !reflect.DeepEqual(entries[0].Permissions, []string{"view"}) {
+		t.Fatalf("repeated permission changed the grant %+v", entries)
+	}
+}
+
+func TestValidateResourcePattern(t *testing.T) {
+	for _, resource := range []string{"", "group[", "^group(", "[]a]x["} {
+		if err := validateResourcePattern(resource); err == nil {
+			t.Errorf("%q should be invalid", resource)
+		}
+	}
+	for _, resource := range append(resourcesAllow, resourcesDeny...) {
+		if err := validateResourcePattern(resource); err != nil {
+			t.Errorf("%q should be valid: %s", resource, err)
+		}
+	}
+}
+
+func TestDenyRulesOverrideAllows(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = insertPermissionEntry("group2", "^group[0-9]$", resourceGroup, permDelete, true, &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decision, err := state.explainAction(nil, userWithPerm, "group1", resourceGroup, permDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Allowed || decision.Rule == nil || decision.Rule.Resource != "^group[0-9]$" {
+		t.Fatalf("deny rule should win %+v", decision)
+	}
+	decision, err = state.explainAction(nil, userWithPerm, "group1", resourceGroup, permUpdate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decision.Allowed || decision.Rule == nil || decision.Rule.Resource != "group1" {
+		t.Fatalf("update should still be allowed %+v", decision)
+	}
+	holders, err := state.getPermissionHolders("group1", resourceGroup, permDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(holders) != 0 {
+		t.Fatalf("denied users should not hold the permission %v", holders)
+	}
+
+	// Allowing the same bits again on the same grant replaces the deny.
+	err = insertPermissionEntry("group2", "^group[0-9]$", resourceGroup, permDelete, false, &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allow, err := state.canPerformAction(nil, userWithPerm, "group1", resourceGroup, permDelete)
+	if err != nil || !allow {
+		t.Fatalf("delete should be allowed again, err=%v", err)
+	}
+	allow, err = state.canPerformAction(nil, userWithPerm, "group9", resourceGroup, permDelete)
+	if err != nil || !allow {
+		t.Fatalf("regexp grant should match group9, err=%v", err)
+	}
+}
+
+func TestPermissionTestHandler(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", permissionsTestPath+"?username=user3&resourceType=group&resource=foo&permission=create", nil)
+	cookie := testCreateValidAdminCookie(state.authenticator)
+	req.AddCookie(&cookie)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(state.permissionTestHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var pageData permissionTestPageData
+	err = json.Unmarshal(rr.Body.Bytes(), &pageData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pageData.Tested || !pageData.Decision.Allowed || pageData.Decision.Rule.Groupname != "group2" {
+		t.Fatalf("bad decision %+v", pageData.Decision)
+	}
+
+	req = httptest.NewRequest("GET", permissionsTestPath+"?username=user2&resourceType=group&resource=foo&permission=fly", nil)
+	req.AddCookie(&cookie)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(state.permissionTestHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("bad permission returned %v", rr.Code)
+	}
+}
+
+func testUserRequest(state *RuntimeState, username string, method string, target string,
+	handler http.HandlerFunc, formValues url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(formValues.Encode()))
+	cookie := testGenValidCookie(state.authenticator, username)
+	req.AddCookie(&cookie)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestMembershipPermission(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	formValues := url.Values{"groupname": {"group2"}, "members": {"user2"}}
+	rr := testUserRequest(&state, "user2", "POST", addmembersbuttonPath, state.addmemberstoExistingGroup, formValues)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("add members without grant returned %d", rr.Code)
+	}
+	// create/delete grants do not give access to the membership.
+	err = insertPermissionEntry("group1", "group*", resourceGroup, permCreate|permDelete, false, &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = testUserRequest(&state, "user2", "POST", addmembersbuttonPath, state.addmemberstoExistingGroup, formValues)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("add members with create grant returned %d", rr.Code)
+	}
+
+	err = insertPermissionEntry("group1", "group*", resourceGroup, permMembership, false, &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = testUserRequest(&state, "user2", "POST", addmembersbuttonPath, state.addmemberstoExistingGroup, formValues)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("add members with membership grant returned %d", rr.Code)
+	}
+	formValues = url.Values{"groupname": {"group2"}, "members": {"user3"}}
+	rr = testUserRequest(&state, "user2", "POST", deletemembersbuttonPath, state.deletemembersfromExistingGroup, formValues)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("delete members with membership grant returned %d", rr.Code)
+	}
+	members, _, err := state.Userinfo.GetusersofaGroup("group2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(members, []string{"user1", "user2"}) {
+		t.Fatalf("unexpected members of group2 %v", members)
+	}
+}
+
+func TestOwnershipPermission(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	formValues := url.Values{"groupnames": {"group3"}, "managegroup": {"group2"}}
+	rr := testUserRequest(&state, userWithPerm, "POST", changeownershipbuttonPath, state.changeownership, formValues)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("change owner without grant returned %d", rr.Code)
+	}
+	err = insertPermissionEntry("group2", "group3", resourceGroup, permOwnership, false, &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = testUserRequest(&state, userWithPerm, "POST", changeownershipbuttonPath, state.changeownership, formValues)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("change owner with ownership grant returned %d", rr.Code)
+	}
+	transfer, err := getOwnershipTransfer("group3", &state)
+	if err != nil || transfer == nil || transfer.ManageGroup != "group2" {
+		t.Fatalf("transfer of group3 was not recorded %+v err=%v", transfer, err)
+	}
+}
+
+func TestHiddenGroups(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Config.Base.HiddenGroups = []string{"group2"}
+
+	visibleGroups := func(username string) []string {
+		rr := testUserRequest(&state, username, "GET", getGroupsJSPath+"?type=all&encoding=json",
+			state.getGroupsJSHandler, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("getGroups.js returned %d", rr.Code)
+		}
+		var groupsJSON groupsJSONData
+		err := json.NewDecoder(rr.Body).Decode(&groupsJSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var groups []string
+		for _, groupTuple := range groupsJSON.Groups {
+			groups = append(groups, groupTuple[0])
+		}
+		sort.Strings(groups)
+		return groups
+	}
+	groupInfoCode := func(username string) int {
+		return testUserRequest(&state, username, "GET", groupinfoPath+"?groupname=group2",
+			state.groupInfoWebpage, nil).Code
+	}
+
+	if groups := visibleGroups("user2"); !reflect.DeepEqual(groups, []string{"group1", "group3"}) {
+		t.Fatalf("hidden group is listed %v", groups)
+	}
+	if code := groupInfoCode("user2"); code != http.StatusBadRequest {
+		t.Fatalf("group info of hidden group returned %d", code)
+	}
+	// Members and admins still see the group.
+	for _, username := range []string{"user1", "user3"} {
+		if groups := visibleGroups(username); len(groups) != 3 {
+			t.Fatalf("%s should see every group %v", username, groups)
+		}
+		if code := groupInfoCode(username); code != http.StatusOK {
+			t.Fatalf("group info for %s returned %d", username, code)
+		}
+	}
+
+	err = insertPermissionEntry("group1", "group2", resourceGroup, permView, false, &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups := visibleGroups("user2"); len(groups) != 3 {
+		t.Fatalf("view grant should show the hidden group %v", groups)
+	}
+	if code := groupInfoCode("user2"); code != http.StatusOK {
+		t.Fatalf("group info with view grant returned %d", code)
+	}
+}
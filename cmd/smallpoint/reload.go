@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/Symantec/ldap-group-management/lib/authn"
+)
+
+// The config, shared secrets and revocation list files are checked for
+// changes this often, a SIGHUP reloads them at once.
+const configCheckInterval = 30 * time.Second
+
+// keepStartupSettings copies into config the base settings which are only
+// used at startup, such as the listening address, and returns the names of
+// the ones which changed. Only the base section is reloaded, the openid,
+// saml and directory sections keep their startup values.
+func keepStartupSettings(config *AppConfigFile, current *AppConfigFile) []string {
+	startupSettings := []struct {
+		name    string
+		changed bool
+	}{
+		{"http_address", config.Base.HttpAddress != current.Base.HttpAddress},
+		{"tls_cert_filename", config.Base.TLSCertFilename != current.Base.TLSCertFilename},
+		{"tls_key_filename", config.Base.TLSKeyFilename != current.Base.TLSKeyFilename},
+		{"client_ca_filename", config.Base.ClientCAFilename != current.Base.ClientCAFilename},
+		{"storage_url", config.Base.StorageURL != current.Base.StorageURL},
+		{"log_directory", config.Base.LogDirectory != current.Base.LogDirectory},
+		{"directory_backend", config.Base.DirectoryBackend != current.Base.DirectoryBackend},
+		{"orphaned_groups_check_interval",
+			config.Base.OrphanedGroupsCheckInterval != current.Base.OrphanedGroupsCheckInterval},
+		{"event_delivery_interval", config.Base.EventDeliveryInterval != current.Base.EventDeliveryInterval},
+		{"mail_delivery_interval", config.Base.MailDeliveryInterval != current.Base.MailDeliveryInterval},
+		{"openid", config.OpenID != current.OpenID},
+		{"saml", config.SAML != current.SAML},
+	}
+	var changed []string
+	for _, setting := range startupSettings {
+		if setting.changed {
+			changed = append(changed, setting.name)
+		}
+	}
+	config.Base.HttpAddress = current.Base.HttpAddress
+	config.Base.TLSCertFilename = current.Base.TLSCertFilename
+	config.Base.TLSKeyFilename = current.Base.TLSKeyFilename
+	config.Base.ClientCAFilename = current.Base.ClientCAFilename
+	config.Base.StorageURL = current.Base.StorageURL
+	config.Base.LogDirectory = current.Base.LogDirectory
+	config.Base.DirectoryBackend = current.Base.DirectoryBackend
+	config.Base.OrphanedGroupsCheckInterval = current.Base.OrphanedGroupsCheckInterval
+	config.Base.EventDeliveryInterval = current.Base.EventDeliveryInterval
+	config.Base.MailDeliveryInterval = current.Base.MailDeliveryInterval
+	return changed
+}
+
+// reloadConfig reads the config and shared secrets files again. Everything is
+// validated and built before the running configuration is replaced, a bad
+// file leaves it untouched.
+func (state *RuntimeState) reloadConfig(configFilename string) error {
+	config, err := readConfigFile(configFilename)
+	if err != nil {
+		return err
+	}
+	if len(config.Base.ClusterSharedSecretFilename) > 1 {
+		config.Base.SharedSecrets, err = getClusterSecretsFile(config.Base.ClusterSharedSecretFilename)
+		if err != nil {
+			return err
+		}
+	}
+	sinks, err := state.newNotificationSinks(config.Base.NotificationSinks)
+	if err != nil {
+		return err
+	}
+	certificateMapper, err := authn.NewClientCertificateMapper(config.Base.ClientCertificateRules,
+		config.Base.ClientCRLFilenames)
+	if err != nil {
+		return err
+	}
+	for _, group := range config.Base.AutoGroups {
+		GroupExistsornot, _, err := state.Userinfo.GroupnameExistsornot(group)
+		if err != nil {
+			return err
+		}
+		if !GroupExistsornot {
+			return errors.New("Group " + group + " doesn't exist in CPE LDAP")
+		}
+	}
+
+	htmlTemplate, err := state.parseTemplates(config.Base.TemplatesPath)
+	if err != nil {
+		return err
+	}
+	emailTemplates, err := parseEmailTemplates(config.Base.TemplatesPath)
+	if err != nil {
+		return err
+	}
+	// Only reloads write the config, reading it here needs no lock.
+	for _, name := range keepStartupSettings(&config, &state.Config) {
+		log.Printf("config reload: %s changed, it takes effect after a restart", name)
+	}
+	// The secrets are the only part which can still be refused, nothing
+	// else has changed if they are.
+	if len(config.Base.SharedSecrets) > 0 {
+		err = state.authenticator.SetSharedSecrets(config.Base.SharedSecrets)
+		if err != nil {
+			return err
+		}
+	}
+	state.configMutex.Lock()
+	state.Config.Base = config.Base
+	state.htmlTemplate = htmlTemplate
+	state.emailTemplates = emailTemplates
+	state.notificationSinks = sinks
+	state.configMutex.Unlock()
+	state.authenticator.SetClientCertificateMapper(certificateMapper)
+	return nil
+}
+
+// currentConfig returns a copy of the base config, a reload replaces it
+// while requests and background tasks run.
+func (state *RuntimeState) currentConfig() baseConfig {
+	state.configMutex.RLock()
+	defer state.configMutex.RUnlock()
+	return state.Config.Base
+}
+
+// configModTimes returns the modification times of filenames, zero for the
+// missing ones.
+func configModTimes(filenames ...string) []time.Time {
+	modTimes := make([]time.Time, len(filenames))
+	for i, filename := range filenames {
+		if filename == "" {
+			continue
+		}
+		info, err := os.Stat(filename)
+		if err == nil {
+			modTimes[i] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// configReloadLoop reloads the configuration on SIGHUP and whenever the
+// config, shared secrets or revocation list files change.
+func (state *RuntimeState) configReloadLoop(configFilename string) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	watchedFiles := func() []time.Time {
+		config := state.currentConfig()
+		return configModTimes(append([]string{configFilename, config.ClusterSharedSecretFilename},
+			config.ClientCRLFilenames...)...)
+	}
+	modTimes := watchedFiles()
+	for {
+		select {
+		case <-hangup:
+		case <-time.After(configCheckInterval):
+			if reflect.DeepEqual(watchedFiles(), modTimes) {
+				continue
+			}
+		}
+		err := state.reloadConfig(configFilename)
+		if err != nil {
+			log.Printf("config reload failed, keeping the running configuration: %s", err)
+		} else {
+			log.Printf("config reloaded from %s", configFilename)
+		}
+		modTimes = watchedFiles()
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// Delegated roles. Each one is held by the members of the directory groups
+// listed for it under roles in the configuration, or of the identity provider
+// groups listed for it under idp_roles.
+const (
+	roleHelpdesk            = "helpdesk"
+	roleAuditor             = "auditor"
+	rolePermissionAdmin     = "permission-admin"
+	roleServiceAccountAdmin = "service-account-admin"
+)
+
+// roleAdmin can only be granted through idp_roles, the directory admins are
+// configured in the target backend.
+const roleAdmin = "admin"
+
+// Capabilities which are not about a directory resource.
+const (
+	capViewPermissions = 1 << iota
+	capManagePermissions
+	capExportGroups
+)
+
+var capabilityMapping = map[string]int{
+	"view_permissions":   capViewPermissions,
+	"manage_permissions": capManagePermissions,
+	"export_groups":      capExportGroups,
+}
+
+type roleDefinition struct {
+	// Grants holds the permissions a role has on every resource of a type.
+	Grants       map[int]int
+	Capabilities int
+}
+
+const permAll = permCreate | permUpdate | permDelete | permMembership | permOwnership | permView
+
+var roleDefinitions = map[string]roleDefinition{
+	roleHelpdesk: {
+		Grants: map[int]int{resourceGroup: permMembership | permView},
+	},
+	roleAuditor: {
+		Grants:       map[int]int{resourceGroup: permView, resourceSVC: permView},
+		Capabilities: capViewPermissions | capExportGroups,
+	},
+	rolePermissionAdmin: {
+		Capabilities: capViewPermissions | capManagePermissions,
+	},
+	roleServiceAccountAdmin: {
+		Grants: map[int]int{resourceSVC: permAll},
+	},
+}
+
+func validateRoles(roles map[string][]string) error {
+	for role, groups := range roles {
+		if _, ok := roleDefinitions[role]; !ok {
+			return fmt.Errorf("unknown role %s", role)
+		}
+		if len(groups) < 1 {
+			return fmt.Errorf("role %s has no groups", role)
+		}
+	}
+	return nil
+}
+
+func validateIdPRoles(roles map[string][]string) error {
+	delegatedRoles := make(map[string][]string)
+	for role, groups := range roles {
+		if role == roleAdmin {
+			if len(groups) < 1 {
+				return fmt.Errorf("role %s has no groups", role)
+			}
+			continue
+		}
+		delegatedRoles[role] = groups
+	}
+	return validateRoles(delegatedRoles)
+}
+
+// rolesOfGroups returns the roles of roleGroups held by a member of groups.
+func rolesOfGroups(roleGroups map[string][]string, groups []string) []string {
+	isMember := make(map[string]bool)
+	for _, group := range groups {
+		isMember[group] = true
+	}
+	roles := []string{}
+	for role, groups := range roleGroups {
+		for _, group := range groups {
+			if isMember[group] {
+				roles = append(roles, role)
+				break
+			}
+		}
+	}
+	return roles
+}
+
+// isMappedIdPGroup tells whether group grants a role, the other groups of
+// the identity provider are not kept in the auth cookie.
+func (state *RuntimeState) isMappedIdPGroup(group string) bool {
+	for _, groups := range state.currentConfig().IdPRoles {
+		for _, mappedGroup := range groups {
+			if mappedGroup == group {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type idpGroupsContextKey struct{}
+
+// requestIdPGroups holds the identity provider groups of the user a request
+// was authenticated as, once it is known.
+type requestIdPGroups struct {
+	username string
+	groups   []string
+}
+
+// withIdPGroups gives every request of handler a place to keep the identity
+// provider groups of its user.
+func withIdPGroups(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), idpGroupsContextKey{}, &requestIdPGroups{})
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// setIdPGroups records the identity provider groups username authenticated
+// with for the rest of r.
+func setIdPGroups(r *http.Request, username string, groups []string) {
+	idpGroups, ok := r.Context().Value(idpGroupsContextKey{}).(*requestIdPGroups)
+	if ok {
+		idpGroups.username = username
+		idpGroups.groups = groups
+	}
+}
+
+// getIdPRoles returns the roles username holds through the identity provider
+// groups it authenticated r with, admin included. Users other than the one
+// of r, and requests without one, hold none.
+func (state *RuntimeState) getIdPRoles(r *http.Request, username string) []string {
+	if r == nil {
+		return nil
+	}
+	idpRoles := state.currentConfig().IdPRoles
+	if len(idpRoles) < 1 {
+		return nil
+	}
+	idpGroups, ok := r.Context().Value(idpGroupsContextKey{}).(*requestIdPGroups)
+	if !ok || idpGroups.username != username || len(idpGroups.groups) < 1 {
+		return nil
+	}
+	return rolesOfGroups(idpRoles, idpGroups.groups)
+}
+
+// isAdmin accepts admins of the identity provider before asking the
+// directory, so they keep their access during a directory outage.
+func (state *RuntimeState) isAdmin(r *http.Request, username string) bool {
+	for _, role := range state.getIdPRoles(r, username) {
+		if role == roleAdmin {
+			return true
+		}
+	}
+	return state.Userinfo.UserisadminOrNot(username)
+}
+
+// getUserRoles returns the sorted names of the roles username holds through
+// its group memberships. Admins are not listed, they can do everything.
+func (state *RuntimeState) getUserRoles(r *http.Request, username string) ([]string, error) {
+	roles := []string{}
+	idpRoles := state.getIdPRoles(r, username)
+	if roleGroups := state.currentConfig().Roles; len(roleGroups) > 0 {
+		userGroups, err := state.Userinfo.GetgroupsofUser(username)
+		if err != nil {
+			if len(idpRoles) < 1 {
+				return nil, err
+			}
+			log.Printf("cannot get groups of %s, using identity provider roles only: %s", username, err)
+		}
+		roles = rolesOfGroups(roleGroups, userGroups)
+	}
+	for _, role := range idpRoles {
+		if role == roleAdmin {
+			continue
+		}
+		duplicate := false
+		for _, heldRole := range roles {
+			duplicate = duplicate || heldRole == role
+		}
+		if !duplicate {
+			roles = append(roles, role)
+		}
+	}
+	sort.Strings(roles)
+	return roles, nil
+}
+
+// privilegedGroups returns the groups whose members are admins or hold a
+// role.
+func (state *RuntimeState) privilegedGroups() []string {
+	groups := []string{state.adminGroupName()}
+	for _, roleGroups := range state.currentConfig().Roles {
+		groups = append(groups, roleGroups...)
+	}
+	return groups
+}
+
+// isPrivilegedGroup tells whether the members of groupname are admins or
+// hold a role.
+func (state *RuntimeState) isPrivilegedGroup(groupname string) bool {
+	for _, group := range state.privilegedGroups() {
+		if group == groupname {
+			return true
+		}
+	}
+	return false
+}
+
+// isPrivilegedAction tells whether permission on resources lets its holder
+// change a privileged group beyond viewing it. Only admins may, otherwise a
+// helpdesk member or a holder of a grant could make itself an admin.
+func (state *RuntimeState) isPrivilegedAction(resources string, resourceType, permission int) bool {
+	return resourceType == resourceGroup && permission&^permView != 0 && state.isPrivilegedGroup(resources)
+}
+
+// grantReachesPrivilegedGroup tells whether a grant of permission on the
+// resource pattern reaches a privileged group beyond viewing it, wildcards
+// and regular expressions included.
+func (state *RuntimeState) grantReachesPrivilegedGroup(resource string, resourceType, permission int) (bool, error) {
+	if resourceType != resourceGroup || permission&^permView == 0 {
+		return false, nil
+	}
+	for _, group := range state.privilegedGroups() {
+		if group == "" {
+			continue
+		}
+		match, err := checkResourceMatch(resource, group)
+		if err != nil || match {
+			return match, err
+		}
+	}
+	return false, nil
+}
+
+// requirePrivilegedGrantAdmin writes the error response and returns false
+// when username may not write or delete a grant of permission on resource.
+func (state *RuntimeState) requirePrivilegedGrantAdmin(w http.ResponseWriter, r *http.Request, username, resource string,
+	resourceType, permission int) bool {
+	privileged, err := state.grantReachesPrivilegedGroup(resource, resourceType, permission)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return false
+	}
+	if privileged && !state.isAdmin(r, username) {
+		http.Error(w, fmt.Sprintf("only admins can change grants of more than view on %s, it matches a group granting admin rights or a role",
+			resource), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// roleGrantingPermission returns the first role of username which grants
+// permission on every resource of resourceType, or an empty string.
+func (state *RuntimeState) roleGrantingPermission(r *http.Request, username, resources string, resourceType, permission int) (string, error) {
+	roles, err := state.getUserRoles(r, username)
+	if err != nil {
+		return "", err
+	}
+	for _, role := range roles {
+		if roleDefinitions[role].Grants[resourceType]&permission == permission {
+			return role, nil
+		}
+	}
+	return "", nil
+}
+
+func (state *RuntimeState) hasCapability(r *http.Request, username string, capability int) (bool, error) {
+	if state.isAdmin(r, username) {
+		return true, nil
+	}
+	roles, err := state.getUserRoles(r, username)
+	if err != nil {
+		return false, err
+	}
+	for _, role := range roles {
+		if roleDefinitions[role].Capabilities&capability == capability {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// requireCapability writes the error response and returns false when
+// username lacks capability.
+func (state *RuntimeState) requireCapability(w http.ResponseWriter, r *http.Request, username string, capability int) bool {
+	allowed, err := state.hasCapability(r, username, capability)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return false
+	}
+	if !allowed {
+		http.Error(w, "you are not authorized", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// userHasCapability is used by the templates to adapt pages to the roles of
+// the caller.
+func (state *RuntimeState) userHasCapability(r *http.Request, username string, capabilityName string) (bool, error) {
+	capability, ok := capabilityMapping[capabilityName]
+	if !ok {
+		return false, fmt.Errorf("unknown capability %s", capabilityName)
+	}
+	return state.hasCapability(r, username, capability)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Symantec/ldap-group-management/lib/authn"
+	"github.com/Symantec/ldap-group-management/lib/userinfo"
+)
+
+func TestValidateRoles(t *testing.T) {
+	err := validateRoles(map[string][]string{roleHelpdesk: {"group1"}, roleAuditor: {"group2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = validateRoles(map[string][]string{"superuser": {"group1"}})
+	if err == nil {
+		t.Fatal("unknown role should fail")
+	}
+	err = validateRoles(map[string][]string{roleHelpdesk: {}})
+	if err == nil {
+		t.Fatal("role without groups should fail")
+	}
+}
+
+func TestDelegatedRoles(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Config.Base.Roles = map[string][]string{
+		roleHelpdesk:        {"group1"},
+		roleAuditor:         {"group2"},
+		rolePermissionAdmin: {"group3"},
+	}
+	// The template functions are bound to the state they were loaded with.
+	err = state.loadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roles, err := state.getUserRoles(nil, "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(roles, []string{roleAuditor, roleHelpdesk, rolePermissionAdmin}) {
+		t.Fatalf("unexpected roles of user1 %v", roles)
+	}
+
+	// helpdesk manages the membership of any group.
+	err = state.Userinfo.CreateGroup(userinfo.GroupInfo{Groupname: "group4", Description: userinfo.SelfManaged,
+		MemberUid: []string{"user3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decision, err := state.explainAction(nil, "user2", "group4", resourceGroup, permMembership)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decision.Allowed || decision.Reason != "granted by role helpdesk" {
+		t.Fatalf("helpdesk should manage membership %+v", decision)
+	}
+	formValues := url.Values{"groupname": {"group4"}, "members": {"user2"}}
+	rr := testUserRequest(&state, "user2", "POST", addmembersbuttonPath, state.addmemberstoExistingGroup, formValues)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("helpdesk add members returned %d", rr.Code)
+	}
+	allow, err := state.canPerformAction(nil, "user2", "group4", resourceGroup, permDelete)
+	if err != nil || allow {
+		t.Fatalf("helpdesk must not delete groups, err=%v", err)
+	}
+
+	// but not of the admin group nor of the groups holding roles.
+	state.Config.TargetLDAP.AdminGroup = "group2"
+	for _, groupname := range []string{"group2", "group3"} {
+		allow, err = state.canPerformAction(nil, "user2", groupname, resourceGroup, permMembership)
+		if err != nil || allow {
+			t.Fatalf("helpdesk must not manage the membership of %s, err=%v", groupname, err)
+		}
+		allow, err = state.canPerformAction(nil, "user2", groupname, resourceGroup, permView)
+		if err != nil || !allow {
+			t.Fatalf("helpdesk should still view %s, err=%v", groupname, err)
+		}
+	}
+	rr = testUserRequest(&state, "user2", "POST", addmembersbuttonPath, state.addmemberstoExistingGroup,
+		url.Values{"groupname": {"group2"}, "members": {"user2"}})
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("helpdesk add members to the admin group returned %d", rr.Code)
+	}
+	state.Config.TargetLDAP.AdminGroup = ""
+
+	// Deny rules win over the role.
+	err = insertPermissionEntry("group1", "group4", resourceGroup, permMembership, true, &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decision, err = state.explainAction(nil, "user2", "group4", resourceGroup, permMembership)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Allowed || decision.Rule == nil {
+		t.Fatalf("deny rule should win over helpdesk %+v", decision)
+	}
+
+	// auditors can read the grants but not change them.
+	rr = testUserRequest(&state, "user3", "GET", permissionsListPath, state.permissionsListHandler, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("auditor permission list returned %d", rr.Code)
+	}
+	rr = testUserRequest(&state, "user3", "POST", permissionsDeletePath, state.permissionDeleteHandler,
+		url.Values{"ids": {"1"}})
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("auditor permission delete returned %d", rr.Code)
+	}
+	rr = testUserRequest(&state, "user2", "GET", permissionsListPath, state.permissionsListHandler, nil)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("helpdesk permission list returned %d", rr.Code)
+	}
+
+	// The sidebar follows the capabilities of the role.
+	req := httptest.NewRequest("GET", allLDAPgroupsPath, nil)
+	cookie := testGenValidCookie(state.authenticator, "user3")
+	req.AddCookie(&cookie)
+	req.Header.Set("Accept", "text/html")
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(state.allGroupsHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("all groups page returned %d", rr.Code)
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, "Permission Grants") || !strings.Contains(body, "Roles: auditor") {
+		t.Fatalf("auditor sidebar is missing links or roles:\n%s", body)
+	}
+	if strings.Contains(body, "Permission Management") {
+		t.Fatal("auditor sidebar should not link to permission management")
+	}
+}
+
+func TestPermissionAdminCannotPromoteItself(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// user3 is a permission admin through group2, group1 is the admin group.
+	state.Config.Base.Roles = map[string][]string{rolePermissionAdmin: {"group2"}}
+	state.Config.TargetLDAP.AdminGroup = "group1"
+
+	for _, resourceName := range []string{"*", "^.*", "group1", "group2"} {
+		rr := testUserRequest(&state, "user3", "POST", permissionmanagePath, state.permissionManageHandler,
+			url.Values{"groupname": {"group2"}, "resourceType": {"group"}, "resourceName": {resourceName},
+				"permissions": {"membership"}})
+		if rr.Code != http.StatusForbidden {
+			t.Fatalf("membership grant on %s returned %d", resourceName, rr.Code)
+		}
+	}
+	for _, formValues := range []url.Values{
+		{"groupname": {"group2"}, "resourceType": {"group"}, "resourceName": {"*"}, "permissions": {"view"}},
+		{"groupname": {"group2"}, "resourceType": {"group"}, "resourceName": {"group3"}, "permissions": {"membership"}},
+	} {
+		rr := testUserRequest(&state, "user3", "POST", permissionmanagePath, state.permissionManageHandler, formValues)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("grant %v returned %d", formValues, rr.Code)
+		}
+	}
+	entries, err := listPermissionEntries("group2", resourceGroup, "", &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var viewGrant string
+	for _, entry := range entries {
+		if entry.Resource == "*" {
+			viewGrant = strconv.FormatInt(entry.ID, 10)
+		}
+	}
+	rr := testUserRequest(&state, "user3", "POST", permissionsEditPath, state.permissionEditHandler,
+		url.Values{"id": {viewGrant}, "permissions": {"view,membership"}})
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("widening the grant on * returned %d", rr.Code)
+	}
+
+	// Grants written before the check do not help either.
+	err = insertPermissionEntry("group2", "*", resourceGroup, permMembership, false, &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = testUserRequest(&state, "user3", "POST", addmembersbuttonPath, state.addmemberstoExistingGroup,
+		url.Values{"groupname": {"group1"}, "members": {"user3"}})
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("adding itself to the admin group returned %d", rr.Code)
+	}
+	isMember, _, err := state.Userinfo.IsgroupmemberorNot("group1", "user3")
+	if err != nil || isMember {
+		t.Fatalf("user3 joined the admin group, err=%v", err)
+	}
+	allow, err := state.canPerformAction(nil, "user3", "group3", resourceGroup, permMembership)
+	if err != nil || !allow {
+		t.Fatalf("grants on other groups should keep working, err=%v", err)
+	}
+}
+
+func testIdPUserRequest(state *RuntimeState, username string, idpGroups []string, method string, target string,
+	handler http.HandlerFunc, formValues url.Values) *httptest.ResponseRecorder {
+	expiresAt := time.Now().Add(time.Hour * cookieExpirationHours)
+	cookieValue, err := state.authenticator.GenUserCookieValueWithGroups(username, idpGroups, expiresAt)
+	if err != nil {
+		panic(err)
+	}
+	req := httptest.NewRequest(method, target, strings.NewReader(formValues.Encode()))
+	req.AddCookie(&http.Cookie{Name: authn.AuthCookieName, Value: cookieValue, Path: indexPath})
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	withIdPGroups(handler).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestIdPRoles(t *testing.T) {
+	err := validateIdPRoles(map[string][]string{roleAdmin: {"idp-admins"}, roleHelpdesk: {"idp-helpdesk"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = validateIdPRoles(map[string][]string{roleAdmin: {}})
+	if err == nil {
+		t.Fatal("admin role without groups should fail")
+	}
+
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Config.Base.Roles = map[string][]string{roleAuditor: {"group1"}}
+	state.Config.Base.IdPRoles = map[string][]string{
+		roleAdmin:    {"idp-admins"},
+		roleHelpdesk: {"idp-helpdesk"},
+	}
+	if !state.isMappedIdPGroup("idp-admins") || state.isMappedIdPGroup("everyone") {
+		t.Fatal("bad filter of identity provider groups")
+	}
+
+	rr := testIdPUserRequest(&state, "user2", []string{"idp-admins"}, "GET", mailQueuePath, state.mailQueueHandler, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("admin through the identity provider got %d", rr.Code)
+	}
+	// The roles only come from the groups of the request itself.
+	rr = testIdPUserRequest(&state, "user2", nil, "GET", mailQueuePath, state.mailQueueHandler, nil)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("user without identity provider groups got %d", rr.Code)
+	}
+
+	formValues := url.Values{"groupname": {"group2"}, "members": {"user2"}}
+	rr = testIdPUserRequest(&state, "user2", []string{"idp-helpdesk"}, "POST", addmembersbuttonPath,
+		state.addmemberstoExistingGroup, formValues)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("helpdesk through the identity provider got %d", rr.Code)
+	}
+	var roles []string
+	testIdPUserRequest(&state, "user2", []string{"idp-helpdesk"}, "GET", indexPath,
+		func(w http.ResponseWriter, r *http.Request) {
+			username, err := state.GetRemoteUserName(w, r)
+			if err != nil {
+				return
+			}
+			roles, err = state.getUserRoles(r, username)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}, nil)
+	if !reflect.DeepEqual(roles, []string{roleAuditor, roleHelpdesk}) {
+		t.Fatalf("unexpected roles of user2 %v", roles)
+	}
+	roles, err = state.getUserRoles(nil, "user2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(roles, []string{roleAuditor}) {
+		t.Fatalf("identity provider roles outlived the request %v", roles)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultSearchPageSize = 50
+	maxSearchPageSize     = 1000
+
+	searchMatchPrefix    = "prefix"
+	searchMatchSubstring = "substring"
+	searchMatchRegexp    = "regexp"
+
+	searchSortName      = "name"
+	searchSortManagedBy = "managed_by"
+)
+
+// searchQuery is a page of the directory entries matching a filter, sorted
+// by a column. Filters ignore case, regular expressions do not.
+type searchQuery struct {
+	filter     string
+	prefix     bool
+	pattern    *regexp.Regexp
+	sortColumn string
+	descending bool
+	offset     int
+	limit      int
+}
+
+type groupSearchResult struct {
+	Name      string   `json:"name"`
+	ManagedBy []string `json:"managed_by"`
+}
+
+type groupsSearchPage struct {
+	Total  int                 `json:"total"`
+	Offset int                 `json:"offset"`
+	Limit  int                 `json:"limit"`
+	Groups []groupSearchResult `json:"groups"`
+}
+
+type usersSearchPage struct {
+	Total  int      `json:"total"`
+	Offset int      `json:"offset"`
+	Limit  int      `json:"limit"`
+	Users  []string `json:"users"`
+}
+
+// parseSearchQuery reads the q, match, sort, order, offset and limit
+// parameters of r, sortColumns are the accepted sort columns, the first
+// one is the default.
+func parseSearchQuery(r *http.Request, sortColumns ...string) (searchQuery, error) {
+	query := searchQuery{
+		filter:     strings.ToLower(r.FormValue("q")),
+		sortColumn: sortColumns[0],
+		limit:      defaultSearchPageSize,
+	}
+	switch r.FormValue("match") {
+	case "", searchMatchSubstring:
+	case searchMatchPrefix:
+		query.prefix = true
+	case searchMatchRegexp:
+		pattern, err := regexp.Compile(r.FormValue("q"))
+		if err != nil {
+			return query, fmt.Errorf("invalid regexp %s", r.FormValue("q"))
+		}
+		query.pattern = pattern
+	default:
+		return query, fmt.Errorf("invalid match %s", r.FormValue("match"))
+	}
+	if column := r.FormValue("sort"); column != "" {
+		valid := false
+		for _, sortColumn := range sortColumns {
+			valid = valid || column == sortColumn
+		}
+		if !valid {
+			return query, fmt.Errorf("invalid sort %s", column)
+		}
+		query.sortColumn = column
+	}
+	switch r.FormValue("order") {
+	case "", "asc":
+	case "desc":
+		query.descending = true
+	default:
+		return query, fmt.Errorf("invalid order %s", r.FormValue("order"))
+	}
+	if offset := r.FormValue("offset"); offset != "" {
+		value, err := strconv.Atoi(offset)
+		if err != nil || value < 0 {
+			return query, fmt.Errorf("invalid offset %s", offset)
+		}
+		query.offset = value
+	}
+	if limit := r.FormValue("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil {
+			return query, fmt.Errorf("invalid limit %s", limit)
+		}
+		if value > 0 {
+			query.limit = value
+		}
+		if query.limit > maxSearchPageSize {
+			query.limit = maxSearchPageSize
+		}
+	}
+	return query, nil
+}
+
+func (query *searchQuery) matches(name string) bool {
+	if query.pattern != nil {
+		return query.pattern.MatchString(name)
+	}
+	if query.prefix {
+		return strings.HasPrefix(strings.ToLower(name), query.filter)
+	}
+	return strings.Contains(strings.ToLower(name), query.filter)
+}
+
+// page returns the bounds of the page of query among total entries.
+func (query *searchQuery) page(total int) (int, int) {
+	start := query.offset
+	if start > total {
+		start = total
+	}
+	end := start + query.limit
+	if end > total {
+		end = total
+	}
+	return start, end
+}
+
+// searchGroupsHandler returns a page of the groups visible to the caller
+// with their managers, from the cached list of all groups.
+func (state *RuntimeState) searchGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != getMethod {
+		state.writeFailureResponse(w, r, "GET Method is required", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := state.GetRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	query, err := parseSearchQuery(r, searchSortName, searchSortManagedBy)
+	if err != nil {
+		state.writeFailureResponse(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	allGroups, err := state.Userinfo.GetAllGroupsManagedBy()
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	canView, err := state.newGroupViewFilter(r, username)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	groups := []groupSearchResult{}
+	for _, groupTuple := range allGroups {
+		if len(groupTuple) < 1 || !query.matches(groupTuple[0]) {
+			continue
+		}
+		visible, err := canView(groupTuple[0])
+		if err != nil {
+			log.Println(err)
+			state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+			return
+		}
+		if visible {
+			groups = append(groups, groupSearchResult{Name: groupTuple[0], ManagedBy: groupTuple[1:]})
+		}
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		first, second := groups[i], groups[j]
+		if query.descending {
+			first, second = second, first
+		}
+		if query.sortColumn == searchSortManagedBy {
+			firstManagers := strings.Join(first.ManagedBy, ",")
+			secondManagers := strings.Join(second.ManagedBy, ",")
+			if firstManagers != secondManagers {
+				return firstManagers < secondManagers
+			}
+		}
+		return first.Name < second.Name
+	})
+	start, end := query.page(len(groups))
+	page := groupsSearchPage{Total: len(groups), Offset: start, Limit: query.limit, Groups: groups[start:end]}
+	w.Header().Set("Cache-Control", "private, max-age=15")
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(page)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// searchUsersHandler returns a page of the users, from the cached list of
+// all users.
+func (state *RuntimeState) searchUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != getMethod {
+		state.writeFailureResponse(w, r, "GET Method is required", http.StatusMethodNotAllowed)
+		return
+	}
+	_, err := state.GetRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	query, err := parseSearchQuery(r, searchSortName)
+	if err != nil {
+		state.writeFailureResponse(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	allUsers, err := state.Userinfo.GetallUsers()
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	users := []string{}
+	for _, user := range allUsers {
+		if query.matches(user) {
+			users = append(users, user)
+		}
+	}
+	if query.descending {
+		sort.Sort(sort.Reverse(sort.StringSlice(users)))
+	} else {
+		sort.Strings(users)
+	}
+	start, end := query.page(len(users))
+	page := usersSearchPage{Total: len(users), Offset: start, Limit: query.limit, Users: users[start:end]}
+	w.Header().Set("Cache-Control", "private, max-age=15")
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(page)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestSearchGroups(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	searchGroups := func(username string, query url.Values) (groupsSearchPage, int) {
+		var page groupsSearchPage
+		rr := testUserRequest(&state, username, "GET", searchGroupsPath+"?"+query.Encode(),
+			state.searchGroupsHandler, nil)
+		if rr.Code == http.StatusOK {
+			err := json.Unmarshal(rr.Body.Bytes(), &page)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return page, rr.Code
+	}
+	groupNames := func(page groupsSearchPage) []string {
+		names := []string{}
+		for _, group := range page.Groups {
+			names = append(names, group.Name)
+		}
+		return names
+	}
+
+	searches := []struct {
+		query url.Values
+		total int
+		names []string
+	}{
+		{url.Values{}, 3, []string{"group1", "group2", "group3"}},
+		{url.Values{"q": {"GROUP3"}}, 1, []string{"group3"}},
+		{url.Values{"q": {"roup"}, "match": {"prefix"}}, 0, []string{}},
+		{url.Values{"q": {"grou"}, "match": {"prefix"}, "order": {"desc"}}, 3, []string{"group3", "group2", "group1"}},
+		{url.Values{"q": {"^group[13]$"}, "match": {"regexp"}}, 2, []string{"group1", "group3"}},
+		{url.Values{"q": {"GROUP1"}, "match": {"regexp"}}, 0, []string{}},
+		{url.Values{"sort": {"managed_by"}}, 3, []string{"group3", "group1", "group2"}},
+		{url.Values{"limit": {"2"}}, 3, []string{"group1", "group2"}},
+		{url.Values{"limit": {"2"}, "offset": {"2"}}, 3, []string{"group3"}},
+		{url.Values{"offset": {"10"}}, 3, []string{}},
+	}
+	for _, search := range searches {
+		page, code := searchGroups("user1", search.query)
+		if code != http.StatusOK {
+			t.Fatalf("search %v returned %d", search.query, code)
+		}
+		if page.Total != search.total || !reflect.DeepEqual(groupNames(page), search.names) {
+			t.Errorf("search %v returned %+v, expected %v of %d", search.query, page, search.names, search.total)
+		}
+	}
+	page, _ := searchGroups("user1", url.Values{"q": {"group3"}})
+	if len(page.Groups) != 1 || !reflect.DeepEqual(page.Groups[0].ManagedBy, []string{"group1"}) {
+		t.Fatalf("bad managers %+v", page.Groups)
+	}
+
+	for _, query := range []url.Values{{"match": {"fuzzy"}}, {"q": {"group("}, "match": {"regexp"}}, {"sort": {"members"}}, {"order": {"up"}},
+		{"offset": {"-1"}}, {"limit": {"many"}}} {
+		_, code := searchGroups("user1", query)
+		if code != http.StatusBadRequest {
+			t.Errorf("search %v returned %d", query, code)
+		}
+	}
+
+	// Hidden groups are left out of the results and of the total.
+	state.Config.Base.HiddenGroups = []string{"group2"}
+	page, _ = searchGroups("user2", url.Values{})
+	if page.Total != 2 || !reflect.DeepEqual(groupNames(page), []string{"group1", "group3"}) {
+		t.Fatalf("search with hidden group returned %+v", page)
+	}
+}
+
+func TestSearchUsers(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	searches := []struct {
+		query url.Values
+		total int
+		users []string
+	}{
+		{url.Values{}, 3, []string{"user1", "user2", "user3"}},
+		{url.Values{"q": {"2"}}, 1, []string{"user2"}},
+		{url.Values{"q": {"2"}, "match": {"prefix"}}, 0, []string{}},
+		{url.Values{"order": {"desc"}, "limit": {"2"}}, 3, []string{"user3", "user2"}},
+	}
+	for _, search := range searches {
+		rr := testUserRequest(&state, "user2", "GET", searchUsersPath+"?"+search.query.Encode(),
+			state.searchUsersHandler, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("search %v returned %d", search.query, rr.Code)
+		}
+		var page usersSearchPage
+		err = json.Unmarshal(rr.Body.Bytes(), &page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Total != search.total || !reflect.DeepEqual(page.Users, search.users) {
+			t.Errorf("search %v returned %+v, expected %v of %d", search.query, page, search.users, search.total)
+		}
+	}
+	rr := testUserRequest(&state, "user2", "GET", searchUsersPath+"?sort=managed_by", state.searchUsersHandler, nil)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("search by managers returned %d", rr.Code)
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// The last use of a session is written at most once per interval, not on
+// every request.
+const sessionTouchInterval = time.Minute
+
+type userSession struct {
+	ID         string
+	Username   string
+	Created    time.Time
+	LastSeen   time.Time
+	Expires    time.Time
+	RemoteAddr string
+	UserAgent  string
+	Current    bool
+}
+
+// dbSessionStore keeps the sessions of the auth cookies in the smallpoint
+// database.
+type dbSessionStore struct {
+	state *RuntimeState
+}
+
+func (store *dbSessionStore) NewSession(username string, r *http.Request, expires time.Time) (string, error) {
+	err := deleteExpiredSessions(store.state)
+	if err != nil {
+		return "", err
+	}
+	random := make([]byte, 32)
+	_, err = rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	remoteAddr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteAddr = r.RemoteAddr
+	}
+	now := time.Now()
+	session := userSession{ID: hex.EncodeToString(random), Username: username, Created: now, LastSeen: now,
+		Expires: expires, RemoteAddr: remoteAddr, UserAgent: r.UserAgent()}
+	err = insertSession(session, store.state)
+	if err != nil {
+		return "", err
+	}
+	return session.ID, nil
+}
+
+func (store *dbSessionStore) CheckSession(id string, username string) (bool, error) {
+	session, err := getSession(id, store.state)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	if session == nil || session.Username != username || session.Expires.Before(now) {
+		return false, nil
+	}
+	if now.Sub(session.LastSeen) > sessionTouchInterval {
+		err = touchSession(id, now, store.state)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (store *dbSessionStore) EndSession(id string) error {
+	_, err := deleteSession(id, "", store.state)
+	return err
+}
+
+var insertSessionStmt = map[string]string{
+	"sqlite": "insert into sessions(id, username, created, last_seen, expires, remote_addr, user_agent) " +
+		"values (?,?,?,?,?,?,?);",
+	"postgres": "insert into sessions(id, username, created, last_seen, expires, remote_addr, user_agent) " +
+		"values ($1,$2,$3,$4,$5,$6,$7);",
+}
+
+func insertSession(session userSession, state *RuntimeState) error {
+	stmtText := insertSessionStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(session.ID, session.Username, session.Created.Unix(), session.LastSeen.Unix(),
+		session.Expires.Unix(), session.RemoteAddr, session.UserAgent)
+	return err
+}
+
+var getSessionStmt = map[string]string{
+	"sqlite": "select id, username, created, last_seen, expires, remote_addr, user_agent " +
+		"from sessions where id=?;",
+	"postgres": "select id, username, created, last_seen, expires, remote_addr, user_agent " +
+		"from sessions where id=$1;",
+}
+
+var getUserSessionsStmt = map[string]string{
+	"sqlite": "select id, username, created, last_seen, expires, remote_addr, user_agent " +
+		"from sessions where username=? and expires>=? order by last_seen desc;",
+	"postgres": "select id, username, created, last_seen, expires, remote_addr, user_agent " +
+		"from sessions where username=$1 and expires>=$2 order by last_seen desc;",
+}
+
+func querySessions(state *RuntimeState, stmtText string, args ...interface{}) ([]userSession, error) {
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []userSession{}
+	for rows.Next() {
+		var session userSession
+		var created, lastSeen, expires int64
+		err = rows.Scan(&session.ID, &session.Username, &created, &lastSeen, &expires,
+			&session.RemoteAddr, &session.UserAgent)
+		if err != nil {
+			return nil, err
+		}
+		session.Created = time.Unix(created, 0)
+		session.LastSeen = time.Unix(lastSeen, 0)
+		session.Expires = time.Unix(expires, 0)
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// getSession returns nil when there is no session id.
+func getSession(id string, state *RuntimeState) (*userSession, error) {
+	sessions, err := querySessions(state, getSessionStmt[state.dbType], id)
+	if err != nil || len(sessions) < 1 {
+		return nil, err
+	}
+	return &sessions[0], nil
+}
+
+// getUserSessions returns the sessions of username which have not expired,
+// the most recently used first.
+func getUserSessions(username string, state *RuntimeState) ([]userSession, error) {
+	return querySessions(state, getUserSessionsStmt[state.dbType], username, time.Now().Unix())
+}
+
+var touchSessionStmt = map[string]string{
+	"sqlite":   "update sessions set last_seen=? where id=?;",
+	"postgres": "update sessions set last_seen=$1 where id=$2;",
+}
+
+func touchSession(id string, lastSeen time.Time, state *RuntimeState) error {
+	stmtText := touchSessionStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(lastSeen.Unix(), id)
+	return err
+}
+
+var deleteSessionStmt = map[string]string{
+	"sqlite":   "delete from sessions where id=?;",
+	"postgres": "delete from sessions where id=$1;",
+}
+
+var deleteUserSessionStmt = map[string]string{
+	"sqlite":   "delete from sessions where id=? and username=?;",
+	"postgres": "delete from sessions where id=$1 and username=$2;",
+}
+
+// deleteSession ends session id, only when it belongs to username unless
+// username is empty. It reports whether there was such a session.
+func deleteSession(id, username string, state *RuntimeState) (bool, error) {
+	stmtText := deleteSessionStmt[state.dbType]
+	args := []interface{}{id}
+	if username != "" {
+		stmtText = deleteUserSessionStmt[state.dbType]
+		args = append(args, username)
+	}
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return false, err
+	}
+	defer stmt.Close()
+	result, err := stmt.Exec(args...)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+var deleteAllUserSessionsStmt = map[string]string{
+	"sqlite":   "delete from sessions where username=?;",
+	"postgres": "delete from sessions where username=$1;",
+}
+
+func deleteAllUserSessions(username string, state *RuntimeState) (int64, error) {
+	stmtText := deleteAllUserSessionsStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return 0, err
+	}
+	defer stmt.Close()
+	result, err := stmt.Exec(username)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+var deleteExpiredSessionsStmt = map[string]string{
+	"sqlite":   "delete from sessions where expires<?;",
+	"postgres": "delete from sessions where expires<$1;",
+}
+
+func deleteExpiredSessions(state *RuntimeState) error {
+	stmtText := deleteExpiredSessionsStmt[state.dbType]
+	stmt, err := state.db.Prepare(stmtText)
+	if err != nil {
+		log.Println("Error prepare statement " + stmtText)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(time.Now().Unix())
+	return err
+}
+
+func (state *RuntimeState) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != postMethod {
+		state.writeFailureResponse(w, r, "POST Method is required", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := state.getAuthenticatedUserName(w, r)
+	if err != nil {
+		return
+	}
+	if target := impersonatedUser(r); target != "" {
+		setImpersonationCookie(w, "", -1)
+		state.recordEvent(eventImpersonationEnded, "", target, username,
+			fmt.Sprintf("%s stopped viewing as %s.", username, target))
+	}
+	err = state.authenticator.Logout(w, r)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	pageData := simpleMessagePageData{
+		Title:          "Logged Out",
+		SuccessMessage: fmt.Sprintf("%s, you are logged out.", username),
+		ContinueURL:    indexPath,
+	}
+	state.renderTemplateOrReturnJson(w, r, "simpleMessagePage", pageData)
+}
+
+// sessionsHandler lists the open sessions of the caller, admins can list the
+// ones of another user with the username parameter.
+func (state *RuntimeState) sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != getMethod {
+		state.writeFailureResponse(w, r, "GET Method is required", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := state.GetRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	isAdmin := state.isAdmin(r, username)
+	sessionUser := r.URL.Query().Get("username")
+	if sessionUser == "" {
+		sessionUser = username
+	}
+	if sessionUser != username && !isAdmin {
+		http.Error(w, "you are not authorized", http.StatusForbidden)
+		return
+	}
+	sessions, err := getUserSessions(sessionUser, state)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	currentID := state.authenticator.GetSessionID(r)
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == currentID
+	}
+	pageData := sessionsPageData{
+		UserName:    username,
+		IsAdmin:     isAdmin,
+		Title:       "Active Sessions of " + sessionUser,
+		SessionUser: sessionUser,
+		Sessions:    sessions,
+	}
+	state.renderTemplateOrReturnJson(w, r, "sessionsPage", pageData)
+}
+
+// revokeSessionHandler ends one of the sessions of the caller.
+func (state *RuntimeState) revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != postMethod {
+		state.writeFailureResponse(w, r, "POST Method is required", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := state.GetRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		if err.Error() == "missing form body" {
+			http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+		} else {
+			state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		}
+		return
+	}
+	deleted, err := deleteSession(r.PostFormValue("id"), username, state)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		state.writeFailureResponse(w, r, "No such session", http.StatusNotFound)
+		return
+	}
+	pageData := simpleMessagePageData{
+		UserName:       username,
+		IsAdmin:        state.isAdmin(r, username),
+		Title:          "Session Revoked",
+		SuccessMessage: "The session was revoked.",
+		ContinueURL:    sessionsPath,
+	}
+	state.renderTemplateOrReturnJson(w, r, "simpleMessagePage", pageData)
+}
+
+// revokeUserSessionsHandler ends every session of a user, users may do it
+// for themselves and admins for anyone.
+func (state *RuntimeState) revokeUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != postMethod {
+		state.writeFailureResponse(w, r, "POST Method is required", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := state.GetRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		if err.Error() == "missing form body" {
+			http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+		} else {
+			state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		}
+		return
+	}
+	isAdmin := state.isAdmin(r, username)
+	sessionUser := r.PostFormValue("username")
+	if sessionUser == "" {
+		sessionUser = username
+	}
+	if sessionUser != username && !isAdmin {
+		http.Error(w, "you are not authorized", http.StatusForbidden)
+		return
+	}
+	revoked, err := deleteAllUserSessions(sessionUser, state)
+	if err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, "Something wrong with internal server.", http.StatusInternalServerError)
+		return
+	}
+	state.recordEvent(eventSessionsRevoked, "", sessionUser, username,
+		fmt.Sprintf("%d sessions of %s were revoked by %s.", revoked, sessionUser, username))
+
+	pageData := simpleMessagePageData{
+		UserName:       username,
+		IsAdmin:        isAdmin,
+		Title:          "Sessions Revoked",
+		SuccessMessage: fmt.Sprintf("%d sessions of %s were revoked.", revoked, sessionUser),
+		ContinueURL:    sessionsPath,
+	}
+	state.renderTemplateOrReturnJson(w, r, "simpleMessagePage", pageData)
+}
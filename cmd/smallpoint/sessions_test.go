@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Symantec/ldap-group-management/lib/authn"
+)
+
+// testSessionRequest opens a session of username and sends a request with
+// its cookie.
+func testSessionRequest(state *RuntimeState, store *dbSessionStore, username string) func(method string,
+	target string, handler http.HandlerFunc, formValues url.Values) *httptest.ResponseRecorder {
+	expiresAt := time.Now().Add(time.Hour * cookieExpirationHours)
+	sessionID, err := store.NewSession(username, httptest.NewRequest("GET", indexPath, nil), expiresAt)
+	if err != nil {
+		panic(err)
+	}
+	cookieValue, err := state.authenticator.GenSessionCookieValue(username, sessionID, expiresAt)
+	if err != nil {
+		panic(err)
+	}
+	return func(method string, target string, handler http.HandlerFunc, formValues url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(formValues.Encode()))
+		req.AddCookie(&http.Cookie{Name: authn.AuthCookieName, Value: cookieValue, Path: indexPath})
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+}
+
+func TestSessions(t *testing.T) {
+	state, err := setupTestState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &dbSessionStore{state: &state}
+	state.authenticator.SetSessionStore(store)
+	adminRequest := testSessionRequest(&state, store, "user1")
+	user2Request := testSessionRequest(&state, store, "user2")
+	otherUser2Request := testSessionRequest(&state, store, "user2")
+
+	rr := user2Request("GET", sessionsPath, state.sessionsHandler, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("sessions page returned %d", rr.Code)
+	}
+	var pageData sessionsPageData
+	err = json.NewDecoder(rr.Body).Decode(&pageData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pageData.Sessions) != 2 || pageData.Sessions[0].Current == pageData.Sessions[1].Current {
+		t.Fatalf("bad sessions of user2 %+v", pageData.Sessions)
+	}
+	rr = user2Request("GET", sessionsPath+"?username=user1", state.sessionsHandler, nil)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("sessions of another user returned %d", rr.Code)
+	}
+
+	// A user can end its other sessions but not the ones of someone else.
+	var otherID string
+	for _, session := range pageData.Sessions {
+		if !session.Current {
+			otherID = session.ID
+		}
+	}
+	rr = adminRequest("POST", revokeSessionPath, state.revokeSessionHandler, url.Values{"id": {otherID}})
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("revoke of the session of another user returned %d", rr.Code)
+	}
+	rr = user2Request("POST", revokeSessionPath, state.revokeSessionHandler, url.Values{"id": {otherID}})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("revoke returned %d", rr.Code)
+	}
+	rr = otherUser2Request("GET", sessionsPath, state.sessionsHandler, nil)
+	if rr.Code != http.StatusFound {
+		t.Fatalf("revoked session returned %d", rr.Code)
+	}
+
+	rr = user2Request("POST", revokeUserSessionsPath, state.revokeUserSessionsHandler, url.Values{"username": {"user1"}})
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("revoke of the sessions of another user returned %d", rr.Code)
+	}
+	rr = adminRequest("POST", revokeUserSessionsPath, state.revokeUserSessionsHandler, url.Values{"username": {"user2"}})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("admin revoke returned %d", rr.Code)
+	}
+	rr = user2Request("GET", sessionsPath, state.sessionsHandler, nil)
+	if rr.Code != http.StatusFound {
+		t.Fatalf("session revoked by an admin returned %d", rr.Code)
+	}
+	events, err := getOutboxEvents(0, 100, &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Event != eventSessionsRevoked || events[0].Username != "user2" {
+		t.Fatalf("bad events %+v", events)
+	}
+
+	rr = adminRequest("POST", logoutPath, state.logoutHandler, url.Values{})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("logout returned %d", rr.Code)
+	}
+	sessions, err := getUserSessions("user1", &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 0 {
+		t.Fatalf("logout left sessions %+v", sessions)
+	}
+	rr = adminRequest("GET", sessionsPath, state.sessionsHandler, nil)
+	if rr.Code != http.StatusFound {
+		t.Fatalf("logged out session returned %d", rr.Code)
+	}
+}
@@ -63,6 +63,17 @@ const headerHTMLText = `
 <div class="w3-overlay w3-hide-large w3-animate-opacity"  style="cursor:pointer" title="close side menu" id="myOverlay"></div>
 {{end}}`
 
+const impersonationBannerHTMLText = `
+{{define "impersonationBanner"}}
+<div class="w3-bar w3-red w3-center" style="position:fixed;bottom:0;z-index:5;padding:8px">
+    <strong>{{.Admin}}, you are viewing smallpoint as {{.UserName}}.</strong>
+    {{if .AllowWrites}}Changes you make are made as {{.UserName}}.{{else}}Changes are blocked.{{end}}
+    <form action="/impersonate/stop" method="post" style="display:inline">
+        <button type="submit" class="w3-button w3-small w3-white">Stop Viewing as {{.UserName}}</button>
+    </form>
+</div>
+{{end}}`
+
 const footerHTMLText = `
 {{define "footer"}}
 <footer class="w3-container w3-padding-16 w3-light-grey w3-bottom">
@@ -82,6 +93,7 @@ const sidebarHTMLText = `
         <div class="w3-col s8 w3-bar">
 	    {{if .UserName}}
             <span>Welcome, <strong>{{.UserName}}</strong></span><br>
+	    {{if not .IsAdmin}}{{with userRoles .UserName}}<small>Roles: {{range .}}{{.}} {{end}}</small><br>{{end}}{{end}}
 	    {{end}}
         </div>
     </div>
@@ -100,11 +112,32 @@ const sidebarHTMLText = `
         <a href="/delete_group" class="w3-bar-item w3-button w3-padding"><i class="fa fa-users fa-fw"></i>&nbsp; Delete Group</a>
         <a href="/create_serviceaccount" class="w3-bar-item w3-button w3-padding"><i class="fa fa-users fa-fw"></i>&nbsp; Create Service Account</a>
         <a href="/change_owner" class="w3-bar-item w3-button w3-padding"><i class="fa fa-users fa-fw"></i>&nbsp; Change Group Ownership(RegExp)</a>
-	{{if .IsAdmin}}
+        <a href="/ownership_transfers" class="w3-bar-item w3-button w3-padding"><i class="fa fa-users fa-fw"></i>&nbsp; Ownership Transfers</a>
+	{{if .UserName}}
+	{{if userHasCapability .UserName "manage_permissions"}}
 	<a href="/permissionmanage" class="w3-bar-item w3-button w3-padding"><i class="fa fa-users fa-fw"></i>&nbsp; Permission Management</a>
 	{{end}}
+	{{if userHasCapability .UserName "view_permissions"}}
+	<a href="/permissions" class="w3-bar-item w3-button w3-padding"><i class="fa fa-users fa-fw"></i>&nbsp; Permission Grants</a>
+	{{end}}
+	{{if .IsAdmin}}
+	<a href="/orphaned_groups" class="w3-bar-item w3-button w3-padding"><i class="fa fa-users fa-fw"></i>&nbsp; Orphaned Groups</a>
+	<a href="/mail_queue" class="w3-bar-item w3-button w3-padding"><i class="fa fa-envelope fa-fw"></i>&nbsp; Mail Queue</a>
+	<form action="/impersonate" method="post" class="w3-bar-item">
+	    <input type="text" name="username" placeholder="Username" style="width:120px">
+	    <button type="submit" class="w3-button w3-small w3-teal"><i class="fa fa-eye fa-fw"></i> View as User</button>
+	</form>
+	{{end}}
+	{{if userHasCapability .UserName "export_groups"}}
+	<a href="/export_groups/" class="w3-bar-item w3-button w3-padding"><i class="fa fa-users fa-fw"></i>&nbsp; Export Groups (LDIF)</a>
+	{{end}}
+	{{end}}
         <a href="/addmembers" class="w3-bar-item w3-button w3-padding"><i class="fa fa-users fa-fw"></i>&nbsp; Add Members to Group</a>
         <a href="/deletemembers" class="w3-bar-item w3-button w3-padding"><i class="fa fa-users fa-fw"></i>&nbsp; Remove Members from Group</a>
+        <a href="/sessions" class="w3-bar-item w3-button w3-padding"><i class="fa fa-key fa-fw"></i>&nbsp; My Active Sessions</a>
+        <form action="/logout" method="post">
+            <button type="submit" class="w3-bar-item w3-button w3-padding"><i class="fa fa-sign-out fa-fw"></i>&nbsp; Logout</button>
+        </form>
 
         <br><br>
     </div>
@@ -194,7 +227,6 @@ const allGroupsPageText = `
 
 <head>
     {{template "commonHead" . }}
-    <script type="text/javascript" src="/getGroups.js?type=all"></script>
 </head>
 <body class="w3-light-grey" >
 {{template "header" .}}
@@ -252,6 +284,7 @@ type pendingRequestsPageData struct {
 
 	UserName           string
 	HasPendingRequests bool
+	Invitations        []groupInvitation
 	JSSources          []string
 }
 
@@ -317,6 +350,34 @@ const pendingRequestsPageText = `
     <p>You don't have any pending requests at the moment.</p>
 </div>
 
+{{end}}
+
+{{if .Invitations}}
+<header class="w3-container" style="padding-top:12px">
+    <h5><b><i class="fa fa-envelope"></i>My Invitations</b></h5>
+</header>
+<div class="w3-panel">
+    <table class="w3-table w3-striped w3-white" id="my_invitations" style="width:100%;margin:0;">
+        <tr><th>Group</th><th>Invited by</th><th>Expires</th><th></th></tr>
+        {{range .Invitations}}
+        <tr>
+            <td><a href="/group_info/?groupname={{.Groupname}}">{{.Groupname}}</a></td>
+            <td>{{.InvitedBy}}</td>
+            <td>{{.ExpiresAt.Format "2006-01-02 15:04"}}</td>
+            <td>
+                <form action="/invitations/accept" method="POST" style="display:inline">
+                    <input name="groupname" type="hidden" value="{{.Groupname}}">
+                    <button type="submit" class="w3-button w3-text-new-white w3-new-blue">Accept</button>
+                </form>
+                <form action="/invitations/revoke" method="POST" style="display:inline">
+                    <input name="groupname" type="hidden" value="{{.Groupname}}">
+                    <button type="submit" class="w3-button w3-text-new-white w3-red">Decline</button>
+                </form>
+            </td>
+        </tr>
+        {{end}}
+    </table>
+</div>
 {{end}}
 
 
@@ -333,9 +394,12 @@ type pendingActionsPageData struct {
 	Title   string
 	IsAdmin bool
 
-	UserName          string
-	HasPendingActions bool
-	JSSources         []string
+	UserName                string
+	HasPendingActions       bool
+	Invitations             []groupInvitation
+	NotificationPreference  string
+	NotificationPreferences []string
+	JSSources               []string
 }
 
 const pendingActionsPageText = `
@@ -424,6 +488,48 @@ const pendingActionsPageText = `
 
 {{end}}
 
+{{if .Invitations}}
+<header class="w3-container" style="padding-top:12px">
+    <h5><b><i class="fa fa-envelope"></i>Outstanding Invitations</b></h5>
+</header>
+<div class="w3-panel">
+    <table class="w3-table w3-striped w3-white" id="outstanding_invitations" style="width:100%;margin:0;">
+        <tr><th>Group</th><th>User</th><th>Invited by</th><th>Expires</th><th></th></tr>
+        {{range .Invitations}}
+        <tr>
+            <td><a href="/group_info/?groupname={{.Groupname}}">{{.Groupname}}</a></td>
+            <td>{{.Username}}</td>
+            <td>{{.InvitedBy}}</td>
+            <td>{{.ExpiresAt.Format "2006-01-02 15:04"}}</td>
+            <td>
+                <form action="/invitations/revoke" method="POST" style="display:inline">
+                    <input name="groupname" type="hidden" value="{{.Groupname}}">
+                    <input name="username" type="hidden" value="{{.Username}}">
+                    <button type="submit" class="w3-button w3-text-new-white w3-red">Revoke</button>
+                </form>
+            </td>
+        </tr>
+        {{end}}
+    </table>
+</div>
+{{end}}
+
+<header class="w3-container" style="padding-top:12px" id="notifications">
+    <h5><b><i class="fa fa-bell"></i>Email Notifications</b></h5>
+</header>
+<div class="w3-panel">
+    <form action="/notification_preferences" method="POST">
+        <label for="frequency">Email me about access requests:</label>
+        <select name="frequency" id="frequency">
+            {{$current := .NotificationPreference}}
+            {{range .NotificationPreferences}}
+            <option value="{{.}}" {{if eq . $current}}selected{{end}}>{{.}}</option>
+            {{end}}
+        </select>
+        <button type="submit" class="w3-button w3-text-new-white w3-new-blue">Save</button>
+    </form>
+</div>
+
 
   </div><!-- end of content div -->
 {{template "footer"}}
@@ -449,8 +555,6 @@ const createGroupPageText = `
 <head>
     {{template "commonHead" . }}
     <script type="text/javascript" src="/js/createGroup.js"></script>
-    <script type="text/javascript" src="/getGroups.js?type=allNoManager"></script>
-    <script type="text/javascript" src="/getUsers.js"></script>
 </head>
 <body class="w3-light-grey" >
 {{template "header" .}}
@@ -473,9 +577,9 @@ const createGroupPageText = `
             </tr>
             <tr>
                 <td>description</td>
-                <td><select  id="select_groups" required="required" name="description" type="text">
-                    <option value="self-managed">self-managed</option>
-                </select><br/></td>
+                <td><input autocomplete="off" id="cg_managedby" list="select_groups" name="description" required="required" type="text" value="self-managed"/>
+                    <datalist id="select_groups">
+                    </datalist><br/></td>
             </tr>
             <tr>
                 <td>Members</td>
@@ -540,7 +644,6 @@ const deleteGroupPageText = `
 <head>
     {{template "commonHead" . }}
     <script type="text/javascript" src="/js/deleteGroup.js"></script>
-    <script type="text/javascript" src="/getGroups.js?type=allNoManager"></script>
 </head>
 <body class="w3-light-grey" >
 {{template "header" .}}
@@ -655,8 +758,6 @@ const addMembersToGroupPageText = `
 <head>
     {{template "commonHead" . }}
     <script type="text/javascript" src="/js/addMemberToGroup.js"></script>
-    <script type="text/javascript" src="/getGroups.js?type=allNoManager"></script>
-    <script type="text/javascript" src="/getUsers.js"></script>
 </head>
 <body class="w3-light-grey" >
 {{template "header" .}}
@@ -735,6 +836,10 @@ type groupInfoPageData struct {
 	IsGroupAdmin        bool
 	GroupName           string
 	GroupManagedbyValue string
+	OrphanReason        string
+	JoinPolicy          string
+	JoinPolicies        []string
+	HasInvitation       bool
 	JSSources           []string
 }
 
@@ -746,7 +851,6 @@ const groupInfoPageText = `
     {{template "commonHead" . }}
     <script type="text/javascript" src="/js/groupInfo.js"></script>
     <script type="text/javascript" src="/getUsers.js?type=group&groupName={{.GroupName}}"></script>
-    <script type="text/javascript" src="/getUsers.js"></script>
     </head>
 <body class="w3-light-grey">
 {{template "header" .}}
@@ -762,21 +866,81 @@ const groupInfoPageText = `
     <br>
     <br>
     <h4><b>Group Managed Attribute:<strong id="group_managedby">{{.GroupManagedbyValue}}</strong></b></h4>
+    <h4><b>Join Policy:<strong id="group_join_policy">{{.JoinPolicy}}</strong></b></h4>
+    {{if .OrphanReason}}
+    <div class="w3-panel w3-pale-red w3-border" id="orphan_warning">
+        <p>Nobody can approve requests for this group: {{.OrphanReason}}. Please contact an administrator.</p>
+    </div>
+    {{end}}
 </header>
 
 <div class="w3-panel">
     {{if .IsGroupAdmin}}
     <button class="w3-button w3-right w3-text-new-white w3-new-blue" id="length_btn" data-toggle="modal" data-target="#myModalAddMember">Add Members</button>
     <button class="w3-button w3-right w3-text-new-white w3-new-blue" id="length_btn" data-toggle="modal" data-target="#myModalRemoveMembers">Remove Members</button>    
+    <button class="w3-button w3-right w3-text-new-white w3-new-blue" id="length_btn" data-toggle="modal" data-target="#myModalInvite">Invite Users</button>
+    <button class="w3-button w3-right w3-text-new-white w3-new-blue" id="length_btn" data-toggle="modal" data-target="#myModalJoinPolicy">Join Policy</button>
     {{end}}
     {{if .IsMember}}
     <button class="w3-button w3-right w3-text-new-white w3-new-blue" id="length_btn" data-toggle="modal" data-target="#myModalExitGroup">Exit group</button>
-    {{else}}
+    {{else if .HasInvitation}}
+    <form action="/invitations/accept" method="POST" style="display:inline">
+        <input name="groupname" type="hidden" value="{{.GroupName}}">
+        <button type="submit" class="w3-button w3-right w3-text-new-white w3-new-blue" id="btn_accept_invitation">Accept Invitation</button>
+    </form>
+    {{else if or .IsGroupAdmin (eq .JoinPolicy "open" "approval-required")}}
     <button class="w3-button w3-right w3-text-new-white w3-new-blue" id="length_btn" data-toggle="modal" data-target="#myModal_joingroup">Join Group</button>
     {{end}}
 
 
     {{if .IsGroupAdmin}}
+    <div class="modal fade" id="myModalInvite" role="dialog">
+        <div class="modal-dialog">
+            <div class="modal-content">
+                <div class="modal-header">
+                    <button type="button" class="close" data-dismiss="modal"></button>
+                    <h4 class="modal-title"><p>Who do you want to invite to this group?</p></h4>
+                </div>
+                <form action="/invite" method="POST">
+                <div class="modal-body">
+                    GroupName: <input name="groupname" required type="text" value="{{.GroupName}}" readonly><br/>
+                    Users (comma separated): <input autocomplete="off" name="members" required type="text"><br/>
+                </div>
+                <div class="modal-footer">
+                    <button type="submit" class="btn btn-default">Invite</button>
+                    <button type="button" class="btn btn-default" data-dismiss="modal">Cancel</button>
+                </div>
+                </form>
+            </div>
+        </div>
+    </div>
+
+    <div class="modal fade" id="myModalJoinPolicy" role="dialog">
+        <div class="modal-dialog">
+            <div class="modal-content">
+                <div class="modal-header">
+                    <button type="button" class="close" data-dismiss="modal"></button>
+                    <h4 class="modal-title"><p>How can users join this group?</p></h4>
+                </div>
+                <form action="/join_policy" method="POST">
+                <div class="modal-body">
+                    <input name="groupname" type="hidden" value="{{.GroupName}}">
+                    <select name="policy">
+                    {{$current := .JoinPolicy}}
+                    {{range .JoinPolicies}}
+                        <option value="{{.}}" {{if eq . $current}}selected{{end}}>{{.}}</option>
+                    {{end}}
+                    </select>
+                </div>
+                <div class="modal-footer">
+                    <button type="submit" class="btn btn-default">Save</button>
+                    <button type="button" class="btn btn-default" data-dismiss="modal">Cancel</button>
+                </div>
+                </form>
+            </div>
+        </div>
+    </div>
+
     <div class="modal fade" id="myModalAddMember" role="dialog">
         <div class="modal-dialog">
 
@@ -922,7 +1086,6 @@ const createServiceAccountPageText = `
 
 <head>
     {{template "commonHead" . }}
-    <script type="text/javascript" src="/getGroups.js?type=allNoManager"></script>
 </head>
 <body class="w3-light-grey" >
 {{template "header" .}}
@@ -986,7 +1149,6 @@ const changeGroupOwnershipPageText = `
 <head>
     {{template "commonHead" . }}
     <script type="text/javascript" src="/js/changeGroupOwnership.js"></script>
-    <script type="text/javascript" src="/getGroups.js?type=allNoManager"></script>
 </head>
 <body class="w3-light-grey" >
 {{template "header" .}}
@@ -1074,8 +1236,6 @@ const deleteMembersFromGroupPageText = `
 <head>
     {{template "commonHead" . }}
     <script type="text/javascript" src="/js/deleteMembersFromGroup.js"></script>
-    <script type="text/javascript" src="/getGroups.js?type=allNoManager"></script>
-    <script type="text/javascript" src="/getUsers.js"></script>
 </head>
 <body class="w3-light-grey" >
 {{template "header" .}}
@@ -1161,7 +1321,6 @@ const permManagePageText = `
 <head>
     {{template "commonHead" . }}
     <script type="text/javascript" src="/js/permissionManage.js"></script>
-    <script type="text/javascript" src="/getGroups.js?type=allNoManager"></script>
 </head>
 <body class="w3-light-grey">
 {{template "header" .}}
@@ -1193,9 +1352,17 @@ const permManagePageText = `
 	<tr>
 	  <td>Resource Name</td>
 	  <td>
-	    <input autocomplete="off" type="text" id="resource_name">
+	    <input autocomplete="off" type="text" id="resource_name"><br/>
+	    <small>A name, a glob such as team-*-admins, or an anchored regexp starting with ^</small>
 	  </td>
 	</tr>
+	<tr>
+	  <td>Effect</td>
+	  <td><select id="effect_select" type="text">
+	    <option value="allow">allow</option>
+	    <option value="deny">deny</option>
+	  </select></td>
+	</tr>
 	<tr>
 	  <td>Permissions</td>
 	  <td>
@@ -1206,6 +1373,9 @@ const permManagePageText = `
 	      <option id="option-create" value="create">create</option>
 	      <option id="option-update" value="update">update</option>
 	      <option id="option-delete" value="delete">delete</option>
+	      <option id="option-membership" value="membership">membership</option>
+	      <option id="option-ownership" value="ownership">ownership</option>
+	      <option id="option-view" value="view">view</option>
 	    </datalist>
 	  </td>
 	</tr>
@@ -1226,6 +1396,7 @@ const permManagePageText = `
 		ResourceType: <input autocomplete="off" id="permission_resource_type" name="resourceType" required type="text" readonly/><br/>
 		ResourceName: <input autocomplete="off" id="permission_resource_name" name="resourceName" required type="text" readonly/><br/>
 		Permissions: <input autocomplete="off" id="permissions_content" name="permissions" required="required" type="text" readonly/><br/>
+		Effect: <input autocomplete="off" id="permission_effect" name="effect" required type="text" readonly/><br/>
 	      </form>
 	    </div>
 	    <div class="modal-footer">
@@ -1244,3 +1415,442 @@ const permManagePageText = `
 </html>
 {{end}}
 `
+
+type permissionsPageData struct {
+	Title   string
+	IsAdmin bool
+
+	UserName            string
+	JSSources           []string `json:",omitempty"`
+	GroupnameFilter     string
+	ResourceTypeFilter  string
+	ResourceFilter      string
+	PermissionFilter    string
+	Permissions         []permissionEntry
+	HasEffectiveHolders bool     `json:",omitempty"`
+	EffectiveHolders    []string `json:",omitempty"`
+	CanManage           bool
+}
+
+const permissionsPageText = `
+{{define "permissionsPage"}}
+<html>
+
+<head>
+    {{template "commonHead" . }}
+</head>
+<body class="w3-light-grey">
+{{template "header" .}}
+
+<!-- !PAGE CONTENT! -->
+<div class="w3-main" style="margin-left:300px;margin-top:43px;">
+  <div id="content" style="min-height: 500px;margin-bottom:100px;">
+    <header class="w3-container" style="padding-top:12px">
+      <h5><b><i class="fa fa-group"></i>{{.Title}}</b></h5>
+    </header>
+
+    <div class="w3-panel">
+      <form method="GET" action="/permissions" autocomplete="off">
+        Group: <input name="groupname" type="text" value="{{.GroupnameFilter}}">
+        Resource Type: <select name="resourceType">
+          <option value="" {{if eq .ResourceTypeFilter ""}}selected{{end}}>any</option>
+          <option value="group" {{if eq .ResourceTypeFilter "group"}}selected{{end}}>group</option>
+          <option value="service_account" {{if eq .ResourceTypeFilter "service_account"}}selected{{end}}>service account</option>
+        </select>
+        Resource: <input name="resource" type="text" value="{{.ResourceFilter}}">
+        Holders of: <select name="permission">
+          <option value="" {{if eq .PermissionFilter ""}}selected{{end}}></option>
+          <option value="create" {{if eq .PermissionFilter "create"}}selected{{end}}>create</option>
+          <option value="update" {{if eq .PermissionFilter "update"}}selected{{end}}>update</option>
+          <option value="delete" {{if eq .PermissionFilter "delete"}}selected{{end}}>delete</option>
+          <option value="membership" {{if eq .PermissionFilter "membership"}}selected{{end}}>membership</option>
+          <option value="ownership" {{if eq .PermissionFilter "ownership"}}selected{{end}}>ownership</option>
+          <option value="view" {{if eq .PermissionFilter "view"}}selected{{end}}>view</option>
+        </select>
+        <button class="w3-button w3-text-new-white w3-new-blue" type="submit">Filter</button>
+      </form>
+      <p><a href="/permissions/test">Test a permission for a user</a></p>
+    </div>
+
+    {{if .HasEffectiveHolders}}
+    <div class="w3-panel">
+      <p>Users holding {{.PermissionFilter}} on {{.ResourceTypeFilter}} {{.ResourceFilter}} (admins hold every permission):
+      {{range .EffectiveHolders}}{{.}} {{else}}none{{end}}</p>
+    </div>
+    {{end}}
+
+    <div class="w3-panel">
+      <table class="w3-table w3-striped w3-white">
+        <tr>
+          <th>Group</th><th>Resource Type</th><th>Resource</th><th>Allowed / Denied</th><th>Group Members</th><th></th>
+        </tr>
+        {{range .Permissions}}
+        <tr>
+          <td>{{.Groupname}}</td>
+          <td>{{.ResourceType}}</td>
+          <td>{{.Resource}}</td>
+          <td>
+            {{if $.CanManage}}
+            <form method="POST" action="/permissions/edit/" autocomplete="off">
+              <input name="id" type="hidden" value="{{.ID}}">
+              <input name="permissions" type="text" placeholder="allow" value="{{range $i, $p := .Permissions}}{{if $i}},{{end}}{{$p}}{{end}}">
+              <input name="denyPermissions" type="text" placeholder="deny" value="{{range $i, $p := .DenyPermissions}}{{if $i}},{{end}}{{$p}}{{end}}">
+              <button class="w3-button w3-text-new-white w3-new-blue" type="submit">Save</button>
+            </form>
+            {{else}}
+            allow: {{range .Permissions}}{{.}} {{end}}<br>
+            deny: {{range .DenyPermissions}}{{.}} {{end}}
+            {{end}}
+          </td>
+          <td>{{range .Holders}}{{.}} {{end}}</td>
+          <td>
+            {{if $.CanManage}}
+            <form method="POST" action="/permissions/delete/">
+              <input name="ids" type="hidden" value="{{.ID}}">
+              <button class="w3-button w3-text-new-white w3-red" type="submit">Delete</button>
+            </form>
+            {{end}}
+          </td>
+        </tr>
+        {{else}}
+        <tr><td colspan="6">No permission grants found.</td></tr>
+        {{end}}
+      </table>
+    </div>
+  </div>
+  {{template "footer"}}
+</div>
+
+</body>
+</html>
+{{end}}
+`
+
+type permissionTestPageData struct {
+	Title   string
+	IsAdmin bool
+
+	UserName     string
+	JSSources    []string `json:",omitempty"`
+	TestUsername string
+	ResourceType string
+	Resource     string
+	Permission   string
+	Tested       bool
+	Decision     permissionDecision
+}
+
+const permissionTestPageText = `
+{{define "permissionTestPage"}}
+<html>
+
+<head>
+    {{template "commonHead" . }}
+</head>
+<body class="w3-light-grey">
+{{template "header" .}}
+
+<!-- !PAGE CONTENT! -->
+<div class="w3-main" style="margin-left:300px;margin-top:43px;">
+  <div id="content" style="min-height: 500px;margin-bottom:100px;">
+    <header class="w3-container" style="padding-top:12px">
+      <h5><b><i class="fa fa-group"></i>{{.Title}}</b></h5>
+    </header>
+
+    <div class="w3-panel">
+      <form method="GET" action="/permissions/test" autocomplete="off">
+        User: <input name="username" type="text" required value="{{.TestUsername}}">
+        Resource Type: <select name="resourceType">
+          <option value="group" {{if eq .ResourceType "group"}}selected{{end}}>group</option>
+          <option value="service_account" {{if eq .ResourceType "service_account"}}selected{{end}}>service account</option>
+        </select>
+        Resource: <input name="resource" type="text" required value="{{.Resource}}">
+        Action: <select name="permission">
+          <option value="create" {{if eq .Permission "create"}}selected{{end}}>create</option>
+          <option value="update" {{if eq .Permission "update"}}selected{{end}}>update</option>
+          <option value="delete" {{if eq .Permission "delete"}}selected{{end}}>delete</option>
+          <option value="membership" {{if eq .Permission "membership"}}selected{{end}}>membership</option>
+          <option value="ownership" {{if eq .Permission "ownership"}}selected{{end}}>ownership</option>
+          <option value="view" {{if eq .Permission "view"}}selected{{end}}>view</option>
+        </select>
+        <button class="w3-button w3-text-new-white w3-new-blue" type="submit">Test</button>
+      </form>
+    </div>
+
+    {{if .Tested}}
+    <div class="w3-panel">
+      <p><b>{{if .Decision.Allowed}}Allowed{{else}}Denied{{end}}</b>: {{.Decision.Reason}}</p>
+    </div>
+    {{end}}
+  </div>
+  {{template "footer"}}
+</div>
+
+</body>
+</html>
+{{end}}
+`
+
+type ownershipTransfersPageData struct {
+	Title   string
+	IsAdmin bool
+
+	UserName  string
+	JSSources []string `json:",omitempty"`
+	Transfers []ownershipTransfer
+}
+
+const ownershipTransfersPageText = `
+{{define "ownershipTransfersPage"}}
+<html>
+
+<head>
+    {{template "commonHead" . }}
+</head>
+<body class="w3-light-grey">
+{{template "header" .}}
+
+<!-- !PAGE CONTENT! -->
+<div class="w3-main" style="margin-left:300px;margin-top:43px;">
+  <div id="content" style="min-height: 500px;margin-bottom:100px;">
+    <header class="w3-container" style="padding-top:12px">
+      <h5><b><i class="fa fa-group"></i>{{.Title}}</b></h5>
+    </header>
+
+    <div class="w3-panel">
+      <table class="w3-table w3-striped w3-white">
+        <tr>
+          <th>Group</th><th>Current Managers</th><th>New Manager</th><th>Requested By</th><th>Requested At</th><th></th>
+        </tr>
+        {{range .Transfers}}
+        <tr>
+          <td>{{.Groupname}}</td>
+          <td>{{range $i, $manager := .CurrentManagers}}{{if $i}}, {{end}}{{$manager}}{{end}}</td>
+          <td>{{.ManageGroup}}</td>
+          <td>{{.RequestedBy}}</td>
+          <td>{{.RequestedAt.Format "2006-01-02 15:04"}}</td>
+          <td>
+            {{if .CanAccept}}
+            <form method="POST" action="/ownership_transfers/accept" style="display:inline">
+              <input name="groupname" type="hidden" value="{{.Groupname}}">
+              <button class="w3-button w3-text-new-white w3-new-blue" type="submit">Accept</button>
+            </form>
+            {{end}}
+            {{if .CanCancelOrDeny}}
+            <form method="POST" action="/ownership_transfers/reject" style="display:inline">
+              <input name="groupname" type="hidden" value="{{.Groupname}}">
+              <button class="w3-button w3-text-new-white w3-red" type="submit">{{if .CanAccept}}Reject{{else}}Cancel{{end}}</button>
+            </form>
+            {{end}}
+          </td>
+        </tr>
+        {{else}}
+        <tr><td colspan="6">No pending ownership transfers.</td></tr>
+        {{end}}
+      </table>
+    </div>
+  </div>
+  {{template "footer"}}
+</div>
+
+</body>
+</html>
+{{end}}
+`
+
+type orphanedGroupsPageData struct {
+	Title   string
+	IsAdmin bool
+
+	UserName       string
+	JSSources      []string `json:",omitempty"`
+	OrphanedGroups []orphanedGroup
+}
+
+const orphanedGroupsPageText = `
+{{define "orphanedGroupsPage"}}
+<html>
+
+<head>
+    {{template "commonHead" . }}
+</head>
+<body class="w3-light-grey">
+{{template "header" .}}
+
+<!-- !PAGE CONTENT! -->
+<div class="w3-main" style="margin-left:300px;margin-top:43px;">
+  <div id="content" style="min-height: 500px;margin-bottom:100px;">
+    <header class="w3-container" style="padding-top:12px">
+      <h5><b><i class="fa fa-group"></i>{{.Title}}</b></h5>
+    </header>
+
+    <div class="w3-panel">
+      <table class="w3-table w3-striped w3-white">
+        <tr>
+          <th>Group</th><th>Manager</th><th>Problem</th>
+        </tr>
+        {{range .OrphanedGroups}}
+        <tr>
+          <td><a href="/group_info/?groupname={{.Groupname}}">{{.Groupname}}</a></td>
+          <td>{{.Manager}}</td>
+          <td>{{.Reason}}</td>
+        </tr>
+        {{else}}
+        <tr><td colspan="3">Every group can be managed.</td></tr>
+        {{end}}
+      </table>
+    </div>
+  </div>
+  {{template "footer"}}
+</div>
+
+</body>
+</html>
+{{end}}
+`
+
+type mailQueuePageData struct {
+	Title   string
+	IsAdmin bool
+
+	UserName  string
+	JSSources []string `json:",omitempty"`
+	Mails     []queuedMail
+}
+
+const mailQueuePageText = `
+{{define "mailQueuePage"}}
+<html>
+
+<head>
+    {{template "commonHead" . }}
+</head>
+<body class="w3-light-grey">
+{{template "header" .}}
+
+<!-- !PAGE CONTENT! -->
+<div class="w3-main" style="margin-left:300px;margin-top:43px;">
+  <div id="content" style="min-height: 500px;margin-bottom:100px;">
+    <header class="w3-container" style="padding-top:12px">
+      <h5><b><i class="fa fa-envelope"></i>{{.Title}}</b></h5>
+    </header>
+
+    <div class="w3-panel">
+      <table class="w3-table w3-striped w3-white">
+        <tr>
+          <th>Email</th><th>Recipients</th><th>Queued</th><th>Attempts</th><th>Status</th><th>Last Error</th><th></th>
+        </tr>
+        {{range .Mails}}
+        <tr>
+          <td>{{.Template}}</td>
+          <td>{{range .Recipients}}{{.}}<br>{{end}}</td>
+          <td>{{.Created.Format "2006-01-02 15:04 MST"}}</td>
+          <td>{{.Attempts}}{{if not .NextAttempt.IsZero}} (next {{.NextAttempt.Format "15:04 MST"}}){{end}}</td>
+          <td>{{.Status}}</td>
+          <td>{{.LastError}}</td>
+          <td>
+            {{if eq .Status "failed"}}
+            <form action="/mail_queue/retry" method="post">
+              <input type="hidden" name="id" value="{{.ID}}">
+              <button type="submit" class="w3-button w3-small w3-teal">Retry</button>
+            </form>
+            {{end}}
+          </td>
+        </tr>
+        {{else}}
+        <tr><td colspan="7">The mail queue is empty.</td></tr>
+        {{end}}
+      </table>
+    </div>
+  </div>
+  {{template "footer"}}
+</div>
+
+</body>
+</html>
+{{end}}
+`
+
+type sessionsPageData struct {
+	Title   string
+	IsAdmin bool
+
+	UserName    string
+	JSSources   []string `json:",omitempty"`
+	SessionUser string
+	Sessions    []userSession
+}
+
+const sessionsPageText = `
+{{define "sessionsPage"}}
+<html>
+
+<head>
+    {{template "commonHead" . }}
+</head>
+<body class="w3-light-grey">
+{{template "header" .}}
+
+<!-- !PAGE CONTENT! -->
+<div class="w3-main" style="margin-left:300px;margin-top:43px;">
+  <div id="content" style="min-height: 500px;margin-bottom:100px;">
+    <header class="w3-container" style="padding-top:12px">
+      <h5><b><i class="fa fa-key"></i>{{.Title}}</b></h5>
+    </header>
+
+    {{if .IsAdmin}}
+    <div class="w3-panel">
+      <form action="/sessions" method="get">
+        <input type="text" name="username" placeholder="Username" value="{{.SessionUser}}">
+        <button type="submit" class="w3-button w3-small w3-teal">Show Sessions</button>
+      </form>
+    </div>
+    {{end}}
+
+    <div class="w3-panel">
+      <table class="w3-table w3-striped w3-white">
+        <tr>
+          <th>Logged In</th><th>Last Seen</th><th>Expires</th><th>Address</th><th>Browser</th><th></th>
+        </tr>
+        {{$sessionUser := .SessionUser}}
+        {{$userName := .UserName}}
+        {{range .Sessions}}
+        <tr>
+          <td>{{.Created.Format "2006-01-02 15:04 MST"}}</td>
+          <td>{{.LastSeen.Format "2006-01-02 15:04 MST"}}</td>
+          <td>{{.Expires.Format "2006-01-02 15:04 MST"}}</td>
+          <td>{{.RemoteAddr}}</td>
+          <td>{{.UserAgent}}</td>
+          <td>
+            {{if .Current}}
+            This session
+            {{else if eq $sessionUser $userName}}
+            <form action="/sessions/revoke" method="post">
+              <input type="hidden" name="id" value="{{.ID}}">
+              <button type="submit" class="w3-button w3-small w3-teal">Revoke</button>
+            </form>
+            {{end}}
+          </td>
+        </tr>
+        {{else}}
+        <tr><td colspan="6">There are no active sessions.</td></tr>
+        {{end}}
+      </table>
+    </div>
+
+    {{if .Sessions}}
+    <div class="w3-panel">
+      <form action="/sessions/revoke_user" method="post">
+        <input type="hidden" name="username" value="{{.SessionUser}}">
+        <button type="submit" class="w3-button w3-red">Revoke All Sessions of {{.SessionUser}}</button>
+      </form>
+    </div>
+    {{end}}
+  </div>
+  {{template "footer"}}
+</div>
+
+</body>
+</html>
+{{end}}
+`
@@ -1,5 +1,7 @@
 document.addEventListener('DOMContentLoaded', function () {
           document.getElementById('cg_groupname').addEventListener('input', group_groupname);
           document.getElementById('cg_members').addEventListener('input', groupadd_members);
+          searchDatalist('cg_groupname', 'select_groups', 'groups');
+          searchDatalist('cg_members', 'select_members', 'users', groupadd_members);
           document.getElementById('btn_addpeopletogroup').addEventListener('click', addpeopletogroup_form_submit);
 });
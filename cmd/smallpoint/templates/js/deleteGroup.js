@@ -1,4 +1,5 @@
 document.addEventListener('DOMContentLoaded', function () {
           document.getElementById('cg_groupnames').addEventListener('input', delete_groups);
+          searchDatalist('cg_groupnames', 'select_groups', 'groups', delete_groups);
           document.getElementById('btn_deletegroup').addEventListener('click', deletegroup_form_submit);
 });
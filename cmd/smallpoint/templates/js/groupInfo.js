@@ -1,5 +1,6 @@
 document.addEventListener('DOMContentLoaded', function () {
           document.getElementById('cg_members').addEventListener('input', groupadd_members);
+          searchDatalist('cg_members', 'select_members', 'users', groupadd_members);
           document.getElementById('cg_members_remove').addEventListener('input', groupremove_members);
 	  document.getElementById('btn_form_modal_addmember').addEventListener('click', addmember_form_submit);
 	  document.getElementById('btn_form_modal_removemember').addEventListener('click', removemember_form_submit);
@@ -90,10 +90,42 @@ function Parsearray(array) {
 }
 
 function RequestAccess(final_groupnames) {
+    requestAccessTable({data: final_groupnames});
+}
+
+// RequestAccessSearch pages, filters and sorts the groups on the server
+// instead of loading all of them.
+function RequestAccessSearch() {
+    requestAccessTable({serverSide: true, searchDelay: 400, ajax: searchGroups});
+}
+
+function searchGroups(data, callback) {
+    var sortColumns = ["name", "name", "managed_by"];
+    var params = {
+        q: data.search.value,
+        offset: data.start,
+        limit: data.length,
+        sort: sortColumns[data.order[0].column],
+        order: data.order[0].dir
+    };
+    $.getJSON("/search/groups", params, function(page) {
+        var groupnames = [];
+        for (var i = 0; i < page.groups.length; i++) {
+            groupnames.push([page.groups[i].name].concat(page.groups[i].managed_by));
+        }
+        callback({
+            draw: data.draw,
+            recordsTotal: page.total,
+            recordsFiltered: page.total,
+            data: array(groupnames)
+        });
+    });
+}
+
+function requestAccessTable(source) {
 
     $(document).ready(function() {
-        $('#display').DataTable( {
-            data: final_groupnames,
+        $('#display').DataTable( $.extend({
             columns: [
                 {title:"select"},
                 {title:"groups"},
@@ -109,7 +141,7 @@ function RequestAccess(final_groupnames) {
                 selector: 'td:first-child'
             },
             order:[[1,'asc']]
-        } );
+        }, source) );
     } );
 
     $(document).ready(function() {
@@ -266,6 +298,46 @@ function list_members(users){
     }
 }
 
+// searchDatalist fills the datalist id with the users or groups (kind)
+// matching what is typed in the input inputid, the directory is searched on
+// the server instead of being loaded with the page. picked is called once
+// the options are in, to take a name typed in full.
+function searchDatalist(inputid, id, kind, picked) {
+    var timer = null;
+    document.getElementById(inputid).addEventListener('input', function () {
+        var query = this.value;
+        clearTimeout(timer);
+        if (query.length < 1) {
+            return;
+        }
+        timer = setTimeout(function () {
+            $.getJSON("/search/" + kind, {q: query, limit: 50}, function(page) {
+                var chosen = [];
+                $("div.suggestion div b").each(function () {
+                    chosen.push($(this).text());
+                });
+                var names = [];
+                var results = kind === "users" ? page.users : page.groups;
+                for (var i = 0; i < results.length; i++) {
+                    var name = kind === "users" ? results[i] : results[i].name;
+                    if (chosen.indexOf(name) < 0) {
+                        names.push(name);
+                    }
+                }
+                $("#" + id).empty();
+                if (id === "select_members") {
+                    list_members(names);
+                } else {
+                    datalist(names);
+                }
+                if (picked != null) {
+                    picked();
+                }
+            });
+        }, 300);
+    });
+}
+
 function ReloadOnSuccessOrAlert(xhttp) {
     if (xhttp.readyState === 4) {
         if (xhttp.status === 200) {
@@ -383,10 +455,10 @@ function deletemembers_fromgroup_form_submit() {
 function group_groupname(){
 
     var val = document.getElementById("cg_groupname").value;
-    var select=document.getElementById('select_groups').value;
+    var managedby = $('#cg_managedby').val();
 
     $('#group_groupname').val(val);
-    $('#group_managedby').val(select);
+    $('#group_managedby').val(managedby);
 
 }
 
@@ -604,22 +676,29 @@ function refractor_removemembers() {
 }
 
 function listgroup_regexp() {
-    $(document).ready(function() {
-        var select = document.getElementById('select_groups').childNodes;
-        var regexp = new RegExp(document.getElementById("group_regexp").value);
-        var output = '';
-        for (var i = 1; i < select.length; i++) {
-            if (select[i].value.match(regexp)) {
-                output += select[i].value + '\n';
+    var regexp = document.getElementById("group_regexp").value;
+    var output = '';
+    // The groups are matched on the server a page at a time.
+    var listgroups_page = function(offset) {
+        $.getJSON("/search/groups", {q: regexp, match: "regexp", offset: offset, limit: 1000}, function(page) {
+            for (var i = 0; i < page.groups.length; i++) {
+                output += page.groups[i].name + '\n';
             }
-        }
-        if (output.length < 1) {
-            document.getElementById('listgroups_output').value = "No matched groups";
-        } else {
-            document.getElementById('listgroups_output').value = output;
-        }
-        $('#group_members').val(output.replace(/\n/g,','));
-    });
+            if (page.groups.length > 0 && offset + page.groups.length < page.total) {
+                listgroups_page(offset + page.groups.length);
+                return;
+            }
+            if (output.length < 1) {
+                document.getElementById('listgroups_output').value = "No matched groups";
+            } else {
+                document.getElementById('listgroups_output').value = output;
+            }
+            $('#group_members').val(output.replace(/\n/g,','));
+        }).fail(function() {
+            document.getElementById('listgroups_output').value = "Invalid regular expression";
+        });
+    };
+    listgroups_page(0);
 }
 
 function dm_groupname() {
@@ -710,6 +789,9 @@ function resource_type() {
 	
 	var resource_name = document.getElementById("resource_name").value;
 	$('#permission_resource_name').val(resource_name);
+
+	var effect = document.getElementById("effect_select").value;
+	$('#permission_effect').val(effect);
 }
 
 function permissionmanage_form_submit() {
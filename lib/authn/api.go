@@ -1,10 +1,14 @@
 package authn
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"os"
+	"sync"
 	"time"
+
+	"gopkg.in/square/go-jose.v2"
 )
 
 type OpenIDConfig struct {
@@ -14,7 +18,32 @@ type OpenIDConfig struct {
 	AuthURL      string `yaml:"auth_url"`
 	TokenURL     string `yaml:"token_url"`
 	UserinfoURL  string `yaml:"userinfo_url"`
+	JWKSURL      string `yaml:"jwks_url"`
 	Scopes       string `yaml:"scopes"`
+	// Expected iss of the ID tokens, defaults to ProviderURL and is
+	// required without it when ID tokens are checked with JWKSURL.
+	Issuer string `yaml:"issuer"`
+	// Claim of the ID token or userinfo listing the groups of the user.
+	GroupsClaim string `yaml:"groups_claim"`
+}
+
+// SAMLConfig describes the SAML identity provider used to log in instead of
+// the OpenID provider, and the key and certificate of this service provider.
+type SAMLConfig struct {
+	IdPSSOURL              string `yaml:"idp_sso_url"`
+	IdPEntityID            string `yaml:"idp_entity_id"`
+	IdPCertificateFilename string `yaml:"idp_certificate_filename"`
+	// Required, usually the https URL of the metadata. Nothing is taken
+	// from the Host header of the requests.
+	EntityID string `yaml:"entity_id"`
+	// Defaults to SAMLACSPath on the host of entity_id, it is required when
+	// entity_id is not an https URL.
+	ACSURL              string `yaml:"acs_url"`
+	CertificateFilename string `yaml:"certificate_filename"`
+	KeyFilename         string `yaml:"key_filename"`
+	// Attribute holding the username, the NameID is used if empty.
+	UsernameAttribute string `yaml:"username_attribute"`
+	GroupsAttribute   string `yaml:"groups_attribute"`
 }
 
 type AuthCookie struct {
@@ -24,17 +53,46 @@ type AuthCookie struct {
 
 type SetHeadersFunc func(w http.ResponseWriter) error
 
+// SessionStore keeps the sessions behind the auth cookies so that they can
+// be ended before the cookies expire.
+type SessionStore interface {
+	// NewSession records a login of username from r and returns its id.
+	NewSession(username string, r *http.Request, expires time.Time) (string, error)
+	// CheckSession reports whether the session id of username is still open.
+	CheckSession(id string, username string) (bool, error)
+	EndSession(id string) error
+}
+
 type Authenticator struct {
 	openID         OpenIDConfig
+	secretsMutex   sync.RWMutex
 	sharedSecrets  []string
 	appName        string
 	netClient      *http.Client
 	logger         *log.Logger
 	setHeadersFunc SetHeadersFunc
+	groupFilter    func(group string) bool
+	sessionStore   SessionStore
+	providerMutex  sync.Mutex
+	provider       *providerMetadata
+	keySetMutex    sync.Mutex
+	keySet         jose.JSONWebKeySet
+	keySetFetched  time.Time
+	saml           *samlServiceProvider
+	// Maps verified client certificates to usernames, their common
+	// name is used if nil.
+	certificateMapperMutex sync.RWMutex
+	certificateMapper      *ClientCertificateMapper
+	// Replaced secrets keep validating cookies until the last ones they
+	// signed have expired.
+	retiredSecrets           []string
+	retiredSecretsExpiration time.Time
 }
 
 const Oauth2redirectPath = "/oauth2/redirect"
 const AuthCookieName = "authn_cookie"
+const SAMLMetadataPath = "/saml/metadata"
+const SAMLACSPath = "/saml/acs"
 
 const secsBetweenCleanup = 30
 
@@ -67,11 +125,101 @@ func NewAuthenticator(config OpenIDConfig, appName string, netClient *http.Clien
 func (a *Authenticator) GetRemoteUserName(w http.ResponseWriter, r *http.Request) (string, error) {
 	return a.getRemoteUserName(w, r)
 }
+
+// GetRemoteUser also returns the groups the identity provider put in the
+// groups claim when the user logged in.
+func (a *Authenticator) GetRemoteUser(w http.ResponseWriter, r *http.Request) (string, []string, error) {
+	return a.getRemoteUser(w, r)
+}
+
+// SetSharedSecrets replaces the secrets signing the cookies, tokens signed
+// with the previous secrets stay valid until they expire.
+func (a *Authenticator) SetSharedSecrets(secrets []string) error {
+	if len(secrets) < 1 || len(secrets[0]) < 1 {
+		return errors.New("no shared secrets")
+	}
+	a.setSharedSecrets(secrets)
+	return nil
+}
+
+// SetGroupFilter limits the groups kept from the groups claim to the ones
+// accepted by filter, they travel in the auth cookie.
+func (a *Authenticator) SetGroupFilter(filter func(group string) bool) {
+	a.groupFilter = filter
+}
+
+// FilterGroups returns the groups accepted by the group filter.
+func (a *Authenticator) FilterGroups(groups []string) []string {
+	var filtered []string
+	for _, group := range groups {
+		if a.groupFilter == nil || a.groupFilter(group) {
+			filtered = append(filtered, group)
+		}
+	}
+	return filtered
+}
+
+// SetClientCertificateMapper replaces the rules turning client certificates
+// into usernames.
+func (a *Authenticator) SetClientCertificateMapper(mapper *ClientCertificateMapper) {
+	a.certificateMapperMutex.Lock()
+	defer a.certificateMapperMutex.Unlock()
+	a.certificateMapper = mapper
+}
+
+// SetSessionStore makes every auth cookie refer to a session of store,
+// cookies without an open session are rejected.
+func (a *Authenticator) SetSessionStore(store SessionStore) {
+	a.sessionStore = store
+}
+
+// GetSessionID returns the session of the auth cookie of r, if any.
+func (a *Authenticator) GetSessionID(r *http.Request) string {
+	return a.getSessionID(r)
+}
+
+// Logout ends the session of r and clears its auth cookie.
+func (a *Authenticator) Logout(w http.ResponseWriter, r *http.Request) error {
+	return a.logout(w, r)
+}
+
+// EnableSAML sends the users to log in at the SAML identity provider of
+// config instead of the OpenID provider.
+func (a *Authenticator) EnableSAML(config SAMLConfig) error {
+	sp, err := newSAMLServiceProvider(config)
+	if err != nil {
+		return err
+	}
+	a.saml = sp
+	return nil
+}
+
+// SAMLMetadataHandler serves the metadata to register with the identity
+// provider.
+func (a *Authenticator) SAMLMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	a.samlMetadataHandler(w, r)
+}
+
+// SAMLACSHandler receives the responses the identity provider posts back.
+func (a *Authenticator) SAMLACSHandler(w http.ResponseWriter, r *http.Request) {
+	a.samlACSHandler(w, r)
+}
+
 func (a *Authenticator) Oauth2RedirectPathHandler(w http.ResponseWriter, r *http.Request) {
 	a.oauth2RedirectPathHandler(w, r)
 }
 
 // This function is only for testing purposes, should not be used in prod
 func (a *Authenticator) GenUserCookieValue(username string, expires time.Time) (string, error) {
-	return a.genUserCookieValue(username, expires)
+	return a.genUserCookieValue(username, nil, "", expires)
+}
+
+// This function is only for testing purposes, should not be used in prod
+func (a *Authenticator) GenUserCookieValueWithGroups(username string, groups []string, expires time.Time) (string, error) {
+	return a.genUserCookieValue(username, groups, "", expires)
+}
+
+// This function is only for testing purposes, should not be used in prod
+func (a *Authenticator) GenSessionCookieValue(username string, sessionID string, expires time.Time) (string, error) {
+	return a.genUserCookieValue(username, nil, sessionID, expires)
 }
@@ -0,0 +1,160 @@
+package authn
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+)
+
+const (
+	ClientCertificateSourceCN    = "cn"
+	ClientCertificateSourceEmail = "email"
+	ClientCertificateSourceURI   = "uri"
+)
+
+var errClientCertificateRevoked = errors.New("client certificate revoked")
+
+// ClientCertificateRule maps the client certificates of an issuer to
+// usernames. The value taken from the certificate must fully match Match,
+// the username is Replace expanded with its submatches.
+type ClientCertificateRule struct {
+	// Common name or distinguished name of the issuer, any if empty.
+	Issuer string `yaml:"issuer"`
+	// One of cn, email or uri, the last two are subject alternative names.
+	Source  string `yaml:"source"`
+	Match   string `yaml:"match"`
+	Replace string `yaml:"replace"`
+}
+
+type clientCertificateRule struct {
+	ClientCertificateRule
+	match *regexp.Regexp
+}
+
+// ClientCertificateMapper turns verified client certificates into usernames
+// and rejects the ones listed in its revocation lists.
+type ClientCertificateMapper struct {
+	rules []clientCertificateRule
+	crls  []*pkix.CertificateList
+}
+
+// NewClientCertificateMapper compiles rules and loads the revocation lists,
+// in PEM or DER, from crlFilenames. Without rules the common name of every
+// certificate is its username.
+func NewClientCertificateMapper(rules []ClientCertificateRule,
+	crlFilenames []string) (*ClientCertificateMapper, error) {
+	if len(rules) < 1 {
+		rules = []ClientCertificateRule{{Source: ClientCertificateSourceCN}}
+	}
+	var mapper ClientCertificateMapper
+	for i, rule := range rules {
+		switch rule.Source {
+		case ClientCertificateSourceCN, ClientCertificateSourceEmail, ClientCertificateSourceURI:
+		default:
+			return nil, fmt.Errorf("client certificate rule %d: invalid source %q", i, rule.Source)
+		}
+		if rule.Match == "" {
+			rule.Match = ".+"
+		}
+		if rule.Replace == "" {
+			rule.Replace = "$0"
+		}
+		match, err := regexp.Compile("^(?:" + rule.Match + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("client certificate rule %d: %s", i, err)
+		}
+		mapper.rules = append(mapper.rules, clientCertificateRule{rule, match})
+	}
+	for _, filename := range crlFilenames {
+		crlBytes, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		if block, _ := pem.Decode(crlBytes); block != nil {
+			crlBytes = block.Bytes
+		}
+		crl, err := x509.ParseDERCRL(crlBytes)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse %s: %s", filename, err)
+		}
+		mapper.crls = append(mapper.crls, crl)
+	}
+	return &mapper, nil
+}
+
+func (rule *clientCertificateRule) values(cert *x509.Certificate) []string {
+	switch rule.Source {
+	case ClientCertificateSourceEmail:
+		return cert.EmailAddresses
+	case ClientCertificateSourceURI:
+		var uris []string
+		for _, uri := range cert.URIs {
+			uris = append(uris, uri.String())
+		}
+		return uris
+	}
+	return []string{cert.Subject.CommonName}
+}
+
+// username returns the username of the first rule matching cert, or an
+// empty string if none does.
+func (mapper *ClientCertificateMapper) username(cert *x509.Certificate) string {
+	for _, rule := range mapper.rules {
+		if rule.Issuer != "" && rule.Issuer != cert.Issuer.CommonName && rule.Issuer != cert.Issuer.String() {
+			continue
+		}
+		for _, value := range rule.values(cert) {
+			indexes := rule.match.FindStringSubmatchIndex(value)
+			if indexes == nil {
+				continue
+			}
+			username := string(rule.match.ExpandString(nil, rule.Replace, value, indexes))
+			if username != "" {
+				return username
+			}
+		}
+	}
+	return ""
+}
+
+// isRevoked reports whether a certificate of chain is listed in a revocation
+// list signed by its issuer. Lists past their next update are still used,
+// their entries stay revoked in the later ones.
+func (mapper *ClientCertificateMapper) isRevoked(chain []*x509.Certificate) bool {
+	for i := 0; i+1 < len(chain); i++ {
+		cert, issuer := chain[i], chain[i+1]
+		for _, crl := range mapper.crls {
+			if issuer.CheckCRLSignature(crl) != nil {
+				continue
+			}
+			for _, revoked := range crl.TBSCertList.RevokedCertificates {
+				if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// getClientCertificateUsername maps the verified chains of a client
+// certificate to a username. An empty username without error means that no
+// rule accepts the certificate and the user must log in otherwise.
+func (s *Authenticator) getClientCertificateUsername(chains [][]*x509.Certificate) (string, error) {
+	s.certificateMapperMutex.RLock()
+	certificateMapper := s.certificateMapper
+	s.certificateMapperMutex.RUnlock()
+	if certificateMapper == nil {
+		return chains[0][0].Subject.CommonName, nil
+	}
+	for _, chain := range chains {
+		if certificateMapper.isRevoked(chain) {
+			return "", errClientCertificateRevoked
+		}
+	}
+	return certificateMapper.username(chains[0][0]), nil
+}
@@ -0,0 +1,197 @@
+package authn
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCertificateAuthority struct {
+	key         *rsa.PrivateKey
+	certificate *x509.Certificate
+}
+
+func newTestCertificateAuthority(t *testing.T, commonName string) *testCertificateAuthority {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificateAuthority{key: key, certificate: certificate}
+}
+
+func (ca *testCertificateAuthority) issue(t *testing.T, serial int64, commonName string,
+	emails []string, uris []string) *x509.Certificate {
+	template := x509.Certificate{
+		SerialNumber:   big.NewInt(serial),
+		Subject:        pkix.Name{CommonName: commonName},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		EmailAddresses: emails,
+	}
+	for _, uri := range uris {
+		parsedURI, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.URIs = append(template.URIs, parsedURI)
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, &template, ca.certificate, &ca.key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+func (ca *testCertificateAuthority) writeCRL(t *testing.T, filename string, serials ...int64) {
+	var revoked []pkix.RevokedCertificate
+	for _, serial := range serials {
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: big.NewInt(serial),
+			RevocationTime: time.Now()})
+	}
+	crl, err := ca.certificate.CreateCRL(rand.Reader, ca.key, revoked, time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func clientCertificateRequest(ca *testCertificateAuthority, cert *x509.Certificate) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{cert, ca.certificate}},
+	}
+	return req
+}
+
+func TestClientCertificateMapping(t *testing.T) {
+	humans := newTestCertificateAuthority(t, "Human CA")
+	services := newTestCertificateAuthority(t, "Service CA")
+	rules := []ClientCertificateRule{
+		{Issuer: "Human CA", Source: ClientCertificateSourceEmail, Match: `([a-z0-9]+)@example\.com`,
+			Replace: "$1"},
+		{Issuer: "CN=Service CA", Source: ClientCertificateSourceURI, Match: `spiffe://example\.com/(.+)`,
+			Replace: "svc-$1"},
+	}
+	mapper, err := NewClientCertificateMapper(rules, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator := NewAuthenticator(testOpenIDConfig, "smallpoint", nil, []string{}, nil, nil)
+	authenticator.SetClientCertificateMapper(mapper)
+
+	mappings := []struct {
+		ca       *testCertificateAuthority
+		cert     *x509.Certificate
+		username string
+	}{
+		{humans, humans.issue(t, 2, "Some User", []string{"other@example.org", "user1@example.com"}, nil),
+			"user1"},
+		{services, services.issue(t, 2, "user1", nil, []string{"spiffe://example.com/deployer"}),
+			"svc-deployer"},
+		// Service certificates cannot claim human names.
+		{services, services.issue(t, 3, "user1", []string{"user1@example.com"}, nil), ""},
+		{humans, humans.issue(t, 3, "user1", []string{"user1@example.org"}, nil), ""},
+	}
+	for _, mapping := range mappings {
+		rr := httptest.NewRecorder()
+		username, _, err := authenticator.GetRemoteUser(rr, clientCertificateRequest(mapping.ca, mapping.cert))
+		if mapping.username == "" {
+			// Unmapped certificates fall back to the login.
+			if err == nil || rr.Code != http.StatusFound {
+				t.Errorf("%s was not sent to the login, got %s", mapping.cert.Subject, username)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if username != mapping.username {
+			t.Errorf("%s mapped to %s instead of %s", mapping.cert.Subject, username, mapping.username)
+		}
+	}
+
+	_, err = NewClientCertificateMapper([]ClientCertificateRule{{Source: "dns"}}, nil)
+	if err == nil {
+		t.Error("invalid source accepted")
+	}
+	_, err = NewClientCertificateMapper([]ClientCertificateRule{{Source: "cn", Match: "("}}, nil)
+	if err == nil {
+		t.Error("invalid match accepted")
+	}
+}
+
+func TestClientCertificateRevocation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCertificateAuthority(t, "Human CA")
+	other := newTestCertificateAuthority(t, "Other CA")
+	crlFilename := filepath.Join(dir, "human.crl")
+	ca.writeCRL(t, crlFilename, 3)
+	// Lists of other issuers do not apply.
+	otherCRLFilename := filepath.Join(dir, "other.crl")
+	other.writeCRL(t, otherCRLFilename, 2)
+	mapper, err := NewClientCertificateMapper(nil, []string{crlFilename, otherCRLFilename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator := NewAuthenticator(OpenIDConfig{}, "smallpoint", nil, []string{}, nil, nil)
+	authenticator.SetClientCertificateMapper(mapper)
+
+	rr := httptest.NewRecorder()
+	username, _, err := authenticator.GetRemoteUser(rr, clientCertificateRequest(ca, ca.issue(t, 2, "user1", nil, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "user1" {
+		t.Fatalf("mapped to %s", username)
+	}
+	rr = httptest.NewRecorder()
+	_, _, err = authenticator.GetRemoteUser(rr, clientCertificateRequest(ca, ca.issue(t, 3, "user2", nil, nil)))
+	if err == nil || rr.Code != http.StatusUnauthorized {
+		t.Fatalf("revoked certificate accepted, got %d", rr.Code)
+	}
+
+	_, err = NewClientCertificateMapper(nil, []string{filepath.Join(dir, "missing.crl")})
+	if err == nil {
+		t.Error("missing revocation list accepted")
+	}
+}
@@ -25,6 +25,21 @@ type oauth2StateJWT struct {
 	NotBefore  int64    `json:"nbf,omitempty"`
 	IssuedAt   int64    `json:"iat,omitempty"`
 	ReturnURL  string   `json:"return_url,omitempty"`
+	Nonce      string   `json:"nonce,omitempty"`
+}
+
+// loginJWT keeps the secrets of a login in progress in a cookie instead of
+// the URLs seen by the provider.
+type loginJWT struct {
+	Issuer       string   `json:"iss,omitempty"`
+	Subject      string   `json:"sub,omitempty"`
+	Audience     []string `json:"aud,omitempty"`
+	Expiration   int64    `json:"exp,omitempty"`
+	NotBefore    int64    `json:"nbf,omitempty"`
+	IssuedAt     int64    `json:"iat,omitempty"`
+	Nonce        string   `json:"nonce,omitempty"`
+	CodeVerifier string   `json:"code_verifier,omitempty"`
+	ReturnURL    string   `json:"return_url,omitempty"`
 }
 
 type accessToken struct {
@@ -41,12 +56,17 @@ type openidConnectUserInfo struct {
 	Username          string `json:"username,omitempty"`
 	PreferredUsername string `json:"preferred_username,omitempty"`
 	Email             string `json:"email,omitempty"`
+	// Groups comes from the claim named by groups_claim, when configured.
+	Groups      []string `json:"-"`
+	groupsFound bool
 }
 
 type authNCookieJWT struct {
 	Issuer     string   `json:"iss,omitempty"`
 	Subject    string   `json:"sub,omitempty"`
 	Username   string   `json:"username,omitempty"`
+	Groups     []string `json:"groups,omitempty"`
+	SessionID  string   `json:"sid,omitempty"`
 	Audience   []string `json:"aud,omitempty"`
 	Expiration int64    `json:"exp,omitempty"`
 	NotBefore  int64    `json:"nbf,omitempty"`
@@ -65,11 +85,13 @@ func randomStringGeneration() (string, error) {
 
 const cookieExpirationHours = 2
 
-func (a *Authenticator) genUserCookieValue(username string, expires time.Time) (string, error) {
-	if len(a.sharedSecrets[0]) < 1 {
+func (a *Authenticator) genUserCookieValue(username string, groups []string, sessionID string,
+	expires time.Time) (string, error) {
+	secret := a.signingSecret()
+	if len(secret) < 1 {
 		return "", errors.New("invalid authenticator state, no shared secrets")
 	}
-	key := []byte(a.sharedSecrets[0])
+	key := []byte(secret)
 	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: key}, (&jose.SignerOptions{}).WithType("JWT"))
 	if err != nil {
 		a.logger.Printf("New jose signer error err: %s", err)
@@ -81,6 +103,8 @@ func (a *Authenticator) genUserCookieValue(username string, expires time.Time) (
 	stateToken := authNCookieJWT{Issuer: issuer,
 		Subject:    subject,
 		Username:   username,
+		Groups:     groups,
+		SessionID:  sessionID,
 		Audience:   []string{issuer},
 		NotBefore:  now,
 		IssuedAt:   now,
@@ -88,9 +112,18 @@ func (a *Authenticator) genUserCookieValue(username string, expires time.Time) (
 	return jwt.Signed(sig).Claims(stateToken).CompactSerialize()
 }
 
-func (s *Authenticator) setAndStoreAuthCookie(w http.ResponseWriter, username string) error {
+func (s *Authenticator) setAndStoreAuthCookie(w http.ResponseWriter, r *http.Request, username string,
+	groups []string) error {
 	expires := time.Now().Add(time.Hour * cookieExpirationHours)
-	cookieValue, err := s.genUserCookieValue(username, expires)
+	var sessionID string
+	if s.sessionStore != nil {
+		var err error
+		sessionID, err = s.sessionStore.NewSession(username, r, expires)
+		if err != nil {
+			return err
+		}
+	}
+	cookieValue, err := s.genUserCookieValue(username, groups, sessionID, expires)
 	if err != nil {
 		return err
 	}
@@ -103,22 +136,26 @@ func getRedirURL(r *http.Request) string {
 	return "https://" + r.Host + Oauth2redirectPath
 }
 
-func (s *Authenticator) generateAuthCodeURL(state string, r *http.Request) string {
+func (s *Authenticator) generateAuthCodeURL(authURL string, state string, login loginJWT,
+	r *http.Request) string {
 	var buf bytes.Buffer
-	buf.WriteString(s.openID.AuthURL)
+	buf.WriteString(authURL)
 	redirectURL := getRedirURL(r)
 	v := url.Values{
-		"response_type": {"code"},
-		"client_id":     {s.openID.ClientID},
-		"scope":         {s.openID.Scopes},
-		"redirect_uri":  {redirectURL},
+		"response_type":         {"code"},
+		"client_id":             {s.openID.ClientID},
+		"scope":                 {s.openID.Scopes},
+		"redirect_uri":          {redirectURL},
+		"nonce":                 {login.Nonce},
+		"code_challenge":        {pkceChallenge(login.CodeVerifier)},
+		"code_challenge_method": {"S256"},
 	}
 
 	if state != "" {
 		// TODO(light): Docs say never to omit state; don't allow empty.
 		v.Set("state", state)
 	}
-	if strings.Contains(s.openID.AuthURL, "?") {
+	if strings.Contains(authURL, "?") {
 		buf.WriteByte('&')
 	} else {
 		buf.WriteByte('?')
@@ -128,13 +165,15 @@ func (s *Authenticator) generateAuthCodeURL(state string, r *http.Request) strin
 }
 
 const redirCookieName = "redir_cookie"
+const loginCookieName = "login_cookie"
 const maxAgeSecondsRedirCookie = 300
 
-func (s *Authenticator) generateValidStateString(r *http.Request) (string, error) {
-	if len(s.sharedSecrets[0]) < 1 {
+func (s *Authenticator) generateValidStateString(r *http.Request, nonce string) (string, error) {
+	secret := s.signingSecret()
+	if len(secret) < 1 {
 		return "", errors.New("invalid authenticator state, no shared secrets")
 	}
-	key := []byte(s.sharedSecrets[0])
+	key := []byte(secret)
 	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: key}, (&jose.SignerOptions{}).WithType("JWT"))
 	if err != nil {
 		log.Printf("New jose signer error err: %s", err)
@@ -147,26 +186,125 @@ func (s *Authenticator) generateValidStateString(r *http.Request) (string, error
 		Subject:    subject,
 		Audience:   []string{issuer},
 		ReturnURL:  r.URL.String(),
+		Nonce:      nonce,
 		NotBefore:  now,
 		IssuedAt:   now,
 		Expiration: now + maxAgeSecondsRedirCookie}
 	return jwt.Signed(sig).Claims(stateToken).CompactSerialize()
 }
 
+// newLogin returns the nonce and PKCE code verifier of a new login with the
+// cookie holding them until the provider redirects back.
+func (s *Authenticator) newLogin(returnURL string) (loginJWT, *http.Cookie, error) {
+	var login loginJWT
+	secret := s.signingSecret()
+	if len(secret) < 1 {
+		return login, nil, errors.New("invalid authenticator state, no shared secrets")
+	}
+	nonce, err := randomStringGeneration()
+	if err != nil {
+		return login, nil, err
+	}
+	codeVerifier, err := randomStringGeneration()
+	if err != nil {
+		return login, nil, err
+	}
+	key := []byte(secret)
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: key}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return login, nil, err
+	}
+	issuer := s.appName
+	now := time.Now().Unix()
+	login = loginJWT{Issuer: issuer,
+		Subject:      "state:" + loginCookieName,
+		Audience:     []string{issuer},
+		NotBefore:    now,
+		IssuedAt:     now,
+		Expiration:   now + maxAgeSecondsRedirCookie,
+		Nonce:        strings.TrimRight(nonce, "="),
+		CodeVerifier: strings.TrimRight(codeVerifier, "="),
+		ReturnURL:    returnURL}
+	cookieValue, err := jwt.Signed(sig).Claims(login).CompactSerialize()
+	if err != nil {
+		return login, nil, err
+	}
+	cookie := &http.Cookie{Name: loginCookieName, Value: cookieValue, Path: Oauth2redirectPath,
+		MaxAge: maxAgeSecondsRedirCookie, HttpOnly: true, Secure: true}
+	return login, cookie, nil
+}
+
 // This is where the redirect to the oath2 provider is computed.
 func (s *Authenticator) oauth2DoRedirectoToProviderHandler(w http.ResponseWriter, r *http.Request) {
-	stateString, err := s.generateValidStateString(r)
+	if s.saml != nil {
+		s.samlDoRedirectToIdPHandler(w, r)
+		return
+	}
+	provider, err := s.getProvider()
+	if err != nil {
+		s.logger.Printf("Error getting the openid provider err: %s\n", err)
+		http.Error(w, "Internal Error ", http.StatusInternalServerError)
+		return
+	}
+	login, loginCookie, err := s.newLogin(r.URL.String())
+	if err != nil {
+		log.Printf("Error from newLogin err: %s\n", err)
+		http.Error(w, "Internal Error ", http.StatusInternalServerError)
+		return
+	}
+	stateString, err := s.generateValidStateString(r, login.Nonce)
 	if err != nil {
 		log.Printf("Error from generateValidStateString err: %s\n", err)
 		http.Error(w, "Internal Error ", http.StatusInternalServerError)
 		return
 	}
-	http.Redirect(w, r, s.generateAuthCodeURL(stateString, r), http.StatusFound)
+	http.SetCookie(w, loginCookie)
+	http.Redirect(w, r, s.generateAuthCodeURL(provider.AuthorizationEndpoint, stateString, login, r), http.StatusFound)
 }
 
 // Next are the functions for checking the callback
+func (s *Authenticator) signingSecret() string {
+	s.secretsMutex.RLock()
+	defer s.secretsMutex.RUnlock()
+	return s.sharedSecrets[0]
+}
+
+// verificationSecrets returns the shared secrets followed by the retired ones
+// which may still have signed unexpired cookies.
+func (s *Authenticator) verificationSecrets() []string {
+	s.secretsMutex.RLock()
+	defer s.secretsMutex.RUnlock()
+	secrets := append([]string{}, s.sharedSecrets...)
+	if time.Now().Before(s.retiredSecretsExpiration) {
+		secrets = append(secrets, s.retiredSecrets...)
+	}
+	return secrets
+}
+
+func (s *Authenticator) setSharedSecrets(secrets []string) {
+	s.secretsMutex.Lock()
+	defer s.secretsMutex.Unlock()
+	isShared := make(map[string]bool)
+	for _, secret := range secrets {
+		isShared[secret] = true
+	}
+	var retiredSecrets []string
+	if time.Now().Before(s.retiredSecretsExpiration) {
+		retiredSecrets = s.retiredSecrets
+	}
+	retiredSecrets = append(retiredSecrets, s.sharedSecrets...)
+	s.retiredSecrets = nil
+	for _, secret := range retiredSecrets {
+		if !isShared[secret] {
+			s.retiredSecrets = append(s.retiredSecrets, secret)
+		}
+	}
+	s.retiredSecretsExpiration = time.Now().Add(time.Hour * cookieExpirationHours)
+	s.sharedSecrets = secrets
+}
+
 func (s *Authenticator) JWTClaims(t *jwt.JSONWebToken, dest ...interface{}) (err error) {
-	for _, key := range s.sharedSecrets {
+	for _, key := range s.verificationSecrets() {
 		binkey := []byte(key)
 		err = t.Claims(binkey, dest...)
 		if err == nil {
@@ -240,6 +378,27 @@ func (s *Authenticator) getVerifyReturnStateJWT(r *http.Request) (oauth2StateJWT
 	return inboundJWT, nil
 }
 
+func (s *Authenticator) getVerifyLoginCookie(r *http.Request) (loginJWT, error) {
+	login := loginJWT{}
+	loginCookie, err := r.Cookie(loginCookieName)
+	if err != nil {
+		return login, err
+	}
+	tok, err := jwt.ParseSigned(loginCookie.Value)
+	if err != nil {
+		return login, err
+	}
+	if err := s.JWTClaims(tok, &login); err != nil {
+		return login, err
+	}
+	if login.Issuer != s.appName || login.Subject != "state:"+loginCookieName ||
+		login.NotBefore > time.Now().Unix() || login.Expiration < time.Now().Unix() ||
+		login.Nonce == "" || login.CodeVerifier == "" {
+		return login, errors.New("invalid JWT values")
+	}
+	return login, nil
+}
+
 func (s *Authenticator) oauth2RedirectPathHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		//s.logger.Printf("Bad method on redirect, should only be GET")
@@ -258,14 +417,27 @@ func (s *Authenticator) oauth2RedirectPathHandler(w http.ResponseWriter, r *http
 		http.Error(w, "null or bad inboundState", http.StatusUnauthorized)
 		return
 	}
+	login, err := s.getVerifyLoginCookie(r)
+	if err != nil || login.Nonce != inboundJWT.Nonce {
+		s.logger.Printf("error processing login cookie err: %v\n", err)
+		http.Error(w, "null or bad login cookie", http.StatusUnauthorized)
+		return
+	}
+	provider, err := s.getProvider()
+	if err != nil {
+		s.logger.Printf("Error getting the openid provider err: %s\n", err)
+		http.Error(w, "bad transaction with openic context ", http.StatusInternalServerError)
+		return
+	}
 	// OK state  is valid.. now we perform the token exchange
 	redirectURL := getRedirURL(r)
-	tokenRespBody, err := s.getBytesFromSuccessfullPost(s.openID.TokenURL,
+	tokenRespBody, err := s.getBytesFromSuccessfullPost(provider.TokenEndpoint,
 		url.Values{"redirect_uri": {redirectURL},
 			"code":          {authCode},
 			"grant_type":    {"authorization_code"},
 			"client_id":     {s.openID.ClientID},
 			"client_secret": {s.openID.ClientSecret},
+			"code_verifier": {login.CodeVerifier},
 		})
 	if err != nil {
 		s.logger.Printf("Error getting byes fom post err: %s", err)
@@ -279,32 +451,64 @@ func (s *Authenticator) oauth2RedirectPathHandler(w http.ResponseWriter, r *http
 		http.Error(w, "cannot decode oath2 response for token ", http.StatusInternalServerError)
 		return
 	}
-	// TODO: tolower
-	if oauth2AccessToken.TokenType != "Bearer" || len(oauth2AccessToken.AccessToken) < 1 {
+	if !strings.EqualFold(oauth2AccessToken.TokenType, "Bearer") || len(oauth2AccessToken.AccessToken) < 1 {
 		s.logger.Printf("token type invalid token=%s", string(tokenRespBody))
 		http.Error(w, "invalid accessToken ", http.StatusInternalServerError)
 		return
 	}
 
-	// Now we use the access_token (from token exchange) to get userinfo
-	userInfoRespBody, err := s.getBytesFromSuccessfullPost(s.openID.UserinfoURL,
-		url.Values{"access_token": {oauth2AccessToken.AccessToken}})
-	if err != nil {
-		s.logger.Println(err)
-		http.Error(w, "bad transaction with openic context ", http.StatusInternalServerError)
-		return
-	}
+	// An OpenID Connect provider, one publishing its keys, must identify
+	// the user with a valid ID token.
 	var userInfo openidConnectUserInfo
-	err = json.Unmarshal(userInfoRespBody, &userInfo)
-	if err != nil {
-		s.logger.Printf("Error unmarshalling userinfo ")
-		//s.logger.Debugf(1, "unmarshal error %s\n", string(tokenRespBody))
-		http.Error(w, "cannot decode oath2 userinfo token ", http.StatusInternalServerError)
-		return
+	if provider.JWKSURI != "" {
+		userInfo, err = s.validateIDToken(provider, oauth2AccessToken.IDToken, login.Nonce)
+		if err != nil {
+			s.logger.Printf("invalid ID token err: %s", err)
+			http.Error(w, "invalid ID token", http.StatusUnauthorized)
+			return
+		}
 	}
 	username := getUsernameFromUserinfo(userInfo)
+	groups := userInfo.Groups
+	needGroups := s.openID.GroupsClaim != "" && !userInfo.groupsFound && provider.UserinfoEndpoint != ""
+	if len(username) < 1 || needGroups {
+		// Now we use the access_token (from token exchange) to get userinfo
+		var claims map[string]interface{}
+		err = s.getJSON(provider.UserinfoEndpoint,
+			http.Header{"Authorization": {"Bearer " + oauth2AccessToken.AccessToken}}, &claims)
+		if err != nil {
+			s.logger.Println(err)
+			http.Error(w, "bad transaction with openic context ", http.StatusInternalServerError)
+			return
+		}
+		endpointUserInfo, err := s.getUserInfoFromClaims(claims)
+		if err != nil {
+			s.logger.Printf("Error unmarshalling userinfo err: %s", err)
+			http.Error(w, "cannot decode oath2 userinfo token ", http.StatusInternalServerError)
+			return
+		}
+		if userInfo.Subject != "" && endpointUserInfo.Subject != userInfo.Subject {
+			s.logger.Printf("userinfo subject %s does not match ID token subject %s",
+				endpointUserInfo.Subject, userInfo.Subject)
+			http.Error(w, "invalid userinfo", http.StatusUnauthorized)
+			return
+		}
+		if len(username) < 1 {
+			username = getUsernameFromUserinfo(endpointUserInfo)
+		}
+		if !userInfo.groupsFound {
+			groups = endpointUserInfo.Groups
+		}
+	}
+	if len(username) < 1 {
+		s.logger.Printf("no username in userinfo")
+		http.Error(w, "cannot find username", http.StatusUnauthorized)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: loginCookieName, Value: "", Path: Oauth2redirectPath,
+		MaxAge: -1, HttpOnly: true, Secure: true})
 
-	err = s.setAndStoreAuthCookie(w, username)
+	err = s.setAndStoreAuthCookie(w, r, username, groups)
 	if err != nil {
 		s.logger.Println(err)
 		http.Error(w, "cannot set auth Cookie", http.StatusInternalServerError)
@@ -317,21 +521,28 @@ func (s *Authenticator) oauth2RedirectPathHandler(w http.ResponseWriter, r *http
 
 // validateUserCookieValue returns "" if no or bad username, returns non-nil error for fatal errors only
 func (s *Authenticator) validateUserCookieValue(remoteCookieValue string) (string, error) {
+	inboundJWT, err := s.parseUserCookieValue(remoteCookieValue)
+	return inboundJWT.Username, err
+}
+
+// parseUserCookieValue returns the claims of the cookie, their username is
+// empty if the cookie is bad.
+func (s *Authenticator) parseUserCookieValue(remoteCookieValue string) (authNCookieJWT, error) {
 	inboundJWT := authNCookieJWT{}
 	if len(remoteCookieValue) < 1 {
 		s.logger.Printf("Invalid cookie value (too small)")
-		return "", nil
+		return authNCookieJWT{}, nil
 	}
 	tok, err := jwt.ParseSigned(remoteCookieValue)
 	if err != nil {
 		s.logger.Printf("Invalid cookie value(jwt) (%s)", err)
-		return "", nil
+		return authNCookieJWT{}, nil
 	}
 	if err := s.JWTClaims(tok, &inboundJWT); err != nil {
 		s.logger.Printf("error validating JWT claims err: %s\n", err)
 		// TODO: this path could have fatal errors, need to take this into account
 		// to avoid a potential redirect loop.
-		return "", nil
+		return authNCookieJWT{}, nil
 	}
 	// At this point we know the signature is valid, but now we must
 	// validate the contents of the JWT token
@@ -340,29 +551,42 @@ func (s *Authenticator) validateUserCookieValue(remoteCookieValue string) (strin
 	if inboundJWT.Issuer != issuer || inboundJWT.Subject != subject ||
 		inboundJWT.NotBefore > time.Now().Unix() || inboundJWT.Expiration < time.Now().Unix() {
 		s.logger.Printf("invalid JWT values")
-		return "", nil
+		return authNCookieJWT{}, nil
 	}
 	username := inboundJWT.Username
 	if len(username) < 1 {
-		return "", errors.New("bad cookie Vauue state")
+		return authNCookieJWT{}, errors.New("bad cookie Vauue state")
 	}
-	return inboundJWT.Username, nil
+	return inboundJWT, nil
 
 }
 
 func (s *Authenticator) getRemoteUserName(w http.ResponseWriter, r *http.Request) (string, error) {
+	username, _, err := s.getRemoteUser(w, r)
+	return username, err
+}
+
+func (s *Authenticator) getRemoteUser(w http.ResponseWriter, r *http.Request) (string, []string, error) {
 	// If you have a verified cert, no need for cookies
 	if r.TLS != nil {
 		if len(r.TLS.VerifiedChains) > 0 {
-			clientName := r.TLS.VerifiedChains[0][0].Subject.CommonName
-			return clientName, nil
+			clientName, err := s.getClientCertificateUsername(r.TLS.VerifiedChains)
+			if err != nil {
+				s.logger.Printf("rejected client certificate %s: %s",
+					r.TLS.VerifiedChains[0][0].Subject, err)
+				http.Error(w, "invalid client certificate", http.StatusUnauthorized)
+				return "", nil, err
+			}
+			if clientName != "" {
+				return clientName, nil, nil
+			}
 		}
 	}
 
 	if s.setHeadersFunc != nil {
 		err := s.setHeadersFunc(w)
 		if err != nil {
-			return "", err
+			return "", nil, err
 		}
 	}
 
@@ -370,18 +594,60 @@ func (s *Authenticator) getRemoteUserName(w http.ResponseWriter, r *http.Request
 	if err != nil {
 		//s.logger.Debugf(1, "Err cookie %s", err)
 		s.oauth2DoRedirectoToProviderHandler(w, r)
-		return "", err
+		return "", nil, err
 	}
-	username, err := s.validateUserCookieValue(remoteCookie.Value)
+	inboundJWT, err := s.parseUserCookieValue(remoteCookie.Value)
 	if err != nil {
 		http.Error(w, "bad transaction with openic context ", http.StatusInternalServerError)
-		return "", err
+		return "", nil, err
 	}
-	if username == "" {
+	if inboundJWT.Username == "" {
 		log.Printf("invalid Cookie Value")
 		s.oauth2DoRedirectoToProviderHandler(w, r)
-		return "", errors.New("Invalid Cookie Value")
+		return "", nil, errors.New("Invalid Cookie Value")
 
 	}
-	return username, nil
+	if s.sessionStore != nil {
+		valid := false
+		if inboundJWT.SessionID != "" {
+			valid, err = s.sessionStore.CheckSession(inboundJWT.SessionID, inboundJWT.Username)
+			if err != nil {
+				http.Error(w, "cannot check session", http.StatusInternalServerError)
+				return "", nil, err
+			}
+		}
+		if !valid {
+			log.Printf("session of %s is no longer valid", inboundJWT.Username)
+			s.oauth2DoRedirectoToProviderHandler(w, r)
+			return "", nil, errors.New("Invalid session")
+		}
+	}
+	return inboundJWT.Username, inboundJWT.Groups, nil
+}
+
+// getSessionID returns the session of the auth cookie of r, or an empty
+// string.
+func (s *Authenticator) getSessionID(r *http.Request) string {
+	remoteCookie, err := r.Cookie(AuthCookieName)
+	if err != nil {
+		return ""
+	}
+	inboundJWT, err := s.parseUserCookieValue(remoteCookie.Value)
+	if err != nil {
+		return ""
+	}
+	return inboundJWT.SessionID
+}
+
+func (s *Authenticator) logout(w http.ResponseWriter, r *http.Request) error {
+	sessionID := s.getSessionID(r)
+	if sessionID != "" && s.sessionStore != nil {
+		err := s.sessionStore.EndSession(sessionID)
+		if err != nil {
+			return err
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: AuthCookieName, Value: "", Path: "/",
+		MaxAge: -1, HttpOnly: true, Secure: true})
+	return nil
 }
@@ -12,6 +12,9 @@ import (
 	"time"
 )
 
+var testOpenIDConfig = OpenIDConfig{AuthURL: "https://idp.example.com/authorize",
+	TokenURL: "https://idp.example.com/token", UserinfoURL: "https://idp.example.com/userinfo"}
+
 func TestOauth2RedirectHandlerSucccess(t *testing.T) {
 	//slogger := stdlog.New(os.Stderr, "", stdlog.LstdFlags)
 	//logger := debuglogger.New(slogger)
@@ -23,7 +26,11 @@ func TestOauth2RedirectHandlerSucccess(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	stateString, err := authenticator.generateValidStateString(req)
+	login, loginCookie, err := authenticator.newLogin("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateString, err := authenticator.generateValidStateString(req, login.Nonce)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -32,12 +39,14 @@ func TestOauth2RedirectHandlerSucccess(t *testing.T) {
 		"code":  {"12345"},
 	}
 	redirReq, err := http.NewRequest("GET", "/?"+v.Encode(), nil)
+	redirReq.AddCookie(loginCookie)
 
 	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, "{\"access_token\": \"6789\", \"token_type\": \"Bearer\",\"username\":\"user\"}")
 	}))
 	defer ts.Close()
 	authenticator.netClient = ts.Client()
+	authenticator.openID.AuthURL = ts.URL
 	authenticator.openID.TokenURL = ts.URL
 	authenticator.openID.UserinfoURL = ts.URL
 
@@ -104,7 +113,7 @@ func TestValidateUserCookieValue(t *testing.T) {
 
 func TestGetRemoteUserNameHandler(t *testing.T) {
 
-	authenticator := NewAuthenticator(OpenIDConfig{}, "smallpoint", nil, []string{}, nil, nil)
+	authenticator := NewAuthenticator(testOpenIDConfig, "smallpoint", nil, []string{}, nil, nil)
 
 	// Test with no cookies... inmediate redirect
 	urlList := []string{"/", "/static/foo"}
@@ -183,3 +192,39 @@ func TestGetRemoteUserNameHandler(t *testing.T) {
 	}, http.StatusFound)
 
 }
+
+func TestSharedSecretRotation(t *testing.T) {
+	authenticator := NewAuthenticator(OpenIDConfig{}, "smallpoint", nil, []string{"secret1"}, nil, nil)
+	expires := time.Now().Add(time.Hour)
+	oldCookie, err := authenticator.GenUserCookieValue("user", expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = authenticator.SetSharedSecrets(nil)
+	if err == nil {
+		t.Fatal("empty secrets should be refused")
+	}
+	err = authenticator.SetSharedSecrets([]string{"secret2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	username, err := authenticator.validateUserCookieValue(oldCookie)
+	if err != nil || username != "user" {
+		t.Fatalf("cookie of the previous secret rejected during the rotation %q %v", username, err)
+	}
+	newCookie, err := authenticator.GenUserCookieValue("user", expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated := NewAuthenticator(OpenIDConfig{}, "smallpoint", nil, []string{"secret2"}, nil, nil)
+	username, err = rotated.validateUserCookieValue(newCookie)
+	if err != nil || username != "user" {
+		t.Fatal("new cookies should be signed with the new secret")
+	}
+
+	authenticator.retiredSecretsExpiration = time.Now()
+	username, err = authenticator.validateUserCookieValue(oldCookie)
+	if err != nil || username != "" {
+		t.Fatal("cookie of the retired secret accepted after the rotation")
+	}
+}
@@ -0,0 +1,234 @@
+package authn
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const discoveryPath = "/.well-known/openid-configuration"
+
+// Clock skew tolerated when checking the times of an ID token.
+const idTokenLeeway = time.Minute
+
+// Minimum time between two fetches of the key set, so that tokens with
+// made up key IDs cannot make us hammer the provider.
+const keySetRefreshInterval = time.Minute
+
+// Algorithms an ID token may be signed with, the symmetric ones would make
+// the client secret the signing key.
+var idTokenAlgorithms = map[string]bool{
+	string(jose.RS256): true, string(jose.RS384): true, string(jose.RS512): true,
+	string(jose.PS256): true, string(jose.PS384): true, string(jose.PS512): true,
+	string(jose.ES256): true, string(jose.ES384): true, string(jose.ES512): true,
+}
+
+// providerMetadata holds the part of the discovery document we use.
+type providerMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type idTokenClaims struct {
+	jwt.Claims
+	Nonce string `json:"nonce"`
+}
+
+func (s *Authenticator) getJSON(url string, header http.Header, dest interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Accept", "application/json")
+	response, err := s.netClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", url, response.Status)
+	}
+	return json.Unmarshal(body, dest)
+}
+
+// getProvider returns the endpoints of the provider. The ones missing
+// from the configuration come from the discovery document of ProviderURL,
+// which is fetched once it is needed and kept after it succeeds.
+func (s *Authenticator) getProvider() (providerMetadata, error) {
+	s.providerMutex.Lock()
+	defer s.providerMutex.Unlock()
+	if s.provider != nil {
+		return *s.provider, nil
+	}
+	issuer := s.openID.Issuer
+	if issuer == "" {
+		issuer = s.openID.ProviderURL
+	}
+	provider := providerMetadata{
+		Issuer:                issuer,
+		AuthorizationEndpoint: s.openID.AuthURL,
+		TokenEndpoint:         s.openID.TokenURL,
+		UserinfoEndpoint:      s.openID.UserinfoURL,
+		JWKSURI:               s.openID.JWKSURL,
+	}
+	if s.openID.ProviderURL != "" {
+		var discovered providerMetadata
+		err := s.getJSON(strings.TrimSuffix(s.openID.ProviderURL, "/")+discoveryPath, nil, &discovered)
+		if err != nil {
+			return provider, err
+		}
+		if strings.TrimSuffix(discovered.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+			return provider, fmt.Errorf("discovery document of %s is for issuer %s",
+				s.openID.ProviderURL, discovered.Issuer)
+		}
+		provider.Issuer = discovered.Issuer
+		if provider.AuthorizationEndpoint == "" {
+			provider.AuthorizationEndpoint = discovered.AuthorizationEndpoint
+		}
+		if provider.TokenEndpoint == "" {
+			provider.TokenEndpoint = discovered.TokenEndpoint
+		}
+		if provider.UserinfoEndpoint == "" {
+			provider.UserinfoEndpoint = discovered.UserinfoEndpoint
+		}
+		if provider.JWKSURI == "" {
+			provider.JWKSURI = discovered.JWKSURI
+		}
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" {
+		return provider, errors.New("missing authorization or token endpoint")
+	}
+	if provider.JWKSURI != "" && provider.Issuer == "" {
+		return provider, errors.New("missing issuer to check the ID tokens against")
+	}
+	s.provider = &provider
+	return provider, nil
+}
+
+// getSigningKey returns the key of the provider with keyID. The key set is
+// fetched again when keyID is unknown so that rotated keys are picked up,
+// at most once per keySetRefreshInterval.
+func (s *Authenticator) getSigningKey(jwksURI string, keyID string) (*jose.JSONWebKey, error) {
+	s.keySetMutex.Lock()
+	defer s.keySetMutex.Unlock()
+	keys := s.keySet.Key(keyID)
+	if len(keys) < 1 && time.Since(s.keySetFetched) >= keySetRefreshInterval {
+		s.keySetFetched = time.Now()
+		var keySet jose.JSONWebKeySet
+		err := s.getJSON(jwksURI, nil, &keySet)
+		if err != nil {
+			return nil, err
+		}
+		s.keySet = keySet
+		keys = s.keySet.Key(keyID)
+	}
+	for _, key := range keys {
+		if key.Use == "" || key.Use == "sig" {
+			return &key, nil
+		}
+	}
+	return nil, fmt.Errorf("no signing key %q in %s", keyID, jwksURI)
+}
+
+// validateIDToken checks the signature and the claims of rawIDToken and
+// returns the user it was issued for.
+func (s *Authenticator) validateIDToken(provider providerMetadata, rawIDToken string,
+	nonce string) (openidConnectUserInfo, error) {
+	var userInfo openidConnectUserInfo
+	token, err := jwt.ParseSigned(rawIDToken)
+	if err != nil {
+		return userInfo, err
+	}
+	if len(token.Headers) != 1 || !idTokenAlgorithms[token.Headers[0].Algorithm] {
+		return userInfo, errors.New("invalid ID token algorithm")
+	}
+	key, err := s.getSigningKey(provider.JWKSURI, token.Headers[0].KeyID)
+	if err != nil {
+		return userInfo, err
+	}
+	var claims idTokenClaims
+	var rawClaims map[string]interface{}
+	err = token.Claims(key.Key, &claims, &rawClaims)
+	if err != nil {
+		return userInfo, err
+	}
+	userInfo, err = s.getUserInfoFromClaims(rawClaims)
+	if err != nil {
+		return userInfo, err
+	}
+	err = claims.ValidateWithLeeway(jwt.Expected{
+		Issuer:   provider.Issuer,
+		Audience: jwt.Audience{s.openID.ClientID},
+		Time:     time.Now(),
+	}, idTokenLeeway)
+	if err != nil {
+		return userInfo, err
+	}
+	if claims.Expiry == nil || claims.Subject == "" {
+		return userInfo, errors.New("ID token without expiration or subject")
+	}
+	if claims.Nonce != nonce {
+		return userInfo, errors.New("invalid ID token nonce")
+	}
+	return userInfo, nil
+}
+
+// getUserInfoFromClaims decodes the claims of an ID token or of the userinfo
+// endpoint, keeping the groups which pass the group filter.
+func (s *Authenticator) getUserInfoFromClaims(claims map[string]interface{}) (openidConnectUserInfo, error) {
+	var userInfo openidConnectUserInfo
+	encoded, err := json.Marshal(claims)
+	if err != nil {
+		return userInfo, err
+	}
+	err = json.Unmarshal(encoded, &userInfo)
+	if err != nil {
+		return userInfo, err
+	}
+	if s.openID.GroupsClaim == "" {
+		return userInfo, nil
+	}
+	var groups []string
+	switch value := claims[s.openID.GroupsClaim].(type) {
+	case nil:
+		return userInfo, nil
+	case string:
+		groups = []string{value}
+	case []interface{}:
+		for _, group := range value {
+			if groupname, ok := group.(string); ok {
+				groups = append(groups, groupname)
+			}
+		}
+	default:
+		return userInfo, fmt.Errorf("invalid %s claim", s.openID.GroupsClaim)
+	}
+	userInfo.groupsFound = true
+	userInfo.Groups = s.FilterGroups(groups)
+	return userInfo, nil
+}
+
+// pkceChallenge is the S256 code challenge of verifier (RFC 7636).
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
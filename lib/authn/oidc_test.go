@@ -0,0 +1,425 @@
+package authn
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const testClientID = "smallpoint-client"
+
+type fakeAuthorization struct {
+	challenge string
+	nonce     string
+}
+
+// fakeOIDCProvider is a minimal OpenID Connect provider, its tokens are
+// signed with the key named signingKeyID.
+type fakeOIDCProvider struct {
+	server *httptest.Server
+
+	mutex          sync.Mutex
+	keys           map[string]*rsa.PrivateKey
+	publishedKeys  []string
+	signingKeyID   string
+	authorizations map[string]fakeAuthorization
+	// Claims added to the ID tokens, a "nonce" replaces the one requested.
+	extraClaims  map[string]interface{}
+	userinfo     map[string]interface{}
+	jwksRequests int
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	provider := &fakeOIDCProvider{
+		keys:           make(map[string]*rsa.PrivateKey),
+		authorizations: make(map[string]fakeAuthorization),
+		extraClaims:    map[string]interface{}{"preferred_username": "alice"},
+		userinfo:       map[string]interface{}{"sub": "alice-id", "preferred_username": "alice"},
+	}
+	provider.addKey(t, "key1", true)
+	provider.signingKeyID = "key1"
+	mux := http.NewServeMux()
+	mux.HandleFunc(discoveryPath, provider.discoveryHandler)
+	mux.HandleFunc("/token", provider.tokenHandler)
+	mux.HandleFunc("/userinfo", provider.userinfoHandler)
+	mux.HandleFunc("/jwks", provider.jwksHandler)
+	provider.server = httptest.NewTLSServer(mux)
+	return provider
+}
+
+func (p *fakeOIDCProvider) addKey(t *testing.T, keyID string, published bool) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.keys[keyID] = key
+	if published {
+		p.publishedKeys = append(p.publishedKeys, keyID)
+	}
+}
+
+func (p *fakeOIDCProvider) discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(providerMetadata{
+		Issuer:                p.server.URL,
+		AuthorizationEndpoint: p.server.URL + "/authorize",
+		TokenEndpoint:         p.server.URL + "/token",
+		UserinfoEndpoint:      p.server.URL + "/userinfo",
+		JWKSURI:               p.server.URL + "/jwks",
+	})
+}
+
+func (p *fakeOIDCProvider) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.jwksRequests++
+	var keySet jose.JSONWebKeySet
+	for _, keyID := range p.publishedKeys {
+		keySet.Keys = append(keySet.Keys, jose.JSONWebKey{Key: &p.keys[keyID].PublicKey, KeyID: keyID,
+			Algorithm: string(jose.RS256), Use: "sig"})
+	}
+	json.NewEncoder(w).Encode(keySet)
+}
+
+func (p *fakeOIDCProvider) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if r.Method != "POST" || r.ParseForm() != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	authorization, ok := p.authorizations[r.PostForm.Get("code")]
+	if !ok || r.PostForm.Get("client_id") != testClientID ||
+		pkceChallenge(r.PostForm.Get("code_verifier")) != authorization.challenge {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+	delete(p.authorizations, r.PostForm.Get("code"))
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: p.keys[p.signingKeyID]},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", p.signingKeyID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	claims := jwt.Claims{Issuer: p.server.URL, Subject: "alice-id", Audience: jwt.Audience{testClientID},
+		IssuedAt: jwt.NewNumericDate(now), Expiry: jwt.NewNumericDate(now.Add(time.Hour))}
+	extraClaims := map[string]interface{}{"nonce": authorization.nonce}
+	for key, value := range p.extraClaims {
+		extraClaims[key] = value
+	}
+	idToken, err := jwt.Signed(signer).Claims(claims).Claims(extraClaims).CompactSerialize()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "access-" + authorization.nonce,
+		"token_type": "bearer", "expires_in": 3600, "id_token": idToken})
+}
+
+func (p *fakeOIDCProvider) userinfoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" || !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer access-") {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	json.NewEncoder(w).Encode(p.userinfo)
+}
+
+// login sends a request without credentials to authenticator, plays the
+// part of the user at the provider and returns the response to the
+// callback.
+func (p *fakeOIDCProvider) login(t *testing.T, authenticator *Authenticator) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/groups", nil)
+	rr := httptest.NewRecorder()
+	_, err := authenticator.GetRemoteUserName(rr, req)
+	if err == nil || rr.Code != http.StatusFound {
+		t.Fatalf("expected a redirect to the provider, got %d", rr.Code)
+	}
+	location, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := location.Query()
+	if !strings.HasPrefix(location.String(), p.server.URL+"/authorize?") ||
+		query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" ||
+		query.Get("nonce") == "" || query.Get("client_id") != testClientID {
+		t.Fatalf("bad authorization request %s", location)
+	}
+	p.mutex.Lock()
+	p.authorizations["code-"+query.Get("nonce")] = fakeAuthorization{challenge: query.Get("code_challenge"),
+		nonce: query.Get("nonce")}
+	p.mutex.Unlock()
+
+	callback := httptest.NewRequest("GET", Oauth2redirectPath+"?"+url.Values{
+		"state": {query.Get("state")}, "code": {"code-" + query.Get("nonce")}}.Encode(), nil)
+	for _, cookie := range rr.Result().Cookies() {
+		callback.AddCookie(cookie)
+	}
+	rr = httptest.NewRecorder()
+	authenticator.Oauth2RedirectPathHandler(rr, callback)
+	return rr
+}
+
+func checkLoggedIn(t *testing.T, authenticator *Authenticator, rr *httptest.ResponseRecorder, expectedUser string) {
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != "/groups" {
+		t.Fatalf("login failed with %d: %s", rr.Code, rr.Body.String())
+	}
+	for _, cookie := range rr.Result().Cookies() {
+		if cookie.Name == AuthCookieName {
+			username, err := authenticator.validateUserCookieValue(cookie.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if username != expectedUser {
+				t.Fatalf("logged in as %q", username)
+			}
+			return
+		}
+	}
+	t.Fatal("no auth cookie set")
+}
+
+func newTestOIDCAuthenticator(provider *fakeOIDCProvider) *Authenticator {
+	return NewAuthenticator(OpenIDConfig{ClientID: testClientID, ClientSecret: "secret",
+		ProviderURL: provider.server.URL, Scopes: "openid profile"},
+		"smallpoint", provider.server.Client(), []string{}, nil, nil)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	defer provider.server.Close()
+	authenticator := newTestOIDCAuthenticator(provider)
+	checkLoggedIn(t, authenticator, provider.login(t, authenticator), "alice")
+
+	// Without a username in the ID token the userinfo endpoint is used.
+	provider.extraClaims = map[string]interface{}{}
+	provider.userinfo["preferred_username"] = "alice2"
+	checkLoggedIn(t, authenticator, provider.login(t, authenticator), "alice2")
+
+	// The userinfo must be about the user of the ID token.
+	provider.userinfo["sub"] = "mallory-id"
+	rr := provider.login(t, authenticator)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("userinfo of another subject returned %d", rr.Code)
+	}
+}
+
+func TestOIDCRejectsBadIDTokens(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	defer provider.server.Close()
+	authenticator := newTestOIDCAuthenticator(provider)
+
+	provider.extraClaims["nonce"] = "replayed"
+	rr := provider.login(t, authenticator)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong nonce returned %d", rr.Code)
+	}
+	delete(provider.extraClaims, "nonce")
+
+	provider.extraClaims["aud"] = "another-client"
+	rr = provider.login(t, authenticator)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong audience returned %d", rr.Code)
+	}
+	delete(provider.extraClaims, "aud")
+
+	provider.addKey(t, "rogue", false)
+	provider.signingKeyID = "rogue"
+	rr = provider.login(t, authenticator)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("unknown signing key returned %d", rr.Code)
+	}
+
+	// The callback must come from the browser which started the login.
+	provider.signingKeyID = "key1"
+	req := httptest.NewRequest("GET", "/", nil)
+	login, _, err := authenticator.newLogin("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateString, err := authenticator.generateValidStateString(req, login.Nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback := httptest.NewRequest("GET", Oauth2redirectPath+"?"+url.Values{
+		"state": {stateString}, "code": {"code"}}.Encode(), nil)
+	rr = httptest.NewRecorder()
+	authenticator.Oauth2RedirectPathHandler(rr, callback)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("callback without login cookie returned %d", rr.Code)
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	defer provider.server.Close()
+	authenticator := newTestOIDCAuthenticator(provider)
+	checkLoggedIn(t, authenticator, provider.login(t, authenticator), "alice")
+	checkLoggedIn(t, authenticator, provider.login(t, authenticator), "alice")
+	if provider.jwksRequests != 1 {
+		t.Fatalf("key set fetched %d times", provider.jwksRequests)
+	}
+
+	// Unknown keys only refresh the key set once per interval.
+	provider.addKey(t, "key2", true)
+	provider.signingKeyID = "key2"
+	rr := provider.login(t, authenticator)
+	if rr.Code != http.StatusUnauthorized || provider.jwksRequests != 1 {
+		t.Fatalf("key set refreshed right after a fetch, got %d", rr.Code)
+	}
+	authenticator.keySetFetched = time.Now().Add(-keySetRefreshInterval)
+	checkLoggedIn(t, authenticator, provider.login(t, authenticator), "alice")
+	if provider.jwksRequests != 2 {
+		t.Fatalf("key set fetched %d times after a rotation", provider.jwksRequests)
+	}
+}
+
+func TestOIDCIssuer(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	defer provider.server.Close()
+	openID := OpenIDConfig{ClientID: testClientID, ClientSecret: "secret", Scopes: "openid profile",
+		AuthURL: provider.server.URL + "/authorize", TokenURL: provider.server.URL + "/token",
+		UserinfoURL: provider.server.URL + "/userinfo", JWKSURL: provider.server.URL + "/jwks"}
+	authenticator := NewAuthenticator(openID, "smallpoint", provider.server.Client(), []string{}, nil, nil)
+	_, err := authenticator.getProvider()
+	if err == nil {
+		t.Fatal("ID tokens checked without an issuer")
+	}
+
+	openID.Issuer = "https://other.example.com"
+	authenticator = NewAuthenticator(openID, "smallpoint", provider.server.Client(), []string{}, nil, nil)
+	rr := provider.login(t, authenticator)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("ID token of another issuer returned %d", rr.Code)
+	}
+	openID.Issuer = provider.server.URL
+	authenticator = NewAuthenticator(openID, "smallpoint", provider.server.Client(), []string{}, nil, nil)
+	checkLoggedIn(t, authenticator, provider.login(t, authenticator), "alice")
+}
+
+func TestOIDCGroupsClaim(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	defer provider.server.Close()
+	authenticator := NewAuthenticator(OpenIDConfig{ClientID: testClientID, ClientSecret: "secret",
+		ProviderURL: provider.server.URL, Scopes: "openid profile", GroupsClaim: "groups"},
+		"smallpoint", provider.server.Client(), []string{}, nil, nil)
+	authenticator.SetGroupFilter(func(group string) bool { return group != "everyone" })
+	loginGroups := func() []string {
+		rr := provider.login(t, authenticator)
+		checkLoggedIn(t, authenticator, rr, "alice")
+		for _, cookie := range rr.Result().Cookies() {
+			if cookie.Name == AuthCookieName {
+				req := httptest.NewRequest("GET", "/groups", nil)
+				req.AddCookie(cookie)
+				_, groups, err := authenticator.GetRemoteUser(httptest.NewRecorder(), req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return groups
+			}
+		}
+		return nil
+	}
+
+	provider.extraClaims["groups"] = []string{"idp-admins", "everyone"}
+	groups := loginGroups()
+	if len(groups) != 1 || groups[0] != "idp-admins" {
+		t.Fatalf("bad groups from the ID token %q", groups)
+	}
+
+	// Without the claim in the ID token the userinfo endpoint is used.
+	delete(provider.extraClaims, "groups")
+	provider.userinfo["groups"] = "idp-auditors"
+	groups = loginGroups()
+	if len(groups) != 1 || groups[0] != "idp-auditors" {
+		t.Fatalf("bad groups from the userinfo %q", groups)
+	}
+}
+
+type testSessionStore struct {
+	sessions map[string]string
+}
+
+func (store *testSessionStore) NewSession(username string, r *http.Request, expires time.Time) (string, error) {
+	id := "session" + strconv.Itoa(len(store.sessions))
+	store.sessions[id] = username
+	return id, nil
+}
+
+func (store *testSessionStore) CheckSession(id string, username string) (bool, error) {
+	return store.sessions[id] == username, nil
+}
+
+func (store *testSessionStore) EndSession(id string) error {
+	delete(store.sessions, id)
+	return nil
+}
+
+func TestSessions(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	defer provider.server.Close()
+	authenticator := newTestOIDCAuthenticator(provider)
+	store := &testSessionStore{sessions: make(map[string]string)}
+	authenticator.SetSessionStore(store)
+	rr := provider.login(t, authenticator)
+	checkLoggedIn(t, authenticator, rr, "alice")
+	if len(store.sessions) != 1 {
+		t.Fatalf("login opened %d sessions", len(store.sessions))
+	}
+	req := httptest.NewRequest("GET", "/groups", nil)
+	for _, cookie := range rr.Result().Cookies() {
+		if cookie.Name == AuthCookieName {
+			req.AddCookie(cookie)
+		}
+	}
+	username, err := authenticator.GetRemoteUserName(httptest.NewRecorder(), req)
+	if err != nil || username != "alice" {
+		t.Fatalf("session cookie rejected %q %v", username, err)
+	}
+	if authenticator.GetSessionID(req) != "session0" {
+		t.Fatalf("bad session id %q", authenticator.GetSessionID(req))
+	}
+
+	rr = httptest.NewRecorder()
+	err = authenticator.Logout(rr, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.sessions) != 0 {
+		t.Fatal("logout left the session open")
+	}
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != AuthCookieName || cookies[0].MaxAge >= 0 {
+		t.Fatalf("logout did not clear the cookie %v", cookies)
+	}
+	rr = httptest.NewRecorder()
+	_, err = authenticator.GetRemoteUserName(rr, req)
+	if err == nil || rr.Code != http.StatusFound {
+		t.Fatalf("ended session returned %d", rr.Code)
+	}
+
+	// Cookies issued without a session are not accepted either.
+	cookieValue, err := authenticator.GenUserCookieValue("alice", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest("GET", "/groups", nil)
+	req.AddCookie(&http.Cookie{Name: AuthCookieName, Value: cookieValue})
+	rr = httptest.NewRecorder()
+	_, err = authenticator.GetRemoteUserName(rr, req)
+	if err == nil || rr.Code != http.StatusFound {
+		t.Fatalf("cookie without session returned %d", rr.Code)
+	}
+}
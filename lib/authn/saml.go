@@ -0,0 +1,534 @@
+package authn
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const (
+	samlProtocolNS  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlAssertionNS = "urn:oasis:names:tc:SAML:2.0:assertion"
+
+	samlHTTPPostBinding     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	samlStatusSuccess       = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	samlBearerConfirmation  = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	samlNameIDUnspecified   = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+	samlSignatureRSASHA256  = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	samlTimeFormat          = "2006-01-02T15:04:05Z"
+	samlMaxClockSkew        = time.Minute
+	samlMaxResponseBodySize = 1 << 20
+)
+
+// samlServiceProvider holds the keys of a SAML login, assertions are
+// remembered until they expire so that none is accepted twice.
+type samlServiceProvider struct {
+	config          SAMLConfig
+	key             *rsa.PrivateKey
+	certificate     *x509.Certificate
+	idpCertificates []*x509.Certificate
+
+	assertionsMutex sync.Mutex
+	assertions      map[string]time.Time
+}
+
+type samlIssuer struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Value   string   `xml:",chardata"`
+}
+
+type samlNameIDPolicy struct {
+	XMLName     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol NameIDPolicy"`
+	AllowCreate bool     `xml:",attr"`
+}
+
+type samlAuthnRequest struct {
+	XMLName                     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+	ID                          string   `xml:",attr"`
+	Version                     string   `xml:",attr"`
+	IssueInstant                string   `xml:",attr"`
+	Destination                 string   `xml:",attr"`
+	AssertionConsumerServiceURL string   `xml:",attr"`
+	ProtocolBinding             string   `xml:",attr"`
+	Issuer                      samlIssuer
+	NameIDPolicy                samlNameIDPolicy
+}
+
+type samlAssertion struct {
+	ID      string `xml:",attr"`
+	Issuer  string `xml:"Issuer"`
+	Subject struct {
+		NameID               string `xml:"NameID"`
+		SubjectConfirmations []struct {
+			Method string `xml:",attr"`
+			Data   struct {
+				Recipient    string    `xml:",attr"`
+				NotOnOrAfter time.Time `xml:",attr"`
+				InResponseTo string    `xml:",attr"`
+			} `xml:"SubjectConfirmationData"`
+		} `xml:"SubjectConfirmation"`
+	}
+	Conditions struct {
+		NotBefore            time.Time `xml:",attr"`
+		NotOnOrAfter         time.Time `xml:",attr"`
+		AudienceRestrictions []struct {
+			Audiences []string `xml:"Audience"`
+		} `xml:"AudienceRestriction"`
+	}
+	Attributes []struct {
+		Name         string   `xml:",attr"`
+		FriendlyName string   `xml:",attr"`
+		Values       []string `xml:"AttributeValue"`
+	} `xml:"AttributeStatement>Attribute"`
+}
+
+// attributeValues returns the values of the attribute called name or with
+// name as its friendly name.
+func (assertion *samlAssertion) attributeValues(name string) []string {
+	var values []string
+	for _, attribute := range assertion.Attributes {
+		if attribute.Name == name || attribute.FriendlyName == name {
+			for _, value := range attribute.Values {
+				values = append(values, strings.TrimSpace(value))
+			}
+		}
+	}
+	return values
+}
+
+func loadPEMBlock(filename string, blockType string) ([]byte, error) {
+	pemBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, pemBytes = pem.Decode(pemBytes)
+		if block == nil {
+			return nil, fmt.Errorf("no %s in %s", blockType, filename)
+		}
+		if strings.HasSuffix(block.Type, blockType) {
+			return block.Bytes, nil
+		}
+	}
+}
+
+func loadCertificates(filename string) ([]*x509.Certificate, error) {
+	pemBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var certificates []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, pemBytes = pem.Decode(pemBytes)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+	if len(certificates) < 1 {
+		return nil, fmt.Errorf("no certificate in %s", filename)
+	}
+	return certificates, nil
+}
+
+func newSAMLServiceProvider(config SAMLConfig) (*samlServiceProvider, error) {
+	if config.IdPSSOURL == "" || config.IdPEntityID == "" || config.IdPCertificateFilename == "" ||
+		config.CertificateFilename == "" || config.KeyFilename == "" || config.EntityID == "" {
+		return nil, errors.New("saml needs the sso url, entity id and certificate of the idp " +
+			"and an entity id, certificate and key of its own")
+	}
+	if config.ACSURL == "" {
+		entityURL, err := url.Parse(config.EntityID)
+		if err != nil || entityURL.Scheme != "https" || entityURL.Host == "" {
+			return nil, errors.New("saml needs an acs_url when entity_id is not an https URL")
+		}
+		config.ACSURL = "https://" + entityURL.Host + SAMLACSPath
+	}
+	idpCertificates, err := loadCertificates(config.IdPCertificateFilename)
+	if err != nil {
+		return nil, err
+	}
+	certificates, err := loadCertificates(config.CertificateFilename)
+	if err != nil {
+		return nil, err
+	}
+	keyBytes, err := loadPEMBlock(config.KeyFilename, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	var key interface{}
+	key, err = x509.ParsePKCS1PrivateKey(keyBytes)
+	if err != nil {
+		key, err = x509.ParsePKCS8PrivateKey(keyBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("the saml key must be an RSA key")
+	}
+	return &samlServiceProvider{
+		config:          config,
+		key:             rsaKey,
+		certificate:     certificates[0],
+		idpCertificates: idpCertificates,
+		assertions:      make(map[string]time.Time),
+	}, nil
+}
+
+// samlRequestID derives the ID of the AuthnRequest from the nonce of the
+// login cookie, IDs cannot start with a digit.
+func samlRequestID(nonce string) string {
+	return "_" + nonce
+}
+
+// generateSAMLRedirectURL returns the URL of the HTTP-Redirect binding with
+// a signed AuthnRequest.
+func (sp *samlServiceProvider) generateSAMLRedirectURL(r *http.Request, login loginJWT) (string, error) {
+	request := samlAuthnRequest{
+		ID:                          samlRequestID(login.Nonce),
+		Version:                     "2.0",
+		IssueInstant:                time.Now().UTC().Format(samlTimeFormat),
+		Destination:                 sp.config.IdPSSOURL,
+		AssertionConsumerServiceURL: sp.config.ACSURL,
+		ProtocolBinding:             samlHTTPPostBinding,
+		Issuer:                      samlIssuer{Value: sp.config.EntityID},
+		NameIDPolicy:                samlNameIDPolicy{AllowCreate: true},
+	}
+	requestXML, err := xml.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+	var deflated bytes.Buffer
+	writer, err := flate.NewWriter(&deflated, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	_, err = writer.Write(requestXML)
+	if err != nil {
+		return "", err
+	}
+	err = writer.Close()
+	if err != nil {
+		return "", err
+	}
+	// The signature covers the parameters in this order, as they are sent.
+	query := "SAMLRequest=" + url.QueryEscape(base64.StdEncoding.EncodeToString(deflated.Bytes())) +
+		"&SigAlg=" + url.QueryEscape(samlSignatureRSASHA256)
+	digest := sha256.Sum256([]byte(query))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, sp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	query += "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(signature))
+	separator := "?"
+	if strings.Contains(sp.config.IdPSSOURL, "?") {
+		separator = "&"
+	}
+	return sp.config.IdPSSOURL + separator + query, nil
+}
+
+func (s *Authenticator) samlDoRedirectToIdPHandler(w http.ResponseWriter, r *http.Request) {
+	login, loginCookie, err := s.newLogin(r.URL.String())
+	if err != nil {
+		s.logger.Printf("Error from newLogin err: %s\n", err)
+		http.Error(w, "Internal Error ", http.StatusInternalServerError)
+		return
+	}
+	redirectURL, err := s.saml.generateSAMLRedirectURL(r, login)
+	if err != nil {
+		s.logger.Printf("Error generating the AuthnRequest err: %s\n", err)
+		http.Error(w, "Internal Error ", http.StatusInternalServerError)
+		return
+	}
+	// The IdP posts back from another site, the cookie would not be sent
+	// with the default SameSite policy of current browsers.
+	loginCookie.Path = SAMLACSPath
+	w.Header().Add("Set-Cookie", loginCookie.String()+"; SameSite=None")
+	http.Redirect(w, r, redirectURL, http.StatusFound)
+}
+
+// samlChildElement returns the only child of el in namespace space named
+// tag, or nil if there is none or several.
+func samlChildElement(el *etree.Element, space, tag string) *etree.Element {
+	var found *etree.Element
+	for _, child := range el.ChildElements() {
+		if child.Tag == tag && child.NamespaceURI() == space {
+			if found != nil {
+				return nil
+			}
+			found = child
+		}
+	}
+	return found
+}
+
+// validateSAMLResponse checks the signature of the response or of its
+// assertion against the certificates of the IdP and returns the content of
+// the assertion. Only signed content is used.
+func (sp *samlServiceProvider) validateSAMLResponse(r *http.Request, encodedResponse string,
+	requestID string) (*samlAssertion, error) {
+	responseXML, err := base64.StdEncoding.DecodeString(encodedResponse)
+	if err != nil {
+		return nil, err
+	}
+	doc := etree.NewDocument()
+	err = doc.ReadFromBytes(responseXML)
+	if err != nil {
+		return nil, err
+	}
+	response := doc.Root()
+	if response == nil || response.Tag != "Response" || response.NamespaceURI() != samlProtocolNS {
+		return nil, errors.New("not a SAML response")
+	}
+	if samlChildElement(response, samlAssertionNS, "EncryptedAssertion") != nil {
+		return nil, errors.New("encrypted assertions are not supported")
+	}
+	validationContext := dsig.NewDefaultValidationContext(
+		&dsig.MemoryX509CertificateStore{Roots: sp.idpCertificates})
+	signedResponse, err := validationContext.Validate(response)
+	var assertionElement *etree.Element
+	switch err {
+	case nil:
+		response = signedResponse
+		assertionElement = samlChildElement(response, samlAssertionNS, "Assertion")
+	case dsig.ErrMissingSignature:
+		assertionElement = samlChildElement(response, samlAssertionNS, "Assertion")
+		if assertionElement == nil {
+			break
+		}
+		assertionElement, err = validationContext.Validate(assertionElement)
+		if err != nil {
+			return nil, fmt.Errorf("invalid assertion signature: %s", err)
+		}
+	default:
+		return nil, fmt.Errorf("invalid response signature: %s", err)
+	}
+	if assertionElement == nil {
+		return nil, errors.New("the response must have one assertion")
+	}
+
+	status := response.FindElement("./Status/StatusCode")
+	if status == nil || status.SelectAttrValue("Value", "") != samlStatusSuccess {
+		return nil, errors.New("the IdP did not authenticate the user")
+	}
+	acsURL := sp.config.ACSURL
+	if destination := response.SelectAttrValue("Destination", ""); destination != "" && destination != acsURL {
+		return nil, fmt.Errorf("response sent to %s", destination)
+	}
+	if inResponseTo := response.SelectAttrValue("InResponseTo", ""); inResponseTo != requestID {
+		return nil, errors.New("response to another request")
+	}
+
+	assertionDoc := etree.NewDocument()
+	assertionDoc.SetRoot(assertionElement)
+	assertionXML, err := assertionDoc.WriteToBytes()
+	if err != nil {
+		return nil, err
+	}
+	var assertion samlAssertion
+	err = xml.Unmarshal(assertionXML, &assertion)
+	if err != nil {
+		return nil, err
+	}
+	if assertion.Issuer != sp.config.IdPEntityID {
+		return nil, fmt.Errorf("assertion issued by %s", assertion.Issuer)
+	}
+	now := time.Now()
+	if assertion.Conditions.NotOnOrAfter.IsZero() ||
+		now.Add(samlMaxClockSkew).Before(assertion.Conditions.NotBefore) ||
+		!now.Add(-samlMaxClockSkew).Before(assertion.Conditions.NotOnOrAfter) {
+		return nil, errors.New("assertion is not valid at this time")
+	}
+	if len(assertion.Conditions.AudienceRestrictions) < 1 {
+		return nil, errors.New("assertion without audience")
+	}
+	entityID := sp.config.EntityID
+	for _, restriction := range assertion.Conditions.AudienceRestrictions {
+		found := false
+		for _, audience := range restriction.Audiences {
+			found = found || strings.TrimSpace(audience) == entityID
+		}
+		if !found {
+			return nil, errors.New("assertion for another audience")
+		}
+	}
+	confirmed := false
+	for _, confirmation := range assertion.Subject.SubjectConfirmations {
+		if confirmation.Method == samlBearerConfirmation && confirmation.Data.Recipient == acsURL &&
+			confirmation.Data.InResponseTo == requestID &&
+			now.Add(-samlMaxClockSkew).Before(confirmation.Data.NotOnOrAfter) {
+			confirmed = true
+		}
+	}
+	if !confirmed {
+		return nil, errors.New("assertion without a valid bearer confirmation")
+	}
+	if assertion.ID == "" || !sp.rememberAssertion(assertion.ID, assertion.Conditions.NotOnOrAfter) {
+		return nil, errors.New("assertion already used")
+	}
+	return &assertion, nil
+}
+
+// rememberAssertion returns false if id was seen before.
+func (sp *samlServiceProvider) rememberAssertion(id string, expires time.Time) bool {
+	sp.assertionsMutex.Lock()
+	defer sp.assertionsMutex.Unlock()
+	now := time.Now()
+	for seenID, seenExpires := range sp.assertions {
+		if seenExpires.Add(samlMaxClockSkew).Before(now) {
+			delete(sp.assertions, seenID)
+		}
+	}
+	if _, ok := sp.assertions[id]; ok {
+		return false
+	}
+	sp.assertions[id] = expires
+	return true
+}
+
+func (s *Authenticator) samlACSHandler(w http.ResponseWriter, r *http.Request) {
+	if s.saml == nil {
+		http.Error(w, "SAML is not enabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, samlMaxResponseBodySize)
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	login, err := s.getVerifyLoginCookie(r)
+	if err != nil {
+		s.logger.Printf("error processing login cookie err: %v\n", err)
+		http.Error(w, "null or bad login cookie", http.StatusUnauthorized)
+		return
+	}
+	assertion, err := s.saml.validateSAMLResponse(r, r.PostFormValue("SAMLResponse"), samlRequestID(login.Nonce))
+	if err != nil {
+		s.logger.Printf("invalid SAML response err: %s\n", err)
+		http.Error(w, "invalid SAML response", http.StatusUnauthorized)
+		return
+	}
+	username := strings.TrimSpace(assertion.Subject.NameID)
+	if s.saml.config.UsernameAttribute != "" {
+		values := assertion.attributeValues(s.saml.config.UsernameAttribute)
+		username = ""
+		if len(values) > 0 {
+			username = values[0]
+		}
+	}
+	if username == "" {
+		s.logger.Printf("SAML assertion without username")
+		http.Error(w, "no username in the SAML assertion", http.StatusUnauthorized)
+		return
+	}
+	var groups []string
+	if s.saml.config.GroupsAttribute != "" {
+		groups = s.FilterGroups(assertion.attributeValues(s.saml.config.GroupsAttribute))
+	}
+	http.SetCookie(w, &http.Cookie{Name: loginCookieName, Value: "", Path: SAMLACSPath,
+		MaxAge: -1, HttpOnly: true, Secure: true})
+	err = s.setAndStoreAuthCookie(w, r, username, groups)
+	if err != nil {
+		s.logger.Println(err)
+		http.Error(w, "cannot set auth Cookie", http.StatusInternalServerError)
+		return
+	}
+	destinationPath := "/"
+	if strings.HasPrefix(login.ReturnURL, "/") && !strings.HasPrefix(login.ReturnURL, "//") {
+		destinationPath = login.ReturnURL
+	}
+	http.Redirect(w, r, destinationPath, http.StatusFound)
+}
+
+type samlKeyDescriptor struct {
+	Use     string `xml:"use,attr"`
+	KeyInfo struct {
+		XMLName     xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# KeyInfo"`
+		Certificate string   `xml:"X509Data>X509Certificate"`
+	}
+}
+
+type samlEndpoint struct {
+	Binding  string `xml:",attr"`
+	Location string `xml:",attr"`
+	Index    int    `xml:"index,attr"`
+}
+
+type samlEntityDescriptor struct {
+	XMLName         xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	EntityID        string   `xml:"entityID,attr"`
+	SPSSODescriptor struct {
+		AuthnRequestsSigned        bool                `xml:",attr"`
+		WantAssertionsSigned       bool                `xml:",attr"`
+		ProtocolSupportEnumeration string              `xml:"protocolSupportEnumeration,attr"`
+		KeyDescriptors             []samlKeyDescriptor `xml:"KeyDescriptor"`
+		NameIDFormat               string
+		AssertionConsumerService   samlEndpoint
+	}
+}
+
+func (s *Authenticator) samlMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	if s.saml == nil {
+		http.Error(w, "SAML is not enabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	var metadata samlEntityDescriptor
+	metadata.EntityID = s.saml.config.EntityID
+	metadata.SPSSODescriptor.AuthnRequestsSigned = true
+	metadata.SPSSODescriptor.WantAssertionsSigned = true
+	metadata.SPSSODescriptor.ProtocolSupportEnumeration = samlProtocolNS
+	var keyDescriptor samlKeyDescriptor
+	keyDescriptor.Use = "signing"
+	keyDescriptor.KeyInfo.Certificate = base64.StdEncoding.EncodeToString(s.saml.certificate.Raw)
+	metadata.SPSSODescriptor.KeyDescriptors = []samlKeyDescriptor{keyDescriptor}
+	metadata.SPSSODescriptor.NameIDFormat = samlNameIDUnspecified
+	metadata.SPSSODescriptor.AssertionConsumerService = samlEndpoint{Binding: samlHTTPPostBinding,
+		Location: s.saml.config.ACSURL}
+	metadataXML, err := xml.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		s.logger.Println(err)
+		http.Error(w, "Internal Error ", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write([]byte(xml.Header))
+	w.Write(metadataXML)
+}
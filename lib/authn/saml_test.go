@@ -0,0 +1,401 @@
+package authn
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const testSAMLIdPEntityID = "https://idp.example.com/saml"
+const testSAMLHost = "smallpoint.example.com"
+
+type testKeyStore struct {
+	key         *rsa.PrivateKey
+	certificate []byte
+}
+
+func (ks *testKeyStore) GetKeyPair() (*rsa.PrivateKey, []byte, error) {
+	return ks.key, ks.certificate, nil
+}
+
+func newTestKeyStore(t *testing.T, commonName string) *testKeyStore {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testKeyStore{key: key, certificate: certificate}
+}
+
+func writePEMFile(t *testing.T, filename string, blockType string, content []byte) {
+	err := ioutil.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: content}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setupTestSAML returns an authenticator logging in at a SAML IdP signing
+// with the returned key store.
+func setupTestSAML(t *testing.T, dir string) (*Authenticator, *testKeyStore) {
+	idp := newTestKeyStore(t, "idp")
+	sp := newTestKeyStore(t, "sp")
+	config := SAMLConfig{
+		IdPSSOURL:              "https://idp.example.com/sso",
+		IdPEntityID:            testSAMLIdPEntityID,
+		IdPCertificateFilename: filepath.Join(dir, "idp.pem"),
+		EntityID:               "https://" + testSAMLHost + SAMLMetadataPath,
+		CertificateFilename:    filepath.Join(dir, "sp.pem"),
+		KeyFilename:            filepath.Join(dir, "sp.key"),
+		GroupsAttribute:        "groups",
+	}
+	writePEMFile(t, config.IdPCertificateFilename, "CERTIFICATE", idp.certificate)
+	writePEMFile(t, config.CertificateFilename, "CERTIFICATE", sp.certificate)
+	writePEMFile(t, config.KeyFilename, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(sp.key))
+	authenticator := NewAuthenticator(OpenIDConfig{}, "smallpoint", nil, []string{}, nil, nil)
+	err := authenticator.EnableSAML(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authenticator, idp
+}
+
+type testSAMLResponse struct {
+	requestID    string
+	assertionID  string
+	audience     string
+	recipient    string
+	notOnOrAfter time.Time
+	username     string
+	groups       []string
+}
+
+func newTestSAMLResponse(requestID string) testSAMLResponse {
+	return testSAMLResponse{
+		requestID:    requestID,
+		assertionID:  "_assertion-" + requestID,
+		audience:     "https://" + testSAMLHost + SAMLMetadataPath,
+		recipient:    "https://" + testSAMLHost + SAMLACSPath,
+		notOnOrAfter: time.Now().Add(5 * time.Minute),
+		username:     "user1",
+		groups:       []string{"idp-admins", "idp-users"},
+	}
+}
+
+// encode builds the response, signs its assertion with signer when it is
+// not nil and returns it base64 encoded.
+func (response testSAMLResponse) encode(t *testing.T, signer *testKeyStore) string {
+	now := time.Now().UTC().Format(samlTimeFormat)
+	notOnOrAfter := response.notOnOrAfter.UTC().Format(samlTimeFormat)
+
+	assertion := etree.NewElement("saml:Assertion")
+	assertion.CreateAttr("xmlns:saml", samlAssertionNS)
+	assertion.CreateAttr("ID", response.assertionID)
+	assertion.CreateAttr("Version", "2.0")
+	assertion.CreateAttr("IssueInstant", now)
+	assertion.CreateElement("saml:Issuer").SetText(testSAMLIdPEntityID)
+	subject := assertion.CreateElement("saml:Subject")
+	subject.CreateElement("saml:NameID").SetText(response.username)
+	confirmation := subject.CreateElement("saml:SubjectConfirmation")
+	confirmation.CreateAttr("Method", samlBearerConfirmation)
+	confirmationData := confirmation.CreateElement("saml:SubjectConfirmationData")
+	confirmationData.CreateAttr("Recipient", response.recipient)
+	confirmationData.CreateAttr("NotOnOrAfter", notOnOrAfter)
+	confirmationData.CreateAttr("InResponseTo", response.requestID)
+	conditions := assertion.CreateElement("saml:Conditions")
+	conditions.CreateAttr("NotBefore", now)
+	conditions.CreateAttr("NotOnOrAfter", notOnOrAfter)
+	conditions.CreateElement("saml:AudienceRestriction").CreateElement("saml:Audience").SetText(response.audience)
+	attribute := assertion.CreateElement("saml:AttributeStatement").CreateElement("saml:Attribute")
+	attribute.CreateAttr("Name", "groups")
+	for _, group := range response.groups {
+		attribute.CreateElement("saml:AttributeValue").SetText(group)
+	}
+	if signer != nil {
+		var err error
+		assertion, err = dsig.NewDefaultSigningContext(signer).SignEnveloped(assertion)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	doc := etree.NewDocument()
+	root := doc.CreateElement("samlp:Response")
+	root.CreateAttr("xmlns:samlp", samlProtocolNS)
+	root.CreateAttr("xmlns:saml", samlAssertionNS)
+	root.CreateAttr("ID", "_response-"+response.requestID)
+	root.CreateAttr("Version", "2.0")
+	root.CreateAttr("IssueInstant", now)
+	root.CreateAttr("Destination", response.recipient)
+	root.CreateAttr("InResponseTo", response.requestID)
+	root.CreateElement("saml:Issuer").SetText(testSAMLIdPEntityID)
+	root.CreateElement("samlp:Status").CreateElement("samlp:StatusCode").CreateAttr("Value", samlStatusSuccess)
+	root.AddChild(assertion)
+	responseXML, err := doc.WriteToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(responseXML)
+}
+
+func postSAMLResponse(authenticator *Authenticator, loginCookie *http.Cookie, encodedResponse string) *httptest.ResponseRecorder {
+	form := url.Values{"SAMLResponse": {encodedResponse}}
+	req := httptest.NewRequest("POST", "https://"+testSAMLHost+SAMLACSPath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if loginCookie != nil {
+		req.AddCookie(loginCookie)
+	}
+	rr := httptest.NewRecorder()
+	authenticator.SAMLACSHandler(rr, req)
+	return rr
+}
+
+func TestSAMLRedirectToIdP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "saml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	authenticator, _ := setupTestSAML(t, dir)
+
+	req := httptest.NewRequest("GET", "https://"+testSAMLHost+"/groups?x=1", nil)
+	rr := httptest.NewRecorder()
+	authenticator.oauth2DoRedirectoToProviderHandler(rr, req)
+	if rr.Code != http.StatusFound {
+		t.Fatalf("expected a redirect, got %d", rr.Code)
+	}
+	setCookie := rr.Header().Get("Set-Cookie")
+	if !strings.Contains(setCookie, "Path="+SAMLACSPath) || !strings.Contains(setCookie, "SameSite=None") {
+		t.Fatalf("bad login cookie %s", setCookie)
+	}
+	location, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(location.String(), "https://idp.example.com/sso?") {
+		t.Fatalf("redirected to %s", location)
+	}
+	query := location.Query()
+	signedQuery := location.RawQuery[:strings.Index(location.RawQuery, "&Signature=")]
+	signature, err := base64.StdEncoding.DecodeString(query.Get("Signature"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(signedQuery))
+	err = rsa.VerifyPKCS1v15(&authenticator.saml.key.PublicKey, crypto.SHA256, digest[:], signature)
+	if err != nil {
+		t.Fatalf("bad AuthnRequest signature: %s", err)
+	}
+	deflated, err := base64.StdEncoding.DecodeString(query.Get("SAMLRequest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestXML, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var request samlAuthnRequest
+	err = xml.Unmarshal(requestXML, &request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.AssertionConsumerServiceURL != "https://"+testSAMLHost+SAMLACSPath ||
+		request.Issuer.Value != "https://"+testSAMLHost+SAMLMetadataPath || !strings.HasPrefix(request.ID, "_") {
+		t.Fatalf("bad AuthnRequest %s", requestXML)
+	}
+}
+
+func TestSAMLACS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "saml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	authenticator, idp := setupTestSAML(t, dir)
+	authenticator.SetGroupFilter(func(group string) bool { return group == "idp-admins" })
+
+	login, loginCookie, err := authenticator.newLogin("/groups?x=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestID := samlRequestID(login.Nonce)
+	encodedResponse := newTestSAMLResponse(requestID).encode(t, idp)
+	rr := postSAMLResponse(authenticator, loginCookie, encodedResponse)
+	if rr.Code != http.StatusFound {
+		t.Fatalf("expected a redirect, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if location := rr.Header().Get("Location"); location != "/groups?x=1" {
+		t.Fatalf("redirected to %s", location)
+	}
+	var authCookie *http.Cookie
+	for _, cookie := range rr.Result().Cookies() {
+		if cookie.Name == AuthCookieName {
+			authCookie = cookie
+		}
+	}
+	if authCookie == nil {
+		t.Fatal("no auth cookie set")
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(authCookie)
+	username, groups, err := authenticator.GetRemoteUser(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "user1" || len(groups) != 1 || groups[0] != "idp-admins" {
+		t.Fatalf("logged in as %s with groups %v", username, groups)
+	}
+
+	// The same assertion cannot be used twice.
+	rr = postSAMLResponse(authenticator, loginCookie, encodedResponse)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("replayed assertion accepted, got %d", rr.Code)
+	}
+}
+
+func TestSAMLACSRejectsInvalidResponses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "saml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	authenticator, idp := setupTestSAML(t, dir)
+	otherIdP := newTestKeyStore(t, "other")
+
+	invalidResponses := []struct {
+		name   string
+		signer *testKeyStore
+		modify func(response *testSAMLResponse)
+	}{
+		{"unsigned", nil, func(response *testSAMLResponse) {}},
+		{"unknown signer", otherIdP, func(response *testSAMLResponse) {}},
+		{"other audience", idp, func(response *testSAMLResponse) { response.audience = "https://other.example.com" }},
+		{"other recipient", idp, func(response *testSAMLResponse) {
+			response.recipient = "https://other.example.com" + SAMLACSPath
+		}},
+		{"expired", idp, func(response *testSAMLResponse) {
+			response.notOnOrAfter = time.Now().Add(-5 * time.Minute)
+		}},
+		{"other request", idp, func(response *testSAMLResponse) { response.requestID = "_other" }},
+	}
+	for _, invalid := range invalidResponses {
+		login, loginCookie, err := authenticator.newLogin("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := newTestSAMLResponse(samlRequestID(login.Nonce))
+		invalid.modify(&response)
+		rr := postSAMLResponse(authenticator, loginCookie, response.encode(t, invalid.signer))
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("%s response accepted, got %d", invalid.name, rr.Code)
+		}
+	}
+
+	// A valid response needs the login cookie of its request.
+	login, _, err := authenticator.newLogin("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := postSAMLResponse(authenticator, nil, newTestSAMLResponse(samlRequestID(login.Nonce)).encode(t, idp))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("response without login cookie accepted, got %d", rr.Code)
+	}
+}
+
+func TestSAMLMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "saml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	authenticator, _ := setupTestSAML(t, dir)
+
+	// The Host header of the request does not change the metadata.
+	rr := httptest.NewRecorder()
+	authenticator.SAMLMetadataHandler(rr, httptest.NewRequest("GET", "https://attacker.example.com"+SAMLMetadataPath, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got %d", rr.Code)
+	}
+	var metadata samlEntityDescriptor
+	err = xml.Unmarshal(rr.Body.Bytes(), &metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.EntityID != "https://"+testSAMLHost+SAMLMetadataPath ||
+		metadata.SPSSODescriptor.AssertionConsumerService.Location != "https://"+testSAMLHost+SAMLACSPath ||
+		len(metadata.SPSSODescriptor.KeyDescriptors) != 1 ||
+		metadata.SPSSODescriptor.KeyDescriptors[0].KeyInfo.Certificate !=
+			base64.StdEncoding.EncodeToString(authenticator.saml.certificate.Raw) {
+		t.Fatalf("bad metadata %s", rr.Body.String())
+	}
+
+	// Without SAML there is no metadata.
+	authenticator = NewAuthenticator(OpenIDConfig{}, "smallpoint", nil, []string{}, nil, nil)
+	rr = httptest.NewRecorder()
+	authenticator.SAMLMetadataHandler(rr, httptest.NewRequest("GET", SAMLMetadataPath, nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("got %d", rr.Code)
+	}
+}
+
+func TestSAMLServiceProviderURLs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "saml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	authenticator, _ := setupTestSAML(t, dir)
+	config := authenticator.saml.config
+	if config.ACSURL != "https://"+testSAMLHost+SAMLACSPath {
+		t.Fatalf("bad default acs url %s", config.ACSURL)
+	}
+
+	config.EntityID = ""
+	config.ACSURL = ""
+	_, err = newSAMLServiceProvider(config)
+	if err == nil {
+		t.Fatal("saml without entity_id should fail")
+	}
+	config.EntityID = "urn:smallpoint"
+	_, err = newSAMLServiceProvider(config)
+	if err == nil {
+		t.Fatal("saml without acs_url and an entity_id which is not a URL should fail")
+	}
+	config.ACSURL = "https://login.example.com" + SAMLACSPath
+	sp, err := newSAMLServiceProvider(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sp.config.ACSURL != config.ACSURL || sp.config.EntityID != "urn:smallpoint" {
+		t.Fatalf("bad service provider config %+v", sp.config)
+	}
+}
@@ -0,0 +1,447 @@
+package ldaptest
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/Symantec/ldap-group-management/lib/ldif"
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+var errInvalidFilter = errors.New("invalid filter")
+
+// normalizeValue implements a caseIgnoreMatch-like comparison: case and
+// insignificant spaces are ignored.
+func normalizeValue(value string) string {
+	return strings.ToLower(strings.Join(strings.Fields(value), " "))
+}
+
+func containsValue(values []string, value string, caseIgnore bool) bool {
+	for _, candidate := range values {
+		if candidate == value || (caseIgnore && normalizeValue(candidate) == normalizeValue(value)) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchFilter(entry *ldif.Entry, filter *ber.Packet) (bool, error) {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			match, err := matchFilter(entry, child)
+			if err != nil || !match {
+				return false, err
+			}
+		}
+		return true, nil
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			match, err := matchFilter(entry, child)
+			if err != nil {
+				return false, err
+			}
+			if match {
+				return true, nil
+			}
+		}
+		return false, nil
+	case ldap.FilterNot:
+		if len(filter.Children) != 1 {
+			return false, errInvalidFilter
+		}
+		match, err := matchFilter(entry, filter.Children[0])
+		return !match, err
+	case ldap.FilterPresent:
+		attribute := packetString(filter)
+		if strings.EqualFold(attribute, "objectClass") {
+			return true, nil
+		}
+		return len(entry.GetAttributeValues(attribute)) > 0, nil
+	case ldap.FilterEqualityMatch, ldap.FilterApproxMatch:
+		if len(filter.Children) != 2 {
+			return false, errInvalidFilter
+		}
+		values := entry.GetAttributeValues(packetString(filter.Children[0]))
+		return containsValue(values, packetString(filter.Children[1]), true), nil
+	case ldap.FilterGreaterOrEqual, ldap.FilterLessOrEqual:
+		if len(filter.Children) != 2 {
+			return false, errInvalidFilter
+		}
+		assertion := packetString(filter.Children[1])
+		for _, value := range entry.GetAttributeValues(packetString(filter.Children[0])) {
+			cmp := compareValues(value, assertion)
+			if (filter.Tag == ldap.FilterGreaterOrEqual && cmp >= 0) ||
+				(filter.Tag == ldap.FilterLessOrEqual && cmp <= 0) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case ldap.FilterSubstrings:
+		if len(filter.Children) != 2 {
+			return false, errInvalidFilter
+		}
+		for _, value := range entry.GetAttributeValues(packetString(filter.Children[0])) {
+			if matchSubstrings(normalizeValue(value), filter.Children[1].Children) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, errInvalidFilter
+}
+
+func compareValues(a, b string) int {
+	intA, errA := strconv.ParseInt(a, 10, 64)
+	intB, errB := strconv.ParseInt(b, 10, 64)
+	if errA == nil && errB == nil {
+		switch {
+		case intA < intB:
+			return -1
+		case intA > intB:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(normalizeValue(a), normalizeValue(b))
+}
+
+func matchSubstrings(value string, pieces []*ber.Packet) bool {
+	for _, piece := range pieces {
+		substring := normalizeValue(packetString(piece))
+		switch piece.Tag {
+		case ldap.FilterSubstringsInitial:
+			if !strings.HasPrefix(value, substring) {
+				return false
+			}
+			value = value[len(substring):]
+		case ldap.FilterSubstringsAny:
+			index := strings.Index(value, substring)
+			if index < 0 {
+				return false
+			}
+			value = value[index+len(substring):]
+		case ldap.FilterSubstringsFinal:
+			if !strings.HasSuffix(value, substring) {
+				return false
+			}
+			value = ""
+		}
+	}
+	return true
+}
+
+func selectAttributes(entry *ldif.Entry, requested []string) []ldif.Attribute {
+	var wanted []string
+	for _, name := range requested {
+		switch {
+		case name == "*":
+			return entry.Attributes
+		case strings.EqualFold(name, "dn"), name == "1.1", name == "+":
+			continue
+		}
+		wanted = append(wanted, name)
+	}
+	if len(requested) == 0 {
+		return entry.Attributes
+	}
+	var attributes []ldif.Attribute
+	for _, name := range wanted {
+		values := entry.GetAttributeValues(name)
+		if len(values) > 0 {
+			attributes = append(attributes, ldif.Attribute{Name: name, Values: values})
+		}
+	}
+	return attributes
+}
+
+func newSearchResultEntry(messageID int64, entry *ldif.Entry, attributes []ldif.Attribute) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, applicationSearchResultEntry, nil, "Search Result Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.DN, "objectName"))
+	attributesPacket := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+	for _, attribute := range attributes {
+		attributePacket := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+		attributePacket.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, attribute.Name, "type"))
+		valuesPacket := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		for _, value := range attribute.Values {
+			valuesPacket.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "value"))
+		}
+		attributePacket.AppendChild(valuesPacket)
+		attributesPacket.AppendChild(attributePacket)
+	}
+	op.AppendChild(attributesPacket)
+	return newMessage(messageID, op, nil)
+}
+
+func newSearchResultReference(messageID int64, urls []string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, applicationSearchResultRef, nil, "Search Result Reference")
+	for _, url := range urls {
+		op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, url, "URI"))
+	}
+	return newMessage(messageID, op, nil)
+}
+
+func (s *Server) handleSearch(messageID int64, request *ber.Packet, controls *ber.Packet) []*ber.Packet {
+	if len(request.Children) < 8 {
+		return []*ber.Packet{newResultMessage(messageID, applicationSearchResultDone,
+			ldap.LDAPResultProtocolError, "", "invalid search request", nil)}
+	}
+	baseDN := normalizeDN(packetString(request.Children[0]))
+	scope := packetInt(request.Children[1])
+	filter := request.Children[6]
+	var requested []string
+	for _, attribute := range request.Children[7].Children {
+		requested = append(requested, packetString(attribute))
+	}
+	paging, err := decodePagingControl(controls)
+	if err != nil {
+		return []*ber.Packet{newResultMessage(messageID, applicationSearchResultDone,
+			ldap.LDAPResultProtocolError, "", err.Error(), nil)}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if paging != nil {
+		s.pagedSearches++
+	}
+	if urls := s.referralFor(baseDN); urls != nil {
+		return []*ber.Packet{newResultMessage(messageID, applicationSearchResultDone,
+			ldap.LDAPResultReferral, "", "", urls)}
+	}
+	if _, ok := s.entries[baseDN]; baseDN != "" && !ok {
+		return []*ber.Packet{newResultMessage(messageID, applicationSearchResultDone,
+			ldap.LDAPResultNoSuchObject, "", "no such object: "+baseDN, nil)}
+	}
+	var matches []*ldif.Entry
+	for _, key := range s.order {
+		if !inScope(key, baseDN, scope) || s.referralFor(key) != nil {
+			continue
+		}
+		entry := s.entries[key]
+		match, err := matchFilter(entry, filter)
+		if err != nil {
+			return []*ber.Packet{newResultMessage(messageID, applicationSearchResultDone,
+				ldap.LDAPResultProtocolError, "", err.Error(), nil)}
+		}
+		if match {
+			matches = append(matches, entry)
+		}
+	}
+	var references [][]string
+	for _, referralDN := range s.referralDNs() {
+		if referralDN != baseDN && inScope(referralDN, baseDN, scope) {
+			references = append(references, s.referrals[referralDN])
+		}
+	}
+
+	var responseControls *ber.Packet
+	if paging != nil {
+		total := len(matches)
+		size := paging.size
+		if s.MaxPageSize > 0 && size > s.MaxPageSize {
+			size = s.MaxPageSize
+		}
+		start := paging.offset
+		if start > total {
+			start = total
+		}
+		end := start + size
+		if end > total {
+			end = total
+		}
+		cookie := ""
+		if end < total && size > 0 {
+			cookie = strconv.Itoa(end)
+		}
+		if start > 0 {
+			references = nil
+		}
+		matches = matches[start:end]
+		responseControls = encodePagingControl(total, cookie)
+	}
+
+	var responses []*ber.Packet
+	for _, entry := range matches {
+		responses = append(responses, newSearchResultEntry(messageID, entry, selectAttributes(entry, requested)))
+	}
+	for _, urls := range references {
+		responses = append(responses, newSearchResultReference(messageID, urls))
+	}
+	done := newResultMessage(messageID, applicationSearchResultDone, ldap.LDAPResultSuccess, "", "", nil)
+	if responseControls != nil {
+		done.AppendChild(responseControls)
+	}
+	return append(responses, done)
+}
+
+func decodeAttribute(packet *ber.Packet) (string, []string, error) {
+	if len(packet.Children) != 2 {
+		return "", nil, errors.New("invalid attribute")
+	}
+	var values []string
+	for _, value := range packet.Children[1].Children {
+		values = append(values, packetString(value))
+	}
+	return packetString(packet.Children[0]), values, nil
+}
+
+func setAttribute(entry *ldif.Entry, name string, values []string) {
+	for i, attribute := range entry.Attributes {
+		if strings.EqualFold(attribute.Name, name) {
+			if len(values) == 0 {
+				entry.Attributes = append(entry.Attributes[:i], entry.Attributes[i+1:]...)
+				return
+			}
+			entry.Attributes[i].Values = values
+			return
+		}
+	}
+	if len(values) > 0 {
+		entry.Attributes = append(entry.Attributes, ldif.Attribute{Name: name, Values: values})
+	}
+}
+
+func (s *Server) handleAdd(messageID int64, request *ber.Packet) []*ber.Packet {
+	result := func(code int, diagnostic string) []*ber.Packet {
+		return []*ber.Packet{newResultMessage(messageID, applicationAddResponse, code, "", diagnostic, nil)}
+	}
+	if len(request.Children) != 2 {
+		return result(ldap.LDAPResultProtocolError, "invalid add request")
+	}
+	entry := &ldif.Entry{DN: packetString(request.Children[0])}
+	for _, attributePacket := range request.Children[1].Children {
+		name, values, err := decodeAttribute(attributePacket)
+		if err != nil {
+			return result(ldap.LDAPResultProtocolError, err.Error())
+		}
+		if len(values) == 0 {
+			return result(ldap.LDAPResultInvalidAttributeSyntax, "no values for attribute "+name)
+		}
+		for i, value := range values {
+			if containsValue(values[:i], value, true) {
+				return result(ldap.LDAPResultAttributeOrValueExists, "duplicate value for attribute "+name)
+			}
+		}
+		entry.AddAttributeValues(name, values...)
+	}
+	key := normalizeDN(entry.DN)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if urls := s.referralFor(key); urls != nil {
+		return []*ber.Packet{newResultMessage(messageID, applicationAddResponse,
+			ldap.LDAPResultReferral, "", "", urls)}
+	}
+	if _, ok := s.entries[key]; ok {
+		return result(ldap.LDAPResultEntryAlreadyExists, "entry already exists")
+	}
+	if _, ok := s.entries[parentDN(key)]; !ok {
+		return result(ldap.LDAPResultNoSuchObject, "parent does not exist")
+	}
+	s.putEntry(entry)
+	return result(ldap.LDAPResultSuccess, "")
+}
+
+func (s *Server) handleModify(messageID int64, request *ber.Packet) []*ber.Packet {
+	result := func(code int, diagnostic string) []*ber.Packet {
+		return []*ber.Packet{newResultMessage(messageID, applicationModifyResponse, code, "", diagnostic, nil)}
+	}
+	if len(request.Children) != 2 {
+		return result(ldap.LDAPResultProtocolError, "invalid modify request")
+	}
+	key := normalizeDN(packetString(request.Children[0]))
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if urls := s.referralFor(key); urls != nil {
+		return []*ber.Packet{newResultMessage(messageID, applicationModifyResponse,
+			ldap.LDAPResultReferral, "", "", urls)}
+	}
+	existing, ok := s.entries[key]
+	if !ok {
+		return result(ldap.LDAPResultNoSuchObject, "no such object")
+	}
+	// changes are applied to a copy so a failing change leaves the entry untouched
+	entry := copyEntry(existing)
+	for _, change := range request.Children[1].Children {
+		if len(change.Children) != 2 {
+			return result(ldap.LDAPResultProtocolError, "invalid change")
+		}
+		name, values, err := decodeAttribute(change.Children[1])
+		if err != nil {
+			return result(ldap.LDAPResultProtocolError, err.Error())
+		}
+		current := entry.GetAttributeValues(name)
+		switch packetInt(change.Children[0]) {
+		case ldap.AddAttribute:
+			if len(values) == 0 {
+				return result(ldap.LDAPResultProtocolError, "no values to add to "+name)
+			}
+			for _, value := range values {
+				if containsValue(current, value, true) {
+					return result(ldap.LDAPResultAttributeOrValueExists, "value already exists in "+name)
+				}
+				current = append(current, value)
+			}
+			setAttribute(entry, name, current)
+		case ldap.DeleteAttribute:
+			if len(current) == 0 {
+				return result(ldap.LDAPResultNoSuchAttribute, "no such attribute "+name)
+			}
+			if len(values) == 0 {
+				setAttribute(entry, name, nil)
+				continue
+			}
+			var remaining []string
+			for _, value := range values {
+				if !containsValue(current, value, true) {
+					return result(ldap.LDAPResultNoSuchAttribute, "no such value in "+name)
+				}
+			}
+			for _, value := range current {
+				if !containsValue(values, value, true) {
+					remaining = append(remaining, value)
+				}
+			}
+			setAttribute(entry, name, remaining)
+		case ldap.ReplaceAttribute:
+			setAttribute(entry, name, values)
+		default:
+			return result(ldap.LDAPResultUnwillingToPerform, "unsupported modify operation")
+		}
+	}
+	s.entries[key] = entry
+	return result(ldap.LDAPResultSuccess, "")
+}
+
+func (s *Server) handleDelete(messageID int64, request *ber.Packet) []*ber.Packet {
+	result := func(code int, diagnostic string) []*ber.Packet {
+		return []*ber.Packet{newResultMessage(messageID, applicationDelResponse, code, "", diagnostic, nil)}
+	}
+	key := normalizeDN(packetString(request))
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if urls := s.referralFor(key); urls != nil {
+		return []*ber.Packet{newResultMessage(messageID, applicationDelResponse,
+			ldap.LDAPResultReferral, "", "", urls)}
+	}
+	if _, ok := s.entries[key]; !ok {
+		return result(ldap.LDAPResultNoSuchObject, "no such object")
+	}
+	for _, other := range s.order {
+		if strings.HasSuffix(other, ","+key) {
+			return result(ldap.LDAPResultNotAllowedOnNonLeaf, "entry has children")
+		}
+	}
+	delete(s.entries, key)
+	for i, other := range s.order {
+		if other == key {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	return result(ldap.LDAPResultSuccess, "")
+}
@@ -0,0 +1,453 @@
+// Package ldaptest provides an in-memory LDAP server for tests. It speaks
+// enough of the protocol (bind, search with paging, add, modify, delete and
+// referrals) for the ldap.v2 client used by smallpoint, and is seeded from
+// LDIF.
+package ldaptest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Symantec/ldap-group-management/lib/ldif"
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+const (
+	applicationBindRequest       = 0
+	applicationBindResponse      = 1
+	applicationUnbindRequest     = 2
+	applicationSearchRequest     = 3
+	applicationSearchResultEntry = 4
+	applicationSearchResultDone  = 5
+	applicationModifyRequest     = 6
+	applicationModifyResponse    = 7
+	applicationAddRequest        = 8
+	applicationAddResponse       = 9
+	applicationDelRequest        = 10
+	applicationDelResponse       = 11
+	applicationModifyDNRequest   = 12
+	applicationModifyDNResponse  = 13
+	applicationCompareRequest    = 14
+	applicationCompareResponse   = 15
+	applicationAbandonRequest    = 16
+	applicationSearchResultRef   = 19
+	applicationExtendedRequest   = 23
+	applicationExtendedResponse  = 24
+)
+
+// Server is an in-memory directory. Entries are kept in insertion order so
+// search results are deterministic.
+type Server struct {
+	// MaxPageSize caps the size of each page of a paged search the way
+	// production servers do, zero means the client page size is honoured.
+	MaxPageSize int
+
+	mutex         sync.Mutex
+	entries       map[string]*ldif.Entry
+	order         []string
+	referrals     map[string][]string
+	pagedSearches int
+	listener      net.Listener
+	rootCAs       *x509.CertPool
+	connections   map[net.Conn]struct{}
+	connWait      sync.WaitGroup
+}
+
+func New() *Server {
+	return &Server{
+		entries:     make(map[string]*ldif.Entry),
+		referrals:   make(map[string][]string),
+		connections: make(map[net.Conn]struct{}),
+	}
+}
+
+// NewFromLDIF returns a server seeded with the entries of an LDIF document.
+func NewFromLDIF(reader io.Reader) (*Server, error) {
+	s := New()
+	err := s.LoadLDIF(reader)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func normalizeDN(dn string) string {
+	parts := strings.Split(dn, ",")
+	for i, part := range parts {
+		parts[i] = strings.ToLower(strings.TrimSpace(part))
+	}
+	return strings.Join(parts, ",")
+}
+
+func parentDN(dn string) string {
+	index := strings.Index(dn, ",")
+	if index < 0 {
+		return ""
+	}
+	return dn[index+1:]
+}
+
+// LoadLDIF adds the entries of an LDIF document without any checks, so the
+// suffix entries can be loaded.
+func (s *Server) LoadLDIF(reader io.Reader) error {
+	entries, err := ldif.Parse(reader)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := range entries {
+		s.putEntry(&entries[i])
+	}
+	return nil
+}
+
+func (s *Server) putEntry(entry *ldif.Entry) {
+	key := normalizeDN(entry.DN)
+	if _, ok := s.entries[key]; !ok {
+		s.order = append(s.order, key)
+	}
+	s.entries[key] = entry
+}
+
+// AddReferral makes the server answer searches at or below dn with a
+// referral to urls, and return a continuation reference to searches whose
+// scope contains it.
+func (s *Server) AddReferral(dn string, urls ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.referrals[normalizeDN(dn)] = urls
+}
+
+// Entry returns a copy of the entry at dn, or nil if it does not exist.
+func (s *Server) Entry(dn string) *ldif.Entry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, ok := s.entries[normalizeDN(dn)]
+	if !ok {
+		return nil
+	}
+	return copyEntry(entry)
+}
+
+// PagedSearchCount returns how many search requests carried a paging control.
+func (s *Server) PagedSearchCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.pagedSearches
+}
+
+func copyEntry(entry *ldif.Entry) *ldif.Entry {
+	newEntry := &ldif.Entry{DN: entry.DN}
+	for _, attribute := range entry.Attributes {
+		newEntry.Attributes = append(newEntry.Attributes, ldif.Attribute{
+			Name:   attribute.Name,
+			Values: append([]string(nil), attribute.Values...)})
+	}
+	return newEntry
+}
+
+// RootCAs returns a pool trusting the certificate served by StartTLS.
+func (s *Server) RootCAs() *x509.CertPool {
+	return s.rootCAs
+}
+
+// StartTLS listens on a random local port with a freshly generated
+// certificate for localhost and returns the ldaps url of the server.
+func (s *Server) StartTLS() (string, error) {
+	cert, rootCAs, err := generateLocalhostCertificate()
+	if err != nil {
+		return "", err
+	}
+	s.rootCAs = rootCAs
+	listener, err := tls.Listen("tcp", "127.0.0.1:0",
+		&tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		return "", err
+	}
+	s.listener = listener
+	go s.serve()
+	port := listener.Addr().(*net.TCPAddr).Port
+	return fmt.Sprintf("ldaps://localhost:%d", port), nil
+}
+
+func (s *Server) Close() error {
+	if s.listener == nil {
+		return nil
+	}
+	err := s.listener.Close()
+	s.mutex.Lock()
+	for conn := range s.connections {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	s.connWait.Wait()
+	return err
+}
+
+func generateLocalhostCertificate() (tls.Certificate, *x509.CertPool, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	parsed, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(parsed)
+	return tls.Certificate{Certificate: [][]byte{derBytes}, PrivateKey: key}, rootCAs, nil
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.connections[conn] = struct{}{}
+		s.mutex.Unlock()
+		s.connWait.Add(1)
+		go func() {
+			defer s.connWait.Done()
+			s.handleConnection(conn)
+			s.mutex.Lock()
+			delete(s.connections, conn)
+			s.mutex.Unlock()
+		}()
+	}
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		if len(packet.Children) < 2 {
+			log.Printf("ldaptest: invalid message")
+			return
+		}
+		messageID := packetInt(packet.Children[0])
+		request := packet.Children[1]
+		var controls *ber.Packet
+		if len(packet.Children) > 2 {
+			controls = packet.Children[2]
+		}
+		var responses []*ber.Packet
+		switch request.Tag {
+		case applicationBindRequest:
+			responses = s.handleBind(messageID, request)
+		case applicationUnbindRequest:
+			return
+		case applicationSearchRequest:
+			responses = s.handleSearch(messageID, request, controls)
+		case applicationModifyRequest:
+			responses = s.handleModify(messageID, request)
+		case applicationAddRequest:
+			responses = s.handleAdd(messageID, request)
+		case applicationDelRequest:
+			responses = s.handleDelete(messageID, request)
+		case applicationModifyDNRequest:
+			responses = []*ber.Packet{newResultMessage(messageID, applicationModifyDNResponse,
+				ldap.LDAPResultUnwillingToPerform, "", "modify dn not supported", nil)}
+		case applicationCompareRequest:
+			responses = []*ber.Packet{newResultMessage(messageID, applicationCompareResponse,
+				ldap.LDAPResultUnwillingToPerform, "", "compare not supported", nil)}
+		case applicationExtendedRequest:
+			responses = []*ber.Packet{newResultMessage(messageID, applicationExtendedResponse,
+				ldap.LDAPResultUnwillingToPerform, "", "extended operations not supported", nil)}
+		case applicationAbandonRequest:
+			continue
+		default:
+			log.Printf("ldaptest: unsupported operation %d", request.Tag)
+			return
+		}
+		for _, response := range responses {
+			if _, err := conn.Write(response.Bytes()); err != nil {
+				log.Printf("ldaptest: write: %s", err)
+				return
+			}
+		}
+	}
+}
+
+func packetString(packet *ber.Packet) string {
+	if value, ok := packet.Value.(string); ok {
+		return value
+	}
+	if packet.Data != nil {
+		return packet.Data.String()
+	}
+	return ""
+}
+
+func packetInt(packet *ber.Packet) int64 {
+	switch value := packet.Value.(type) {
+	case int64:
+		return value
+	case uint64:
+		return int64(value)
+	}
+	return 0
+}
+
+func newMessage(messageID int64, op *ber.Packet, controls *ber.Packet) *ber.Packet {
+	message := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	message.AppendChild(op)
+	if controls != nil {
+		message.AppendChild(controls)
+	}
+	return message
+}
+
+func newResultMessage(messageID int64, tag ber.Tag, resultCode int, matchedDN, diagnostic string, referrals []string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, resultCode, "resultCode"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, matchedDN, "matchedDN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, diagnostic, "diagnosticMessage"))
+	if len(referrals) > 0 {
+		referral := ber.Encode(ber.ClassContext, ber.TypeConstructed, 3, nil, "Referral")
+		for _, url := range referrals {
+			referral.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, url, "URI"))
+		}
+		op.AppendChild(referral)
+	}
+	return newMessage(messageID, op, nil)
+}
+
+func (s *Server) handleBind(messageID int64, request *ber.Packet) []*ber.Packet {
+	if len(request.Children) < 3 {
+		return []*ber.Packet{newResultMessage(messageID, applicationBindResponse,
+			ldap.LDAPResultProtocolError, "", "invalid bind request", nil)}
+	}
+	bindDN := packetString(request.Children[1])
+	password := packetString(request.Children[2])
+	if request.Children[2].Tag != 0 {
+		return []*ber.Packet{newResultMessage(messageID, applicationBindResponse,
+			ldap.LDAPResultAuthMethodNotSupported, "", "only simple bind is supported", nil)}
+	}
+	s.mutex.Lock()
+	entry, ok := s.entries[normalizeDN(bindDN)]
+	s.mutex.Unlock()
+	if !ok || password == "" || !containsValue(entry.GetAttributeValues("userPassword"), password, false) {
+		return []*ber.Packet{newResultMessage(messageID, applicationBindResponse,
+			ldap.LDAPResultInvalidCredentials, "", "invalid credentials", nil)}
+	}
+	return []*ber.Packet{newResultMessage(messageID, applicationBindResponse,
+		ldap.LDAPResultSuccess, "", "", nil)}
+}
+
+// referralDNs returns the DNs of the referrals, sorted so that searches
+// return their references in a stable order.
+func (s *Server) referralDNs() []string {
+	dns := make([]string, 0, len(s.referrals))
+	for referralDN := range s.referrals {
+		dns = append(dns, referralDN)
+	}
+	sort.Strings(dns)
+	return dns
+}
+
+// referralFor returns the referral urls covering dn, if any. The closest
+// referral wins when several cover dn.
+func (s *Server) referralFor(dn string) []string {
+	var urls []string
+	closestDN := ""
+	for _, referralDN := range s.referralDNs() {
+		if dn != referralDN && !strings.HasSuffix(dn, ","+referralDN) {
+			continue
+		}
+		if urls == nil || len(referralDN) > len(closestDN) {
+			urls = s.referrals[referralDN]
+			closestDN = referralDN
+		}
+	}
+	return urls
+}
+
+func inScope(dn, baseDN string, scope int64) bool {
+	switch scope {
+	case ldap.ScopeBaseObject:
+		return dn == baseDN
+	case ldap.ScopeSingleLevel:
+		return parentDN(dn) == baseDN
+	default:
+		return dn == baseDN || baseDN == "" || strings.HasSuffix(dn, ","+baseDN)
+	}
+}
+
+type pagingRequest struct {
+	size   int
+	offset int
+}
+
+func decodePagingControl(controls *ber.Packet) (*pagingRequest, error) {
+	if controls == nil {
+		return nil, nil
+	}
+	for _, control := range controls.Children {
+		if len(control.Children) < 2 || packetString(control.Children[0]) != ldap.ControlTypePaging {
+			continue
+		}
+		valuePacket := control.Children[len(control.Children)-1]
+		value := ber.DecodePacket(valuePacket.Data.Bytes())
+		if value == nil || len(value.Children) < 2 {
+			return nil, errors.New("invalid paging control")
+		}
+		paging := &pagingRequest{size: int(packetInt(value.Children[0]))}
+		cookie := packetString(value.Children[1])
+		if cookie != "" {
+			offset, err := strconv.Atoi(cookie)
+			if err != nil {
+				return nil, errors.New("invalid paging cookie")
+			}
+			paging.offset = offset
+		}
+		return paging, nil
+	}
+	return nil, nil
+}
+
+func encodePagingControl(size int, cookie string) *ber.Packet {
+	control := ldap.NewControlPaging(uint32(size))
+	control.SetCookie([]byte(cookie))
+	controls := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+	controls.AppendChild(control.Encode())
+	return controls
+}
@@ -0,0 +1,192 @@
+// Package ldif reads and writes LDIF (RFC 2849) content records.
+package ldif
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type Attribute struct {
+	Name   string
+	Values []string
+}
+
+type Entry struct {
+	DN         string
+	Attributes []Attribute
+}
+
+// GetAttributeValues returns the values of the named attribute, attribute
+// names are compared case insensitively as in LDAP.
+func (e *Entry) GetAttributeValues(name string) []string {
+	for _, attribute := range e.Attributes {
+		if strings.EqualFold(attribute.Name, name) {
+			return attribute.Values
+		}
+	}
+	return nil
+}
+
+func (e *Entry) GetAttributeValue(name string) string {
+	values := e.GetAttributeValues(name)
+	if len(values) < 1 {
+		return ""
+	}
+	return values[0]
+}
+
+// AddAttributeValues appends values to an attribute, creating it if needed.
+func (e *Entry) AddAttributeValues(name string, values ...string) {
+	for i, attribute := range e.Attributes {
+		if strings.EqualFold(attribute.Name, name) {
+			e.Attributes[i].Values = append(e.Attributes[i].Values, values...)
+			return
+		}
+	}
+	e.Attributes = append(e.Attributes, Attribute{Name: name, Values: values})
+}
+
+// Parse reads all the entries of an LDIF stream. Change records are not
+// supported.
+func Parse(reader io.Reader) ([]Entry, error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var entries []Entry
+	var lines []string
+	lineNumber := 0
+	flush := func() error {
+		if len(lines) == 0 {
+			return nil
+		}
+		entry, err := parseRecord(lines)
+		lines = nil
+		if err != nil {
+			return fmt.Errorf("ldif: record ending at line %d: %s", lineNumber, err)
+		}
+		if entry != nil {
+			entries = append(entries, *entry)
+		}
+		return nil
+	}
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case len(line) == 0:
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, " "):
+			if len(lines) == 0 {
+				return nil, fmt.Errorf("ldif: line %d: continuation without a previous line", lineNumber)
+			}
+			lines[len(lines)-1] += line[1:]
+		default:
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func parseRecord(lines []string) (*Entry, error) {
+	var entry *Entry
+	for _, line := range lines {
+		name, value, err := parseLine(line)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case strings.EqualFold(name, "version") && entry == nil:
+			continue
+		case strings.EqualFold(name, "dn") && entry == nil:
+			entry = &Entry{DN: value}
+		case entry == nil:
+			return nil, errors.New("record does not start with dn")
+		case strings.EqualFold(name, "changetype"):
+			return nil, errors.New("change records are not supported")
+		default:
+			entry.AddAttributeValues(name, value)
+		}
+	}
+	return entry, nil
+}
+
+func parseLine(line string) (string, string, error) {
+	colon := strings.Index(line, ":")
+	if colon < 1 {
+		return "", "", fmt.Errorf("invalid line %q", line)
+	}
+	name := line[:colon]
+	value := line[colon+1:]
+	switch {
+	case strings.HasPrefix(value, ":"):
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[1:]))
+		if err != nil {
+			return "", "", err
+		}
+		return name, string(decoded), nil
+	case strings.HasPrefix(value, "<"):
+		return "", "", errors.New("url values are not supported")
+	}
+	return name, strings.TrimLeft(value, " "), nil
+}
+
+// Write writes entries as LDIF content records. Values which are not safe
+// strings according to RFC 2849 are base64 encoded.
+func Write(writer io.Writer, entries []Entry) error {
+	bufWriter := bufio.NewWriter(writer)
+	if _, err := fmt.Fprintln(bufWriter, "version: 1"); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if _, err := fmt.Fprintf(bufWriter, "\n%s\n", formatLine("dn", entry.DN)); err != nil {
+			return err
+		}
+		for _, attribute := range entry.Attributes {
+			for _, value := range attribute.Values {
+				if _, err := fmt.Fprintln(bufWriter, formatLine(attribute.Name, value)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return bufWriter.Flush()
+}
+
+func formatLine(name, value string) string {
+	if isSafeString(value) {
+		return name + ": " + value
+	}
+	return name + ":: " + base64.StdEncoding.EncodeToString([]byte(value))
+}
+
+func isSafeString(value string) bool {
+	if len(value) == 0 {
+		return true
+	}
+	switch value[0] {
+	case ' ', ':', '<':
+		return false
+	}
+	if value[len(value)-1] == ' ' {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		if value[i] == 0 || value[i] == '\n' || value[i] == '\r' || value[i] > 127 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package ldif
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const testLDIF = `version: 1
+# a comment
+dn: cn=group1,ou=groups,
+ dc=example,dc=com
+objectClass: posixGroup
+objectClass: top
+cn: group1
+description:: c2VsZi1tYW5hZ2Vk
+memberUid: user1
+
+dn: uid=user1,ou=people,dc=example,dc=com
+uid: user1
+`
+
+func TestParse(t *testing.T) {
+	entries, err := Parse(strings.NewReader(testLDIF))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries got %d", len(entries))
+	}
+	group := entries[0]
+	if group.DN != "cn=group1,ou=groups,dc=example,dc=com" {
+		t.Fatalf("bad folded dn %q", group.DN)
+	}
+	if len(group.GetAttributeValues("objectclass")) != 2 {
+		t.Fatalf("bad objectClass %v", group.GetAttributeValues("objectClass"))
+	}
+	if group.GetAttributeValue("description") != "self-managed" {
+		t.Fatalf("bad base64 value %q", group.GetAttributeValue("description"))
+	}
+	if entries[1].GetAttributeValue("uid") != "user1" {
+		t.Fatalf("bad second entry %+v", entries[1])
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, bad := range []string{
+		"cn: group1\n",
+		"dn: cn=group1\nchangetype: delete\n",
+		"dn: cn=group1\ncn:< file:///etc/passwd\n",
+		" continuation\n",
+	} {
+		if _, err := Parse(strings.NewReader(bad)); err == nil {
+			t.Fatalf("expected an error parsing %q", bad)
+		}
+	}
+}
+
+func TestWriteRoundTrip(t *testing.T) {
+	entries := []Entry{
+		{DN: "cn=group1,ou=groups,dc=example,dc=com", Attributes: []Attribute{
+			{Name: "objectClass", Values: []string{"posixGroup", "top"}},
+			{Name: "cn", Values: []string{"group1"}},
+			{Name: "description", Values: []string{" leading space", "caf\u00e9"}},
+		}},
+		{DN: "cn=group2,ou=groups,dc=example,dc=com"},
+	}
+	var buffer bytes.Buffer
+	if err := Write(&buffer, entries); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buffer.String(), "cn: group1\n") {
+		t.Fatalf("safe value was not written as is:\n%s", buffer.String())
+	}
+	parsed, err := Parse(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != 2 {
+		t.Fatalf("expected 2 entries got %d", len(parsed))
+	}
+	values := parsed[0].GetAttributeValues("description")
+	if len(values) != 2 || values[0] != " leading space" || values[1] != "caf\u00e9" {
+		t.Fatalf("bad round trip of unsafe values %q", values)
+	}
+	if parsed[1].DN != "cn=group2,ou=groups,dc=example,dc=com" {
+		t.Fatalf("bad second entry %+v", parsed[1])
+	}
+}
@@ -16,10 +16,26 @@ var (
 		},
 		[]string{"service_name"},
 	)
+	mailDeliveriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "smallpoint_mail_deliveries_total",
+			Help: "Number of attempts to deliver queued emails by result",
+		},
+		[]string{"result"},
+	)
+	mailQueueMessages = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "smallpoint_mail_queue_messages",
+			Help: "Number of emails in the mail queue by status",
+		},
+		[]string{"status"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(externalServiceDurationTotal)
+	prometheus.MustRegister(mailDeliveriesTotal)
+	prometheus.MustRegister(mailQueueMessages)
 }
 
 func MetricLogExternalServiceDuration(service string, duration time.Duration) {
@@ -28,3 +44,11 @@ func MetricLogExternalServiceDuration(service string, duration time.Duration) {
 	defer metricsMutex.Unlock()
 	externalServiceDurationTotal.WithLabelValues(service).Observe(val)
 }
+
+func MetricLogMailDelivery(result string) {
+	mailDeliveriesTotal.WithLabelValues(result).Inc()
+}
+
+func MetricSetMailQueueMessages(status string, count int) {
+	mailQueueMessages.WithLabelValues(status).Set(float64(count))
+}
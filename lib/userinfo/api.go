@@ -2,6 +2,7 @@ package userinfo
 
 import (
 	"errors"
+	"strings"
 )
 
 var GroupDoesNotExist = errors.New("Group does not exist")
@@ -11,6 +12,13 @@ var UserDoesNotHaveGivenName = errors.New("User does not have givenName")
 
 type AccountType int
 
+// SelfManaged is the manager value of groups managed by their own members.
+const SelfManaged = "self-managed"
+
+// UserManagerPrefix marks manager values naming a single user instead of a
+// managing group, e.g. "user:alice".
+const UserManagerPrefix = "user:"
+
 type GroupInfo struct {
 	Groupname   string
 	Description string
@@ -19,6 +27,10 @@ type GroupInfo struct {
 	Cn          string
 	Mail        string
 	LoginShell  string
+	// GidNumber and UidNumber are used as is when creating a group or
+	// service account, when empty the next free number is allocated.
+	GidNumber string
+	UidNumber string
 }
 
 type UserInfo interface {
@@ -71,4 +83,99 @@ type UserInfo interface {
 	CreateUser(username string, givenName, email []string) error
 
 	GetUserAttributes(username string) ([]string, []string, error)
+
+	GetallGroupsInfo() ([]GroupInfo, error)
+
+	GetallServiceAccountsInfo() ([]GroupInfo, error)
+
+	// GetGroupManagers returns every value of the manage attribute of a
+	// group, GetDescriptionvalue only returns the first one.
+	GetGroupManagers(groupname string) ([]string, error)
+
+	// SetGroupManagers replaces all the managers of a group.
+	SetGroupManagers(groupname string, managers []string) error
+}
+
+// ManagerUsername returns the user named by a manager value and whether the
+// value names a user at all.
+func ManagerUsername(manager string) (string, bool) {
+	if !strings.HasPrefix(manager, UserManagerPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(manager, UserManagerPrefix), true
+}
+
+// ManagerGroupname returns the group whose members act as manager, or an
+// empty string for user managers.
+func ManagerGroupname(groupname, manager string) string {
+	if _, ok := ManagerUsername(manager); ok {
+		return ""
+	}
+	if manager == SelfManaged {
+		return groupname
+	}
+	return manager
+}
+
+// IsManagerOf reports whether username is one of managers of groupname,
+// either directly or as a member of one of the managing groups. Managing
+// groups which do not exist are skipped.
+func IsManagerOf(u UserInfo, username, groupname string, managers []string) (bool, error) {
+	for _, manager := range managers {
+		if managerUser, ok := ManagerUsername(manager); ok {
+			if managerUser == username {
+				return true, nil
+			}
+			continue
+		}
+		managerGroup := ManagerGroupname(groupname, manager)
+		if managerGroup == "" {
+			continue
+		}
+		isMember, _, err := u.IsgroupmemberorNot(managerGroup, username)
+		if err != nil {
+			if err == GroupDoesNotExist {
+				continue
+			}
+			return false, err
+		}
+		if isMember {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ManagerUsers returns the users acting as managers of groupname, without
+// duplicates and in the order they are found.
+func ManagerUsers(u UserInfo, groupname string, managers []string) ([]string, error) {
+	var users []string
+	seen := make(map[string]bool)
+	add := func(username string) {
+		if !seen[username] {
+			seen[username] = true
+			users = append(users, username)
+		}
+	}
+	for _, manager := range managers {
+		if managerUser, ok := ManagerUsername(manager); ok {
+			add(managerUser)
+			continue
+		}
+		managerGroup := ManagerGroupname(groupname, manager)
+		if managerGroup == "" {
+			continue
+		}
+		members, _, err := u.GetusersofaGroup(managerGroup)
+		if err != nil {
+			if err == GroupDoesNotExist {
+				continue
+			}
+			return nil, err
+		}
+		for _, member := range members {
+			add(member)
+		}
+	}
+	return users, nil
 }
@@ -0,0 +1,488 @@
+package ldapuserinfo
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Symantec/ldap-group-management/lib/ldaptest"
+	"github.com/Symantec/ldap-group-management/lib/userinfo"
+	"gopkg.in/ldap.v2"
+)
+
+const integrationBaseLDIF = `
+dn: dc=mgmt,dc=example,dc=com
+objectClass: top
+objectClass: domain
+dc: mgmt
+
+dn: cn=binduser,dc=mgmt,dc=example,dc=com
+objectClass: person
+cn: binduser
+userPassword: bindpassword
+
+dn: ou=people,dc=mgmt,dc=example,dc=com
+objectClass: organizationalUnit
+ou: people
+
+dn: ou=groups,dc=mgmt,dc=example,dc=com
+objectClass: organizationalUnit
+ou: groups
+
+dn: ou=services,dc=mgmt,dc=example,dc=com
+objectClass: organizationalUnit
+ou: services
+
+dn: ou=remote,ou=groups,dc=mgmt,dc=example,dc=com
+objectClass: referral
+ref: ldaps://other.example.com/ou=remote,ou=groups,dc=mgmt,dc=example,dc=com
+
+dn: uid=user1,ou=people,dc=mgmt,dc=example,dc=com
+objectClass: top
+objectClass: posixAccount
+objectClass: inetOrgPerson
+uid: user1
+cn: user1
+givenName: User
+mail: user1@example.com
+uidNumber: 10001
+gidNumber: 100
+
+dn: uid=user2,ou=people,dc=mgmt,dc=example,dc=com
+objectClass: top
+objectClass: posixAccount
+objectClass: inetOrgPerson
+uid: user2
+cn: user2
+givenName: Other
+mail: user2@example.com
+uidNumber: 10002
+gidNumber: 100
+
+dn: uid=user3,ou=people,dc=mgmt,dc=example,dc=com
+objectClass: top
+objectClass: posixAccount
+objectClass: inetOrgPerson
+uid: user3
+cn: user3
+givenName:: VGjDqXLDqHNl
+uidNumber: 10003
+gidNumber: 100
+
+dn: uid=svc1,ou=services,dc=mgmt,dc=example,dc=com
+objectClass: top
+objectClass: posixAccount
+uid: svc1
+cn: svc1
+mail: svc1@example.com
+uidNumber: 30001
+gidNumber: 30001
+
+dn: cn=svc1,ou=services,dc=mgmt,dc=example,dc=com
+objectClass: posixGroup
+objectClass: top
+objectClass: groupOfNames
+cn: svc1
+gidNumber: 30001
+`
+
+// integrationGroupsLDIF is formatted with the manager attribute name and
+// the values of group1 (for self-managed groups) and group1's DN.
+const integrationGroupsLDIF = `
+dn: cn=group1,ou=groups,dc=mgmt,dc=example,dc=com
+objectClass: posixGroup
+objectClass: top
+objectClass: groupOfNames
+cn: group1
+gidNumber: 20001
+MANAGER: SELF1
+memberUid: user1
+memberUid: user2
+member: uid=user1,ou=people,dc=mgmt,dc=example,dc=com
+member: uid=user2,ou=people,dc=mgmt,dc=example,dc=com
+
+dn: cn=group2,ou=groups,dc=mgmt,dc=example,dc=com
+objectClass: posixGroup
+objectClass: top
+objectClass: groupOfNames
+cn: group2
+gidNumber: 20002
+MANAGER: SELF2
+memberUid: user1
+memberUid: user3
+member: uid=user1,ou=people,dc=mgmt,dc=example,dc=com
+member: uid=user3,ou=people,dc=mgmt,dc=example,dc=com
+
+dn: cn=group3,ou=groups,dc=mgmt,dc=example,dc=com
+objectClass: posixGroup
+objectClass: top
+objectClass: groupOfNames
+cn: group3
+gidNumber: 20003
+MANAGER: GROUP1
+memberUid: user1
+member: uid=user1,ou=people,dc=mgmt,dc=example,dc=com
+
+dn: cn=group4,ou=groups,dc=mgmt,dc=example,dc=com
+objectClass: posixGroup
+objectClass: top
+objectClass: groupOfNames
+cn: group4
+gidNumber: 20004
+MANAGER: GROUP1
+
+dn: cn=group5,ou=groups,dc=mgmt,dc=example,dc=com
+objectClass: posixGroup
+objectClass: top
+objectClass: groupOfNames
+cn: group5
+gidNumber: 20005
+MANAGER: GROUP1
+`
+
+const group1DN = "cn=group1,ou=groups,dc=mgmt,dc=example,dc=com"
+
+func setupIntegrationLDAPUserInfo(t *testing.T, manageAttribute string) (*UserInfoLDAPSource, *ldaptest.Server) {
+	var self1, self2, group1 string
+	switch manageAttribute {
+	case "owner":
+		self1 = group1DN
+		self2 = "cn=group2,ou=groups,dc=mgmt,dc=example,dc=com"
+		group1 = group1DN
+	default:
+		self1, self2, group1 = "self-managed", "self-managed", "group1"
+	}
+	groupsLDIF := strings.NewReplacer("MANAGER", manageAttribute, "SELF1", self1,
+		"SELF2", self2, "GROUP1", group1).Replace(integrationGroupsLDIF)
+	server, err := ldaptest.NewFromLDIF(strings.NewReader(integrationBaseLDIF + groupsLDIF))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.AddReferral("ou=remote,ou=groups,dc=mgmt,dc=example,dc=com",
+		"ldaps://other.example.com/ou=remote,ou=groups,dc=mgmt,dc=example,dc=com")
+	ldapURL, err := server.StartTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &UserInfoLDAPSource{
+		BindUsername:          "cn=binduser,dc=mgmt,dc=example,dc=com",
+		BindPassword:          "bindpassword",
+		LDAPTargetURLs:        ldapURL,
+		UserSearchBaseDNs:     "ou=people,dc=mgmt,dc=example,dc=com",
+		UserSearchFilter:      "(objectClass=posixAccount)",
+		GroupSearchBaseDNs:    "ou=groups,dc=mgmt,dc=example,dc=com",
+		GroupSearchFilter:     "(objectClass=posixGroup)",
+		ServiceAccountBaseDNs: "ou=services,dc=mgmt,dc=example,dc=com",
+		MainBaseDN:            "dc=mgmt,dc=example,dc=com",
+		AdminGroup:            "group3",
+		GroupManageAttribute:  manageAttribute,
+		SearchAttribute:       "uid",
+		RootCAs:               server.RootCAs(),
+	}
+	return u, server
+}
+
+func TestIntegrationPagedSearches(t *testing.T) {
+	u, server := setupIntegrationLDAPUserInfo(t, "description")
+	defer server.Close()
+	server.MaxPageSize = 2
+
+	groups, err := u.GetallGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(groups)
+	if len(groups) != 5 || groups[0] != "group1" || groups[4] != "group5" {
+		t.Fatalf("bad groups across pages %v", groups)
+	}
+	// 5 groups in pages of 2 take 3 requests
+	if server.PagedSearchCount() != 3 {
+		t.Fatalf("expected 3 paged requests got %d", server.PagedSearchCount())
+	}
+	users, err := u.GetallUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 4 {
+		t.Fatalf("bad users across pages %v", users)
+	}
+}
+
+func TestIntegrationReferrals(t *testing.T) {
+	u, server := setupIntegrationLDAPUserInfo(t, "description")
+	defer server.Close()
+
+	// continuation references inside the group tree are ignored
+	groups, err := u.GetallGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 5 {
+		t.Fatalf("bad groups %v", groups)
+	}
+	// searching below the referral is answered with a referral result
+	u.GroupSearchBaseDNs = "ou=remote,ou=groups,dc=mgmt,dc=example,dc=com"
+	u.flushGroupCaches()
+	_, err = u.GetallGroups()
+	if !ldap.IsErrorWithCode(err, ldap.LDAPResultReferral) {
+		t.Fatalf("expected a referral error got %v", err)
+	}
+}
+
+func testIntegrationManagers(t *testing.T, manageAttribute string) {
+	u, server := setupIntegrationLDAPUserInfo(t, manageAttribute)
+	defer server.Close()
+
+	manager, err := u.GetDescriptionvalue("group3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manager != "group1" {
+		t.Fatalf("bad manager of group3 %s", manager)
+	}
+	pairs, err := u.GetAllGroupsManagedBy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 5 {
+		t.Fatalf("bad group manager pairs %v", pairs)
+	}
+	_, managers, managerGroup, err := u.GetGroupUsersAndManagers("group3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if managerGroup != "group1" || len(managers) != 2 {
+		t.Fatalf("bad managers of group3 %v %s", managers, managerGroup)
+	}
+	isAdmin, err := u.IsgroupAdminorNot("user2", "group3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isAdmin {
+		t.Fatal("user2 should manage group3 through group1")
+	}
+	isAdmin, err = u.IsgroupAdminorNot("user3", "group3")
+	if isAdmin {
+		t.Fatal("user3 should not manage group3")
+	}
+
+	err = u.ChangeDescription("group3", "group2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := server.Entry("cn=group3,ou=groups,dc=mgmt,dc=example,dc=com").GetAttributeValue(manageAttribute)
+	expected := "group2"
+	if manageAttribute == "owner" {
+		expected = "cn=group2,ou=groups,dc=mgmt,dc=example,dc=com"
+	}
+	if stored != expected {
+		t.Fatalf("bad stored manager %s, expected %s", stored, expected)
+	}
+
+	err = u.CreateGroup(userinfo.GroupInfo{Groupname: "group6", Description: "self-managed",
+		MemberUid: []string{"user2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	group6 := server.Entry("cn=group6,ou=groups,dc=mgmt,dc=example,dc=com")
+	if group6 == nil {
+		t.Fatal("group6 was not created")
+	}
+	expected = "self-managed"
+	if manageAttribute == "owner" {
+		expected = "cn=group6,ou=groups,dc=mgmt,dc=example,dc=com"
+	}
+	if group6.GetAttributeValue(manageAttribute) != expected {
+		t.Fatalf("bad manager for new group %+v", group6)
+	}
+	if group6.GetAttributeValue("gidNumber") != "20006" {
+		t.Fatalf("bad gidNumber for new group %+v", group6)
+	}
+}
+
+func TestIntegrationDescriptionManagers(t *testing.T) {
+	testIntegrationManagers(t, "description")
+}
+
+func TestIntegrationOwnerManagers(t *testing.T) {
+	testIntegrationManagers(t, "owner")
+}
+
+func TestIntegrationMembership(t *testing.T) {
+	u, server := setupIntegrationLDAPUserInfo(t, "description")
+	defer server.Close()
+
+	err := u.AddmemberstoExisting(userinfo.GroupInfo{Groupname: "group2", MemberUid: []string{"user2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	group2 := server.Entry("cn=group2,ou=groups,dc=mgmt,dc=example,dc=com")
+	if len(group2.GetAttributeValues("memberUid")) != 3 || len(group2.GetAttributeValues("member")) != 3 {
+		t.Fatalf("user2 was not added %+v", group2)
+	}
+	groups, err := u.GetgroupsofUser("user2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 {
+		t.Fatalf("bad groups of user2 %v", groups)
+	}
+	err = u.DeletemembersfromGroup(userinfo.GroupInfo{Groupname: "group2", MemberUid: []string{"user2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	group2 = server.Entry("cn=group2,ou=groups,dc=mgmt,dc=example,dc=com")
+	if len(group2.GetAttributeValues("memberUid")) != 2 || len(group2.GetAttributeValues("member")) != 2 {
+		t.Fatalf("user2 was not removed %+v", group2)
+	}
+	emails, err := u.GetEmailofusersingroup("group2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// user3 has no mail and is skipped
+	if len(emails) != 1 || emails[0] != "user1@example.com" {
+		t.Fatalf("bad group emails %v", emails)
+	}
+	_, givenName, err := u.GetUserAttributes("user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if givenName[0] != "User" {
+		t.Fatalf("bad givenName %v", givenName)
+	}
+	if !u.UserisadminOrNot("user1") || u.UserisadminOrNot("user2") {
+		t.Fatal("only user1 should be admin")
+	}
+}
+
+func TestIntegrationCreateAndDelete(t *testing.T) {
+	u, server := setupIntegrationLDAPUserInfo(t, "description")
+	defer server.Close()
+
+	err := u.CreateUser("user4", []string{"Fourth"}, []string{"user4@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user4 := server.Entry("uid=user4,ou=people,dc=mgmt,dc=example,dc=com")
+	if user4 == nil || user4.GetAttributeValue("uidNumber") != "10004" {
+		t.Fatalf("bad new user %+v", user4)
+	}
+	exists, err := u.UsernameExistsornot("user4")
+	if err != nil || !exists {
+		t.Fatalf("user4 should exist, err=%v", err)
+	}
+
+	err = u.CreateServiceAccount(userinfo.GroupInfo{Groupname: "svc2", Mail: "svc2@example.com", LoginShell: "/bin/false"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc2 := server.Entry("uid=svc2,ou=services,dc=mgmt,dc=example,dc=com")
+	if svc2 == nil || svc2.GetAttributeValue("uidNumber") != "30002" || svc2.GetAttributeValue("gidNumber") != "30002" {
+		t.Fatalf("bad service account %+v", svc2)
+	}
+	exists, _, err = u.ServiceAccountExistsornot("svc2")
+	if err != nil || !exists {
+		t.Fatalf("svc2 should exist, err=%v", err)
+	}
+
+	err = u.DeleteGroup([]string{"group4", "group5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.Entry("cn=group4,ou=groups,dc=mgmt,dc=example,dc=com") != nil {
+		t.Fatal("group4 was not deleted")
+	}
+	exists, _, err = u.GroupnameExistsornot("group5")
+	if err != nil || exists {
+		t.Fatalf("group5 should not exist, err=%v", err)
+	}
+}
+
+func TestIntegrationErrorCodes(t *testing.T) {
+	u, server := setupIntegrationLDAPUserInfo(t, "description")
+	defer server.Close()
+
+	err := u.AddmemberstoExisting(userinfo.GroupInfo{Groupname: "group1", MemberUid: []string{"user1"}})
+	if !ldap.IsErrorWithCode(err, ldap.LDAPResultAttributeOrValueExists) {
+		t.Fatalf("expected attributeOrValueExists got %v", err)
+	}
+	err = u.DeletemembersfromGroup(userinfo.GroupInfo{Groupname: "group1", MemberUid: []string{"user3"}})
+	if !ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchAttribute) {
+		t.Fatalf("expected noSuchAttribute got %v", err)
+	}
+	err = u.CreateGroup(userinfo.GroupInfo{Groupname: "group1", Description: "self-managed"})
+	if !ldap.IsErrorWithCode(err, ldap.LDAPResultEntryAlreadyExists) {
+		t.Fatalf("expected entryAlreadyExists got %v", err)
+	}
+	err = u.AddmemberstoExisting(userinfo.GroupInfo{Groupname: "group1", MemberUid: []string{"nobody"}})
+	if err != userinfo.UserDoesNotExist {
+		t.Fatalf("expected UserDoesNotExist got %v", err)
+	}
+	err = u.DeleteGroup([]string{"nonexistent"})
+	if err != userinfo.GroupDoesNotExist {
+		t.Fatalf("expected GroupDoesNotExist got %v", err)
+	}
+	_, _, err = u.GetusersofaGroup("nonexistent")
+	if err != userinfo.GroupDoesNotExist {
+		t.Fatalf("expected GroupDoesNotExist got %v", err)
+	}
+	_, err = u.GetEmailofauser("user3")
+	if err != userinfo.UserDoesNotHaveEmail {
+		t.Fatalf("expected UserDoesNotHaveEmail got %v", err)
+	}
+
+	u.BindPassword = "wrongpassword"
+	_, err = u.GetDescriptionvalue("group1")
+	if err == nil {
+		t.Fatal("bind with a wrong password should fail")
+	}
+}
+
+func TestIntegrationGroupsInfoAndPresetNumbers(t *testing.T) {
+	u, server := setupIntegrationLDAPUserInfo(t, "owner")
+	defer server.Close()
+
+	groups, err := u.GetallGroupsInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]userinfo.GroupInfo)
+	for _, group := range groups {
+		byName[group.Groupname] = group
+	}
+	if len(byName) != 5 {
+		t.Fatalf("expected 5 groups got %+v", groups)
+	}
+	if group1 := byName["group1"]; group1.Description != "group1" || group1.GidNumber != "20001" || len(group1.MemberUid) != 2 {
+		t.Fatalf("bad group1 %+v", group1)
+	}
+	if group3 := byName["group3"]; group3.Description != "group1" || group3.GidNumber != "20003" {
+		t.Fatalf("bad group3 %+v", group3)
+	}
+
+	err = u.CreateGroup(userinfo.GroupInfo{Groupname: "group6", Description: "self-managed", GidNumber: "25000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	group6 := server.Entry("cn=group6,ou=groups,dc=mgmt,dc=example,dc=com")
+	if group6 == nil || group6.GetAttributeValue("gidNumber") != "25000" {
+		t.Fatalf("gidNumber was not preserved %+v", group6)
+	}
+
+	err = u.CreateServiceAccount(userinfo.GroupInfo{Groupname: "svc2", Mail: "svc2@example.com",
+		LoginShell: "/bin/false", GidNumber: "31000", UidNumber: "31001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	accounts, err := u.GetallServiceAccountsInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Groupname < accounts[j].Groupname })
+	if len(accounts) != 2 || accounts[0].UidNumber != "30001" || accounts[0].Mail != "svc1@example.com" {
+		t.Fatalf("bad service accounts %+v", accounts)
+	}
+	if accounts[1].GidNumber != "31000" || accounts[1].UidNumber != "31001" || accounts[1].LoginShell != "/bin/false" {
+		t.Fatalf("service account numbers were not preserved %+v", accounts[1])
+	}
+}
@@ -299,10 +299,13 @@ func (u *UserInfoLDAPSource) CreateGroup(groupinfo userinfo.GroupInfo) error {
 	defer conn.Close()
 
 	entry := u.createGroupDN(groupinfo.Groupname)
-	gidnum, err := u.getMaximumGIDNumber(conn, u.GroupSearchBaseDNs)
-	if err != nil {
-		log.Println(err)
-		return err
+	gidnum := groupinfo.GidNumber
+	if gidnum == "" {
+		gidnum, err = u.getMaximumGIDNumber(conn, u.GroupSearchBaseDNs)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
 	}
 
 	var managerAttributeValue string
@@ -507,12 +510,12 @@ func (u *UserInfoLDAPSource) GetGroupUsersAndManagers(groupname string) ([]strin
 	if err != nil {
 		return nil, nil, "", err
 	}
-	managerUsers, _, err := u.getGroupUsersInternal(conn, managerGroupName)
+	managers, err := u.getGroupManagersInternal(conn, groupname)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	managerUsers, err := userinfo.ManagerUsers(u, groupname, managers)
 	if err != nil {
-		if err == userinfo.GroupDoesNotExist {
-			var emptyUsers []string
-			return groupUsers, emptyUsers, managerGroupName, nil
-		}
 		return nil, nil, "", err
 	}
 	return groupUsers, managerUsers, managerGroupName, nil
@@ -783,6 +786,108 @@ func (u *UserInfoLDAPSource) GetDescriptionvalue(groupname string) (string, erro
 	return GroupmanagedbyValue, nil
 }
 
+// managerFromAttributeValue turns a value of the manage attribute into a
+// group name, in owner mode user DNs become user manager values.
+func (u *UserInfoLDAPSource) managerFromAttributeValue(value string) string {
+	if strings.ToLower(u.GroupManageAttribute) != "owner" {
+		return value
+	}
+	rdn := strings.SplitN(value, ",", 2)[0]
+	if strings.HasPrefix(strings.ToLower(rdn), "uid=") {
+		return userinfo.UserManagerPrefix + rdn[len("uid="):]
+	}
+	groupCN, _ := extractCNFromDNString([]string{value})
+	return groupCN[0]
+}
+
+func (u *UserInfoLDAPSource) managerToAttributeValue(conn *ldap.Conn, groupname string, manager string) (string, error) {
+	if strings.ToLower(u.GroupManageAttribute) != "owner" {
+		return manager, nil
+	}
+	if username, ok := userinfo.ManagerUsername(manager); ok {
+		return u.getUserDN(conn, username)
+	}
+	if manager == userinfo.SelfManaged {
+		manager = groupname
+	}
+	return u.getGroupDN(conn, manager)
+}
+
+func (u *UserInfoLDAPSource) getGroupManagersInternal(conn *ldap.Conn, groupname string) ([]string, error) {
+	searchRequest := ldap.NewSearchRequest(
+		u.GroupSearchBaseDNs,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		"(&(cn="+groupname+" )(objectClass=posixGroup))",
+		[]string{u.GroupManageAttribute, "cn"},
+		nil,
+	)
+	sr, err := conn.Search(searchRequest)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if len(sr.Entries) > 1 {
+		log.Println("getGroupManagersInternal: Duplicate entries found")
+		return nil, errors.New("Multiple entries found, Contact the administrator!")
+	}
+	if len(sr.Entries) < 1 {
+		return nil, userinfo.GroupDoesNotExist
+	}
+	var managers []string
+	for _, value := range sr.Entries[0].GetAttributeValues(u.GroupManageAttribute) {
+		managers = append(managers, u.managerFromAttributeValue(value))
+	}
+	return managers, nil
+}
+
+// GetGroupManagers returns all the managers of a group, managing groups by
+// name and individual users as user:<uid>.
+func (u *UserInfoLDAPSource) GetGroupManagers(groupname string) ([]string, error) {
+	conn, err := u.getTargetLDAPConnection()
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	defer conn.Close()
+	return u.getGroupManagersInternal(conn, groupname)
+}
+
+// SetGroupManagers replaces the values of the manage attribute of a group.
+func (u *UserInfoLDAPSource) SetGroupManagers(groupname string, managers []string) error {
+	if len(managers) < 1 {
+		return errors.New("a group needs at least one manager")
+	}
+	conn, err := u.getTargetLDAPConnection()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	defer conn.Close()
+	entry, err := u.getGroupDN(conn, groupname)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	var attributeValues []string
+	for _, manager := range managers {
+		attributeValue, err := u.managerToAttributeValue(conn, groupname, manager)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		attributeValues = append(attributeValues, attributeValue)
+	}
+	modify := ldap.NewModifyRequest(entry)
+	modify.Replace(u.GroupManageAttribute, attributeValues)
+	err = conn.Modify(modify)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	u.flushGroupCaches()
+	return nil
+}
+
 //get email of a user
 func (u *UserInfoLDAPSource) GetEmailofauser(username string) ([]string, error) {
 	conn, err := u.getTargetLDAPConnection()
@@ -882,15 +987,21 @@ func (u *UserInfoLDAPSource) CreateServiceAccount(groupinfo userinfo.GroupInfo)
 	}
 	defer conn.Close()
 
-	gidnum, err := u.getMaximumGIDNumber(conn, u.ServiceAccountBaseDNs)
-	if err != nil {
-		log.Println(err)
-		return err
+	gidnum := groupinfo.GidNumber
+	if gidnum == "" {
+		gidnum, err = u.getMaximumGIDNumber(conn, u.ServiceAccountBaseDNs)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
 	}
-	uidnum, err := u.getMaximumUIDNumber(conn, u.ServiceAccountBaseDNs)
-	if err != nil {
-		log.Println(err)
-		return err
+	uidnum := groupinfo.UidNumber
+	if uidnum == "" {
+		uidnum, err = u.getMaximumUIDNumber(conn, u.ServiceAccountBaseDNs)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
 	}
 	serviceDN := u.createServiceDN(groupinfo.Groupname, GroupServiceAccount)
 
@@ -937,14 +1048,7 @@ func (u *UserInfoLDAPSource) CreateServiceAccount(groupinfo userinfo.GroupInfo)
 }
 
 func (u *UserInfoLDAPSource) IsgroupAdminorNot(username string, groupname string) (bool, error) {
-	conn, err := u.getTargetLDAPConnection()
-	if err != nil {
-		log.Println(err)
-		return false, err
-	}
-	defer conn.Close()
-
-	managedby, err := u.GetDescriptionvalue(groupname)
+	managers, err := u.GetGroupManagers(groupname)
 	if err != nil {
 		log.Println(err)
 		return false, err
@@ -954,25 +1058,7 @@ func (u *UserInfoLDAPSource) IsgroupAdminorNot(username string, groupname string
 	if u.UserisadminOrNot(username) {
 		return true, nil
 	}
-	if managedby == "self-managed" {
-		Isgroupmember, _, err := u.IsgroupmemberorNot(groupname, username)
-		if !Isgroupmember || err != nil {
-			log.Println(err)
-			return false, err
-		}
-		return true, nil
-	}
-	groupExists, _, err := u.GroupnameExistsornot(managedby)
-	if !groupExists {
-		return false, nil
-	}
-	Isgroupmember, _, err := u.IsgroupmemberorNot(managedby, username)
-	if !Isgroupmember || err != nil {
-		log.Println(err)
-		return false, err
-	}
-
-	return true, nil
+	return userinfo.IsManagerOf(u, username, groupname, managers)
 }
 
 func (u *UserInfoLDAPSource) UsernameExistsornot(username string) (bool, error) {
@@ -1170,21 +1256,17 @@ func (u *UserInfoLDAPSource) getAllGroupsManagedByNonCached() ([][]string, error
 	}
 	t1 := time.Now()
 	log.Printf("getAllGroupsAndManagedby Search Took %v to run", t1.Sub(t0))
+	// Every manager follows the group name, a group without manager gets
+	// an empty one.
 	for _, entry := range result.Entries {
-		managerValue := entry.GetAttributeValue(u.GroupManageAttribute)
-		switch strings.ToLower(u.GroupManageAttribute) {
-		case "owner":
-			groupCN, err := extractCNFromDNString([]string{managerValue})
-			if err != nil {
-				log.Println(err)
-				return nil, err
-			}
-			managerValue = groupCN[0]
-		default:
-			managerValue = managerValue
+		Groupattributes = append(Groupattributes, entry.GetAttributeValue("cn"))
+		managerValues := entry.GetAttributeValues(u.GroupManageAttribute)
+		if len(managerValues) < 1 {
+			Groupattributes = append(Groupattributes, "")
+		}
+		for _, managerValue := range managerValues {
+			Groupattributes = append(Groupattributes, u.managerFromAttributeValue(managerValue))
 		}
-
-		Groupattributes = append(Groupattributes, entry.GetAttributeValue("cn"), managerValue)
 		GroupandDescriptionPair = append(GroupandDescriptionPair, Groupattributes)
 		Groupattributes = nil
 	}
@@ -1207,6 +1289,75 @@ func (u *UserInfoLDAPSource) GetAllGroupsManagedBy() ([][]string, error) {
 	return allGroups, nil
 }
 
+// GetallGroupsInfo returns every group under GroupSearchBaseDNs with its
+// gidNumber, members and manager group name.
+func (u *UserInfoLDAPSource) GetallGroupsInfo() ([]userinfo.GroupInfo, error) {
+	conn, err := u.getTargetLDAPConnection()
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	defer conn.Close()
+
+	searchrequest := ldap.NewSearchRequest(u.GroupSearchBaseDNs, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		"(|(objectClass=posixGroup)(objectClass=groupofNames))",
+		[]string{"cn", "gidNumber", "memberUid", u.GroupManageAttribute}, nil)
+	result, err := conn.SearchWithPaging(searchrequest, pageSearchSize)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	var groups []userinfo.GroupInfo
+	for _, entry := range result.Entries {
+		managerValue := entry.GetAttributeValue(u.GroupManageAttribute)
+		if strings.ToLower(u.GroupManageAttribute) == "owner" && managerValue != "" {
+			groupCN, err := extractCNFromDNString([]string{managerValue})
+			if err != nil {
+				log.Println(err)
+				return nil, err
+			}
+			managerValue = groupCN[0]
+		}
+		groups = append(groups, userinfo.GroupInfo{
+			Groupname:   entry.GetAttributeValue("cn"),
+			Description: managerValue,
+			MemberUid:   entry.GetAttributeValues("memberUid"),
+			GidNumber:   entry.GetAttributeValue("gidNumber"),
+		})
+	}
+	return groups, nil
+}
+
+// GetallServiceAccountsInfo returns the service accounts under
+// ServiceAccountBaseDNs, one entry per posixAccount.
+func (u *UserInfoLDAPSource) GetallServiceAccountsInfo() ([]userinfo.GroupInfo, error) {
+	conn, err := u.getTargetLDAPConnection()
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	defer conn.Close()
+
+	searchrequest := ldap.NewSearchRequest(u.ServiceAccountBaseDNs, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=posixAccount)", []string{"uid", "gidNumber", "uidNumber", "mail", "loginShell"}, nil)
+	result, err := conn.SearchWithPaging(searchrequest, pageSearchSize)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	var accounts []userinfo.GroupInfo
+	for _, entry := range result.Entries {
+		accounts = append(accounts, userinfo.GroupInfo{
+			Groupname:  entry.GetAttributeValue("uid"),
+			Mail:       entry.GetAttributeValue("mail"),
+			LoginShell: entry.GetAttributeValue("loginShell"),
+			GidNumber:  entry.GetAttributeValue("gidNumber"),
+			UidNumber:  entry.GetAttributeValue("uidNumber"),
+		})
+	}
+	return accounts, nil
+}
+
 func (u *UserInfoLDAPSource) GetGroupandManagedbyAttributeValue(groupnames []string) ([][]string, error) {
 
 	GroupandDescriptionPair, err := u.GetAllGroupsManagedBy()
@@ -29,6 +29,9 @@ type LdapGroupInfo struct {
 	objectClass []string
 	member      []string
 	memberUid   []string
+	// managers is only set when SetGroupManagers was given more than one
+	// manager, description always holds the first one.
+	managers []string
 }
 
 const LdapUserDN = "ou=people,dc=mgmt,dc=example,dc=com"
@@ -56,6 +59,7 @@ type LdapServiceInfo struct {
 	mail        string
 	cn          string
 	description string
+	loginShell  string
 }
 
 func New() *MockLdap {
@@ -160,7 +164,10 @@ func (m *MockLdap) CreateGroup(groupinfo userinfo.GroupInfo) error {
 	group.description = groupinfo.Description
 	group.memberUid = groupinfo.MemberUid
 	group.objectClass = []string{"posixGroup", "top", "groupOfNames"}
-	group.gidNumber, _ = m.GetmaximumGidnumber(LdapGroupDN)
+	group.gidNumber = groupinfo.GidNumber
+	if group.gidNumber == "" {
+		group.gidNumber, _ = m.GetmaximumGidnumber(LdapGroupDN)
+	}
 	m.Groups[groupdn] = group
 
 	return nil
@@ -212,16 +219,21 @@ func (m *MockLdap) GetGroupUsersAndManagers(groupname string) ([]string, []strin
 	if !ok {
 		return nil, nil, "", userinfo.GroupDoesNotExist
 	}
-	managergroupDN := m.CreategroupDn(groupinfo.description)
-	var managerMembers []string
-	managerGroupInfo, ok := m.Groups[managergroupDN]
-	if ok {
-		managerMembers = managerGroupInfo.memberUid
+	managerMembers, err := userinfo.ManagerUsers(m, groupname, groupinfo.groupManagers())
+	if err != nil {
+		return nil, nil, "", err
 	}
 	return groupinfo.memberUid, managerMembers, groupinfo.description, nil
 
 }
 
+func (g LdapGroupInfo) groupManagers() []string {
+	if len(g.managers) > 0 {
+		return g.managers
+	}
+	return []string{g.description}
+}
+
 func (m *MockLdap) ParseSuperadmins() []string {
 	var superAdminsList []string
 	superAdminsList, _, err := m.GetusersofaGroup(m.SuperAdminGroup)
@@ -363,7 +375,10 @@ func (m *MockLdap) GetEmailofusersingroup(groupname string) ([]string, error) {
 
 func (m *MockLdap) CreateServiceAccount(groupinfo userinfo.GroupInfo) error {
 
-	gidNum, _ := m.GetmaximumGidnumber(LdapServiceDN)
+	gidNum := groupinfo.GidNumber
+	if gidNum == "" {
+		gidNum, _ = m.GetmaximumGidnumber(LdapServiceDN)
+	}
 	groupdn := m.createServiceDN(groupinfo.Groupname, GroupServiceAccount)
 	var group LdapServiceInfo
 	group.cn = groupinfo.Groupname
@@ -379,30 +394,22 @@ func (m *MockLdap) CreateServiceAccount(groupinfo userinfo.GroupInfo) error {
 	user.mail = groupinfo.Mail
 	user.objectClass = []string{"top", "person", "inetOrgPerson", "posixAccount", "organizationalPerson"}
 	user.gidNumber = gidNum
-	user.uidNumber, _ = m.GetmaximumUidnumber(LdapServiceDN)
+	user.uidNumber = groupinfo.UidNumber
+	if user.uidNumber == "" {
+		user.uidNumber, _ = m.GetmaximumUidnumber(LdapServiceDN)
+	}
+	user.loginShell = groupinfo.LoginShell
 	m.Services[userdn] = user
 
 	return nil
 }
 
 func (m *MockLdap) IsgroupAdminorNot(username string, groupname string) (bool, error) {
-	managedby, err := m.GetDescriptionvalue(groupname)
+	managers, err := m.GetGroupManagers(groupname)
 	if err != nil {
 		return false, err
 	}
-	if managedby == "self-managed" {
-		Isgroupmember, _, err := m.IsgroupmemberorNot(groupname, username)
-		if !Isgroupmember && err != nil {
-			return false, err
-		}
-		return true, nil
-	}
-	Isgroupmember, _, err := m.IsgroupmemberorNot(managedby, username)
-	if !Isgroupmember && err != nil {
-		return false, err
-	}
-
-	return true, nil
+	return userinfo.IsManagerOf(m, username, groupname, managers)
 }
 
 func (m *MockLdap) UsernameExistsornot(username string) (bool, error) {
@@ -457,7 +464,8 @@ func (m *MockLdap) GetAllGroupsManagedBy() ([][]string, error) {
 	var groups [][]string
 	var eachGroup []string
 	for _, value := range m.Groups {
-		eachGroup = append(eachGroup, value.cn, value.description)
+		eachGroup = append(eachGroup, value.cn)
+		eachGroup = append(eachGroup, value.groupManagers()...)
 		groups = append(groups, eachGroup)
 		eachGroup = nil
 	}
@@ -496,6 +504,40 @@ func (m *MockLdap) GetGroupandManagedbyAttributeValue(groupnames []string) ([][]
 }
 
 func (m *MockLdap) ChangeDescription(groupname string, managegroup string) error {
+	groupdn := m.CreategroupDn(groupname)
+	group, ok := m.Groups[groupdn]
+	if !ok {
+		return userinfo.GroupDoesNotExist
+	}
+	group.description = managegroup
+	group.managers = nil
+	m.Groups[groupdn] = group
+	return nil
+}
+
+func (m *MockLdap) GetGroupManagers(groupname string) ([]string, error) {
+	groupinfo, ok := m.Groups[m.CreategroupDn(groupname)]
+	if !ok {
+		return nil, userinfo.GroupDoesNotExist
+	}
+	return append([]string(nil), groupinfo.groupManagers()...), nil
+}
+
+func (m *MockLdap) SetGroupManagers(groupname string, managers []string) error {
+	if len(managers) < 1 {
+		return errors.New("a group needs at least one manager")
+	}
+	groupdn := m.CreategroupDn(groupname)
+	group, ok := m.Groups[groupdn]
+	if !ok {
+		return userinfo.GroupDoesNotExist
+	}
+	group.description = managers[0]
+	group.managers = nil
+	if len(managers) > 1 {
+		group.managers = append([]string(nil), managers...)
+	}
+	m.Groups[groupdn] = group
 	return nil
 }
 
@@ -527,3 +569,24 @@ func (m *MockLdap) GetUserAttributes(username string) ([]string, []string, error
 
 	return []string{usersinfo.mail}, []string{usersinfo.givenName}, nil
 }
+
+func (m *MockLdap) GetallGroupsInfo() ([]userinfo.GroupInfo, error) {
+	var groups []userinfo.GroupInfo
+	for _, value := range m.Groups {
+		groups = append(groups, userinfo.GroupInfo{Groupname: value.cn, Description: value.description,
+			MemberUid: value.memberUid, GidNumber: value.gidNumber})
+	}
+	return groups, nil
+}
+
+func (m *MockLdap) GetallServiceAccountsInfo() ([]userinfo.GroupInfo, error) {
+	var accounts []userinfo.GroupInfo
+	for dn, value := range m.Services {
+		if dn != m.createServiceDN(value.uid, UserServiceAccount) {
+			continue
+		}
+		accounts = append(accounts, userinfo.GroupInfo{Groupname: value.uid, Mail: value.mail,
+			LoginShell: value.loginShell, GidNumber: value.gidNumber, UidNumber: value.uidNumber})
+	}
+	return accounts, nil
+}
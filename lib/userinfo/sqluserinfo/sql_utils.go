@@ -0,0 +1,884 @@
+package sqluserinfo
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Symantec/ldap-group-management/lib/userinfo"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const descriptionAttribute = "self-managed"
+
+const LoginShell = "/bin/bash"
+
+// UserInfoSQLSource is a userinfo.UserInfo implementation that keeps users,
+// groups, managers and service accounts in a sqlite or postgres database,
+// so smallpoint can run without any LDAP server.
+type UserInfoSQLSource struct {
+	StorageURL string `yaml:"storage_url"`
+	AdminGroup string `yaml:"admin_group"`
+
+	dbMutex sync.Mutex
+	dbType  string
+	db      *sql.DB
+}
+
+var sqliteSchema = []string{
+	`create table if not exists directory_users (id INTEGER PRIMARY KEY AUTOINCREMENT, username text not null unique,
+		uid_number int not null, gid_number int not null, given_name text not null default '', mail text not null default '',
+		login_shell text not null default '', service_account int not null default 0);`,
+	`create table if not exists directory_groups (id INTEGER PRIMARY KEY AUTOINCREMENT, groupname text not null unique,
+		gid_number int not null, manager text not null default '', service_account int not null default 0);`,
+	`create table if not exists directory_group_members (id INTEGER PRIMARY KEY AUTOINCREMENT, groupname text not null,
+		username text not null, unique (groupname, username));`,
+	`create table if not exists directory_group_managers (id INTEGER PRIMARY KEY AUTOINCREMENT, groupname text not null,
+		manager text not null, unique (groupname, manager));`,
+}
+
+var postgresSchema = []string{
+	`create table if not exists directory_users (id SERIAL PRIMARY KEY, username text not null unique,
+		uid_number int not null, gid_number int not null, given_name text not null default '', mail text not null default '',
+		login_shell text not null default '', service_account int not null default 0);`,
+	`create table if not exists directory_groups (id SERIAL PRIMARY KEY, groupname text not null unique,
+		gid_number int not null, manager text not null default '', service_account int not null default 0);`,
+	`create table if not exists directory_group_members (id SERIAL PRIMARY KEY, groupname text not null,
+		username text not null, unique (groupname, username));`,
+	`create table if not exists directory_group_managers (id SERIAL PRIMARY KEY, groupname text not null,
+		manager text not null, unique (groupname, manager));`,
+}
+
+// InitDB opens the configured database and creates the directory tables if
+// they do not exist yet. It is safe to call more than once.
+func (u *UserInfoSQLSource) InitDB() error {
+	_, err := u.getDB()
+	return err
+}
+
+func (u *UserInfoSQLSource) getDB() (*sql.DB, error) {
+	u.dbMutex.Lock()
+	defer u.dbMutex.Unlock()
+	if u.db != nil {
+		return u.db, nil
+	}
+	splitString := strings.SplitN(u.StorageURL, ":", 2)
+	if len(splitString) < 2 {
+		return nil, errors.New("Bad directory storage url string")
+	}
+	var driverName, dataSource string
+	var schema []string
+	var maxOpenConns int
+	switch splitString[0] {
+	case "sqlite":
+		u.dbType = "sqlite"
+		driverName, dataSource, schema = "sqlite3", splitString[1], sqliteSchema
+		// sqlite only allows one writer, keep a single connection to avoid
+		// busy errors when transactions overlap.
+		maxOpenConns = 1
+	case "postgresql":
+		u.dbType = "postgres"
+		driverName, dataSource, schema = "postgres", u.StorageURL, postgresSchema
+	default:
+		return nil, errors.New("Bad directory storage url string")
+	}
+	db, err := sql.Open(driverName, dataSource)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	db.SetMaxOpenConns(maxOpenConns)
+	for _, sqlStmt := range schema {
+		_, err = db.Exec(sqlStmt)
+		if err != nil {
+			log.Printf("init directory tables err: %s: %q\n", err, sqlStmt)
+			db.Close()
+			return nil, err
+		}
+	}
+	u.db = db
+	return u.db, nil
+}
+
+// queryStrings runs a query returning a single text column.
+func (u *UserInfoSQLSource) queryStrings(stmtMap map[string]string, args ...interface{}) ([]string, error) {
+	db, err := u.getDB()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(stmtMap[u.dbType], args...)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+	values := []string{}
+	for rows.Next() {
+		var value string
+		err = rows.Scan(&value)
+		if err != nil {
+			log.Println(err)
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+func (u *UserInfoSQLSource) exec(stmtMap map[string]string, args ...interface{}) (sql.Result, error) {
+	db, err := u.getDB()
+	if err != nil {
+		return nil, err
+	}
+	result, err := db.Exec(stmtMap[u.dbType], args...)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return result, nil
+}
+
+var getAllUsersStmt = map[string]string{
+	"sqlite":   "select username from directory_users order by username;",
+	"postgres": "select username from directory_users order by username;",
+}
+
+func (u *UserInfoSQLSource) GetallUsers() ([]string, error) {
+	return u.queryStrings(getAllUsersStmt)
+}
+
+var maxGIDNumberStmt = map[string]string{
+	"sqlite":   "select coalesce(max(gid_number), 0) from directory_groups where service_account=?;",
+	"postgres": "select coalesce(max(gid_number), 0) from directory_groups where service_account=$1;",
+}
+
+var maxUIDNumberStmt = map[string]string{
+	"sqlite":   "select coalesce(max(uid_number), 0) from directory_users where service_account=?;",
+	"postgres": "select coalesce(max(uid_number), 0) from directory_users where service_account=$1;",
+}
+
+// getMaximumNumber mirrors the LDAP backend: the next id is one more than the
+// current maximum within the same tree (regular vs service accounts).
+func getMaximumNumber(tx *sql.Tx, stmtText string, serviceAccount int) (int, error) {
+	var max int
+	err := tx.QueryRow(stmtText, serviceAccount).Scan(&max)
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+	return max + 1, nil
+}
+
+// presetOrMaximumNumber honours an id given by the caller (e.g. an LDIF
+// import) and falls back to allocating the next one.
+func presetOrMaximumNumber(tx *sql.Tx, preset string, stmtText string, serviceAccount int) (int, error) {
+	if preset == "" {
+		return getMaximumNumber(tx, stmtText, serviceAccount)
+	}
+	value, err := strconv.Atoi(preset)
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+	return value, nil
+}
+
+var insertGroupStmt = map[string]string{
+	"sqlite":   "insert into directory_groups(groupname, gid_number, manager, service_account) values (?,?,?,?);",
+	"postgres": "insert into directory_groups(groupname, gid_number, manager, service_account) values ($1,$2,$3,$4);",
+}
+
+var insertMemberStmt = map[string]string{
+	"sqlite":   "insert into directory_group_members(groupname, username) values (?,?);",
+	"postgres": "insert into directory_group_members(groupname, username) values ($1,$2);",
+}
+
+var userExistsStmt = map[string]string{
+	"sqlite":   "select username from directory_users where username=?;",
+	"postgres": "select username from directory_users where username=$1;",
+}
+
+func (u *UserInfoSQLSource) CreateGroup(groupinfo userinfo.GroupInfo) error {
+	db, err := u.getDB()
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	defer tx.Rollback()
+
+	gidnum, err := presetOrMaximumNumber(tx, groupinfo.GidNumber, maxGIDNumberStmt[u.dbType], 0)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(insertGroupStmt[u.dbType], groupinfo.Groupname, gidnum, groupinfo.Description, 0)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	for _, memberUid := range groupinfo.MemberUid {
+		_, err = tx.Exec(insertMemberStmt[u.dbType], groupinfo.Groupname, memberUid)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+	log.Printf("Created new group (%+v)?", groupinfo)
+	return tx.Commit()
+}
+
+var deleteGroupStmt = map[string]string{
+	"sqlite":   "delete from directory_groups where groupname=?;",
+	"postgres": "delete from directory_groups where groupname=$1;",
+}
+
+var deleteGroupMembersStmt = map[string]string{
+	"sqlite":   "delete from directory_group_members where groupname=?;",
+	"postgres": "delete from directory_group_members where groupname=$1;",
+}
+
+func (u *UserInfoSQLSource) DeleteGroup(groupnames []string) error {
+	db, err := u.getDB()
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	defer tx.Rollback()
+	for _, groupname := range groupnames {
+		result, err := tx.Exec(deleteGroupStmt[u.dbType], groupname)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected < 1 {
+			return userinfo.GroupDoesNotExist
+		}
+		_, err = tx.Exec(deleteGroupMembersStmt[u.dbType], groupname)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		_, err = tx.Exec(deleteExtraManagersStmt[u.dbType], groupname)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+var changeManagerStmt = map[string]string{
+	"sqlite":   "update directory_groups set manager=? where groupname=?;",
+	"postgres": "update directory_groups set manager=$1 where groupname=$2;",
+}
+
+func (u *UserInfoSQLSource) ChangeDescription(groupname string, managegroup string) error {
+	return u.SetGroupManagers(groupname, []string{managegroup})
+}
+
+// The manager column of directory_groups holds the first manager of a group,
+// directory_group_managers the other ones.
+var deleteExtraManagersStmt = map[string]string{
+	"sqlite":   "delete from directory_group_managers where groupname=?;",
+	"postgres": "delete from directory_group_managers where groupname=$1;",
+}
+
+var insertExtraManagerStmt = map[string]string{
+	"sqlite":   "insert into directory_group_managers(groupname, manager) values (?,?);",
+	"postgres": "insert into directory_group_managers(groupname, manager) values ($1,$2);",
+}
+
+var getExtraManagersStmt = map[string]string{
+	"sqlite":   "select manager from directory_group_managers where groupname=? order by id;",
+	"postgres": "select manager from directory_group_managers where groupname=$1 order by id;",
+}
+
+var getAllExtraManagersStmt = map[string]string{
+	"sqlite":   "select groupname, manager from directory_group_managers order by id;",
+	"postgres": "select groupname, manager from directory_group_managers order by id;",
+}
+
+func (u *UserInfoSQLSource) SetGroupManagers(groupname string, managers []string) error {
+	if len(managers) < 1 {
+		return errors.New("a group needs at least one manager")
+	}
+	db, err := u.getDB()
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(changeManagerStmt[u.dbType], managers[0], groupname)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected < 1 {
+		return userinfo.GroupDoesNotExist
+	}
+	_, err = tx.Exec(deleteExtraManagersStmt[u.dbType], groupname)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	for _, manager := range managers[1:] {
+		_, err = tx.Exec(insertExtraManagerStmt[u.dbType], groupname, manager)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (u *UserInfoSQLSource) GetGroupManagers(groupname string) ([]string, error) {
+	managers, err := u.queryStrings(getGroupManagerStmt, groupname)
+	if err != nil {
+		return nil, err
+	}
+	if len(managers) < 1 {
+		return nil, userinfo.GroupDoesNotExist
+	}
+	extraManagers, err := u.queryStrings(getExtraManagersStmt, groupname)
+	if err != nil {
+		return nil, err
+	}
+	return append(managers[:1], extraManagers...), nil
+}
+
+var getAllGroupsStmt = map[string]string{
+	"sqlite":   "select groupname from directory_groups where service_account=0 order by groupname;",
+	"postgres": "select groupname from directory_groups where service_account=0 order by groupname;",
+}
+
+func (u *UserInfoSQLSource) GetallGroups() ([]string, error) {
+	return u.queryStrings(getAllGroupsStmt)
+}
+
+var getGroupsOfUserStmt = map[string]string{
+	"sqlite": `select m.groupname from directory_group_members m join directory_groups g on g.groupname=m.groupname
+		where m.username=? and g.service_account=0 order by m.groupname;`,
+	"postgres": `select m.groupname from directory_group_members m join directory_groups g on g.groupname=m.groupname
+		where m.username=$1 and g.service_account=0 order by m.groupname;`,
+}
+
+func (u *UserInfoSQLSource) GetgroupsofUser(username string) ([]string, error) {
+	return u.queryStrings(getGroupsOfUserStmt, username)
+}
+
+var getGroupManagerStmt = map[string]string{
+	"sqlite":   "select manager from directory_groups where groupname=? and service_account=0;",
+	"postgres": "select manager from directory_groups where groupname=$1 and service_account=0;",
+}
+
+var getGroupMembersStmt = map[string]string{
+	"sqlite":   "select username from directory_group_members where groupname=? order by username;",
+	"postgres": "select username from directory_group_members where groupname=$1 order by username;",
+}
+
+func (u *UserInfoSQLSource) GetusersofaGroup(groupname string) ([]string, string, error) {
+	managers, err := u.queryStrings(getGroupManagerStmt, groupname)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(managers) < 1 {
+		return nil, "", userinfo.GroupDoesNotExist
+	}
+	users, err := u.queryStrings(getGroupMembersStmt, groupname)
+	if err != nil {
+		return nil, "", err
+	}
+	return users, managers[0], nil
+}
+
+func (u *UserInfoSQLSource) GetGroupUsersAndManagers(groupname string) ([]string, []string, string, error) {
+	groupUsers, managerGroupName, err := u.GetusersofaGroup(groupname)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	managers, err := u.GetGroupManagers(groupname)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	managerUsers, err := userinfo.ManagerUsers(u, groupname, managers)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return groupUsers, managerUsers, managerGroupName, nil
+}
+
+func (u *UserInfoSQLSource) UserisadminOrNot(username string) bool {
+	superAdmins, _, err := u.GetusersofaGroup(u.AdminGroup)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	sort.Strings(superAdmins)
+	index := sort.SearchStrings(superAdmins, username)
+	if index < len(superAdmins) && superAdmins[index] == username {
+		return true
+	}
+	return false
+}
+
+var anyGroupExistsStmt = map[string]string{
+	"sqlite":   "select manager from directory_groups where groupname=?;",
+	"postgres": "select manager from directory_groups where groupname=$1;",
+}
+
+func (u *UserInfoSQLSource) AddmemberstoExisting(groupinfo userinfo.GroupInfo) error {
+	managers, err := u.queryStrings(anyGroupExistsStmt, groupinfo.Groupname)
+	if err != nil {
+		return err
+	}
+	if len(managers) < 1 {
+		return userinfo.GroupDoesNotExist
+	}
+	db, err := u.getDB()
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	defer tx.Rollback()
+	for _, memberUid := range groupinfo.MemberUid {
+		var username string
+		err = tx.QueryRow(userExistsStmt[u.dbType], memberUid).Scan(&username)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return userinfo.UserDoesNotExist
+			}
+			log.Println(err)
+			return err
+		}
+		_, err = tx.Exec(insertMemberStmt[u.dbType], groupinfo.Groupname, memberUid)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+var deleteMemberStmt = map[string]string{
+	"sqlite":   "delete from directory_group_members where groupname=? and username=?;",
+	"postgres": "delete from directory_group_members where groupname=$1 and username=$2;",
+}
+
+func (u *UserInfoSQLSource) DeletemembersfromGroup(groupinfo userinfo.GroupInfo) error {
+	managers, err := u.queryStrings(anyGroupExistsStmt, groupinfo.Groupname)
+	if err != nil {
+		return err
+	}
+	if len(managers) < 1 {
+		return userinfo.GroupDoesNotExist
+	}
+	for _, memberUid := range groupinfo.MemberUid {
+		_, err = u.exec(deleteMemberStmt, groupinfo.Groupname, memberUid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *UserInfoSQLSource) IsgroupmemberorNot(groupname string, username string) (bool, string, error) {
+	AllUsersinGroup, GroupmanagedbyValue, err := u.GetusersofaGroup(groupname)
+	if err != nil {
+		log.Println(err)
+		return false, GroupmanagedbyValue, err
+	}
+	for _, entry := range AllUsersinGroup {
+		if entry == username {
+			return true, GroupmanagedbyValue, nil
+		}
+	}
+	return false, GroupmanagedbyValue, nil
+}
+
+func (u *UserInfoSQLSource) GetDescriptionvalue(groupname string) (string, error) {
+	managers, err := u.queryStrings(getGroupManagerStmt, groupname)
+	if err != nil {
+		return "", err
+	}
+	if len(managers) < 1 {
+		return "", userinfo.GroupDoesNotExist
+	}
+	return managers[0], nil
+}
+
+var getUserAttributesStmt = map[string]string{
+	"sqlite":   "select mail, given_name from directory_users where username=?;",
+	"postgres": "select mail, given_name from directory_users where username=$1;",
+}
+
+func (u *UserInfoSQLSource) getUserAttributesInternal(username string) (string, string, error) {
+	db, err := u.getDB()
+	if err != nil {
+		return "", "", err
+	}
+	var mail, givenName string
+	err = db.QueryRow(getUserAttributesStmt[u.dbType], username).Scan(&mail, &givenName)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", "", userinfo.UserDoesNotExist
+		}
+		log.Println(err)
+		return "", "", err
+	}
+	return mail, givenName, nil
+}
+
+func (u *UserInfoSQLSource) GetEmailofauser(username string) ([]string, error) {
+	mail, _, err := u.getUserAttributesInternal(username)
+	if err != nil {
+		return nil, err
+	}
+	if mail == "" {
+		return nil, userinfo.UserDoesNotHaveEmail
+	}
+	return []string{mail}, nil
+}
+
+func (u *UserInfoSQLSource) GetEmailofusersingroup(groupname string) ([]string, error) {
+	groupUsers, _, err := u.GetusersofaGroup(groupname)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	var userEmail []string
+	for _, entry := range groupUsers {
+		mail, err := u.GetEmailofauser(entry)
+		if err != nil {
+			if err == userinfo.UserDoesNotHaveEmail {
+				continue
+			}
+			log.Println(err)
+			return nil, err
+		}
+		userEmail = append(userEmail, mail[0])
+	}
+	return userEmail, nil
+}
+
+var insertUserStmt = map[string]string{
+	"sqlite": `insert into directory_users(username, uid_number, gid_number, given_name, mail, login_shell, service_account)
+		values (?,?,?,?,?,?,?);`,
+	"postgres": `insert into directory_users(username, uid_number, gid_number, given_name, mail, login_shell, service_account)
+		values ($1,$2,$3,$4,$5,$6,$7);`,
+}
+
+func (u *UserInfoSQLSource) CreateServiceAccount(groupinfo userinfo.GroupInfo) error {
+	db, err := u.getDB()
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	defer tx.Rollback()
+
+	gidnum, err := presetOrMaximumNumber(tx, groupinfo.GidNumber, maxGIDNumberStmt[u.dbType], 1)
+	if err != nil {
+		return err
+	}
+	uidnum, err := presetOrMaximumNumber(tx, groupinfo.UidNumber, maxUIDNumberStmt[u.dbType], 1)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(insertGroupStmt[u.dbType], groupinfo.Groupname, gidnum, "", 1)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	_, err = tx.Exec(insertUserStmt[u.dbType], groupinfo.Groupname, uidnum, gidnum,
+		groupinfo.Groupname, groupinfo.Mail, groupinfo.LoginShell, 1)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	return tx.Commit()
+}
+
+func (u *UserInfoSQLSource) IsgroupAdminorNot(username string, groupname string) (bool, error) {
+	managers, err := u.GetGroupManagers(groupname)
+	if err != nil {
+		log.Println(err)
+		return false, err
+	}
+	if u.UserisadminOrNot(username) {
+		return true, nil
+	}
+	return userinfo.IsManagerOf(u, username, groupname, managers)
+}
+
+func (u *UserInfoSQLSource) UsernameExistsornot(username string) (bool, error) {
+	users, err := u.queryStrings(userExistsStmt, username)
+	if err != nil {
+		return false, err
+	}
+	return len(users) > 0, nil
+}
+
+func (u *UserInfoSQLSource) GroupnameExistsornot(groupname string) (bool, string, error) {
+	managers, err := u.queryStrings(anyGroupExistsStmt, groupname)
+	if err != nil {
+		return false, "", err
+	}
+	if len(managers) < 1 {
+		return false, "", nil
+	}
+	return true, managers[0], nil
+}
+
+var serviceAccountExistsStmt = map[string]string{
+	"sqlite":   "select groupname from directory_groups where groupname=? and service_account=1;",
+	"postgres": "select groupname from directory_groups where groupname=$1 and service_account=1;",
+}
+
+func (u *UserInfoSQLSource) ServiceAccountExistsornot(groupname string) (bool, string, error) {
+	names, err := u.queryStrings(serviceAccountExistsStmt, groupname)
+	if err != nil {
+		return false, "", err
+	}
+	if len(names) < 1 {
+		return false, "", nil
+	}
+	return true, names[0], nil
+}
+
+func (u *UserInfoSQLSource) queryGroupManagerPairs(stmtMap map[string]string, args ...interface{}) ([][]string, error) {
+	db, err := u.getDB()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(stmtMap[u.dbType], args...)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+	var GroupandDescriptionPair [][]string
+	for rows.Next() {
+		var groupname, manager string
+		err = rows.Scan(&groupname, &manager)
+		if err != nil {
+			log.Println(err)
+			return nil, err
+		}
+		GroupandDescriptionPair = append(GroupandDescriptionPair, []string{groupname, manager})
+	}
+	return GroupandDescriptionPair, rows.Err()
+}
+
+var getGroupsInfoOfUserStmt = map[string]string{
+	"sqlite": `select g.groupname, g.manager from directory_group_members m join directory_groups g on g.groupname=m.groupname
+		where m.username=? and g.service_account=0 order by g.groupname;`,
+	"postgres": `select g.groupname, g.manager from directory_group_members m join directory_groups g on g.groupname=m.groupname
+		where m.username=$1 and g.service_account=0 order by g.groupname;`,
+}
+
+// GetGroupsInfoOfUser ignores groupdn, there is a single group tree in the database.
+func (u *UserInfoSQLSource) GetGroupsInfoOfUser(groupdn string, username string) ([][]string, error) {
+	return u.queryGroupManagerPairs(getGroupsInfoOfUserStmt, username)
+}
+
+var getAllGroupsManagedByStmt = map[string]string{
+	"sqlite":   "select groupname, manager from directory_groups where service_account=0 order by groupname;",
+	"postgres": "select groupname, manager from directory_groups where service_account=0 order by groupname;",
+}
+
+// GetAllGroupsManagedBy returns the group name followed by all its managers.
+func (u *UserInfoSQLSource) GetAllGroupsManagedBy() ([][]string, error) {
+	groups, err := u.queryGroupManagerPairs(getAllGroupsManagedByStmt)
+	if err != nil {
+		return nil, err
+	}
+	extraManagers, err := u.queryGroupManagerPairs(getAllExtraManagersStmt)
+	if err != nil {
+		return nil, err
+	}
+	if len(extraManagers) < 1 {
+		return groups, nil
+	}
+	groupManagers := make(map[string][]string)
+	for _, pair := range extraManagers {
+		groupManagers[pair[0]] = append(groupManagers[pair[0]], pair[1])
+	}
+	for i, group := range groups {
+		groups[i] = append(group, groupManagers[group[0]]...)
+	}
+	return groups, nil
+}
+
+func (u *UserInfoSQLSource) GetGroupandManagedbyAttributeValue(groupnames []string) ([][]string, error) {
+	var UserGroupInfo [][]string
+	for _, eachgroup := range groupnames {
+		groupdescription, err := u.GetDescriptionvalue(eachgroup)
+		if err != nil {
+			log.Println(err)
+			return nil, err
+		}
+		UserGroupInfo = append(UserGroupInfo, []string{eachgroup, groupdescription})
+	}
+	return UserGroupInfo, nil
+}
+
+func (u *UserInfoSQLSource) CreateUser(username string, givenName, email []string) error {
+	db, err := u.getDB()
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	defer tx.Rollback()
+	uidnum, err := getMaximumNumber(tx, maxUIDNumberStmt[u.dbType], 0)
+	if err != nil {
+		return err
+	}
+	var mail, name string
+	if len(email) > 0 {
+		mail = email[0]
+	}
+	if len(givenName) > 0 {
+		name = givenName[0]
+	}
+	_, err = tx.Exec(insertUserStmt[u.dbType], username, uidnum, 100, name, mail, LoginShell, 0)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	return tx.Commit()
+}
+
+func (u *UserInfoSQLSource) GetUserAttributes(username string) ([]string, []string, error) {
+	mail, givenName, err := u.getUserAttributesInternal(username)
+	if err != nil {
+		return nil, nil, err
+	}
+	if mail == "" {
+		return nil, nil, userinfo.UserDoesNotHaveEmail
+	}
+	if givenName == "" {
+		return nil, nil, userinfo.UserDoesNotHaveGivenName
+	}
+	return []string{mail}, []string{givenName}, nil
+}
+
+var getAllGroupsInfoStmt = map[string]string{
+	"sqlite":   "select groupname, gid_number, manager from directory_groups where service_account=0 order by groupname;",
+	"postgres": "select groupname, gid_number, manager from directory_groups where service_account=0 order by groupname;",
+}
+
+var getAllGroupMembersStmt = map[string]string{
+	"sqlite":   "select groupname, username from directory_group_members order by groupname, username;",
+	"postgres": "select groupname, username from directory_group_members order by groupname, username;",
+}
+
+func (u *UserInfoSQLSource) GetallGroupsInfo() ([]userinfo.GroupInfo, error) {
+	db, err := u.getDB()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(getAllGroupsInfoStmt[u.dbType])
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+	var groups []userinfo.GroupInfo
+	groupIndex := make(map[string]int)
+	for rows.Next() {
+		var groupinfo userinfo.GroupInfo
+		var gidnum int
+		err = rows.Scan(&groupinfo.Groupname, &gidnum, &groupinfo.Description)
+		if err != nil {
+			log.Println(err)
+			return nil, err
+		}
+		groupinfo.GidNumber = strconv.Itoa(gidnum)
+		groupIndex[groupinfo.Groupname] = len(groups)
+		groups = append(groups, groupinfo)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	members, err := u.queryGroupManagerPairs(getAllGroupMembersStmt)
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range members {
+		index, ok := groupIndex[member[0]]
+		if !ok {
+			continue
+		}
+		groups[index].MemberUid = append(groups[index].MemberUid, member[1])
+	}
+	return groups, nil
+}
+
+var getAllServiceAccountsInfoStmt = map[string]string{
+	"sqlite": `select username, uid_number, gid_number, mail, login_shell from directory_users
+		where service_account=1 order by username;`,
+	"postgres": `select username, uid_number, gid_number, mail, login_shell from directory_users
+		where service_account=1 order by username;`,
+}
+
+func (u *UserInfoSQLSource) GetallServiceAccountsInfo() ([]userinfo.GroupInfo, error) {
+	db, err := u.getDB()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(getAllServiceAccountsInfoStmt[u.dbType])
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+	var accounts []userinfo.GroupInfo
+	for rows.Next() {
+		var account userinfo.GroupInfo
+		var uidnum, gidnum int
+		err = rows.Scan(&account.Groupname, &uidnum, &gidnum, &account.Mail, &account.LoginShell)
+		if err != nil {
+			log.Println(err)
+			return nil, err
+		}
+		account.UidNumber = strconv.Itoa(uidnum)
+		account.GidNumber = strconv.Itoa(gidnum)
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
@@ -0,0 +1,365 @@
+package sqluserinfo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/Symantec/ldap-group-management/lib/userinfo"
+)
+
+func setupTestSQLUserInfo(t *testing.T) (*UserInfoSQLSource, func()) {
+	dir, err := ioutil.TempDir("", "sqluserinfo_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	u := &UserInfoSQLSource{
+		StorageURL: "sqlite:" + filepath.Join(dir, "directory.sqlite3"),
+		AdminGroup: "group3",
+	}
+	err = u.InitDB()
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	for _, username := range []string{"user1", "user2", "user3"} {
+		err = u.CreateUser(username, []string{username}, []string{username + "@example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	groups := []userinfo.GroupInfo{
+		{Groupname: "group1", Description: "self-managed", MemberUid: []string{"user1", "user2"}},
+		{Groupname: "group2", Description: "self-managed", MemberUid: []string{"user1", "user3"}},
+		{Groupname: "group3", Description: "group1", MemberUid: []string{"user1"}},
+	}
+	for _, group := range groups {
+		err = u.CreateGroup(group)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return u, cleanup
+}
+
+func TestInitDBBadURL(t *testing.T) {
+	u := &UserInfoSQLSource{StorageURL: "mysql:foo"}
+	if err := u.InitDB(); err == nil {
+		t.Fatal("should have failed on unsupported storage url")
+	}
+}
+
+func TestGetallUsersAndGroups(t *testing.T) {
+	u, cleanup := setupTestSQLUserInfo(t)
+	defer cleanup()
+	users, err := u.GetallUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 3 {
+		t.Fatalf("expected 3 users got %v", users)
+	}
+	groups, err := u.GetallGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 3 || groups[0] != "group1" {
+		t.Fatalf("bad groups %v", groups)
+	}
+	managedBy, err := u.GetAllGroupsManagedBy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(managedBy) != 3 || managedBy[2][0] != "group3" || managedBy[2][1] != "group1" {
+		t.Fatalf("bad group manager pairs %v", managedBy)
+	}
+}
+
+func TestGroupMembership(t *testing.T) {
+	u, cleanup := setupTestSQLUserInfo(t)
+	defer cleanup()
+	groups, err := u.GetgroupsofUser("user2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || groups[0] != "group1" {
+		t.Fatalf("bad groups of user %v", groups)
+	}
+	isMember, manager, err := u.IsgroupmemberorNot("group2", "user3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isMember || manager != "self-managed" {
+		t.Fatalf("user3 should be a member of self-managed group2")
+	}
+	_, _, err = u.GetusersofaGroup("nonexistent")
+	if err != userinfo.GroupDoesNotExist {
+		t.Fatalf("expected GroupDoesNotExist got %v", err)
+	}
+	users, managers, managerGroup, err := u.GetGroupUsersAndManagers("group3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || managerGroup != "group1" || len(managers) != 2 {
+		t.Fatalf("bad users/managers %v %v %s", users, managers, managerGroup)
+	}
+	pairs, err := u.GetGroupsInfoOfUser("", "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 3 {
+		t.Fatalf("bad group info of user %v", pairs)
+	}
+}
+
+func TestAddAndDeleteMembers(t *testing.T) {
+	u, cleanup := setupTestSQLUserInfo(t)
+	defer cleanup()
+	err := u.AddmemberstoExisting(userinfo.GroupInfo{Groupname: "group2", MemberUid: []string{"user2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, _, err := u.GetusersofaGroup("group2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(users)
+	if len(users) != 3 || users[1] != "user2" {
+		t.Fatalf("user2 not added %v", users)
+	}
+	err = u.AddmemberstoExisting(userinfo.GroupInfo{Groupname: "group2", MemberUid: []string{"nobody"}})
+	if err != userinfo.UserDoesNotExist {
+		t.Fatalf("expected UserDoesNotExist got %v", err)
+	}
+	err = u.DeletemembersfromGroup(userinfo.GroupInfo{Groupname: "group2", MemberUid: []string{"user2", "user3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, _, err = u.GetusersofaGroup("group2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0] != "user1" {
+		t.Fatalf("members not removed %v", users)
+	}
+}
+
+func TestCreateDeleteAndChangeManager(t *testing.T) {
+	u, cleanup := setupTestSQLUserInfo(t)
+	defer cleanup()
+	err := u.CreateGroup(userinfo.GroupInfo{Groupname: "group4", Description: "group2", MemberUid: []string{"user2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := u.IsgroupAdminorNot("user3", "group4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !admin {
+		t.Fatal("user3 should manage group4 through group2")
+	}
+	err = u.ChangeDescription("group4", "group1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err = u.IsgroupAdminorNot("user3", "group4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if admin {
+		t.Fatal("user3 should no longer manage group4")
+	}
+	err = u.ChangeDescription("nonexistent", "group1")
+	if err != userinfo.GroupDoesNotExist {
+		t.Fatalf("expected GroupDoesNotExist got %v", err)
+	}
+	err = u.DeleteGroup([]string{"group4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists, _, err := u.GroupnameExistsornot("group4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("group4 should have been deleted")
+	}
+	groups, err := u.GetgroupsofUser("user2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 {
+		t.Fatalf("stale membership left behind %v", groups)
+	}
+}
+
+func TestMultipleManagers(t *testing.T) {
+	u, cleanup := setupTestSQLUserInfo(t)
+	defer cleanup()
+	err := u.CreateGroup(userinfo.GroupInfo{Groupname: "group4", Description: "group1", MemberUid: []string{"user1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = u.SetGroupManagers("group4", []string{"group1", "group2", "user:user3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	managers, err := u.GetGroupManagers("group4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(managers, []string{"group1", "group2", "user:user3"}) {
+		t.Fatalf("bad managers %v", managers)
+	}
+	manager, err := u.GetDescriptionvalue("group4")
+	if err != nil || manager != "group1" {
+		t.Fatalf("first manager should be kept in the groups table %q err=%v", manager, err)
+	}
+	for _, username := range []string{"user2", "user3"} {
+		admin, err := u.IsgroupAdminorNot(username, "group4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !admin {
+			t.Fatalf("%s should manage group4", username)
+		}
+	}
+	_, managerUsers, _, err := u.GetGroupUsersAndManagers("group4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(managerUsers, []string{"user1", "user2", "user3"}) {
+		t.Fatalf("bad manager users %v", managerUsers)
+	}
+	allGroups, err := u.GetAllGroupsManagedBy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(allGroups[3], []string{"group4", "group1", "group2", "user:user3"}) {
+		t.Fatalf("bad managed by entry %v", allGroups[3])
+	}
+
+	err = u.ChangeDescription("group4", "group2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	managers, err = u.GetGroupManagers("group4")
+	if err != nil || !reflect.DeepEqual(managers, []string{"group2"}) {
+		t.Fatalf("ChangeDescription should replace every manager %v err=%v", managers, err)
+	}
+	err = u.SetGroupManagers("group4", nil)
+	if err == nil {
+		t.Fatal("a group without managers should be refused")
+	}
+	err = u.SetGroupManagers("nonexistent", []string{"group1"})
+	if err != userinfo.GroupDoesNotExist {
+		t.Fatalf("expected GroupDoesNotExist got %v", err)
+	}
+}
+
+func TestServiceAccounts(t *testing.T) {
+	u, cleanup := setupTestSQLUserInfo(t)
+	defer cleanup()
+	err := u.CreateServiceAccount(userinfo.GroupInfo{Groupname: "svc1", Mail: "svc1@example.com", LoginShell: "/bin/false"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists, _, err := u.ServiceAccountExistsornot("svc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Fatal("service account should exist")
+	}
+	exists, _, err = u.ServiceAccountExistsornot("group1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("group1 is not a service account")
+	}
+	groups, err := u.GetallGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, group := range groups {
+		if group == "svc1" {
+			t.Fatal("service accounts should not be listed as groups")
+		}
+	}
+	found, err := u.UsernameExistsornot("svc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("service account user should exist")
+	}
+}
+
+func TestUserAttributesAndAdmin(t *testing.T) {
+	u, cleanup := setupTestSQLUserInfo(t)
+	defer cleanup()
+	email, givenName, err := u.GetUserAttributes("user2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email[0] != "user2@example.com" || givenName[0] != "user2" {
+		t.Fatalf("bad attributes %v %v", email, givenName)
+	}
+	_, err = u.GetEmailofauser("nobody")
+	if err != userinfo.UserDoesNotExist {
+		t.Fatalf("expected UserDoesNotExist got %v", err)
+	}
+	emails, err := u.GetEmailofusersingroup("group1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 2 {
+		t.Fatalf("bad group emails %v", emails)
+	}
+	if !u.UserisadminOrNot("user1") {
+		t.Fatal("user1 should be admin")
+	}
+	if u.UserisadminOrNot("user2") {
+		t.Fatal("user2 should not be admin")
+	}
+}
+
+func TestGroupsInfoAndPresetNumbers(t *testing.T) {
+	u, cleanup := setupTestSQLUserInfo(t)
+	defer cleanup()
+	err := u.CreateGroup(userinfo.GroupInfo{Groupname: "group4", Description: "group1", GidNumber: "25000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = u.CreateServiceAccount(userinfo.GroupInfo{Groupname: "svc1", Mail: "svc1@example.com",
+		LoginShell: "/bin/false", GidNumber: "31000", UidNumber: "31001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, err := u.GetallGroupsInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 4 {
+		t.Fatalf("expected 4 groups got %+v", groups)
+	}
+	if groups[0].Groupname != "group1" || groups[0].GidNumber != "1" || len(groups[0].MemberUid) != 2 {
+		t.Fatalf("bad group1 %+v", groups[0])
+	}
+	if groups[3].Groupname != "group4" || groups[3].GidNumber != "25000" || groups[3].Description != "group1" {
+		t.Fatalf("bad group4 %+v", groups[3])
+	}
+	accounts, err := u.GetallServiceAccountsInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 1 || accounts[0].GidNumber != "31000" || accounts[0].UidNumber != "31001" ||
+		accounts[0].Mail != "svc1@example.com" {
+		t.Fatalf("bad service accounts %+v", accounts)
+	}
+}
@@ -34,6 +34,7 @@ install -d %{buildroot}/%{_datarootdir}/smallpoint/templates/css/
 install -p -m 0644 cmd/smallpoint/templates/css/new.css %{buildroot}/%{_datarootdir}/smallpoint/templates/css/new.css
 
 install -d %{buildroot}/%{_datarootdir}/smallpoint/templates/js/
+install -p -m 0644 cmd/smallpoint/templates/js/allGroups.js %{buildroot}/%{_datarootdir}/smallpoint/templates/js/allGroups.js
 install -p -m 0644 cmd/smallpoint/templates/js/addMemberToGroup.js %{buildroot}/%{_datarootdir}/smallpoint/templates/js/addMemberToGroup.js
 install -p -m 0644 cmd/smallpoint/templates/js/changeGroupOwnership.js %{buildroot}/%{_datarootdir}/smallpoint/templates/js/changeGroupOwnership.js
 install -p -m 0644 cmd/smallpoint/templates/js/createGroup.js %{buildroot}/%{_datarootdir}/smallpoint/templates/js/createGroup.js